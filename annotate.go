@@ -0,0 +1,30 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// annotateMain implements `keeping annotate "text"`, which labels the
+// current moment in the output of the running instance.
+func annotateMain(args []string) int {
+	fs := flag.NewFlagSet("annotate", flag.ExitOnError)
+	ctlPath := fs.String("ctl", defaultCtlPath(), "control socket of the running instance")
+	fs.Parse(args)
+	text := strings.Join(fs.Args(), " ")
+	if text == "" {
+		fmt.Println("Usage: keeping annotate [-ctl path] text")
+		return 2
+	}
+	if _, err := ctlRequest(*ctlPath, "annotate", text); err != nil {
+		fmt.Println("ERROR:", err)
+		return 1
+	}
+	return 0
+}
+
+func printAnnotation(text string) {
+	fmt.Printf("=== %s annotation: %s\n", output.Time(time.Now(), time.DateTime, time.Local), text)
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+//go:embed web/index.html
+var dashboardHTML []byte
+
+//go:embed web/history.html
+var historyHTML []byte
+
+// streamMessage is what /ws sends for every record, Type is "result",
+// "interval" or "event".
+type streamMessage struct {
+	Type string `json:"type"`
+	Data any    `json:"data"`
+}
+
+// hub fans records out to the connected stream clients. A client that does
+// not keep up loses messages rather than holding up probing.
+type hub struct {
+	mu   sync.Mutex
+	subs map[chan []byte]struct{}
+}
+
+func newHub() *hub {
+	return &hub{subs: make(map[chan []byte]struct{})}
+}
+
+// Publish sends v to every subscriber.
+func (h *hub) Publish(typ string, v any) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.subs) == 0 {
+		return
+	}
+	b, err := json.Marshal(streamMessage{Type: typ, Data: v})
+	if err != nil {
+		return
+	}
+	for ch := range h.subs {
+		select {
+		case ch <- b:
+		default:
+		}
+	}
+}
+
+// The hub is the sink feeding /ws.
+func (h *hub) HandleResult(r *Result) error           { h.Publish("result", r); return nil }
+func (h *hub) HandleInterval(st *IntervalStats) error { h.Publish("interval", st); return nil }
+func (h *hub) HandleEvent(e *Event) error             { h.Publish("event", e); return nil }
+func (h *hub) Flush() error                           { return nil }
+
+func (h *hub) subscribe() chan []byte {
+	ch := make(chan []byte, 256)
+	h.mu.Lock()
+	h.subs[ch] = struct{}{}
+	h.mu.Unlock()
+	return ch
+}
+
+func (h *hub) unsubscribe(ch chan []byte) {
+	h.mu.Lock()
+	delete(h.subs, ch)
+	h.mu.Unlock()
+}
+
+// apiServer is the HTTP side of a running instance: the live dashboard at /,
+// the record stream at /ws, the history charts at /history, backed by
+// /api/targets, /api/history and /api/events, the interval summaries at
+// /api/intervals, the incident journal at /api/journal, and Prometheus
+// metrics at /metrics.
+type apiServer struct {
+	srv     *http.Server
+	l       net.Listener
+	hub     *hub
+	history *history
+	// metrics writes what /metrics exposes
+	metrics func(*metricsWriter)
+	// journal is the -journal file, note what a POST to /api/journal
+	// records
+	journal string
+	note    func(target, text string) error
+}
+
+func listenAPI(addr string, h *hub, hist *history, metrics func(*metricsWriter)) (*apiServer, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &apiServer{l: l, hub: h, history: hist, metrics: metrics}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", s.serveDashboard)
+	mux.HandleFunc("/ws", s.serveStream)
+	mux.HandleFunc("/history", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = w.Write(historyHTML)
+	})
+	mux.HandleFunc("/api/targets", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, s.history.Targets())
+	})
+	mux.HandleFunc("/api/history", s.serveHistory)
+	mux.HandleFunc("/api/intervals", s.serveIntervals)
+	mux.HandleFunc("/api/journal", s.serveJournal)
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		s.metrics(newMetricsWriter(w))
+	})
+	mux.HandleFunc("/api/events", func(w http.ResponseWriter, r *http.Request) {
+		from, to, _, err := parseRange(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, s.history.Events(from, to))
+	})
+	s.srv = &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	return s, nil
+}
+
+// Addr is the address the server listens on.
+func (s *apiServer) Addr() net.Addr {
+	return s.l.Addr()
+}
+
+func (s *apiServer) Serve() {
+	_ = s.srv.Serve(s.l)
+}
+
+func (s *apiServer) Close() error {
+	return s.srv.Close()
+}
+
+func (s *apiServer) serveDashboard(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, _ = w.Write(dashboardHTML)
+}
+
+// parseRange reads the time range of a history request: "range" back from
+// now (default 1h), or "from" and "to" as RFC 3339, and the bucket "step",
+// by default what makes about 300 points.
+func parseRange(r *http.Request) (from, to time.Time, step time.Duration, err error) {
+	q := r.URL.Query()
+	to = time.Now()
+	span := time.Hour
+	if v := q.Get("range"); v != "" {
+		if span, err = time.ParseDuration(v); err != nil || span <= 0 {
+			return from, to, step, fmt.Errorf("bad range %q", v)
+		}
+	}
+	from = to.Add(-span)
+	if v := q.Get("from"); v != "" {
+		if from, err = time.Parse(time.RFC3339, v); err != nil {
+			return from, to, step, err
+		}
+	}
+	if v := q.Get("to"); v != "" {
+		if to, err = time.Parse(time.RFC3339, v); err != nil {
+			return from, to, step, err
+		}
+	}
+	if !to.After(from) {
+		return from, to, step, errors.New("empty time range")
+	}
+	step = to.Sub(from) / 300
+	if v := q.Get("step"); v != "" {
+		if step, err = time.ParseDuration(v); err != nil {
+			return from, to, step, fmt.Errorf("bad step %q", v)
+		}
+	}
+	// keep the bucket count sane whatever was asked for
+	if min := to.Sub(from) / 10000; step < min {
+		step = min
+	}
+	if step < time.Second {
+		step = time.Second
+	}
+	return from, to, step, nil
+}
+
+// serveHistory answers the buckets of one target (target=name), of all
+// targets of a group (group=name), or of everything.
+func (s *apiServer) serveHistory(w http.ResponseWriter, r *http.Request) {
+	from, to, step, err := parseRange(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	match := matchTargets(r)
+	writeJSON(w, struct {
+		From    time.Time `json:"from"`
+		To      time.Time `json:"to"`
+		StepMs  float64   `json:"step_ms"`
+		Buckets []bucket  `json:"buckets"`
+	}{from, to, ms(step), s.history.Query(match, from, to, step)})
+}
+
+// matchTargets selects the target=name or the group=name of a request, or
+// everything.
+func matchTargets(r *http.Request) func(name, group string) bool {
+	name, group := r.URL.Query().Get("target"), r.URL.Query().Get("group")
+	return func(n, g string) bool {
+		return (name == "" || n == name) && (group == "" || g == group)
+	}
+}
+
+// serveIntervals answers the interval summaries in the range, as a JSON
+// array of rows or, with format=csv, as CSV, the schema of -intervals files.
+func (s *apiServer) serveIntervals(w http.ResponseWriter, r *http.Request) {
+	from, to, _, err := parseRange(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var rows []*intervalRow
+	for _, st := range s.history.Intervals(matchTargets(r), from, to) {
+		rows = append(rows, newIntervalRow(st))
+	}
+	asCSV := r.URL.Query().Get("format") == "csv"
+	if asCSV {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	_ = writeIntervalRows(w, rows, asCSV)
+}
+
+// serveJournal answers the journal entries of the target=name of the
+// request, or of all; a POST of target and text adds a note to the target,
+// refused from other origins as any web page could post a form here.
+func (s *apiServer) serveJournal(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if crossOrigin(r) {
+			http.Error(w, "cross-origin note refused", http.StatusForbidden)
+			return
+		}
+		if err := s.note(r.FormValue("target"), r.FormValue("text")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		http.Error(w, "GET or POST", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.journal == "" {
+		http.Error(w, "no -journal", http.StatusNotFound)
+		return
+	}
+	var targets []string
+	if t := r.URL.Query().Get("target"); t != "" {
+		targets = []string{t}
+	}
+	entries, err := readJournal(s.journal, targets)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if entries == nil {
+		entries = []*journalEntry{}
+	}
+	writeJSON(w, entries)
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func (s *apiServer) serveStream(w http.ResponseWriter, r *http.Request) {
+	ws, err := upgradeWebSocket(w, r)
+	if err != nil {
+		return
+	}
+	defer ws.Close()
+	ch := s.hub.subscribe()
+	defer s.hub.unsubscribe(ch)
+
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		ws.readLoop()
+	}()
+	for {
+		select {
+		case b := <-ch:
+			if ws.WriteText(b) != nil {
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestServeJournalPostOrigin(t *testing.T) {
+	var notes []string
+	s := &apiServer{note: func(target, text string) error {
+		notes = append(notes, target+": "+text)
+		return nil
+	}}
+	for _, tt := range []struct {
+		origin string
+		want   int
+	}{
+		{"", http.StatusNoContent},
+		{"http://127.0.0.1:8080", http.StatusNoContent},
+		{"http://evil.example", http.StatusForbidden},
+		{"http://127.0.0.1:9999", http.StatusForbidden},
+	} {
+		body := url.Values{"target": {"8.8.8.8"}, "text": {"fiber cut"}}.Encode()
+		r := httptest.NewRequest(http.MethodPost, "http://127.0.0.1:8080/api/journal", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if tt.origin != "" {
+			r.Header.Set("Origin", tt.origin)
+		}
+		w := httptest.NewRecorder()
+		s.serveJournal(w, r)
+		if w.Code != tt.want {
+			t.Errorf("Origin %q: status %d, want %d", tt.origin, w.Code, tt.want)
+		}
+	}
+	if len(notes) != 2 || notes[0] != "8.8.8.8: fiber cut" {
+		t.Errorf("notes %q, want two from the same origin", notes)
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// assertResult is written for every host `keeping assert` probed.
+type assertResult struct {
+	Target string `json:"target"`
+	Pass   bool   `json:"pass"`
+	// Failures lists the assertions that did not hold
+	Failures []assertFailure `json:"failures,omitempty"`
+	Error    string          `json:"error,omitempty"`
+	Summary  *Summary        `json:"summary,omitempty"`
+}
+
+// assertFailure is one failed assertion, Check names the flag it came from
+// and the unit of Limit and Actual, e.g. "max_avg_ms" or "max_loss_pct".
+// Actual is -1 for an RTT limit when no reply came back to measure.
+type assertFailure struct {
+	Check  string  `json:"check"`
+	Limit  float64 `json:"limit"`
+	Actual float64 `json:"actual"`
+}
+
+// assertMain implements `keeping assert`, probing hosts and failing when the
+// RTT or loss goes beyond the given limits, for CI/CD network checks. It
+// exits 1 when an assertion fails and 2 when a host could not be probed.
+func assertMain(args []string) int {
+	fs := flag.NewFlagSet("assert", flag.ExitOnError)
+	count := fs.Int("c", 100, "probes to send to each host")
+	interval := fs.Duration("i", time.Second, "")
+	replyTimeout := fs.Duration("W", 5*time.Second, "per-probe reply timeout")
+	size := fs.Int("s", 24, "")
+	methods := fs.String("methods", "", "probe methods to fall back through, e.g. icmp,tcp:443")
+	privileged := fs.Bool("privileged", false, "")
+	maxAvg := fs.Duration("max-avg", 0, "fail when the average RTT is above this")
+	maxMax := fs.Duration("max-max", 0, "fail when the largest RTT is above this")
+	maxStdDev := fs.Duration("max-stddev", 0, "fail when the RTT standard deviation is above this")
+	maxLoss := fs.String("max-loss", "", "fail when the loss is above this, e.g. 0.5%")
+	fs.Usage = func() {
+		fmt.Println("Usage: keeping assert [-c count] [-i interval] [-max-avg d] [-max-max d] [-max-stddev d] [-max-loss pct] host...")
+		fmt.Println("Writes one JSON result per host, exits 1 if an assertion failed, 2 on errors.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if err := applyEnv(fs, "privileged", "methods", "s", "W"); err != nil {
+		fmt.Println("ERROR:", err)
+		return 2
+	}
+	if fs.NArg() == 0 || *count < 1 {
+		fs.Usage()
+		return 2
+	}
+	limits := assertLimits{Avg: *maxAvg, Max: *maxMax, StdDev: *maxStdDev}
+	var err error
+	if limits.Loss, err = parseLossLimit(*maxLoss); err != nil {
+		fmt.Println("ERROR:", err)
+		return 2
+	}
+	s := probeSettings{
+		Interval:     *interval,
+		Timeout:      time.Duration(math.MaxInt64),
+		ReplyTimeout: *replyTimeout,
+		MaxSaneRtt:   time.Minute,
+		Count:        *count,
+		Size:         *size,
+		TTL:          64,
+		Privileged:   *privileged,
+		Timestamping: timestampUser,
+	}
+	if *methods != "" {
+		if s.Methods, err = parseMethods(*methods); err != nil {
+			fmt.Println("ERROR:", err)
+			return 2
+		}
+	}
+
+	results := make([]*assertResult, fs.NArg())
+	var wg sync.WaitGroup
+	for i, host := range fs.Args() {
+		wg.Add(1)
+		go func(i int, host string) {
+			defer wg.Done()
+			res := (&batchJob{Host: host}).run(0, s)
+			results[i] = &assertResult{Target: host, Error: res.Error, Summary: res.Summary}
+		}(i, host)
+	}
+	wg.Wait()
+
+	code := 0
+	enc := json.NewEncoder(os.Stdout)
+	for _, r := range results {
+		if r.Error != "" {
+			code = 2
+			_ = enc.Encode(r)
+			continue
+		}
+		r.Failures = limits.check(r.Summary)
+		r.Pass = len(r.Failures) == 0
+		if !r.Pass && code == 0 {
+			code = 1
+		}
+		_ = enc.Encode(r)
+	}
+	return code
+}
+
+// assertLimits are the limits of keeping assert; a negative loss or a zero
+// RTT limit is none.
+type assertLimits struct {
+	Loss             float64
+	Avg, Max, StdDev time.Duration
+}
+
+// parseLossLimit parses a loss limit in percent, e.g. 0.5%, none when empty.
+func parseLossLimit(s string) (float64, error) {
+	if s == "" {
+		return -1, nil
+	}
+	v, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("invalid loss limit: %s", s)
+	}
+	return v, nil
+}
+
+// check returns the limits sum goes beyond.
+func (l assertLimits) check(sum *Summary) []assertFailure {
+	var failures []assertFailure
+	check := func(name string, limit, actual float64) {
+		if actual > limit {
+			failures = append(failures, assertFailure{Check: name, Limit: limit, Actual: actual})
+		}
+	}
+	if l.Loss >= 0 {
+		check("max_loss_pct", l.Loss, sum.LossPct)
+	}
+	// with no reply at all the RTT limits can't hold
+	noRtt := sum.Recv-sum.Discarded == 0
+	for _, c := range []struct {
+		name   string
+		limit  time.Duration
+		actual float64
+	}{
+		{"max_avg_ms", l.Avg, sum.AvgMs},
+		{"max_max_ms", l.Max, sum.MaxMs},
+		{"max_stddev_ms", l.StdDev, sum.StdDevMs},
+	} {
+		if c.limit <= 0 {
+			continue
+		}
+		if noRtt {
+			failures = append(failures, assertFailure{Check: c.name, Limit: ms(c.limit), Actual: -1})
+			continue
+		}
+		check(c.name, ms(c.limit), c.actual)
+	}
+	return failures
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// What the byte counts add to the payloads, only ICMP's being known up
+// front. A TCP probe is a handshake and a close, an HTTP probe a TCP probe
+// carrying a request and its response, over a new connection every time.
+const (
+	ipv4Header = 20
+	ipv6Header = 40
+	icmpHeader = 8
+	// tcpSegment is a TCP header with the usual options
+	tcpSegment   = 32
+	httpRequest  = 200
+	httpResponse = 300
+	// tlsClient and tlsServer are a TLS handshake, certificates included
+	tlsClient = 600
+	tlsServer = 4000
+)
+
+// probeBytes estimates the bytes a probe puts on the wire out and back,
+// headers included, besides an HTTP response body.
+func probeBytes(method string, ipv4 bool, size int) (sent, recv int) {
+	ip := ipv6Header
+	if ipv4 {
+		ip = ipv4Header
+	}
+	if method == protocolICMP {
+		n := ip + icmpHeader + size
+		return n, n
+	}
+	if strings.HasPrefix(method, protocolPeer+":") {
+		return ip + peerMessage, ip + peerMessage
+	}
+	// SYN, ACK and FIN out, SYN-ACK and FIN-ACK back
+	sent, recv = 3*(ip+tcpSegment), 2*(ip+tcpSegment)
+	switch method {
+	case "http":
+		sent, recv = sent+httpRequest, recv+httpResponse
+	case "https":
+		sent, recv = sent+httpRequest+tlsClient, recv+httpResponse+tlsServer
+	}
+	return sent, recv
+}
+
+// bandwidthAt estimates the bits per second p takes both ways when probing
+// every interval, with the heaviest of its methods.
+func (p *Pinger) bandwidthAt(interval time.Duration) float64 {
+	if interval <= 0 {
+		return 0
+	}
+	// the largest payload of a sweep or of -random-padding
+	size := p.Size
+	for _, s := range p.Sizes {
+		if s > size {
+			size = s
+		}
+	}
+	if p.Padding != nil && p.Padding.max > size {
+		size = p.Padding.max
+	}
+	var most int
+	for _, m := range p.Methods() {
+		if s, r := probeBytes(m, p.ipv4, size); s+r > most {
+			most = s + r
+		}
+	}
+	return float64(most*8) / interval.Seconds()
+}
+
+// bandwidth is bandwidthAt the current interval.
+func (p *Pinger) bandwidth() float64 {
+	p.statsMu.RLock()
+	interval := p.Interval
+	p.statsMu.RUnlock()
+	return p.bandwidthAt(interval)
+}
+
+// bandwidthUnits are the units -max-bandwidth takes, in bits per second.
+var bandwidthUnits = []struct {
+	suffix string
+	bits   float64
+}{
+	{"Gbit", 1e9}, {"Mbit", 1e6}, {"kbit", 1e3}, {"bit", 1},
+	{"GB", 8e9}, {"MB", 8e6}, {"kB", 8e3}, {"B", 8},
+}
+
+// parseBandwidth reads a rate such as 64kbit, 2Mbit or 10kB (per second),
+// bits when it has no unit.
+func parseBandwidth(s string) (float64, error) {
+	num, mult := strings.TrimSuffix(s, "/s"), 1.0
+	for _, u := range bandwidthUnits {
+		if v, ok := strings.CutSuffix(num, u.suffix); ok {
+			num, mult = v, u.bits
+			break
+		}
+	}
+	v, err := strconv.ParseFloat(num, 64)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("invalid bandwidth %q, want e.g. 64kbit, 2Mbit or 10kB", s)
+	}
+	return v * mult, nil
+}
+
+func formatBandwidth(bits float64) string {
+	switch {
+	case bits >= 1e6:
+		return fmt.Sprintf("%.2fMbit/s", bits/1e6)
+	case bits >= 1e3:
+		return fmt.Sprintf("%.2fkbit/s", bits/1e3)
+	}
+	return fmt.Sprintf("%.0fbit/s", bits)
+}
+
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1e9:
+		return fmt.Sprintf("%.2fGB", float64(n)/1e9)
+	case n >= 1e6:
+		return fmt.Sprintf("%.2fMB", float64(n)/1e6)
+	case n >= 1e3:
+		return fmt.Sprintf("%.2fkB", float64(n)/1e3)
+	}
+	return fmt.Sprintf("%dB", n)
+}
+
+// checkBandwidth refuses what would take more than -max-bandwidth in all:
+// the running targets, those in interval probing every interval instead,
+// plus extra. m.mu held.
+func (m *monitor) checkBandwidth(extra float64, interval map[*target]time.Duration) error {
+	if m.settings.MaxBandwidth <= 0 {
+		return nil
+	}
+	total := extra
+	for name, t := range m.targets {
+		if name != t.host {
+			continue
+		}
+		if d, ok := interval[t]; ok {
+			total += t.pinger.bandwidthAt(d)
+		} else {
+			total += t.pinger.bandwidth()
+		}
+	}
+	if total > m.settings.MaxBandwidth {
+		return fmt.Errorf("probing would take an estimated %s, more than -max-bandwidth %s",
+			formatBandwidth(total), formatBandwidth(m.settings.MaxBandwidth))
+	}
+	return nil
+}
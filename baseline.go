@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	// baselineMinSamples is how many intervals a slot needs before
+	// intervals are judged against it.
+	baselineMinSamples = 10
+	// an interval is anomalous when its average is baselineSigmas standard
+	// deviations and baselineRatio times above the usual value
+	baselineSigmas = 3
+	baselineRatio  = 1.5
+)
+
+// welford keeps the running mean and variance of a series.
+type welford struct {
+	n    int
+	mean float64
+	m2   float64
+}
+
+func (w *welford) add(x float64) {
+	w.n++
+	d := x - w.mean
+	w.mean += d / float64(w.n)
+	w.m2 += d * (x - w.mean)
+}
+
+func (w *welford) stddev() float64 {
+	if w.n < 2 {
+		return 0
+	}
+	return math.Sqrt(w.m2 / float64(w.n-1))
+}
+
+// popStddev is the standard deviation of the values themselves, as ping
+// reports it.
+func (w *welford) popStddev() float64 {
+	if w.n == 0 {
+		return 0
+	}
+	return math.Sqrt(w.m2 / float64(w.n))
+}
+
+// profile is the usual interval average of a target by hour of the week,
+// and by hour of the day for weeks not seen often enough yet.
+type profile struct {
+	week [7 * 24]welford
+	day  [24]welford
+}
+
+// baseline learns what latency is usual for each target at each time of day
+// and week, and flags the intervals that stand out against it.
+type baseline struct {
+	mu       sync.Mutex
+	profiles map[string]*profile
+}
+
+func newBaseline() *baseline {
+	return &baseline{profiles: make(map[string]*profile)}
+}
+
+// Observe judges the interval st against the usual value for its time, then
+// learns from it. It returns the usual average, zero while there is not
+// enough history, and a description if st is anomalous.
+func (b *baseline) Observe(st *IntervalStats) (float64, string) {
+	if st.Count == 0 {
+		return 0, ""
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	p, ok := b.profiles[st.Target]
+	if !ok {
+		p = &profile{}
+		b.profiles[st.Target] = p
+	}
+	at := st.Time.Local()
+	hour := at.Hour()
+	slot, when := &p.week[int(at.Weekday())*24+hour], at.Format("Mon 15:00")
+	if slot.n < baselineMinSamples {
+		slot, when = &p.day[hour], at.Format("15:00")
+	}
+	var usual float64
+	var anomaly string
+	if slot.n >= baselineMinSamples {
+		usual = slot.mean
+		if st.AvgMs > usual+baselineSigmas*slot.stddev() && st.AvgMs > usual*baselineRatio {
+			anomaly = fmt.Sprintf("latency is %.1fx its usual %s value (%v vs %v)", st.AvgMs/usual, when,
+				time.Duration(st.AvgMs*float64(time.Millisecond)).Round(time.Microsecond),
+				time.Duration(usual*float64(time.Millisecond)).Round(time.Microsecond))
+		}
+	}
+	p.week[int(at.Weekday())*24+hour].add(st.AvgMs)
+	p.day[hour].add(st.AvgMs)
+	return usual, anomaly
+}
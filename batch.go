@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// batchDefaultCount is the probe count of batch jobs that set none, when -c
+// doesn't either: a job has to end.
+const batchDefaultCount = 5
+
+// batchJob is one line of batch input. Unset fields take the value of the
+// corresponding command line flag.
+type batchJob struct {
+	// ID is handed back in the job's result to tell results apart
+	ID       string `json:"id,omitempty"`
+	Host     string `json:"host"`
+	Count    *int   `json:"count,omitempty"`
+	Interval string `json:"interval,omitempty"`
+	// Timeout is the per-probe reply timeout, like -W
+	Timeout string `json:"timeout,omitempty"`
+	Size    *int   `json:"size,omitempty"`
+	TTL     *int   `json:"ttl,omitempty"`
+	// Methods are the probe methods to fall back through, like -methods
+	Methods []string `json:"methods,omitempty"`
+	// PayloadFile is the body of the ICMP probes, like -payload-file
+	PayloadFile string `json:"payload_file,omitempty"`
+}
+
+// batchResult is written for every job once it has finished.
+type batchResult struct {
+	ID      string    `json:"id,omitempty"`
+	Line    int       `json:"line"`
+	Host    string    `json:"host"`
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+	Summary *Summary  `json:"summary,omitempty"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// runBatch implements `keeping -`: it reads probe jobs as JSON lines from r
+// and runs up to parallel of them at a time, writing one JSON result per
+// job to w in the order they finish. It returns 1 if any job failed.
+func runBatch(r io.Reader, w io.Writer, s probeSettings, parallel int) int {
+	if parallel < 1 {
+		parallel = 1
+	}
+	if s.Count < 0 {
+		s.Count = batchDefaultCount
+	}
+	var (
+		mu     sync.Mutex
+		failed bool
+		wg     sync.WaitGroup
+	)
+	enc := json.NewEncoder(w)
+	emit := func(res *batchResult) {
+		mu.Lock()
+		defer mu.Unlock()
+		if res.Error != "" {
+			failed = true
+		}
+		_ = enc.Encode(res)
+	}
+	slots := make(chan struct{}, parallel)
+	sc := bufio.NewScanner(r)
+	for line := 1; sc.Scan(); line++ {
+		if len(sc.Bytes()) == 0 {
+			continue
+		}
+		var job batchJob
+		js, err := job.settings(sc.Bytes(), s)
+		if err != nil {
+			now := time.Now()
+			emit(&batchResult{ID: job.ID, Line: line, Host: job.Host, Start: now, End: now, Error: err.Error()})
+			continue
+		}
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(line int) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			emit(job.run(line, js))
+		}(line)
+	}
+	wg.Wait()
+	if err := sc.Err(); err != nil {
+		fmt.Fprintln(os.Stderr, "ERROR:", err)
+		return 1
+	}
+	if failed {
+		return 1
+	}
+	return 0
+}
+
+// settings decodes the job from b and returns defaults overridden by it.
+func (job *batchJob) settings(b []byte, defaults probeSettings) (probeSettings, error) {
+	if err := json.Unmarshal(b, job); err != nil {
+		return defaults, err
+	}
+	return job.override(defaults)
+}
+
+// override returns defaults overridden by the fields the job sets.
+func (job *batchJob) override(defaults probeSettings) (probeSettings, error) {
+	s := defaults
+	if job.Host == "" {
+		return s, errors.New("job without host")
+	}
+	if job.Count != nil {
+		if *job.Count < 1 {
+			return s, fmt.Errorf("invalid count %d", *job.Count)
+		}
+		s.Count = *job.Count
+	}
+	for _, d := range []struct {
+		v   string
+		dst *time.Duration
+	}{{job.Interval, &s.Interval}, {job.Timeout, &s.ReplyTimeout}} {
+		if d.v == "" {
+			continue
+		}
+		v, err := time.ParseDuration(d.v)
+		if err != nil || v <= 0 {
+			return s, fmt.Errorf("invalid duration %q", d.v)
+		}
+		*d.dst = v
+	}
+	if job.Size != nil {
+		s.Size = *job.Size
+	}
+	if job.TTL != nil {
+		s.TTL = *job.TTL
+	}
+	if job.Methods != nil {
+		for _, m := range job.Methods {
+			if _, err := parseMethod(m); err != nil {
+				return s, err
+			}
+		}
+		s.Methods = job.Methods
+	}
+	if job.PayloadFile != "" {
+		if s.Padding != nil {
+			return s, errors.New("payload_file and -random-padding both set the payload, pick one")
+		}
+		body, err := readPayloadFile(job.PayloadFile)
+		if err != nil {
+			return s, err
+		}
+		s.Body = body
+	}
+	return s, nil
+}
+
+func (job *batchJob) run(line int, s probeSettings) *batchResult {
+	res := &batchResult{ID: job.ID, Line: line, Host: job.Host, Start: time.Now()}
+	p, err := NewPinger(job.Host)
+	if err == nil {
+		if err = s.apply(p); err == nil {
+			err = p.Run()
+		}
+	}
+	res.End = time.Now()
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	res.Summary = newSummary(job.Host, p.Statistics())
+	return res
+}
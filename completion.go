@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// maxRecentTargets bounds the targets remembered for completion.
+const maxRecentTargets = 100
+
+// subcommands are the first arguments main dispatches on.
+var subcommands = []string{"validate", "assert", "healthcheck", "verify", "annotate", "ctl", "diff", "nat-echo", "nat-timeout", "status", "history", "last", "report", "journal", "run", "remote", "doctor", "completion"}
+
+// ctlCommands are the commands of keeping ctl.
+var ctlCommands = []string{"status", "dump-stats", "pause", "resume", "set-interval", "add-target", "remove-target", "annotate", "note", "reset-stats", "traceroute"}
+
+// stateDir is where keeping keeps what it remembers for the user between
+// runs, $XDG_STATE_HOME/keeping or ~/.local/state/keeping.
+func stateDir() (string, error) {
+	if d := os.Getenv("XDG_STATE_HOME"); d != "" {
+		return filepath.Join(d, "keeping"), nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".local", "state", "keeping"), nil
+}
+
+// recentTargets returns the targets of the latest runs, most recent first.
+func recentTargets() []string {
+	dir, err := stateDir()
+	if err != nil {
+		return nil
+	}
+	f, err := os.Open(filepath.Join(dir, "targets"))
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	var ts []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		if t := strings.TrimSpace(sc.Text()); t != "" {
+			ts = append(ts, t)
+		}
+	}
+	return ts
+}
+
+// rememberTargets puts targets first among the recent targets. It is only
+// a convenience, failing silently where there is no writable home.
+func rememberTargets(targets []string) {
+	dir, err := stateDir()
+	if err != nil {
+		return
+	}
+	seen := make(map[string]bool)
+	var ts []string
+	for _, t := range append(append([]string(nil), targets...), recentTargets()...) {
+		if !seen[t] && !strings.ContainsAny(t, "\n\r") {
+			seen[t] = true
+			ts = append(ts, t)
+		}
+	}
+	if len(ts) > maxRecentTargets {
+		ts = ts[:maxRecentTargets]
+	}
+	if os.MkdirAll(dir, 0o700) != nil {
+		return
+	}
+	tmp := filepath.Join(dir, "targets.tmp")
+	if os.WriteFile(tmp, []byte(strings.Join(ts, "\n")+"\n"), 0o600) == nil {
+		_ = os.Rename(tmp, filepath.Join(dir, "targets"))
+	}
+}
+
+// completionMain implements `keeping completion bash|zsh|fish|powershell`,
+// printing a completion script for the flags registered so far. `keeping
+// completion targets` lists the recent targets, which the scripts call as
+// they complete.
+func completionMain(args []string) int {
+	if len(args) != 1 {
+		fmt.Println("Usage: keeping completion bash|zsh|fish|powershell")
+		return 2
+	}
+	name := filepath.Base(os.Args[0])
+	var flags []*flag.Flag
+	flag.VisitAll(func(f *flag.Flag) { flags = append(flags, f) })
+	sort.Slice(flags, func(i, j int) bool { return flags[i].Name < flags[j].Name })
+	switch args[0] {
+	case "targets":
+		for _, t := range recentTargets() {
+			fmt.Println(t)
+		}
+	case "bash":
+		fmt.Print(bashCompletion(name, flags))
+	case "zsh":
+		fmt.Print(zshCompletion(name, flags))
+	case "fish":
+		fmt.Print(fishCompletion(name, flags))
+	case "powershell":
+		fmt.Print(powershellCompletion(name, flags))
+	default:
+		fmt.Printf("ERROR: no completion for %q, want bash, zsh, fish or powershell\n", args[0])
+		return 2
+	}
+	return 0
+}
+
+func flagNames(flags []*flag.Flag) []string {
+	names := make([]string, len(flags))
+	for i, f := range flags {
+		names[i] = "-" + f.Name
+	}
+	return names
+}
+
+// shellQuote quotes s for a POSIX shell, and fish.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func bashCompletion(name string, flags []*flag.Flag) string {
+	fn := "_" + strings.ReplaceAll(name, "-", "_")
+	return fmt.Sprintf(`# bash completion for %[1]s, e.g. in ~/.bashrc: source <(%[1]s completion bash)
+%[2]s() {
+    local cur=${COMP_WORDS[COMP_CWORD]}
+    if [[ $cur == -* ]]; then
+        COMPREPLY=($(compgen -W %[3]s -- "$cur"))
+        return
+    fi
+    if [[ $COMP_CWORD -eq 2 && ${COMP_WORDS[1]} == ctl ]]; then
+        COMPREPLY=($(compgen -W %[4]s -- "$cur"))
+        return
+    fi
+    if [[ $COMP_CWORD -eq 2 && ${COMP_WORDS[1]} == completion ]]; then
+        COMPREPLY=($(compgen -W 'bash zsh fish powershell' -- "$cur"))
+        return
+    fi
+    local words=$(%[1]s completion targets 2>/dev/null)
+    if [[ $COMP_CWORD -eq 1 ]]; then
+        words="%[5]s $words"
+    fi
+    COMPREPLY=($(compgen -W "$words" -- "$cur"))
+}
+complete -o default -F %[2]s %[1]s
+`, name, fn, shellQuote(strings.Join(flagNames(flags), " ")), shellQuote(strings.Join(ctlCommands, " ")),
+		strings.Join(subcommands, " "))
+}
+
+func zshCompletion(name string, flags []*flag.Flag) string {
+	var b strings.Builder
+	fn := "_" + strings.ReplaceAll(name, "-", "_")
+	fmt.Fprintf(&b, "#compdef %s\n# zsh completion for %[1]s, e.g. in ~/.zshrc: source <(%[1]s completion zsh)\n", name)
+	fmt.Fprintf(&b, "%s() {\n    local -a flags\n    flags=(\n", fn)
+	for _, f := range flags {
+		desc := strings.ReplaceAll(f.Usage, "\n", " ")
+		fmt.Fprintf(&b, "        %s\n", shellQuote("-"+f.Name+":"+desc))
+	}
+	b.WriteString("    )\n")
+	fmt.Fprintf(&b, `    if [[ $PREFIX == -* ]]; then
+        _describe -o flag flags
+        return
+    fi
+    if (( CURRENT == 3 )) && [[ $words[2] == ctl ]]; then
+        compadd %[2]s
+        return
+    fi
+    if (( CURRENT == 3 )) && [[ $words[2] == completion ]]; then
+        compadd bash zsh fish powershell
+        return
+    fi
+    (( CURRENT == 2 )) && compadd %[3]s
+    compadd -- ${(f)"$(%[1]s completion targets 2>/dev/null)"}
+    _files
+}
+compdef %[4]s %[1]s
+`, name, strings.Join(ctlCommands, " "), strings.Join(subcommands, " "), fn)
+	return b.String()
+}
+
+func fishCompletion(name string, flags []*flag.Flag) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# fish completion for %[1]s, e.g. %[1]s completion fish > ~/.config/fish/completions/%[1]s.fish\n", name)
+	fmt.Fprintf(&b, "complete -c %s -n __fish_use_subcommand -f -a %s\n", name, shellQuote(strings.Join(subcommands, " ")))
+	fmt.Fprintf(&b, "complete -c %s -n '__fish_seen_subcommand_from ctl' -f -a %s\n", name, shellQuote(strings.Join(ctlCommands, " ")))
+	fmt.Fprintf(&b, "complete -c %s -n '__fish_seen_subcommand_from completion' -f -a 'bash zsh fish powershell'\n", name)
+	fmt.Fprintf(&b, "complete -c %s -a '(%[1]s completion targets 2>/dev/null)'\n", name)
+	for _, f := range flags {
+		fmt.Fprintf(&b, "complete -c %s -o %s -d %s\n", name, f.Name, shellQuote(strings.ReplaceAll(f.Usage, "\n", " ")))
+	}
+	return b.String()
+}
+
+func powershellCompletion(name string, flags []*flag.Flag) string {
+	quote := func(ss []string) string {
+		q := make([]string, len(ss))
+		for i, s := range ss {
+			q[i] = "'" + strings.ReplaceAll(s, "'", "''") + "'"
+		}
+		return strings.Join(q, ", ")
+	}
+	return fmt.Sprintf(`# PowerShell completion for %[1]s, e.g. in $PROFILE: %[1]s completion powershell | Out-String | Invoke-Expression
+Register-ArgumentCompleter -Native -CommandName %[1]s -ScriptBlock {
+    param($wordToComplete, $commandAst, $cursorPosition)
+    $words = $commandAst.CommandElements | ForEach-Object { $_.ToString() }
+    $n = $words.Count
+    if ($wordToComplete -ne '') { $n-- }
+    if ($wordToComplete -like '-*') {
+        $candidates = @(%[2]s)
+    } elseif ($n -eq 2 -and $words[1] -eq 'ctl') {
+        $candidates = @(%[3]s)
+    } elseif ($n -eq 2 -and $words[1] -eq 'completion') {
+        $candidates = @('bash', 'zsh', 'fish', 'powershell')
+    } else {
+        $candidates = @(& %[1]s completion targets 2>$null)
+        if ($n -eq 1) { $candidates = @(%[4]s) + $candidates }
+    }
+    $candidates | Where-Object { $_ -like "$wordToComplete*" } | ForEach-Object {
+        [System.Management.Automation.CompletionResult]::new($_, $_, 'ParameterValue', $_)
+    }
+}
+`, name, quote(flagNames(flags)), quote(ctlCommands), quote(subcommands))
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	timestampUser   = "user"
+	timestampKernel = "kernel"
+)
+
+var errKernelTimestampsUnsupported = errors.New("kernel timestamping is not supported on this platform")
+
+// icmpConn is an ICMP socket together with the x/net wrappers used to set the
+// per-family options. The plain net.PacketConn is kept so platform code can
+// reach the file descriptor.
+type icmpConn struct {
+	c  net.PacketConn
+	p4 *ipv4.PacketConn
+	p6 *ipv6.PacketConn
+	// kernelTimestamps is set once SO_TIMESTAMPNS is enabled, receive times
+	// then come from the kernel rather than from time.Now after the read.
+	kernelTimestamps bool
+	// flowInfo is the IPv6 flow label probes are sent with, in network
+	// order, once setFlowLabel leased one.
+	flowInfo uint32
+	// ipHeaders is set by enableDetail where reading with recvmsg keeps the
+	// IPv4 header raw sockets receive, which ReadFrom strips.
+	ipHeaders bool
+}
+
+func (c *icmpConn) Close() error {
+	return c.c.Close()
+}
+
+func (c *icmpConn) WriteTo(b []byte, dst net.Addr) (int, error) {
+	if c.flowInfo != 0 {
+		return c.writeFlow(b, dst)
+	}
+	return c.c.WriteTo(b, dst)
+}
+
+// SetTTL sets the TTL (IPv4) or hop limit (IPv6) of outgoing packets and asks
+// for the received one to be reported.
+func (c *icmpConn) SetTTL(ttl int) error {
+	if c.p4 != nil {
+		if err := c.p4.SetTTL(ttl); err != nil {
+			return err
+		}
+		// windows can't deliver control messages, the ttl is then unknown
+		_ = c.p4.SetControlMessage(ipv4.FlagTTL, true)
+		return nil
+	}
+	if err := c.p6.SetHopLimit(ttl); err != nil {
+		return err
+	}
+	_ = c.p6.SetControlMessage(ipv6.FlagHopLimit, true)
+	return nil
+}
+
+// setTOS sets the TOS byte (IPv4) or traffic class (IPv6) of outgoing
+// packets.
+func (c *icmpConn) setTOS(tos int) error {
+	if c.p4 != nil {
+		return c.p4.SetTOS(tos)
+	}
+	return c.p6.SetTrafficClass(tos)
+}
+
+// read reads one packet and stamps it with its receive time.
+func (c *icmpConn) read(b []byte) (*recvPacket, error) {
+	if c.kernelTimestamps || c.ipHeaders {
+		return c.readKernel(b)
+	}
+	r := &recvPacket{bytes: b, ttl: -1, timestamping: timestampUser, tclass: -1}
+	var err error
+	if c.p4 != nil {
+		var cm *ipv4.ControlMessage
+		r.nbytes, cm, r.src, err = c.p4.ReadFrom(b)
+		if cm != nil {
+			r.ttl, r.ifIndex, r.dst = cm.TTL, cm.IfIndex, cm.Dst
+		}
+	} else {
+		var cm *ipv6.ControlMessage
+		r.nbytes, cm, r.src, err = c.p6.ReadFrom(b)
+		if cm != nil {
+			r.ttl, r.ifIndex, r.dst, r.tclass = cm.HopLimit, cm.IfIndex, cm.Dst, cm.TrafficClass
+		}
+	}
+	r.receivedAt = time.Now()
+	return r, err
+}
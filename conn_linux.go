@@ -0,0 +1,160 @@
+//go:build linux
+
+package main
+
+import (
+	"net"
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// listenICMP opens the ICMP socket itself instead of going through
+// icmp.ListenPacket, so the descriptor stays reachable for socket options.
+func listenICMP(v4, privileged bool, source string) (*icmpConn, error) {
+	var c net.PacketConn
+	var err error
+	if privileged {
+		network := "ip6:ipv6-icmp"
+		if v4 {
+			network = "ip4:icmp"
+		}
+		c, err = net.ListenPacket(network, source)
+	} else {
+		c, err = listenDatagramICMP(v4, source)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if v4 {
+		return &icmpConn{c: c, p4: ipv4.NewPacketConn(c)}, nil
+	}
+	return &icmpConn{c: c, p6: ipv6.NewPacketConn(c)}, nil
+}
+
+// listenDatagramICMP opens an unprivileged ICMP socket (SOCK_DGRAM), allowed
+// by net.ipv4.ping_group_range.
+func listenDatagramICMP(v4 bool, source string) (net.PacketConn, error) {
+	family, proto := syscall.AF_INET6, ianaProtocolIPv6ICMP
+	if v4 {
+		family, proto = syscall.AF_INET, ianaProtocolICMP
+	}
+	s, err := syscall.Socket(family, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, proto)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	if source != "" {
+		var sa syscall.Sockaddr
+		ip := net.ParseIP(source)
+		if ip == nil {
+			syscall.Close(s)
+			return nil, &net.AddrError{Err: "invalid source address", Addr: source}
+		}
+		if v4 {
+			sa4 := &syscall.SockaddrInet4{}
+			copy(sa4.Addr[:], ip.To4())
+			sa = sa4
+		} else {
+			sa6 := &syscall.SockaddrInet6{}
+			copy(sa6.Addr[:], ip.To16())
+			sa = sa6
+		}
+		if err := syscall.Bind(s, sa); err != nil {
+			syscall.Close(s)
+			return nil, os.NewSyscallError("bind", err)
+		}
+	}
+	f := os.NewFile(uintptr(s), "icmp")
+	defer f.Close()
+	return net.FilePacketConn(f)
+}
+
+// control runs fn with the socket's file descriptor.
+func (c *icmpConn) control(fn func(fd int) error) error {
+	sc, ok := c.c.(syscall.Conn)
+	if !ok {
+		return syscall.EINVAL
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var opErr error
+	if err := rc.Control(func(fd uintptr) { opErr = fn(int(fd)) }); err != nil {
+		return err
+	}
+	return opErr
+}
+
+// recvmsgHeaders tells that readKernel keeps the IPv4 header of a raw socket.
+const recvmsgHeaders = true
+
+func (c *icmpConn) enableKernelTimestamps() error {
+	err := c.control(func(fd int) error {
+		return os.NewSyscallError("setsockopt",
+			syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_TIMESTAMPNS, 1))
+	})
+	if err != nil {
+		return err
+	}
+	c.kernelTimestamps = true
+	return nil
+}
+
+// readKernel reads with recvmsg so the SCM_TIMESTAMPNS control message can be
+// picked up next to the TTL.
+func (c *icmpConn) readKernel(b []byte) (*recvPacket, error) {
+	oob := make([]byte, 128)
+	r := &recvPacket{bytes: b, ttl: -1, timestamping: timestampUser, tclass: -1}
+	var oobn int
+	var err error
+	switch conn := c.c.(type) {
+	case *net.IPConn:
+		var src *net.IPAddr
+		r.nbytes, oobn, _, src, err = conn.ReadMsgIP(b, oob)
+		r.src = src
+	case *net.UDPConn:
+		var src *net.UDPAddr
+		r.nbytes, oobn, _, src, err = conn.ReadMsgUDP(b, oob)
+		r.src = src
+	default:
+		return nil, errKernelTimestampsUnsupported
+	}
+	r.receivedAt = time.Now()
+	if err != nil {
+		return r, err
+	}
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return r, nil
+	}
+	for _, m := range msgs {
+		switch {
+		case m.Header.Level == syscall.SOL_SOCKET && m.Header.Type == syscall.SCM_TIMESTAMPNS &&
+			len(m.Data) >= int(unsafe.Sizeof(syscall.Timespec{})):
+			ts := (*syscall.Timespec)(unsafe.Pointer(&m.Data[0]))
+			r.receivedAt = time.Unix(ts.Unix())
+			r.timestamping = timestampKernel
+		case m.Header.Level == syscall.IPPROTO_IP && m.Header.Type == syscall.IP_TTL && len(m.Data) >= 4,
+			m.Header.Level == syscall.IPPROTO_IPV6 && m.Header.Type == syscall.IPV6_HOPLIMIT && len(m.Data) >= 4:
+			r.ttl = int(*(*int32)(unsafe.Pointer(&m.Data[0])))
+		}
+	}
+	// what enableDetail asked for
+	if c.p4 != nil {
+		var cm ipv4.ControlMessage
+		if cm.Parse(oob[:oobn]) == nil {
+			r.ifIndex, r.dst = cm.IfIndex, cm.Dst
+		}
+	} else {
+		var cm ipv6.ControlMessage
+		if cm.Parse(oob[:oobn]) == nil {
+			r.ifIndex, r.dst, r.tclass = cm.IfIndex, cm.Dst, cm.TrafficClass
+		}
+	}
+	return r, nil
+}
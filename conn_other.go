@@ -0,0 +1,36 @@
+//go:build !linux
+
+package main
+
+import (
+	"golang.org/x/net/icmp"
+)
+
+func listenICMP(v4, privileged bool, source string) (*icmpConn, error) {
+	var network string
+	switch {
+	case v4 && privileged:
+		network = "ip4:icmp"
+	case v4:
+		network = "udp4"
+	case privileged:
+		network = "ip6:ipv6-icmp"
+	default:
+		network = "udp6"
+	}
+	c, err := icmp.ListenPacket(network, source)
+	if err != nil {
+		return nil, err
+	}
+	return &icmpConn{c: c, p4: c.IPv4PacketConn(), p6: c.IPv6PacketConn()}, nil
+}
+
+const recvmsgHeaders = false
+
+func (c *icmpConn) enableKernelTimestamps() error {
+	return errKernelTimestampsUnsupported
+}
+
+func (c *icmpConn) readKernel(b []byte) (*recvPacket, error) {
+	return nil, errKernelTimestampsUnsupported
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// The control socket protocol is one request line per connection, made of a
+// command and its argument string. The reply starts with a status line, "ok"
+// or "error <message>", followed by free-form output until the server closes
+// the connection.
+
+// ctlHandler runs a control command and returns its output.
+type ctlHandler func(arg string) (string, error)
+
+// ctlServer is the control socket of a running instance.
+type ctlServer struct {
+	l        net.Listener
+	mu       sync.Mutex
+	handlers map[string]ctlHandler
+}
+
+func defaultCtlPath() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "keeping.sock")
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("keeping-%d.sock", os.Getuid()))
+}
+
+// listenCtl opens the control socket at path, for this user alone. A socket
+// file left behind by a dead instance is replaced, one that still answers is
+// an error.
+func listenCtl(path string) (*ctlServer, error) {
+	l, err := listenUnixPrivate(path)
+	if err != nil && errors.Is(err, syscall.EADDRINUSE) {
+		if c, dialErr := net.DialTimeout("unix", path, time.Second); dialErr == nil {
+			c.Close()
+			return nil, fmt.Errorf("%s is in use by another instance", path)
+		}
+		_ = os.Remove(path)
+		l, err = listenUnixPrivate(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &ctlServer{l: l, handlers: make(map[string]ctlHandler)}, nil
+}
+
+// Handle registers the handler for cmd.
+func (s *ctlServer) Handle(cmd string, h ctlHandler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handlers[cmd] = h
+}
+
+// Serve accepts control connections until the server is closed.
+func (s *ctlServer) Serve() {
+	for {
+		c, err := s.l.Accept()
+		if err != nil {
+			return
+		}
+		go s.serveConn(c)
+	}
+}
+
+func (s *ctlServer) serveConn(c net.Conn) {
+	defer c.Close()
+	_ = c.SetDeadline(time.Now().Add(10 * time.Second))
+	line, err := bufio.NewReader(c).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return
+	}
+	cmd, arg, _ := strings.Cut(strings.TrimSpace(line), " ")
+	s.mu.Lock()
+	h, ok := s.handlers[cmd]
+	s.mu.Unlock()
+	if !ok {
+		fmt.Fprintf(c, "error unknown command %q\n", cmd)
+		return
+	}
+	out, err := h(strings.TrimSpace(arg))
+	if err != nil {
+		fmt.Fprintf(c, "error %v\n", err)
+		return
+	}
+	fmt.Fprintln(c, "ok")
+	io.WriteString(c, out)
+}
+
+// Close stops serving and removes the socket file.
+func (s *ctlServer) Close() error {
+	return s.l.Close()
+}
+
+// ctlRequest sends one command to the instance listening at path and returns
+// its output.
+func ctlRequest(path, cmd, arg string) (string, error) {
+	c, err := net.DialTimeout("unix", path, time.Second)
+	if err != nil {
+		return "", fmt.Errorf("no running instance at %s: %w", path, err)
+	}
+	defer c.Close()
+	_ = c.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := fmt.Fprintf(c, "%s %s\n", cmd, arg); err != nil {
+		return "", err
+	}
+	r := bufio.NewReader(c)
+	status, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	status = strings.TrimSpace(status)
+	if msg, ok := strings.CutPrefix(status, "error "); ok {
+		return "", errors.New(msg)
+	}
+	out, err := io.ReadAll(r)
+	return string(out), err
+}
+
+// ctlMain implements `keeping ctl <cmd> [args]`.
+func ctlMain(args []string) int {
+	fs := flag.NewFlagSet("ctl", flag.ExitOnError)
+	ctlPath := fs.String("ctl", defaultCtlPath(), "control socket of the running instance")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fmt.Println("Usage: keeping ctl [-ctl path] <status|dump-stats|pause|resume|set-interval|add-target|remove-target|note|reset-stats|traceroute> [args]")
+		return 2
+	}
+	out, err := ctlRequest(*ctlPath, fs.Arg(0), strings.Join(fs.Args()[1:], " "))
+	if err != nil {
+		fmt.Println("ERROR:", err)
+		return 1
+	}
+	fmt.Print(out)
+	return 0
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestCtlSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keeping.sock")
+	s, err := listenCtl(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if runtime.GOOS != "windows" {
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if perm := fi.Mode().Perm(); perm != 0o600 {
+			t.Errorf("socket mode %o, want 600", perm)
+		}
+	}
+	s.Handle("echo", func(arg string) (string, error) { return arg + "\n", nil })
+	s.Handle("fail", func(string) (string, error) { return "", errors.New("no such target") })
+	go s.Serve()
+	if out, err := ctlRequest(path, "echo", "a b"); err != nil || out != "a b\n" {
+		t.Errorf("echo: %q, %v", out, err)
+	}
+	if _, err := ctlRequest(path, "fail", ""); err == nil || err.Error() != "no such target" {
+		t.Errorf("fail: %v", err)
+	}
+	if _, err := ctlRequest(path, "nope", ""); err == nil || !strings.Contains(err.Error(), `unknown command "nope"`) {
+		t.Errorf("unknown command: %v", err)
+	}
+	if _, err := listenCtl(path); err == nil || !strings.Contains(err.Error(), "in use") {
+		t.Errorf("second instance: %v", err)
+	}
+}
+
+func TestCtlSocketLeftBehind(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keeping.sock")
+	s, err := listenCtl(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the socket file stays behind, as when an instance crashes
+	s.l.(*net.UnixListener).SetUnlinkOnClose(false)
+	s.Close()
+	if _, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	}
+	s, err = listenCtl(path)
+	if err != nil {
+		t.Fatalf("socket left behind: %v", err)
+	}
+	s.Close()
+}
@@ -0,0 +1,27 @@
+//go:build unix
+
+package main
+
+import (
+	"net"
+	"os"
+	"syscall"
+)
+
+// listenUnixPrivate listens on the unix socket path, which only this user
+// may connect to from the moment it exists: the umask is tightened around
+// the bind, the process-wide umask erring on the strict side for any file
+// created meanwhile.
+func listenUnixPrivate(path string) (net.Listener, error) {
+	old := syscall.Umask(0o177)
+	l, err := net.Listen("unix", path)
+	syscall.Umask(old)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0o600); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"text/tabwriter"
+)
+
+// diffMain implements `keeping diff before.json after.json`, comparing the
+// targets two runs have in common.
+func diffMain(args []string) int {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Println("Usage: keeping diff before.json after.json")
+		fmt.Println("Compares summaries written by -summary, or batch mode output.")
+	}
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return 2
+	}
+	before, err := readSummaries(fs.Arg(0))
+	if err != nil {
+		fmt.Println("ERROR:", err)
+		return 1
+	}
+	after, err := readSummaries(fs.Arg(1))
+	if err != nil {
+		fmt.Println("ERROR:", err)
+		return 1
+	}
+	byTarget := func(ss []*Summary) map[string]*Summary {
+		m := make(map[string]*Summary, len(ss))
+		for _, s := range ss {
+			m[s.Target] = s
+		}
+		return m
+	}
+	b, a := byTarget(before), byTarget(after)
+	var names []string
+	for name := range b {
+		names = append(names, name)
+	}
+	for name := range a {
+		if _, ok := b[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "target\tavg before\tavg after\tdelta\tloss before\tloss after\tdelta\tnote")
+	for _, name := range names {
+		sb, sa := b[name], a[name]
+		switch {
+		case sa == nil:
+			fmt.Fprintf(tw, "%s\t%.3fms\t-\t\t%.1f%%\t-\t\tonly in %s\n", name, sb.AvgMs, sb.LossPct, fs.Arg(0))
+			continue
+		case sb == nil:
+			fmt.Fprintf(tw, "%s\t-\t%.3fms\t\t-\t%.1f%%\t\tonly in %s\n", name, sa.AvgMs, sa.LossPct, fs.Arg(1))
+			continue
+		}
+		rel := ""
+		if sb.AvgMs > 0 {
+			rel = fmt.Sprintf(" (%+.0f%%)", (sa.AvgMs-sb.AvgMs)/sb.AvgMs*100)
+		}
+		fmt.Fprintf(tw, "%s\t%.3f±%.3fms\t%.3f±%.3fms\t%+.3fms%s\t%.1f%%\t%.1f%%\t%+.1fpp\t%s\n",
+			name, sb.AvgMs, ci95(sb.StdDevMs, sb.Recv), sa.AvgMs, ci95(sa.StdDevMs, sa.Recv), sa.AvgMs-sb.AvgMs, rel,
+			sb.LossPct, sa.LossPct, sa.LossPct-sb.LossPct, diffHint(sb, sa))
+	}
+	tw.Flush()
+	return 0
+}
+
+// diffHint says whether the change between two summaries looks real: a
+// Welch t test for the mean RTT and a two-proportion z test for the loss.
+// Summaries keep no samples to rank, so unlike the live comparisons this
+// leans on the means, the p-values by the normal approximation.
+func diffHint(b, a *Summary) string {
+	if b.Recv < 2 || a.Recv < 2 {
+		return "too few replies to tell"
+	}
+	var hints []string
+	p := 1.0
+	se := math.Sqrt(b.StdDevMs*b.StdDevMs/float64(b.Recv) + a.StdDevMs*a.StdDevMs/float64(a.Recv))
+	if se > 0 {
+		t := (a.AvgMs - b.AvgMs) / se
+		if p = math.Erfc(math.Abs(t) / math.Sqrt2); p < significant {
+			dir := "slower"
+			if t < 0 {
+				dir = "faster"
+			}
+			hints = append(hints, fmt.Sprintf("after is %s (%s)", dir, formatP(p)))
+		}
+	}
+	lb, la := lossCounts(b), lossCounts(a)
+	nb, na := float64(b.Sent-b.Excused), float64(a.Sent-a.Excused)
+	if pl, more := lossTest(la, na, lb, nb); pl < significant {
+		dir := "less"
+		if more {
+			dir = "more"
+		}
+		hints = append(hints, fmt.Sprintf("%s loss after (%s)", dir, formatP(pl)))
+	}
+	if len(hints) == 0 {
+		return fmt.Sprintf("within noise (%s)", formatP(p))
+	}
+	s := hints[0]
+	for _, h := range hints[1:] {
+		s += ", " + h
+	}
+	return s
+}
+
+func lossCounts(s *Summary) float64 {
+	return float64(s.Sent - s.Excused - s.Recv)
+}
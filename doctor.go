@@ -0,0 +1,229 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A doctor check ends ok, with a warning or failed; what isn't ok comes
+// with a fix.
+const (
+	checkOK   = "ok"
+	checkWarn = "warn"
+	checkFail = "fail"
+)
+
+// doctor runs the checks of `keeping doctor` and keeps their outcome.
+type doctor struct {
+	failed bool
+}
+
+func (d *doctor) report(status, what, detail string, fix ...string) {
+	fmt.Printf("[%s]%s %s: %s\n", status, strings.Repeat(" ", 4-len(status)), what, detail)
+	for _, f := range fix {
+		fmt.Println("       fix:", f)
+	}
+	if status == checkFail {
+		d.failed = true
+	}
+}
+
+// doctorMain implements `keeping doctor`, checking what probing needs on
+// this host and saying how to fix what is missing.
+func doctorMain(args []string) int {
+	fs := flag.NewFlagSet("doctor", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Println("Usage: keeping doctor [host...]")
+		fmt.Println("Checks the sockets, permissions, IPv6, firewall and clock probing needs, and probes the hosts given too.")
+		fmt.Println("Exits 1 when a check failed.")
+	}
+	fs.Parse(args)
+	d := &doctor{}
+	raw, dgram := d.checkSockets()
+	privileged := raw
+	if !raw && !dgram {
+		d.report(checkFail, "probing", "no ICMP socket can be opened, skipping the probes")
+	} else {
+		hosts := []string{"127.0.0.1"}
+		if d.checkIPv6() {
+			hosts = append(hosts, "::1")
+		}
+		for _, h := range hosts {
+			if !d.checkProbe(h, privileged, "localhost") {
+				d.report(checkFail, "firewall", "this host doesn't answer its own pings, a local firewall drops ICMP echo",
+					"allow echo requests and replies on lo, e.g. nft add rule inet filter input iif lo accept")
+			}
+		}
+		gws, err := defaultGateways()
+		if err == nil && len(gws) == 0 {
+			d.report(checkWarn, "gateway", "no default gateway found", "check the default route: ip route show default")
+		}
+		for _, gw := range gws {
+			if !d.checkProbe(gw, privileged, "gateway") {
+				d.report(checkWarn, "firewall", fmt.Sprintf("the gateway %s doesn't answer pings, it or a firewall on the way filters ICMP", gw),
+					"probe a host past it, or fall back to TCP with -methods icmp,tcp:443")
+			}
+		}
+		for _, h := range fs.Args() {
+			d.checkProbe(h, privileged, h)
+		}
+	}
+	d.checkClock()
+	if d.failed {
+		return 1
+	}
+	return 0
+}
+
+// checkSockets tells whether raw and datagram ICMP sockets can be opened,
+// the latter as allowed by ping_group_range.
+func (d *doctor) checkSockets() (raw, dgram bool) {
+	self, _ := os.Executable()
+	if c, err := listenICMP(true, true, ""); err == nil {
+		c.Close()
+		d.report(checkOK, "raw ICMP sockets", "can be opened, --privileged works")
+		raw = true
+	} else {
+		d.report(checkWarn, "raw ICMP sockets", err.Error()+", --privileged and -ttl-sweep won't work",
+			"run as root, or let keeping open them: sudo setcap cap_net_raw+ep "+self)
+	}
+	if c, err := listenICMP(true, false, ""); err == nil {
+		c.Close()
+		d.report(checkOK, "unprivileged ICMP sockets", "can be opened")
+		dgram = true
+	} else {
+		var fix []string
+		if lo, hi, ok := pingGroupRange(); ok {
+			fix = append(fix, fmt.Sprintf("net.ipv4.ping_group_range is %d %d, not including group %d: sudo sysctl -w net.ipv4.ping_group_range=\"0 2147483647\"",
+				lo, hi, os.Getgid()))
+		}
+		status := checkWarn
+		if !raw {
+			status = checkFail
+		}
+		d.report(status, "unprivileged ICMP sockets", err.Error(), fix...)
+	}
+	if c, err := listenICMP(true, raw, ""); err == nil {
+		if err := c.enableKernelTimestamps(); err == nil {
+			d.report(checkOK, "kernel timestamps", "available, -timestamp kernel takes the scheduling delay out of the RTTs")
+		}
+		c.Close()
+	}
+	return raw, dgram
+}
+
+// checkIPv6 tells whether IPv6 probes can go anywhere from here.
+func (d *doctor) checkIPv6() bool {
+	ifs, err := net.InterfaceAddrs()
+	if err != nil {
+		d.report(checkWarn, "IPv6", err.Error())
+		return false
+	}
+	var loopback, global bool
+	for _, a := range ifs {
+		ipn, ok := a.(*net.IPNet)
+		if !ok || ipn.IP.To4() != nil {
+			continue
+		}
+		loopback = loopback || ipn.IP.IsLoopback()
+		global = global || ipn.IP.IsGlobalUnicast()
+	}
+	switch {
+	case !loopback && !global:
+		d.report(checkWarn, "IPv6", "disabled, IPv6 targets can't be probed", "enable it: sudo sysctl -w net.ipv6.conf.all.disable_ipv6=0")
+		return false
+	case !global:
+		d.report(checkWarn, "IPv6", "no global address, only IPv4 targets can be reached", "probe names by their IPv4 address, or get IPv6 connectivity")
+		return loopback
+	}
+	c, err := net.DialUDP("udp6", nil, &net.UDPAddr{IP: net.ParseIP("2001:4860:4860::8888"), Port: 53})
+	if err != nil {
+		d.report(checkWarn, "IPv6", "addresses but no route out: "+err.Error(), "check the IPv6 default route: ip -6 route show default")
+		return true
+	}
+	c.Close()
+	d.report(checkOK, "IPv6", "routed")
+	return true
+}
+
+// checkProbe pings host a few times, reporting whether it answers.
+func (d *doctor) checkProbe(host string, privileged bool, what string) bool {
+	s := probeSettings{
+		Interval:     200 * time.Millisecond,
+		Timeout:      time.Duration(math.MaxInt64),
+		ReplyTimeout: time.Second,
+		MaxSaneRtt:   time.Minute,
+		Count:        3,
+		Size:         24,
+		TTL:          64,
+		Privileged:   privileged,
+		Timestamping: timestampUser,
+	}
+	res := (&batchJob{Host: host}).run(0, s)
+	name := fmt.Sprintf("ping %s (%s)", host, what)
+	if what == host {
+		name = "ping " + host
+	}
+	switch {
+	case res.Error != "":
+		d.report(checkFail, name, res.Error)
+		return false
+	case res.Summary.Recv == 0:
+		if what == host {
+			d.report(checkFail, name, "no reply")
+		}
+		return false
+	}
+	d.report(checkOK, name, fmt.Sprintf("%d/%d replies, avg %.3fms", res.Summary.Recv, res.Summary.Sent, res.Summary.AvgMs))
+	return true
+}
+
+// checkClock measures how fine the clock RTTs are read from is, and how
+// late timers fire, which the probe intervals depend on.
+func (d *doctor) checkClock() {
+	if src, err := clockSource(); err == nil {
+		switch src {
+		case "tsc", "arch_sys_counter", "kvm-clock":
+			d.report(checkOK, "clock source", src)
+		default:
+			d.report(checkWarn, "clock source", src+", slower to read than the TSC, adding to every RTT",
+				"see dmesg for why the kernel left the TSC, such as tsc unstable")
+		}
+	}
+	step := time.Duration(math.MaxInt64)
+	start := time.Now()
+	prev := start
+	for i := 0; i < 100000; i++ {
+		now := time.Now()
+		if dt := now.Sub(prev); dt > 0 && dt < step {
+			step = dt
+		}
+		prev = now
+	}
+	cost := prev.Sub(start) / 100000
+	if step > time.Millisecond {
+		d.report(checkWarn, "clock resolution", fmt.Sprintf("%v, too coarse for sub-millisecond RTTs", step),
+			"use -timestamp kernel where it is available")
+	} else {
+		d.report(checkOK, "clock resolution", fmt.Sprintf("%v, read in %v", step, cost))
+	}
+	lates := make([]time.Duration, 20)
+	for i := range lates {
+		t := time.Now()
+		time.Sleep(time.Millisecond)
+		lates[i] = time.Since(t) - time.Millisecond
+	}
+	sort.Slice(lates, func(i, j int) bool { return lates[i] < lates[j] })
+	if late := lates[len(lates)/2]; late > 2*time.Millisecond {
+		d.report(checkWarn, "timers", fmt.Sprintf("fire %v late, probes go out that much off their schedule", late.Round(time.Microsecond)),
+			"keep -i well above it, and the host less loaded")
+	} else {
+		d.report(checkOK, "timers", fmt.Sprintf("fire %v late", late.Round(time.Microsecond)))
+	}
+}
@@ -0,0 +1,82 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// pingGroupRange returns net.ipv4.ping_group_range, the groups allowed
+// unprivileged ICMP sockets.
+func pingGroupRange() (lo, hi int, ok bool) {
+	b, err := os.ReadFile("/proc/sys/net/ipv4/ping_group_range")
+	if err != nil {
+		return 0, 0, false
+	}
+	if _, err := fmt.Sscan(string(b), &lo, &hi); err != nil {
+		return 0, 0, false
+	}
+	return lo, hi, true
+}
+
+// defaultGateways returns the gateways of the IPv4 and IPv6 default routes,
+// link-local ones with their zone.
+func defaultGateways() ([]string, error) {
+	var gws []string
+	seen := make(map[string]bool)
+	add := func(ip net.IP, zone string) {
+		host := ip.String()
+		if ip.IsLinkLocalUnicast() && zone != "" {
+			host += "%" + zone
+		}
+		if !ip.IsUnspecified() && !seen[host] {
+			seen[host] = true
+			gws = append(gws, host)
+		}
+	}
+	f, err := os.Open("/proc/net/route")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		// Iface Destination Gateway ..., in host order
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 3 || fields[1] != "00000000" {
+			continue
+		}
+		b, err := hex.DecodeString(fields[2])
+		if err != nil || len(b) != 4 {
+			continue
+		}
+		add(net.IPv4(b[3], b[2], b[1], b[0]), "")
+	}
+	if f6, err := os.Open("/proc/net/ipv6_route"); err == nil {
+		defer f6.Close()
+		sc := bufio.NewScanner(f6)
+		for sc.Scan() {
+			// destination, its prefix length, source and its length,
+			// next hop, metric, use and reference counts, flags, device
+			fields := strings.Fields(sc.Text())
+			if len(fields) < 10 || fields[0] != strings.Repeat("0", 32) || fields[1] != "00" {
+				continue
+			}
+			if b, err := hex.DecodeString(fields[4]); err == nil && len(b) == 16 {
+				add(net.IP(b), fields[9])
+			}
+		}
+	}
+	return gws, nil
+}
+
+// clockSource is the clock the kernel reads the time from.
+func clockSource() (string, error) {
+	b, err := os.ReadFile("/sys/devices/system/clocksource/clocksource0/current_clocksource")
+	return strings.TrimSpace(string(b)), err
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// The routes and the clock source are only read on Linux.
+
+func pingGroupRange() (lo, hi int, ok bool) { return 0, 0, false }
+
+func defaultGateways() ([]string, error) {
+	return nil, errors.New("the default gateway is only looked up on Linux")
+}
+
+func clockSource() (string, error) {
+	return "", errors.New("the clock source is only read on Linux")
+}
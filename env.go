@@ -0,0 +1,65 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// envPrefix starts the environment variables setting flags, for containers
+// no one wants to template a command line for: KEEPING_K=1m is -k 1m,
+// KEEPING_METRIC_BUCKETS is -metric-buckets.
+const envPrefix = "KEEPING_"
+
+// envAliases name the variables of flags that would clash with another
+// once upper-cased.
+var envAliases = map[string]string{"I": "DEVICE"}
+
+// envName is the environment variable of flag name.
+func envName(name string) string {
+	if alias, ok := envAliases[name]; ok {
+		return envPrefix + alias
+	}
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// subcommandEnvName is the environment variable of flag name of the
+// subcommand cmd: KEEPING_HEALTHCHECK_MAX_RTT is -max-rtt of keeping
+// healthcheck.
+func subcommandEnvName(cmd, name string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(cmd, "-", "_")) + "_" + strings.TrimPrefix(envName(name), envPrefix)
+}
+
+// applyEnv sets the flags of fs left off the command line from their
+// variables, set even when empty: the command line wins over the
+// environment, which wins over the defaults. A subcommand's flags have
+// variables of their own, its -i or -max-rtt meaning something else than
+// the main command's; those in shared, meaning the same, fall back on the
+// main command's variable, KEEPING_PRIVILEGED.
+func applyEnv(fs *flag.FlagSet, shared ...string) error {
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if given[f.Name] || err != nil {
+			return
+		}
+		name := envName(f.Name)
+		v, ok := os.LookupEnv(name)
+		if fs != flag.CommandLine {
+			if sv, sok := os.LookupEnv(subcommandEnvName(fs.Name(), f.Name)); sok {
+				name, v, ok = subcommandEnvName(fs.Name(), f.Name), sv, true
+			} else if !contains(shared, f.Name) {
+				ok = false
+			}
+		}
+		if !ok {
+			return
+		}
+		if serr := fs.Set(f.Name, v); serr != nil {
+			err = fmt.Errorf("invalid value %q for %s: %w", v, name, serr)
+		}
+	})
+	return err
+}
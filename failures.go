@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// Failure kinds, why probes fail. Statistics, results and metrics count
+// failures by these.
+const (
+	failResolve          = "resolve"
+	failPermission       = "permission"
+	failSend             = "send"
+	failTimeout          = "timeout"
+	failRefused          = "refused"
+	failReset            = "reset"
+	failNetUnreachable   = "net-unreachable"
+	failHostUnreachable  = "host-unreachable"
+	failProtoUnreachable = "proto-unreachable"
+	failPortUnreachable  = "port-unreachable"
+	failProhibited       = "prohibited"
+	failFragNeeded       = "frag-needed"
+	failUnreachable      = "unreachable"
+	failTTLExceeded      = "ttl-exceeded"
+	failHTTPStatus       = "http-status"
+	failOther            = "other"
+)
+
+// probeError is a failure whose kind the transport knows, as an ICMP error
+// answering a probe.
+type probeError struct {
+	kind string
+	err  error
+}
+
+func (e *probeError) Error() string { return e.err.Error() }
+func (e *probeError) Unwrap() error { return e.err }
+
+// failureKind classifies err, def when nothing tells what it is.
+func failureKind(err error, def string) string {
+	var pe *probeError
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &pe):
+		return pe.kind
+	case errors.As(err, &dnsErr):
+		return failResolve
+	case errors.Is(err, syscall.EACCES), errors.Is(err, syscall.EPERM):
+		return failPermission
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return failRefused
+	case errors.Is(err, syscall.ECONNRESET):
+		return failReset
+	case errors.Is(err, syscall.ENETUNREACH):
+		return failNetUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH):
+		return failHostUnreachable
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return failTimeout
+	}
+	return def
+}
+
+// icmpUnreachable is the kind of a destination unreachable code of ICMP, or
+// of ICMPv6.
+func icmpUnreachable(v4 bool, code int) string {
+	if v4 {
+		switch code {
+		case 0, 6:
+			return failNetUnreachable
+		case 1, 7:
+			return failHostUnreachable
+		case 2:
+			return failProtoUnreachable
+		case 3:
+			return failPortUnreachable
+		case 4:
+			return failFragNeeded
+		case 9, 10, 13:
+			return failProhibited
+		}
+		return failUnreachable
+	}
+	switch code {
+	case 0:
+		return failNetUnreachable
+	case 1, 5, 6:
+		return failProhibited
+	case 3:
+		return failHostUnreachable
+	case 4:
+		return failPortUnreachable
+	}
+	return failUnreachable
+}
+
+// icmpError is the failure of a probe answered with an ICMP error by from.
+func icmpError(kind string, from net.Addr) error {
+	what := strings.ReplaceAll(kind, "-", " ")
+	if ip := addrIP(from); ip != nil {
+		return &probeError{kind, fmt.Errorf("%s, reported by %s", what, ip)}
+	}
+	return &probeError{kind, errors.New(what)}
+}
+
+// formatFailures is kind=count for every kind, by name.
+func formatFailures(fs map[string]int) string {
+	kinds := make([]string, 0, len(fs))
+	for k := range fs {
+		kinds = append(kinds, k)
+	}
+	sort.Strings(kinds)
+	for i, k := range kinds {
+		kinds[i] = fmt.Sprintf("%s=%d", k, fs[k])
+	}
+	return strings.Join(kinds, " ")
+}
@@ -0,0 +1,97 @@
+//go:build linux && !386
+
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// Flow label management, from linux/in6.h.
+const (
+	ipv6FlowlabelMgr = 32
+	ipv6FlowinfoSend = 33
+	ipv6FlAGet       = 0
+	ipv6FlSExcl      = 1
+	ipv6FlFCreate    = 1
+)
+
+// in6FlowlabelReq is struct in6_flowlabel_req.
+type in6FlowlabelReq struct {
+	dst     [16]byte
+	label   [4]byte // network order
+	action  uint8
+	share   uint8
+	flags   uint16
+	expires uint16
+	linger  uint16
+	_       uint32
+}
+
+// setFlowLabel leases label for the probes to dst, the kernel only sends
+// flow labels a socket holds, and has writes carry it.
+func (c *icmpConn) setFlowLabel(dst net.IP, label int) error {
+	req := in6FlowlabelReq{action: ipv6FlAGet, share: ipv6FlSExcl, flags: ipv6FlFCreate}
+	copy(req.dst[:], dst.To16())
+	binary.BigEndian.PutUint32(req.label[:], uint32(label))
+	err := c.control(func(fd int) error {
+		b := (*[unsafe.Sizeof(req)]byte)(unsafe.Pointer(&req))
+		if err := syscall.SetsockoptString(fd, syscall.IPPROTO_IPV6, ipv6FlowlabelMgr, string(b[:])); err != nil {
+			return os.NewSyscallError("setsockopt IPV6_FLOWLABEL_MGR", err)
+		}
+		return os.NewSyscallError("setsockopt IPV6_FLOWINFO_SEND",
+			syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, ipv6FlowinfoSend, 1))
+	})
+	if err != nil {
+		return err
+	}
+	c.flowInfo = *(*uint32)(unsafe.Pointer(&req.label))
+	return nil
+}
+
+// writeFlow is WriteTo with the flow label in the destination address,
+// which the syscall package has no field for.
+func (c *icmpConn) writeFlow(b []byte, dst net.Addr) (int, error) {
+	var ip net.IP
+	var zone string
+	switch a := dst.(type) {
+	case *net.IPAddr:
+		ip, zone = a.IP, a.Zone
+	case *net.UDPAddr:
+		ip, zone = a.IP, a.Zone
+	default:
+		return 0, syscall.EINVAL
+	}
+	sa := syscall.RawSockaddrInet6{Family: syscall.AF_INET6, Flowinfo: c.flowInfo}
+	copy(sa.Addr[:], ip.To16())
+	if zone != "" {
+		if ifi, err := net.InterfaceByName(zone); err == nil {
+			sa.Scope_id = uint32(ifi.Index)
+		}
+	}
+	sc, ok := c.c.(syscall.Conn)
+	if !ok {
+		return 0, syscall.EINVAL
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var n uintptr
+	var e syscall.Errno
+	err = rc.Write(func(fd uintptr) bool {
+		n, _, e = syscall.Syscall6(syscall.SYS_SENDTO, fd, uintptr(unsafe.Pointer(&b[0])), uintptr(len(b)), 0,
+			uintptr(unsafe.Pointer(&sa)), unsafe.Sizeof(sa))
+		return e != syscall.EAGAIN
+	})
+	if err != nil {
+		return 0, err
+	}
+	if e != 0 {
+		return 0, &net.OpError{Op: "write", Net: "ip6", Addr: dst, Err: os.NewSyscallError("sendto", e)}
+	}
+	return int(n), nil
+}
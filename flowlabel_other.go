@@ -0,0 +1,18 @@
+//go:build !linux || 386
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// setFlowLabel needs sendto with a raw address, which linux/386 reaches
+// through socketcall only.
+func (c *icmpConn) setFlowLabel(net.IP, int) error {
+	return errors.New("-flowlabel is not supported on this platform")
+}
+
+func (c *icmpConn) writeFlow(b []byte, dst net.Addr) (int, error) {
+	return c.c.WriteTo(b, dst)
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// outputFormat is how times and durations are written, as chosen with
+// -timefmt, -tz, -durations and -precision. The zero value keeps every
+// output's own defaults.
+type outputFormat struct {
+	// layout replaces the layout of every timestamp written; "unix" and
+	// "unixms" write epoch seconds and milliseconds
+	layout string
+	// loc replaces the zone of every timestamp, console and files alike
+	loc *time.Location
+	// ms writes durations on the console as milliseconds with three
+	// decimals instead of Go duration strings
+	ms bool
+	// unit and digits are -precision: RTTs in µs ("us"), ms, or in the
+	// unit suiting each ("auto"), with digits decimals, -1 for the unit's
+	// default; empty, every output keeps its own format
+	unit   string
+	digits int
+}
+
+// output is the format of the process.
+var output outputFormat
+
+// timeLayouts are the names -timefmt takes besides a Go layout.
+var timeLayouts = map[string]string{
+	"rfc3339":     time.RFC3339,
+	"rfc3339nano": time.RFC3339Nano,
+	"datetime":    time.DateTime,
+	"kitchen":     time.Kitchen,
+	"unix":        "unix",
+	"unixms":      "unixms",
+}
+
+func newOutputFormat(timefmt, tz, durations, precision string) (outputFormat, error) {
+	var o outputFormat
+	if err := o.setPrecision(precision); err != nil {
+		return o, err
+	}
+	if timefmt != "" {
+		o.layout = timefmt
+		if l, ok := timeLayouts[strings.ToLower(timefmt)]; ok {
+			o.layout = l
+		} else if !strings.ContainsAny(timefmt, "0123456789") {
+			return o, fmt.Errorf("invalid time format %q, want rfc3339, rfc3339nano, datetime, unix, unixms or a Go layout", timefmt)
+		}
+	}
+	if tz != "" {
+		loc, err := time.LoadLocation(tz)
+		if err != nil {
+			return o, err
+		}
+		o.loc = loc
+	}
+	switch durations {
+	case "", "go":
+	case "ms":
+		o.ms = true
+	default:
+		return o, fmt.Errorf("invalid duration format %q, want go or ms", durations)
+	}
+	return o, nil
+}
+
+// setPrecision sets the -precision UNIT[:DIGITS].
+func (o *outputFormat) setPrecision(spec string) error {
+	o.unit, o.digits = "", -1
+	if spec == "" {
+		return nil
+	}
+	unit, digits, hasDigits := strings.Cut(strings.ToLower(spec), ":")
+	switch unit {
+	case "µs":
+		unit = "us"
+	case "us", "ms", "auto":
+	default:
+		return fmt.Errorf("invalid precision %q, want us, ms or auto, and :DIGITS optionally", spec)
+	}
+	o.unit = unit
+	if hasDigits {
+		n, err := strconv.Atoi(digits)
+		if err != nil || n < 0 || n > 9 {
+			return fmt.Errorf("invalid precision %q, want 0 to 9 digits", spec)
+		}
+		o.digits = n
+	}
+	return nil
+}
+
+// scale returns v, in ms, in the -precision unit, with its suffix and
+// decimals.
+func (o outputFormat) scale(v float64) (float64, string, int) {
+	unit := o.unit
+	if unit == "auto" {
+		switch a := math.Abs(v); {
+		case a < 1:
+			unit = "us"
+		case a >= 1000:
+			unit = "s"
+		default:
+			unit = "ms"
+		}
+	}
+	digits := o.digits
+	switch unit {
+	case "us":
+		if digits < 0 {
+			digits = 0
+		}
+		return v * 1000, "µs", digits
+	case "s":
+		if digits < 0 {
+			digits = 3
+		}
+		return v / 1000, "s", digits
+	}
+	if digits < 0 {
+		digits = 3
+	}
+	return v, "ms", digits
+}
+
+// Time writes t, with layout in zone loc unless the user chose otherwise.
+func (o outputFormat) Time(t time.Time, layout string, loc *time.Location) string {
+	if o.layout != "" {
+		layout = o.layout
+	}
+	if o.loc != nil {
+		loc = o.loc
+	}
+	switch layout {
+	case "unix":
+		return strconv.FormatInt(t.Unix(), 10)
+	case "unixms":
+		return strconv.FormatInt(t.UnixMilli(), 10)
+	}
+	return t.In(loc).Format(layout)
+}
+
+// Zone moves t to the chosen zone, for records whose timestamps their
+// encoding writes, such as JSON.
+func (o outputFormat) Zone(t time.Time) time.Time {
+	if o.loc == nil {
+		return t
+	}
+	return t.In(o.loc)
+}
+
+// Dur writes a duration for the console.
+func (o outputFormat) Dur(d time.Duration) string {
+	if o.unit != "" {
+		return o.Ms(ms(d), 3)
+	}
+	if o.ms {
+		return strconv.FormatFloat(ms(d), 'f', 3, 64) + "ms"
+	}
+	return d.String()
+}
+
+// Ms writes an RTT of v ms for the console, with digits decimals unless
+// -precision says otherwise.
+func (o outputFormat) Ms(v float64, digits int) string {
+	if o.unit == "" {
+		return strconv.FormatFloat(v, 'f', digits, 64) + "ms"
+	}
+	v, suffix, digits := o.scale(v)
+	return strconv.FormatFloat(v, 'f', digits, 64) + suffix
+}
+
+// MsIn writes an RTT of v ms in a report column headed with MsHead: a
+// number in the -precision unit, but with -precision auto, its unit being
+// that of each value.
+func (o outputFormat) MsIn(v float64, digits int) string {
+	switch o.unit {
+	case "":
+		return strconv.FormatFloat(v, 'f', digits, 64)
+	case "auto":
+		return o.Ms(v, digits)
+	}
+	v, _, digits = o.scale(v)
+	return strconv.FormatFloat(v, 'f', digits, 64)
+}
+
+// MsHead is the header of a report column of RTTs named name.
+func (o outputFormat) MsHead(name string) string {
+	switch o.unit {
+	case "us":
+		return name + " µs"
+	case "auto":
+		return name
+	}
+	return name + " ms"
+}
+
+// MsField writes an RTT of v ms in an _ms column of a file, always in ms,
+// with the decimals of -precision, digits without it.
+func (o outputFormat) MsField(v float64, digits int) string {
+	switch o.unit {
+	case "ms":
+		digits = 3
+		if o.digits >= 0 {
+			digits = o.digits
+		}
+	case "us":
+		// µs are the third decimal
+		digits = 3
+		if o.digits > 0 {
+			digits += o.digits
+		}
+	case "auto":
+		digits = 3
+	}
+	return strconv.FormatFloat(v, 'f', digits, 64)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// fwCounter is a firewall packet counter matching the outgoing probes, read
+// with the nft or iptables tool:
+//
+//	nft:FAMILY/TABLE/NAME          a named nftables counter
+//	iptables:TABLE/CHAIN/COMMENT   the iptables rule with that comment
+//	ip6tables:TABLE/CHAIN/COMMENT  the same for IPv6
+//
+// Comparing it with the probes sent tells probes dropped on this host from
+// probes lost in the network.
+type fwCounter struct {
+	spec string
+	tool string
+	args []string
+}
+
+func parseFwCounter(spec string) (*fwCounter, error) {
+	tool, rest, _ := strings.Cut(spec, ":")
+	f := strings.Split(rest, "/")
+	if len(f) != 3 || f[0] == "" || f[1] == "" || f[2] == "" {
+		return nil, fmt.Errorf("invalid firewall counter %q, want nft:FAMILY/TABLE/NAME or iptables:TABLE/CHAIN/COMMENT", spec)
+	}
+	switch tool {
+	case "nft", "iptables", "ip6tables":
+	default:
+		return nil, fmt.Errorf("invalid firewall counter %q, unknown tool %q", spec, tool)
+	}
+	return &fwCounter{spec: spec, tool: tool, args: f}, nil
+}
+
+// read returns the packets counted so far.
+func (c *fwCounter) read() (int64, error) {
+	var cmd *exec.Cmd
+	if c.tool == "nft" {
+		cmd = exec.Command("nft", "-j", "list", "counter", c.args[0], c.args[1], c.args[2])
+	} else {
+		cmd = exec.Command(c.tool, "-t", c.args[0], "-L", c.args[1], "-v", "-x", "-n")
+	}
+	out, err := cmd.Output()
+	if err != nil {
+		if ee, ok := err.(*exec.ExitError); ok && len(ee.Stderr) > 0 {
+			return 0, fmt.Errorf("%s: %s", c.tool, bytes.TrimSpace(ee.Stderr))
+		}
+		return 0, err
+	}
+	if c.tool == "nft" {
+		return parseNftCounter(out)
+	}
+	return parseIptablesCounter(out, c.args[2])
+}
+
+// parseNftCounter reads the packets of `nft -j list counter`.
+func parseNftCounter(out []byte) (int64, error) {
+	var v struct {
+		Nftables []struct {
+			Counter *struct {
+				Packets int64 `json:"packets"`
+			} `json:"counter"`
+		} `json:"nftables"`
+	}
+	if err := json.Unmarshal(out, &v); err != nil {
+		return 0, fmt.Errorf("nft: %w", err)
+	}
+	for _, o := range v.Nftables {
+		if o.Counter != nil {
+			return o.Counter.Packets, nil
+		}
+	}
+	return 0, errors.New("nft: no counter in output")
+}
+
+// parseIptablesCounter finds the rule commented comment in `iptables -L -v
+// -x -n`, whose first column is the packet count.
+func parseIptablesCounter(out []byte, comment string) (int64, error) {
+	mark := "/* " + comment + " */"
+	sc := bufio.NewScanner(bytes.NewReader(out))
+	for sc.Scan() {
+		if !strings.Contains(sc.Text(), mark) {
+			continue
+		}
+		f := strings.Fields(sc.Text())
+		return strconv.ParseInt(f[0], 10, 64)
+	}
+	return 0, fmt.Errorf("no rule commented %q", comment)
+}
+
+// watchFwCounter reads c every so often and, when probes were lost since
+// the last reading, says whether they left the host at all.
+func (m *monitor) watchFwCounter(c *fwCounter, every time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	var lastErr string
+	var prevPkts, prevSent, prevLost int64
+	first := true
+	for {
+		pkts, err := c.read()
+		var sent, lost int64
+		for _, t := range m.list("") {
+			st := t.pinger.Statistics()
+			sent += int64(st.PacketsSent - st.SendErrors)
+			lost += int64(st.PacketsTimedOut)
+		}
+		switch {
+		case err != nil:
+			if err.Error() != lastErr {
+				fmt.Println("WARN: firewall counter:", err)
+				lastErr = err.Error()
+			}
+			first = true
+		case first || sent < prevSent || lost < prevLost || pkts < prevPkts:
+			// targets went away or the counter was reset, start over
+			lastErr, first = "", false
+		default:
+			dSent, dLost, dPkts := sent-prevSent, lost-prevLost, pkts-prevPkts
+			if dLost > 0 {
+				var msg string
+				if dPkts < dSent {
+					msg = fmt.Sprintf("%d probes lost, %d of %d sent never left the host per %s: dropped locally",
+						dLost, dSent-dPkts, dSent, c.spec)
+				} else {
+					msg = fmt.Sprintf("%d probes lost, all %d sent left the host per %s: lost in the network",
+						dLost, dSent, c.spec)
+				}
+				fmt.Println("WARN:", msg)
+				m.event(eventWarning, "", msg)
+			}
+		}
+		prevPkts, prevSent, prevLost = pkts, sent, lost
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
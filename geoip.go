@@ -0,0 +1,397 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Geo is what -geoip found out about the address of a target.
+type Geo struct {
+	ASN uint64 `json:"asn,omitempty"`
+	// Org is the organization of the AS, the provider
+	Org     string `json:"org,omitempty"`
+	Country string `json:"country,omitempty"`
+	// RDNS is the name of the address in reverse DNS
+	RDNS string `json:"rdns,omitempty"`
+}
+
+func (g *Geo) String() string {
+	var parts []string
+	if g.ASN != 0 {
+		parts = append(parts, strings.TrimSpace(fmt.Sprintf("AS%d %s", g.ASN, g.Org)))
+	} else if g.Org != "" {
+		parts = append(parts, g.Org)
+	}
+	return strings.Join(append(parts, nonEmpty(g.Country, g.RDNS)...), ", ")
+}
+
+// provider names the AS of the address, for grouping the targets by it.
+func (g *Geo) provider() string {
+	if g == nil || (g.ASN == 0 && g.Org == "") {
+		return "unknown"
+	}
+	if g.ASN == 0 {
+		return g.Org
+	}
+	return strings.TrimSpace(fmt.Sprintf("AS%d %s", g.ASN, g.Org))
+}
+
+// geoIP looks addresses up in MMDB databases, as the GeoLite2 ASN and
+// Country ones of MaxMind.
+type geoIP struct {
+	dbs []*mmdb
+}
+
+// openGeoIP opens the comma-separated MMDB files of paths.
+func openGeoIP(paths string) (*geoIP, error) {
+	g := &geoIP{}
+	for _, path := range strings.Split(paths, ",") {
+		db, err := openMMDB(path)
+		if err != nil {
+			return nil, fmt.Errorf("-geoip %s: %w", path, err)
+		}
+		g.dbs = append(g.dbs, db)
+	}
+	return g, nil
+}
+
+// lookup returns what the databases and reverse DNS know about ip.
+func (g *geoIP) lookup(ip net.IP) *Geo {
+	geo := &Geo{}
+	for _, db := range g.dbs {
+		rec, err := db.lookup(ip)
+		if err != nil {
+			fmt.Println("WARN: geoip:", err)
+			continue
+		}
+		if geo.ASN == 0 {
+			geo.ASN = mmdbUint(rec["autonomous_system_number"])
+		}
+		if geo.Org == "" {
+			geo.Org, _ = rec["autonomous_system_organization"].(string)
+		}
+		if geo.Country == "" {
+			for _, key := range []string{"country", "registered_country"} {
+				if c, ok := rec[key].(map[string]interface{}); ok {
+					if geo.Country, _ = c["iso_code"].(string); geo.Country != "" {
+						break
+					}
+				}
+			}
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if names, err := net.DefaultResolver.LookupAddr(ctx, ip.String()); err == nil && len(names) > 0 {
+		geo.RDNS = strings.TrimSuffix(names[0], ".")
+	}
+	return geo
+}
+
+func mmdbUint(v interface{}) uint64 {
+	switch v := v.(type) {
+	case uint64:
+		return v
+	case int64:
+		if v > 0 {
+			return uint64(v)
+		}
+	}
+	return 0
+}
+
+// Providers returns, with -geoip and several targets, their statistics
+// added up by the AS of their address.
+func (m *monitor) Providers() string {
+	if m.geo == nil {
+		return ""
+	}
+	ss := m.Summaries()
+	if len(ss) < 2 {
+		return ""
+	}
+	type provider struct {
+		name       string
+		targets    []string
+		sent, recv int
+		rttSum     float64
+	}
+	byName := make(map[string]*provider)
+	var ps []*provider
+	for _, s := range ss {
+		name := s.Geo.provider()
+		p, ok := byName[name]
+		if !ok {
+			p = &provider{name: name}
+			byName[name] = p
+			ps = append(ps, p)
+		}
+		p.targets = append(p.targets, s.Target)
+		p.sent, p.recv = p.sent+s.Sent, p.recv+s.Recv
+		p.rttSum += s.AvgMs * float64(s.Recv)
+	}
+	sort.Slice(ps, func(i, j int) bool { return ps[i].name < ps[j].name })
+	var b strings.Builder
+	b.WriteString(tr("\n--- by provider ---\n"))
+	tw := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "provider\tsent\trecv\tloss\tavg\ttargets")
+	for _, p := range ps {
+		loss, avg := 0.0, 0.0
+		if p.sent > 0 {
+			loss = 100 * float64(p.sent-p.recv) / float64(p.sent)
+		}
+		if p.recv > 0 {
+			avg = p.rttSum / float64(p.recv)
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%.1f%%\t%s\t%s\n", p.name, p.sent, p.recv, loss, output.Ms(avg, 3), strings.Join(p.targets, ", "))
+	}
+	tw.Flush()
+	return b.String()
+}
+
+// mmdb reads a MaxMind DB file, the format documented at
+// https://maxmind.github.io/MaxMind-DB/.
+type mmdb struct {
+	buf        []byte
+	nodeCount  uint64
+	recordSize uint64
+	ipVersion  uint64
+	// data is the data section, following the search tree
+	data []byte
+	// ipv4Start is the node IPv4 addresses start from in an IPv6 tree
+	ipv4Start uint64
+}
+
+var mmdbMetadataStart = []byte("\xab\xcd\xefMaxMind.com")
+
+func openMMDB(path string) (*mmdb, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	i := bytes.LastIndex(buf, mmdbMetadataStart)
+	if i < 0 {
+		return nil, errors.New("not a MaxMind DB file")
+	}
+	meta := buf[i+len(mmdbMetadataStart):]
+	v, _, err := decodeMMDB(meta, 0)
+	if err != nil {
+		return nil, fmt.Errorf("metadata: %w", err)
+	}
+	md, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("metadata is not a map")
+	}
+	db := &mmdb{buf: buf, nodeCount: mmdbUint(md["node_count"]),
+		recordSize: mmdbUint(md["record_size"]), ipVersion: mmdbUint(md["ip_version"])}
+	if db.recordSize != 24 && db.recordSize != 28 && db.recordSize != 32 {
+		return nil, fmt.Errorf("unsupported record size %d", db.recordSize)
+	}
+	treeSize := db.recordSize * 2 / 8 * db.nodeCount
+	if treeSize+16 > uint64(i) {
+		return nil, errors.New("search tree beyond the end of the file")
+	}
+	db.data = buf[treeSize+16 : i]
+	if db.ipVersion == 6 {
+		// IPv4 addresses are ::a.b.c.d
+		for n := 0; n < 96 && db.ipv4Start < db.nodeCount; n++ {
+			db.ipv4Start = db.record(db.ipv4Start, 0)
+		}
+	}
+	return db, nil
+}
+
+// record reads the left (0) or right (1) record of node.
+func (db *mmdb) record(node uint64, bit uint) uint64 {
+	switch db.recordSize {
+	case 24:
+		b := db.buf[node*6+uint64(bit)*3:]
+		return uint64(b[0])<<16 | uint64(b[1])<<8 | uint64(b[2])
+	case 28:
+		b := db.buf[node*7:]
+		if bit == 0 {
+			return uint64(b[3]&0xf0)<<20 | uint64(b[0])<<16 | uint64(b[1])<<8 | uint64(b[2])
+		}
+		return uint64(b[3]&0x0f)<<24 | uint64(b[4])<<16 | uint64(b[5])<<8 | uint64(b[6])
+	}
+	return uint64(binary.BigEndian.Uint32(db.buf[node*8+uint64(bit)*4:]))
+}
+
+// lookup returns the record of the network ip belongs to, nil when there
+// is none.
+func (db *mmdb) lookup(ip net.IP) (map[string]interface{}, error) {
+	bits := ip.To4()
+	node := uint64(0)
+	if bits != nil {
+		if db.ipVersion == 6 {
+			node = db.ipv4Start
+		}
+	} else if bits = ip.To16(); bits == nil || db.ipVersion == 4 {
+		return nil, fmt.Errorf("no IPv6 in the IPv4 database for %s", ip)
+	}
+	for i := 0; i < len(bits)*8 && node < db.nodeCount; i++ {
+		node = db.record(node, uint(bits[i/8]>>(7-i%8)&1))
+	}
+	switch {
+	case node == db.nodeCount:
+		return nil, nil
+	case node < db.nodeCount:
+		return nil, errors.New("invalid search tree")
+	}
+	v, _, err := decodeMMDB(db.data, int(node-db.nodeCount-16))
+	if err != nil {
+		return nil, fmt.Errorf("record of %s: %w", ip, err)
+	}
+	rec, _ := v.(map[string]interface{})
+	return rec, nil
+}
+
+var errMMDBShort = errors.New("truncated data")
+
+// mmdbMaxDepth is how deep maps and arrays may nest, as in libmaxminddb, so
+// that a corrupt file pointing back into a value is an error.
+const mmdbMaxDepth = 512
+
+// decodeMMDB decodes the value at off of the data section data, returning
+// it and the offset following it. Maps are map[string]interface{}, arrays
+// []interface{}, integers uint64 or int64 and floats float64.
+func decodeMMDB(data []byte, off int) (interface{}, int, error) {
+	return decodeMMDBValue(data, off, 0, false)
+}
+
+// decodeMMDBValue is decodeMMDB for a value depth maps and arrays deep,
+// pointed to when viaPointer.
+func decodeMMDBValue(data []byte, off, depth int, viaPointer bool) (interface{}, int, error) {
+	if off < 0 || off >= len(data) {
+		return nil, 0, errMMDBShort
+	}
+	if depth > mmdbMaxDepth {
+		return nil, 0, errors.New("data nested too deep")
+	}
+	ctrl := data[off]
+	off++
+	typ := int(ctrl >> 5)
+	if typ == 1 {
+		// a pointer, to a value elsewhere in data, never to another
+		if viaPointer {
+			return nil, 0, errors.New("pointer to a pointer")
+		}
+		ss, vvv := int(ctrl>>3&3), int(ctrl&7)
+		if off+ss+1 > len(data) {
+			return nil, 0, errMMDBShort
+		}
+		var ptr int
+		switch ss {
+		case 0:
+			ptr = vvv<<8 | int(data[off])
+		case 1:
+			ptr = (vvv<<16 | int(data[off])<<8 | int(data[off+1])) + 2048
+		case 2:
+			ptr = (vvv<<24 | int(data[off])<<16 | int(data[off+1])<<8 | int(data[off+2])) + 526336
+		default:
+			ptr = int(binary.BigEndian.Uint32(data[off:]))
+		}
+		v, _, err := decodeMMDBValue(data, ptr, depth, true)
+		return v, off + ss + 1, err
+	}
+	if typ == 0 {
+		if off >= len(data) {
+			return nil, 0, errMMDBShort
+		}
+		typ = 7 + int(data[off])
+		off++
+	}
+	size := int(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		if off+n > len(data) {
+			return nil, 0, errMMDBShort
+		}
+		extra := 0
+		for _, c := range data[off : off+n] {
+			extra = extra<<8 | int(c)
+		}
+		size = []int{29, 285, 65821}[n-1] + extra
+		off += n
+	}
+	if (typ == 7 || typ == 11) && size > len(data)-off {
+		// every entry takes a byte at least
+		return nil, 0, errMMDBShort
+	}
+	switch typ {
+	case 7: // map
+		m := make(map[string]interface{}, size)
+		for i := 0; i < size; i++ {
+			k, next, err := decodeMMDBValue(data, off, depth+1, false)
+			if err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, errors.New("map key is not a string")
+			}
+			if m[key], off, err = decodeMMDBValue(data, next, depth+1, false); err != nil {
+				return nil, 0, err
+			}
+		}
+		return m, off, nil
+	case 11: // array
+		a := make([]interface{}, size)
+		for i := range a {
+			var err error
+			if a[i], off, err = decodeMMDBValue(data, off, depth+1, false); err != nil {
+				return nil, 0, err
+			}
+		}
+		return a, off, nil
+	case 14: // boolean, its size is the value
+		return size != 0, off, nil
+	}
+	if off+size > len(data) {
+		return nil, 0, errMMDBShort
+	}
+	b := data[off : off+size]
+	off += size
+	switch typ {
+	case 2: // UTF-8 string
+		return string(b), off, nil
+	case 3: // double
+		if size != 8 {
+			return nil, 0, errors.New("invalid double")
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), off, nil
+	case 15: // float
+		if size != 4 {
+			return nil, 0, errors.New("invalid float")
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), off, nil
+	case 4: // bytes
+		return append([]byte(nil), b...), off, nil
+	case 5, 6, 9, 10: // uint16, uint32, uint64, uint128 (its low 64 bits)
+		var u uint64
+		for _, c := range b {
+			u = u<<8 | uint64(c)
+		}
+		return u, off, nil
+	case 8: // int32
+		var u uint32
+		for _, c := range b {
+			u = u<<8 | uint32(c)
+		}
+		if size == 4 {
+			return int64(int32(u)), off, nil
+		}
+		return int64(u), off, nil
+	}
+	return nil, 0, fmt.Errorf("unsupported data type %d", typ)
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// mmdbValue encodes a value of type typ and size with its payload, as the
+// MaxMind DB format writes data.
+func mmdbValue(typ, size int, payload []byte) []byte {
+	var b []byte
+	ctrl := size
+	var extra []byte
+	if size >= 29 {
+		ctrl, extra = 29, []byte{byte(size - 29)}
+	}
+	if typ > 7 {
+		b = append(b, byte(ctrl), byte(typ-7))
+	} else {
+		b = append(b, byte(typ<<5|ctrl))
+	}
+	return append(append(b, extra...), payload...)
+}
+
+func mmdbString(s string) []byte { return mmdbValue(2, len(s), []byte(s)) }
+
+func mmdbUint32(v uint32) []byte {
+	return mmdbValue(6, 4, binary.BigEndian.AppendUint32(nil, v))
+}
+
+// mmdbMap encodes a map of the keys and encoded values of kv.
+func mmdbMap(kv ...any) []byte {
+	b := mmdbValue(7, len(kv)/2, nil)
+	for i := 0; i < len(kv); i += 2 {
+		b = append(append(b, mmdbString(kv[i].(string))...), kv[i+1].([]byte)...)
+	}
+	return b
+}
+
+// writeMMDB writes a database with 24-bit records holding data for the
+// network of the bits of prefix alone, and returns its path.
+func writeMMDB(t *testing.T, ipVersion uint32, prefix []byte, data []byte) string {
+	t.Helper()
+	nodes := uint32(len(prefix))
+	var tree []byte
+	for i, bit := range prefix {
+		next := uint32(i + 1)
+		if next == nodes {
+			next = nodes + 16
+		}
+		rec := [2]uint32{nodes, nodes}
+		rec[bit] = next
+		for _, r := range rec {
+			tree = append(tree, byte(r>>16), byte(r>>8), byte(r))
+		}
+	}
+	meta := mmdbMap("node_count", mmdbUint32(nodes), "record_size", mmdbValue(5, 2, []byte{0, 24}),
+		"ip_version", mmdbValue(5, 2, []byte{0, byte(ipVersion)}))
+	var file []byte
+	file = append(file, tree...)
+	file = append(file, make([]byte, 16)...)
+	file = append(file, data...)
+	file = append(file, mmdbMetadataStart...)
+	file = append(file, meta...)
+	path := filepath.Join(t.TempDir(), "test.mmdb")
+	if err := os.WriteFile(path, file, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// prefixBits is the first n bits of ip.
+func prefixBits(ip net.IP, n int) []byte {
+	bits := make([]byte, n)
+	for i := range bits {
+		bits[i] = ip[i/8] >> (7 - i%8) & 1
+	}
+	return bits
+}
+
+func TestMMDBLookup(t *testing.T) {
+	rec := mmdbMap("autonomous_system_number", mmdbUint32(64500),
+		"autonomous_system_organization", mmdbString("Example Net"),
+		"country", mmdbMap("iso_code", mmdbString("NL")))
+	v4 := net.ParseIP("192.0.2.0").To4()
+	for _, tt := range []struct {
+		name      string
+		ipVersion uint32
+		prefix    []byte
+	}{
+		{"IPv4 database", 4, prefixBits(v4, 24)},
+		// IPv4 addresses are ::a.b.c.d there
+		{"IPv6 database", 6, append(make([]byte, 96), prefixBits(v4, 24)...)},
+	} {
+		db, err := openMMDB(writeMMDB(t, tt.ipVersion, tt.prefix, rec))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		got, err := db.lookup(net.ParseIP("192.0.2.77"))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		want := map[string]interface{}{"autonomous_system_number": uint64(64500),
+			"autonomous_system_organization": "Example Net", "country": map[string]interface{}{"iso_code": "NL"}}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, want)
+		}
+		if got, err := db.lookup(net.ParseIP("198.51.100.1")); err != nil || got != nil {
+			t.Errorf("%s: address outside the network: %v, %v", tt.name, got, err)
+		}
+	}
+	db, err := openMMDB(writeMMDB(t, 4, prefixBits(v4, 24), rec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.lookup(net.ParseIP("2001:db8::1")); err == nil {
+		t.Error("IPv6 address in an IPv4 database: no error")
+	}
+}
+
+func TestOpenMMDBErrors(t *testing.T) {
+	dir := t.TempDir()
+	for _, tt := range []struct {
+		name string
+		file []byte
+		want string
+	}{
+		{"no metadata", []byte("hello"), "not a MaxMind DB"},
+		{"bad record size", append(append([]byte{}, mmdbMetadataStart...),
+			mmdbMap("node_count", mmdbUint32(1), "record_size", mmdbUint32(20), "ip_version", mmdbUint32(4))...), "record size 20"},
+		{"tree too large", append(append([]byte{}, mmdbMetadataStart...),
+			mmdbMap("node_count", mmdbUint32(1000), "record_size", mmdbUint32(24), "ip_version", mmdbUint32(4))...), "beyond the end"},
+	} {
+		path := filepath.Join(dir, tt.name)
+		if err := os.WriteFile(path, tt.file, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := openMMDB(path); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: error %v, want %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestDecodeMMDB(t *testing.T) {
+	double := binary.BigEndian.AppendUint64(nil, math.Float64bits(2.5))
+	float := binary.BigEndian.AppendUint32(nil, math.Float32bits(0.5))
+	long := strings.Repeat("x", 100)
+	for _, tt := range []struct {
+		name string
+		data []byte
+		want interface{}
+	}{
+		{"string", mmdbString("abc"), "abc"},
+		{"long string", mmdbString(long), long},
+		{"double", mmdbValue(3, 8, double), 2.5},
+		{"float", mmdbValue(15, 4, float), 0.5},
+		{"bytes", mmdbValue(4, 2, []byte{1, 2}), []byte{1, 2}},
+		{"uint16", mmdbValue(5, 2, []byte{1, 0}), uint64(256)},
+		{"uint64 short", mmdbValue(9, 1, []byte{7}), uint64(7)},
+		{"int32 negative", mmdbValue(8, 4, []byte{0xff, 0xff, 0xff, 0xfe}), int64(-2)},
+		{"int32 short", mmdbValue(8, 1, []byte{5}), int64(5)},
+		{"bool", mmdbValue(14, 1, nil), true},
+		{"array", append(mmdbValue(11, 2, nil), append(mmdbString("a"), mmdbUint32(1)...)...), []interface{}{"a", uint64(1)}},
+		// a pointer to the string after it
+		{"pointer", append(mmdbValue(1, 0, []byte{3}), append([]byte{0}, mmdbString("hi")...)...), "hi"},
+	} {
+		got, next, err := decodeMMDB(tt.data, 0)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %#v, want %#v", tt.name, got, tt.want)
+		}
+		if tt.name != "pointer" && next != len(tt.data) {
+			t.Errorf("%s: next offset %d, want %d", tt.name, next, len(tt.data))
+		}
+	}
+}
+
+func TestDecodeMMDBCorrupt(t *testing.T) {
+	// a map of one key whose value points back to the map
+	loop := append(mmdbValue(7, 1, nil), append(mmdbString("k"), mmdbValue(1, 0, []byte{0})...)...)
+	deep := bytes.Repeat(mmdbValue(11, 1, nil), mmdbMaxDepth+10)
+	for _, tt := range []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"pointer to itself", mmdbValue(1, 0, []byte{0}), "pointer to a pointer"},
+		{"pointer to a pointer", append(mmdbValue(1, 0, []byte{2}), mmdbValue(1, 0, []byte{0})...), "pointer to a pointer"},
+		{"map pointing into itself", loop, "nested too deep"},
+		{"arrays nested too deep", deep, "nested too deep"},
+		{"truncated string", mmdbValue(2, 5, []byte("ab")), "truncated"},
+		{"map larger than the data", mmdbValue(7, 28, nil), "truncated"},
+		{"pointer beyond the data", mmdbValue(1, 0, []byte{200}), "truncated"},
+		{"map key not a string", append(mmdbValue(7, 1, nil), append(mmdbUint32(1), mmdbUint32(2)...)...), "not a string"},
+		{"bad double", mmdbValue(3, 4, []byte{0, 0, 0, 0}), "invalid double"},
+		{"unknown type", mmdbValue(12, 0, nil), "unsupported data type 12"},
+	} {
+		if _, _, err := decodeMMDB(tt.data, 0); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: error %v, want %q", tt.name, err, tt.want)
+		}
+	}
+}
@@ -2,10 +2,6 @@ module keeping
 
 go 1.20
 
-require (
-	github.com/google/uuid v1.3.0 // indirect
-	github.com/prometheus-community/pro-bing v0.3.0 // indirect
-	golang.org/x/net v0.14.0 // indirect
-	golang.org/x/sync v0.3.0 // indirect
-	golang.org/x/sys v0.11.0 // indirect
-)
+require golang.org/x/net v0.14.0
+
+require golang.org/x/sys v0.11.0 // indirect
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// Home Assistant MQTT discovery: every target shows up as a device with an
+// RTT and a loss sensor, fed by its interval topic, and a connectivity
+// binary sensor fed by its state topic, all unavailable while the instance
+// is offline.
+
+// hassEntity is the discovery config of one entity.
+type hassEntity struct {
+	Name              string     `json:"name"`
+	UniqueID          string     `json:"unique_id"`
+	StateTopic        string     `json:"state_topic"`
+	ValueTemplate     string     `json:"value_template,omitempty"`
+	UnitOfMeasurement string     `json:"unit_of_measurement,omitempty"`
+	DeviceClass       string     `json:"device_class,omitempty"`
+	StateClass        string     `json:"state_class,omitempty"`
+	PayloadOn         string     `json:"payload_on,omitempty"`
+	PayloadOff        string     `json:"payload_off,omitempty"`
+	AvailabilityTopic string     `json:"availability_topic"`
+	Device            hassDevice `json:"device"`
+}
+
+type hassDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer"`
+}
+
+// hassID makes a target name usable in discovery topics and unique ids,
+// which allow letters, digits, _ and - only.
+func hassID(target string) string {
+	return "keeping_" + strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' {
+			return r
+		}
+		return '_'
+	}, target)
+}
+
+// announce publishes the discovery configs of target under the discovery
+// prefix, once per run.
+func (s *mqttSink) announce(target string) error {
+	if s.discovery == "" || s.announced[target] {
+		return nil
+	}
+	id := hassID(target)
+	topic := s.targetTopic(target)
+	device := hassDevice{Identifiers: []string{id}, Name: "keeping " + target, Manufacturer: "keeping"}
+	status := mqttStatusTopic(s.topic)
+	for _, e := range []struct {
+		component, object string
+		entity            hassEntity
+	}{
+		{"sensor", "rtt", hassEntity{
+			Name: "RTT", StateTopic: topic + "/interval", ValueTemplate: "{{ value_json.avg_ms }}",
+			UnitOfMeasurement: "ms", DeviceClass: "duration", StateClass: "measurement",
+		}},
+		{"sensor", "loss", hassEntity{
+			Name: "Loss", StateTopic: topic + "/interval", ValueTemplate: "{{ value_json.loss_pct }}",
+			UnitOfMeasurement: "%", StateClass: "measurement",
+		}},
+		{"sensor", "score", hassEntity{
+			Name: "Quality score", StateTopic: topic + "/interval", ValueTemplate: "{{ value_json.score }}",
+			StateClass: "measurement",
+		}},
+		{"binary_sensor", "state", hassEntity{
+			Name: "Connectivity", StateTopic: topic + "/state",
+			DeviceClass: "connectivity", PayloadOn: "up", PayloadOff: "down",
+		}},
+	} {
+		e.entity.UniqueID = id + "_" + e.object
+		e.entity.AvailabilityTopic = status
+		e.entity.Device = device
+		b, err := json.Marshal(e.entity)
+		if err != nil {
+			return err
+		}
+		t := s.discovery + "/" + e.component + "/" + id + "/" + e.object + "/config"
+		if err := s.c.Publish(t, b, true); err != nil {
+			return err
+		}
+	}
+	s.announced[target] = true
+	return nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// downAfter is the probes lost in a row after which a target is down.
+const downAfter = 3
+
+// hookTimeout bounds a run of the state change hook.
+const hookTimeout = 30 * time.Second
+
+// healthTracker judges every target "up" or "down" from its records: down
+// once downAfter probes were lost in a row or, with SlowMs set, while the
+// average RTT of the last interval is above it. Not safe for concurrent
+// use, sinks call it from their own goroutine.
+type healthTracker struct {
+	SlowMs float64
+
+	lost  map[string]int
+	slow  map[string]bool
+	state map[string]string
+}
+
+func newHealthTracker(slowMs float64) *healthTracker {
+	return &healthTracker{SlowMs: slowMs, lost: make(map[string]int),
+		slow: make(map[string]bool), state: make(map[string]string)}
+}
+
+// result returns the state of r's target after r when it changed, "" when
+// it didn't. The change counts once passed to set.
+func (h *healthTracker) result(r *Result) string {
+	switch r.Status {
+	case resultOK, resultDiscarded:
+		h.lost[r.Target] = 0
+	case resultTimeout, resultError:
+		h.lost[r.Target]++
+	default:
+		return ""
+	}
+	return h.changed(r.Target)
+}
+
+// interval is result for an interval summary, judging its latency.
+func (h *healthTracker) interval(st *IntervalStats) string {
+	if h.SlowMs <= 0 || st.Count == 0 {
+		return ""
+	}
+	h.slow[st.Target] = st.AvgMs > h.SlowMs
+	return h.changed(st.Target)
+}
+
+func (h *healthTracker) changed(target string) string {
+	state := "up"
+	if h.lost[target] >= downAfter || h.slow[target] {
+		state = "down"
+	} else if h.lost[target] > 0 {
+		// a probe or two lost changes nothing yet
+		state = h.state[target]
+	}
+	if state == "" || state == h.state[target] {
+		return ""
+	}
+	return state
+}
+
+func (h *healthTracker) set(target, state string) {
+	h.state[target] = state
+}
+
+// stateHook is the sink acting on state changes, for routers to switch
+// uplinks on: it runs a command with the new state and the target as its
+// last arguments and keeps a file with the state of every target, as JSON,
+// up to date.
+type stateHook struct {
+	health  *healthTracker
+	command []string
+	file    string
+}
+
+// newStateHook runs command, split on blanks, and writes file, either may
+// be empty.
+func newStateHook(command, file string, slowMs float64) *stateHook {
+	return &stateHook{health: newHealthTracker(slowMs), command: strings.Fields(command), file: file}
+}
+
+func (s *stateHook) HandleResult(r *Result) error {
+	return s.update(r.Target, s.health.result(r))
+}
+
+func (s *stateHook) HandleInterval(st *IntervalStats) error {
+	return s.update(st.Target, s.health.interval(st))
+}
+
+func (s *stateHook) HandleEvent(*Event) error { return nil }
+func (s *stateHook) Flush() error             { return nil }
+func (s *stateHook) unsampled()               {}
+
+// unredacted: the hook acts on the target by its name.
+func (s *stateHook) unredacted() {}
+
+func (s *stateHook) update(target, state string) error {
+	if state == "" {
+		return nil
+	}
+	s.health.set(target, state)
+	if s.file != "" {
+		if err := s.writeFile(); err != nil {
+			return err
+		}
+	}
+	if len(s.command) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+	defer cancel()
+	args := append(append([]string{}, s.command[1:]...), state, target)
+	return commandError(s.command[0]+" "+state+" "+target, exec.CommandContext(ctx, s.command[0], args...).CombinedOutput)
+}
+
+// commandError runs a hook and returns its failure, the output included
+// when there is any.
+func commandError(name string, run func() ([]byte, error)) error {
+	out, err := run()
+	if err == nil {
+		return nil
+	}
+	if out = bytes.TrimSpace(out); len(out) > 0 {
+		return fmt.Errorf("%s: %w: %s", name, err, out)
+	}
+	return fmt.Errorf("%s: %w", name, err)
+}
+
+// writeFile replaces the state file in one go, a reader never sees it half
+// written.
+func (s *stateHook) writeFile() error {
+	b, err := json.MarshalIndent(s.health.state, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.file), ".keeping-state-*")
+	if err != nil {
+		return err
+	}
+	_ = tmp.Chmod(0o644)
+	if _, err := tmp.Write(append(b, '\n')); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), s.file)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"sync"
+	"time"
+)
+
+// healthcheckMain implements `keeping healthcheck`, a probe of one host for
+// the healthcheck of a container: done at the first good reply, one line
+// of output, and a hard deadline whatever hangs, name resolution included.
+// It exits 0 when a reply came back within -max-rtt, 1 when none did, the
+// deadline passed or the host could not be probed, and 2 on bad usage.
+func healthcheckMain(args []string) int {
+	fs := flag.NewFlagSet("healthcheck", flag.ExitOnError)
+	probes := fs.Int("probes", 3, "probes to send at most")
+	interval := fs.Duration("i", 200*time.Millisecond, "")
+	maxRtt := fs.Duration("max-rtt", time.Second, "slowest reply that still counts as healthy")
+	timeout := fs.Duration("timeout", 5*time.Second, "unhealthy when not done by then")
+	methods := fs.String("methods", "", "probe methods to fall back through, e.g. icmp,tcp:443")
+	privileged := fs.Bool("privileged", false, "")
+	fs.Usage = func() {
+		fmt.Println("Usage: keeping healthcheck [-probes 3] [-max-rtt 1s] [-timeout 5s] host")
+		fmt.Println("Exits 0 at the first reply within -max-rtt, 1 when none came back in time, 2 on bad usage.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if err := applyEnv(fs, "privileged", "methods"); err != nil {
+		fmt.Println("ERROR:", err)
+		return 2
+	}
+	if fs.NArg() != 1 || *probes < 1 || *maxRtt <= 0 || *timeout <= 0 {
+		fs.Usage()
+		return 2
+	}
+	host := fs.Arg(0)
+	deadline := time.AfterFunc(*timeout, func() {
+		fmt.Printf("unhealthy: %s: not done after %v\n", host, *timeout)
+		os.Exit(1)
+	})
+	defer deadline.Stop()
+
+	s := probeSettings{
+		Interval: *interval,
+		Timeout:  time.Duration(math.MaxInt64),
+		// a later reply is too slow anyway
+		ReplyTimeout: *maxRtt,
+		MaxSaneRtt:   time.Minute,
+		Count:        *probes,
+		Size:         24,
+		TTL:          64,
+		Privileged:   *privileged,
+		Timestamping: timestampUser,
+	}
+	if *methods != "" {
+		var err error
+		if s.Methods, err = parseMethods(*methods); err != nil {
+			fmt.Println("ERROR:", err)
+			return 2
+		}
+	}
+	p, err := NewPinger(host)
+	if err != nil {
+		fmt.Printf("unhealthy: %s: %v\n", host, err)
+		return 1
+	}
+	if err := s.apply(p); err != nil {
+		fmt.Printf("unhealthy: %s: %v\n", host, err)
+		return 1
+	}
+	var mu sync.Mutex
+	var rtt time.Duration
+	p.OnRecv = func(pkt *Packet) {
+		mu.Lock()
+		defer mu.Unlock()
+		if rtt == 0 && pkt.Rtt <= *maxRtt {
+			rtt = pkt.Rtt
+			p.Stop()
+		}
+	}
+	if err := p.Run(); err != nil {
+		fmt.Printf("unhealthy: %s: %v\n", host, err)
+		return 1
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if rtt == 0 {
+		st := p.Statistics()
+		fmt.Printf("unhealthy: %s: no reply within %v, %d of %d probes came back\n", host, *maxRtt, st.PacketsRecv, st.PacketsSent)
+		return 1
+	}
+	fmt.Printf("healthy: %s: %v\n", host, rtt)
+	return 0
+}
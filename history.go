@@ -0,0 +1,340 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// historyKeep is how long the in-memory history keeps samples.
+const historyKeep = 24 * time.Hour
+
+const (
+	// defaultMaxSamples is the raw samples kept per target unless told
+	// otherwise, a day at one probe a second
+	defaultMaxSamples = 86400
+	// historyMaxRecords bounds the interval summaries and the events kept
+	historyMaxRecords = 10000
+)
+
+// sample is one probe as kept by the history: its RTT, or lost.
+type sample struct {
+	At   time.Time
+	Rtt  time.Duration
+	Lost bool
+}
+
+// series are the samples of one target, oldest first: the recent ones raw,
+// older ones folded into minutes.
+type series struct {
+	group   string
+	minutes []minute
+	samples []sample
+}
+
+// minute aggregates the samples of one minute which no longer are kept raw.
+type minute struct {
+	At       time.Time
+	Sent     int
+	Lost     int
+	Min, Max time.Duration
+	Sum      time.Duration
+}
+
+func (mi *minute) add(s sample) {
+	mi.Sent++
+	if s.Lost {
+		mi.Lost++
+		return
+	}
+	if mi.Sent-mi.Lost == 1 || s.Rtt < mi.Min {
+		mi.Min = s.Rtt
+	}
+	if s.Rtt > mi.Max {
+		mi.Max = s.Rtt
+	}
+	mi.Sum += s.Rtt
+}
+
+// history keeps the recent results, interval summaries and events of every
+// target, for charts and anything else looking back further than the
+// current interval.
+//
+// Memory stays bounded however long the run: per target at most
+// MaxSamples raw samples (the backing array up to twice that, 24 bytes
+// each) and a minute aggregate for each of the historyKeep older minutes,
+// plus historyMaxRecords interval summaries and events in all.
+type history struct {
+	// MaxSamples is the raw samples kept per target, older ones are
+	// folded into minutes; zero means defaultMaxSamples.
+	MaxSamples int
+
+	mu        sync.Mutex
+	keep      time.Duration
+	series    map[string]*series
+	intervals []*IntervalStats
+	events    []*Event
+}
+
+func newHistory(keep time.Duration) *history {
+	return &history{keep: keep, series: make(map[string]*series)}
+}
+
+// The history is fed as a sink. Duplicates, discarded and foreign replies
+// are not samples.
+func (h *history) HandleResult(r *Result) error {
+	h.Record(r)
+	return nil
+}
+
+func (h *history) HandleInterval(st *IntervalStats) error {
+	h.RecordInterval(st)
+	return nil
+}
+
+func (h *history) HandleEvent(e *Event) error {
+	h.RecordEvent(e)
+	return nil
+}
+
+func (h *history) Flush() error { return nil }
+
+// Record adds a probe result.
+func (h *history) Record(r *Result) {
+	var s sample
+	switch r.Status {
+	case resultOK:
+		s = sample{At: r.Time, Rtt: time.Duration(r.RttMs * float64(time.Millisecond))}
+	case resultTimeout, resultError:
+		s = sample{At: r.Time, Lost: true}
+	default:
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	se, ok := h.series[r.Target]
+	if !ok {
+		se = &series{group: r.Group}
+		h.series[r.Target] = se
+	}
+	se.samples = append(se.samples, s)
+	since := r.Time.Add(-h.keep)
+	max := h.MaxSamples
+	if max <= 0 {
+		max = defaultMaxSamples
+	}
+	if n := len(se.samples) - max; n > 0 {
+		for _, old := range se.samples[:n] {
+			se.fold(old)
+		}
+		se.samples = dropSamples(se.samples, n)
+	}
+	se.samples = trimSamples(se.samples, since)
+	i := 0
+	for i < len(se.minutes) && se.minutes[i].At.Add(time.Minute).Before(since) {
+		i++
+	}
+	se.minutes = se.minutes[i:]
+}
+
+// fold adds a sample dropped from the raw ones to its minute.
+func (se *series) fold(s sample) {
+	at := s.At.Truncate(time.Minute)
+	if n := len(se.minutes); n == 0 || !se.minutes[n-1].At.Equal(at) {
+		se.minutes = append(se.minutes, minute{At: at})
+	}
+	se.minutes[len(se.minutes)-1].add(s)
+}
+
+// trimSamples drops samples from before since, reallocating once half of
+// the backing array is dead so appends don't grow it forever.
+func trimSamples(ss []sample, since time.Time) []sample {
+	i := 0
+	for i < len(ss) && ss[i].At.Before(since) {
+		i++
+	}
+	return dropSamples(ss, i)
+}
+
+// dropSamples drops the oldest n samples.
+func dropSamples(ss []sample, n int) []sample {
+	if n == 0 {
+		return ss
+	}
+	if n > cap(ss)/2 {
+		return append([]sample(nil), ss[n:]...)
+	}
+	return ss[n:]
+}
+
+func (h *history) RecordEvent(e *Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.events = append(h.events, e)
+	since := e.Time.Add(-h.keep)
+	i := sort.Search(len(h.events), func(i int) bool { return !h.events[i].Time.Before(since) })
+	if n := len(h.events) - historyMaxRecords; i < n {
+		i = n
+	}
+	h.events = h.events[i:]
+}
+
+func (h *history) RecordInterval(st *IntervalStats) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.intervals = append(h.intervals, st)
+	since := st.Time.Add(-h.keep)
+	i := sort.Search(len(h.intervals), func(i int) bool { return !h.intervals[i].Time.Before(since) })
+	if n := len(h.intervals) - historyMaxRecords; i < n {
+		i = n
+	}
+	h.intervals = h.intervals[i:]
+}
+
+// Intervals returns the interval summaries between from and to of the
+// targets selected by match.
+func (h *history) Intervals(match func(name, group string) bool, from, to time.Time) []*IntervalStats {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var sts []*IntervalStats
+	for _, st := range h.intervals {
+		if !st.Time.Before(from) && !st.Time.After(to) && match(st.Target, st.Group) {
+			sts = append(sts, st)
+		}
+	}
+	return sts
+}
+
+// Oldest returns the time of the oldest sample of the target name, raw or
+// folded.
+func (h *history) Oldest(name string) time.Time {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	se, ok := h.series[name]
+	switch {
+	case !ok:
+		return time.Time{}
+	case len(se.minutes) > 0:
+		return se.minutes[0].At
+	case len(se.samples) > 0:
+		return se.samples[0].At
+	}
+	return time.Time{}
+}
+
+// Samples returns a copy of the raw samples of the target name, oldest
+// first.
+func (h *history) Samples(name string) []sample {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	se, ok := h.series[name]
+	if !ok {
+		return nil
+	}
+	return append([]sample(nil), se.samples...)
+}
+
+// historyTarget describes a target in the history.
+type historyTarget struct {
+	Name  string `json:"name"`
+	Group string `json:"group"`
+}
+
+// Targets lists the targets with samples, sorted by name.
+func (h *history) Targets() []historyTarget {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ts := make([]historyTarget, 0, len(h.series))
+	for name, se := range h.series {
+		ts = append(ts, historyTarget{Name: name, Group: se.group})
+	}
+	sort.Slice(ts, func(i, j int) bool { return ts[i].Name < ts[j].Name })
+	return ts
+}
+
+// bucket aggregates the samples of one step of a history query.
+type bucket struct {
+	Time  time.Time `json:"time"`
+	Sent  int       `json:"sent"`
+	Lost  int       `json:"lost"`
+	MinMs float64   `json:"min_ms"`
+	AvgMs float64   `json:"avg_ms"`
+	MaxMs float64   `json:"max_ms"`
+}
+
+// Query aggregates the samples between from and to into buckets of step,
+// over the targets selected by match. Empty buckets are left out.
+func (h *history) Query(match func(name, group string) bool, from, to time.Time, step time.Duration) []bucket {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	n := int(to.Sub(from)/step) + 1
+	bs := make([]bucket, n)
+	sums := make([]time.Duration, n)
+	for name, se := range h.series {
+		if !match(name, se.group) {
+			continue
+		}
+		for _, mi := range se.minutes {
+			if !mi.At.Add(time.Minute).After(from) || mi.At.After(to) {
+				continue
+			}
+			// a minute straddling from goes into the first bucket
+			k := 0
+			if mi.At.After(from) {
+				k = int(mi.At.Sub(from) / step)
+			}
+			b := &bs[k]
+			if recv := mi.Sent - mi.Lost; recv > 0 {
+				if b.Sent-b.Lost == 0 || ms(mi.Min) < b.MinMs {
+					b.MinMs = ms(mi.Min)
+				}
+				b.MaxMs = math.Max(b.MaxMs, ms(mi.Max))
+				sums[k] += mi.Sum
+			}
+			b.Sent += mi.Sent
+			b.Lost += mi.Lost
+		}
+		i := sort.Search(len(se.samples), func(i int) bool { return !se.samples[i].At.Before(from) })
+		for ; i < len(se.samples) && !se.samples[i].At.After(to); i++ {
+			s := se.samples[i]
+			b := &bs[int(s.At.Sub(from)/step)]
+			b.Sent++
+			if s.Lost {
+				b.Lost++
+				continue
+			}
+			rtt := ms(s.Rtt)
+			if b.Sent-b.Lost == 1 || rtt < b.MinMs {
+				b.MinMs = rtt
+			}
+			b.MaxMs = math.Max(b.MaxMs, rtt)
+			sums[int(s.At.Sub(from)/step)] += s.Rtt
+		}
+	}
+	out := bs[:0]
+	for i, b := range bs {
+		if b.Sent == 0 {
+			continue
+		}
+		b.Time = from.Add(time.Duration(i) * step)
+		if recv := b.Sent - b.Lost; recv > 0 {
+			b.AvgMs = ms(sums[i] / time.Duration(recv))
+		}
+		out = append(out, b)
+	}
+	return out
+}
+
+// Events returns the events between from and to.
+func (h *history) Events(from, to time.Time) []*Event {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var es []*Event
+	for _, e := range h.events {
+		if !e.Time.Before(from) && !e.Time.After(to) {
+			es = append(es, e)
+		}
+	}
+	return es
+}
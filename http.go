@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HTTPPhases is where the time of an HTTP probe went.
+type HTTPPhases struct {
+	DNS      time.Duration
+	Connect  time.Duration
+	TLS      time.Duration
+	TTFB     time.Duration
+	Transfer time.Duration
+}
+
+// httpTransport probes a URL with GET requests, each on a fresh connection
+// so every probe pays (and measures) DNS, connect and TLS again.
+type httpTransport struct {
+	url     string
+	client  *http.Client
+	timeout time.Duration
+
+	ctx     context.Context
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+	replies chan *reply
+}
+
+// newHTTPTransport probes rawurl, the target's own URL or the one made up
+// for a fallback method.
+func newHTTPTransport(p *Pinger, rawurl string) (*httpTransport, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	tr := &http.Transport{
+		Proxy:             http.ProxyFromEnvironment,
+		DisableKeepAlives: true,
+	}
+	d := net.Dialer{Control: routingControl(p.Mark, p.Device)}
+	if p.Source != "" {
+		ip := net.ParseIP(p.Source)
+		if ip == nil {
+			cancel()
+			return nil, errors.New("invalid source address " + p.Source)
+		}
+		d.LocalAddr = &net.TCPAddr{IP: ip}
+	}
+	dial := d.DialContext
+	tr.DialContext = dial
+	if p.Proxy != "" {
+		// tunnelled with CONNECT or SOCKS5 alike, plain HTTP included
+		pd, err := newProxyDialer(p.Proxy, d.LocalAddr)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		pd.dialer.Control = d.Control
+		tr.Proxy, dial = nil, pd.DialContext
+		tr.DialContext = dial
+	}
+	if p.pinned {
+		// connect to the chosen address, the URL still provides the Host
+		// header and the TLS server name
+		ip := p.ipaddr.String()
+		tr.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			_, port, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, err
+			}
+			return dial(ctx, network, net.JoinHostPort(ip, port))
+		}
+	}
+	return &httpTransport{
+		url: rawurl,
+		client: &http.Client{
+			Transport: tr,
+			// a redirect is an answer as good as any
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		timeout: p.ReplyTimeout,
+		ctx:     ctx,
+		cancel:  cancel,
+		replies: make(chan *reply),
+	}, nil
+}
+
+func (t *httpTransport) Close() error {
+	t.cancel()
+	t.wg.Wait()
+	return nil
+}
+
+func (t *httpTransport) send(seq int) (*Packet, error) {
+	pkt := &Packet{Seq: seq}
+	ctx := t.ctx
+	cancel := context.CancelFunc(func() {})
+	if t.timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, t.timeout)
+	}
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		defer cancel()
+		r := t.probe(ctx, seq)
+		select {
+		case t.replies <- r:
+		case <-t.ctx.Done():
+		}
+	}()
+	return pkt, nil
+}
+
+func (t *httpTransport) probe(ctx context.Context, seq int) *reply {
+	var dnsStart, connStart, tlsStart, wrote, firstByte time.Time
+	phases := &HTTPPhases{}
+	trace := &httptrace.ClientTrace{
+		DNSStart:          func(httptrace.DNSStartInfo) { dnsStart = time.Now() },
+		DNSDone:           func(httptrace.DNSDoneInfo) { phases.DNS = time.Since(dnsStart) },
+		ConnectStart:      func(string, string) { connStart = time.Now() },
+		ConnectDone:       func(string, string, error) { phases.Connect = time.Since(connStart) },
+		TLSHandshakeStart: func() { tlsStart = time.Now() },
+		TLSHandshakeDone:  func(tls.ConnectionState, error) { phases.TLS = time.Since(tlsStart) },
+		WroteRequest:      func(httptrace.WroteRequestInfo) { wrote = time.Now() },
+		GotFirstResponseByte: func() {
+			firstByte = time.Now()
+			phases.TTFB = firstByte.Sub(wrote)
+		},
+	}
+	r := &reply{seq: seq, pkt: &Packet{TTL: -1, Phases: phases}}
+	ctx, pt := withProxyTime(ctx)
+	defer func() { r.pkt.ProxyConnect = time.Duration(pt.Load()) }()
+	start := time.Now()
+	req, err := http.NewRequestWithContext(httptrace.WithClientTrace(ctx, trace), http.MethodGet, t.url, nil)
+	if err != nil {
+		r.err = err
+		return r
+	}
+	req.Header.Set("User-Agent", "keeping")
+	resp, err := t.client.Do(req)
+	if err != nil {
+		r.err = err
+		return r
+	}
+	n, err := io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	r.receivedAt = time.Now()
+	if err != nil {
+		r.err = err
+		return r
+	}
+	if resp.StatusCode >= 500 {
+		r.err = &probeError{failHTTPStatus, fmt.Errorf("HTTP %s", resp.Status)}
+	}
+	phases.Transfer = r.receivedAt.Sub(firstByte)
+	r.rtt = r.receivedAt.Sub(start)
+	r.pkt.Nbytes = int(n)
+	r.pkt.StatusCode = resp.StatusCode
+	return r
+}
+
+func (t *httpTransport) receive() (*reply, error) {
+	select {
+	case r := <-t.replies:
+		return r, nil
+	case <-t.ctx.Done():
+		return nil, net.ErrClosed
+	}
+}
+
+// phaseCounter averages the HTTP phases over a statistics interval.
+type phaseCounter struct {
+	n   int64
+	sum HTTPPhases
+}
+
+func (c *phaseCounter) Update(ph *HTTPPhases) {
+	if ph == nil {
+		return
+	}
+	c.n++
+	c.sum.DNS += ph.DNS
+	c.sum.Connect += ph.Connect
+	c.sum.TLS += ph.TLS
+	c.sum.TTFB += ph.TTFB
+	c.sum.Transfer += ph.Transfer
+}
+
+// Avg returns the mean of every phase, nil if nothing was counted.
+func (c *phaseCounter) Avg() *HTTPPhases {
+	if c.n == 0 {
+		return nil
+	}
+	n := time.Duration(c.n)
+	return &HTTPPhases{
+		DNS:      c.sum.DNS / n,
+		Connect:  c.sum.Connect / n,
+		TLS:      c.sum.TLS / n,
+		TTFB:     c.sum.TTFB / n,
+		Transfer: c.sum.Transfer / n,
+	}
+}
+
+func (c *phaseCounter) Reset() {
+	*c = phaseCounter{}
+}
+
+// String renders the interval breakdown as a small table.
+func (c *phaseCounter) String() string {
+	avg := c.Avg()
+	if avg == nil {
+		return ""
+	}
+	row := func(cells ...string) string {
+		s := ""
+		for _, c := range cells {
+			s += fmt.Sprintf("%-12s", c)
+		}
+		return strings.TrimRight(s, " ") + "\n"
+	}
+	f := func(d time.Duration) string {
+		return strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', 2, 64) + "ms"
+	}
+	return row("phase", "dns", "connect", "tls", "ttfb", "transfer") +
+		row("avg", f(avg.DNS), f(avg.Connect), f(avg.TLS), f(avg.TTFB), f(avg.Transfer))
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// lang is the language of the console output, see setLang.
+var lang = "en"
+
+// catalogs translate the console output by language, keyed by the English
+// format string. What a catalog lacks is printed in English, and so are the
+// reply lines, kept in the format of ping for the tools reading them, the
+// ERROR: and WARN: prefixes and the machine-readable outputs.
+var catalogs = map[string]map[string]string{
+	"zh": {
+		"PING %s (%s):\n":                                  "PING %s (%s)：\n",
+		"Request timeout for icmp_seq=%d\n":                "请求超时 icmp_seq=%d\n",
+		"Probe failed for seq=%d (%s): %v\n":               "探测失败 seq=%d（%s）：%v\n",
+		"Failed to ping target host:":                      "无法探测目标主机：",
+		"%s resolves to %s like %s, probing them as one\n": "%s 与 %[3]s 同样解析为 %[2]s，合并为一个目标探测\n",
+		"%d packets,RTT min/avg/max/stddev = %s/%s/%s/%s":  "%d 个包，RTT 最小/平均/最大/标准差 = %s/%s/%s/%s",
+		"%sproxy connect avg %s of %s end-to-end\n":        "%s代理连接平均 %s，端到端 %s\n",
+		"%ssent %.2f probes/s, gap avg/max %s/%s, send lag max %s: this host is falling behind\n": "%s每秒发送 %.2f 个探测，间隔平均/最大 %s/%s，发送延迟最大 %s：本机跟不上发送计划\n",
+
+		"--- %s ping statistics ---\n": "--- %s ping 统计 ---\n",
+		"%d packets transmitted, %d packets received, %d duplicates, %v%% packet loss\n":                      "已发送 %d 个包，已接收 %d 个包，重复 %d 个，丢包率 %v%%\n",
+		"round-trip min/avg/max/stddev = %s/%s/%s/%s\n":                                                       "往返时间 最小/平均/最大/标准差 = %s/%s/%s/%s\n",
+		"%s sent, %s received, headers included (estimated)\n":                                                "已发送 %s，已接收 %s，含报头（估计）\n",
+		"%d replies discarded with implausible RTT\n":                                                         "%d 个回复因 RTT 不合理被丢弃\n",
+		"%d distinct reply TTLs:":                                                                             "%d 种不同的回复 TTL：",
+		"%d replies not matching the send time of their probe (stale or replayed), not counted as received\n": "%d 个回复与其探测的发送时间不符（过期或重放），不计为已接收\n",
+		"%d replies from other addresses than %s, not counted as received\n":                                  "%d 个回复来自 %s 以外的地址，不计为已接收\n",
+		"%d replies with a mangled payload: %d truncated, %d oversized, %d corrupted\n":                       "%d 个回复的负载被篡改：截断 %d 个，超长 %d 个，损坏 %d 个\n",
+		"failures: %s\n": "失败：%s\n",
+		"%d probes excused, left out of the loss (local link down, suspend or method recheck)\n": "%d 个探测被豁免，不计入丢包（本地链路断开、休眠或方法复查）\n",
+		"\n--- total ---\n%s sent, %s received over %d targets, headers included (estimated)\n":  "\n--- 合计 ---\n%[3]d 个目标共发送 %[1]s，接收 %[2]s，含报头（估计）\n",
+
+		"\n--- %s per-address comparison ---\n":            "\n--- %s 各地址对比 ---\n",
+		"fastest %s avg %v, slowest %s avg %v (+%v)\n":     "最快 %s 平均 %v，最慢 %s 平均 %v（+%v）\n",
+		"%s is faster than %s (%s)":                        "%s 比 %s 快（%s）",
+		"no significant difference between %s and %s (%s)": "%s 与 %s 无显著差异（%s）",
+		"\n--- %s RTT by payload size ---\n":               "\n--- %s 按负载大小的 RTT ---\n",
+		"\n--- %s RTT by size class and pattern ---\n":     "\n--- %s 按大小类别和填充模式的 RTT ---\n",
+		"forward/reverse loss = %.1f%%/%.1f%%, the peer got %d of %d probes and %d of its replies came back": "去程/回程丢包 = %.1f%%/%.1f%%，对端收到 %d/%d 个探测，其回复有 %d 个返回",
+		"forward/reverse loss = %.1f%%/%.1f%%\n":                                              "去程/回程丢包 = %.1f%%/%.1f%%\n",
+		"%sforward loss %.1f%%, reverse loss %.1f%%\n":                                        "%s去程丢包 %.1f%%，回程丢包 %.1f%%\n",
+		"RTT grows %.3fµs per byte, a bottleneck of about %s if symmetric\n":                  "RTT 每字节增加 %.3fµs，若链路对称，瓶颈约为 %s\n",
+		"\n--- %s by source ---\n":                                                            "\n--- %s 按源地址 ---\n",
+		"no reply through %s\n":                                                               "经由 %s 没有回复\n",
+		"%s: MTU check on port %d passed, path MTU discovery lowered the MSS from %d to %d\n": "%s：端口 %d 的 MTU 检查通过，路径 MTU 发现将 MSS 从 %d 降至 %d\n",
+		"%s: MTU check on port %d passed, %d bytes in segments of %d acknowledged\n":          "%s：端口 %d 的 MTU 检查通过，%d 字节以 %d 字节的分段全部被确认\n",
+		"path MTU blackhole on port %d: %d bytes in segments of %d stalled\n":                 "端口 %d 存在路径 MTU 黑洞：%d 字节以 %d 字节的分段发送时停滞\n",
+		"%srouter counted %d/%d errors and %d/%d discards in/out\n":                           "%s路由器记录了 %d/%d 个错误和 %d/%d 个丢弃（入/出）\n",
+		"statistics reset": "统计已重置",
+		"Late reply for icmp_seq=%d time=%s, after the timeout, counted lost\n":        "icmp_seq=%d 的迟到回复 time=%s，已超时，计为丢失\n",
+		"%s%d late replies, avg %s: a queue filling up rather than loss\n":             "%s%d 个迟到回复，平均 %s：是队列积压而非丢包\n",
+		"%d late replies after the reply timeout, counted lost, rtt avg/max = %s/%s\n": "%d 个回复在超时后到达，计为丢失，rtt 平均/最大 = %s/%s\n",
+		" (out of order)": " (乱序)",
+		"%s%d replies out of order, %.1f%% reordering\n":          "%s%d 个回复乱序，乱序率 %.1f%%\n",
+		"%d replies out of order, %.1f%% reordering\n":            "%d 个回复乱序，乱序率 %.1f%%\n",
+		"=== %s incident snapshot of %s: %s\n":                    "=== %s %s 的故障快照：%s\n",
+		"%s is down":                                              "%s 已断开",
+		"%d probes lost in a row":                                 "连续丢失 %d 个探测",
+		"average RTT above %s":                                    "平均 RTT 超过 %s",
+		"%s is back up":                                           "%s 已恢复",
+		"after %s down":                                           "断开了 %s",
+		"statistics of %s reset":                                  "%s 的统计已重置",
+		"speedtest: %.1f Mbit/s from %s, %s in %.1fs":             "测速：%.1f Mbit/s，来自 %s，%s 用时 %.1fs",
+		"%squality score %.1f, median %s, jitter %s, %d spikes\n": "%s质量评分 %.1f，中位数 %s，抖动 %s，%d 次尖峰\n",
+		"\n--- %s by DSCP class ---\n":                            "\n--- %s 按 DSCP 类别 ---\n",
+		"no loss difference between %s and %s (%s)\n":             "%s 与 %s 之间丢包无差异（%s）\n",
+		"the classes fare alike: the markings are not honoured on the way, or it was never congested\n": "各类别表现相同：路径上未遵循标记，或从未出现拥塞\n",
+		"\n--- %s by profile ---\n":                       "\n--- %s 按探测配置 ---\n",
+		"no size-dependent loss between %s and %s (%s)\n": "%s 与 %s 之间无随大小变化的丢包（%s）\n",
+		"%s loses more than %s (%s): size-dependent loss, as of an MTU or fragmentation trouble\n": "%s 比 %s 丢包更多（%s）：丢包随大小变化，可能是 MTU 或分片问题\n",
+		"%s loses more than %s (%s)\n":                        "%s 比 %s 丢包更多（%s）\n",
+		"\n--- by provider ---\n":                             "\n--- 按运营商 ---\n",
+		"\n--- trend, first vs last quarter of the run ---\n": "\n--- 趋势：运行的首个与最后一个四分之一 ---\n",
+		"path to %s (%s), %d hops:\n":                         "到 %s（%s）的路径，%d 跳：\n",
+		"keeping: %d targets, grouped by %s, sorted by %s":    "keeping：%d 个目标，按 %s 分组，按 %s 排序",
+		"enter/+/- fold  g group  s sort  p pause  i interval  a add  x remove  t trace  r/R reset  q quit": "回车/+/- 折叠  g 分组  s 排序  p 暂停  i 间隔  a 添加  x 移除  t 路由追踪  r/R 重置  q 退出",
+		"interval of %s: ":               "%s 的间隔：",
+		"add target (host [duration]): ": "添加目标（主机 [时长]）：",
+	},
+}
+
+// tr returns the translation of the format string s in lang.
+func tr(s string) string {
+	if t, ok := catalogs[lang][s]; ok {
+		return t
+	}
+	return s
+}
+
+// setLang picks the language of the console output: l, or when empty the
+// one of the locale in LC_ALL, LC_MESSAGES or LANG, English when there is
+// no catalog for it.
+func setLang(l string) error {
+	if l == "" {
+		for _, env := range []string{"LC_ALL", "LC_MESSAGES", "LANG"} {
+			if v := os.Getenv(env); v != "" {
+				l, _, _ = strings.Cut(v, "_")
+				l, _, _ = strings.Cut(l, ".")
+				break
+			}
+		}
+		if _, ok := catalogs[l]; !ok {
+			l = "en"
+		}
+	}
+	if _, ok := catalogs[l]; !ok && l != "en" {
+		return fmt.Errorf("invalid -lang %q, want en or zh", l)
+	}
+	lang = l
+	return nil
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	timeSliceLength = 8
+	trackerLength   = 8
+	minPayloadSize  = timeSliceLength + trackerLength
+
+	ianaProtocolICMP     = 1
+	ianaProtocolIPv6ICMP = 58
+
+	// payloadSlack is how much longer than the probe a reply may be read
+	payloadSlack = 256
+)
+
+// instanceID sets the probes of this process apart from those of any other,
+// the first half of every Pinger's tracker. The second is the target ID,
+// numbering the Pingers of the process.
+var instanceID = func() (id [4]byte) {
+	_, _ = rand.Read(id[:])
+	return id
+}()
+
+var lastTargetID atomic.Uint32
+
+// newTracker is the identity of a new Pinger, instance and target ID.
+func newTracker() (t [trackerLength]byte) {
+	copy(t[:], instanceID[:])
+	id := lastTargetID.Add(1)
+	t[4], t[5], t[6], t[7] = byte(id>>24), byte(id>>16), byte(id>>8), byte(id)
+	return t
+}
+
+// instanceHex is instanceID as recorded in the run event, to find the
+// probes of a run in a capture.
+func instanceHex() string {
+	return hex.EncodeToString(instanceID[:])
+}
+
+// How a reply payload differs from the probe's.
+const (
+	payloadTruncated = "truncated"
+	payloadOversized = "oversized"
+	payloadCorrupted = "corrupted"
+)
+
+// icmpTransport sends ICMP echo requests. The payload starts with the send
+// time and the pinger's tracker, its instance and target ID, which tell our
+// replies apart from those to other ping processes and other targets
+// sharing a raw socket. The send time is checked against the probe's too,
+// see Pinger.process.
+type icmpTransport struct {
+	sock *icmpSocket
+	// in are the packets of the socket about our probes
+	in         <-chan *icmpPacket
+	dst        net.Addr
+	ipv4       bool
+	privileged bool
+	id         int
+	tracker    [trackerLength]byte
+	size       int
+	// sizes are cycled through by sequence number when set, size being
+	// the largest; padding draws the size and pattern instead
+	sizes   []int
+	padding *randomPadding
+	// body replaces the padding when set, see -payload-file
+	body []byte
+	// verbose describes every reply in Packet.Detail
+	verbose bool
+}
+
+func newICMPTransport(p *Pinger) (*icmpTransport, error) {
+	if p.Size < minPayloadSize {
+		return nil, fmt.Errorf("size %d is less than minimum required size %d", p.Size, minPayloadSize)
+	}
+	size := p.Size
+	if p.Padding != nil {
+		size = p.Padding.max
+	}
+	for _, s := range p.Sizes {
+		if s < minPayloadSize {
+			return nil, fmt.Errorf("size %d is less than minimum required size %d", s, minPayloadSize)
+		}
+		if s > size {
+			size = s
+		}
+	}
+	sock, in, err := joinICMPSocket(p)
+	if err != nil {
+		return nil, err
+	}
+	t := &icmpTransport{
+		sock:       sock,
+		in:         in,
+		dst:        p.ipaddr,
+		ipv4:       p.ipv4,
+		privileged: p.privileged,
+		id:         p.id,
+		tracker:    p.tracker,
+		size:       size,
+		sizes:      p.Sizes,
+		padding:    p.Padding,
+		body:       p.Body,
+		verbose:    p.Verbose,
+	}
+	if !p.privileged {
+		t.dst = &net.UDPAddr{IP: p.ipaddr.IP, Zone: p.ipaddr.Zone}
+	}
+	return t, nil
+}
+
+func (t *icmpTransport) Close() error {
+	return t.sock.leave(t.tracker, t.id)
+}
+
+// sizeOf is the payload size of probe seq.
+func (t *icmpTransport) sizeOf(seq int) int {
+	if t.padding != nil {
+		return t.padding.size(seq)
+	}
+	if len(t.sizes) == 0 {
+		return t.size
+	}
+	return t.sizes[seq%len(t.sizes)]
+}
+
+func (t *icmpTransport) send(seq int) (*Packet, error) {
+	data := make([]byte, t.sizeOf(seq))
+	stamp := time.Now()
+	putTime(data, stamp)
+	copy(data[timeSliceLength:], t.tracker[:])
+	t.pad(seq, data[minPayloadSize:])
+
+	var typ icmp.Type = ipv4.ICMPTypeEcho
+	if !t.ipv4 {
+		typ = ipv6.ICMPTypeEchoRequest
+	}
+	msgBytes, err := (&icmp.Message{
+		Type: typ,
+		Body: &icmp.Echo{ID: t.id, Seq: seq, Data: data},
+	}).Marshal(nil)
+	if err != nil {
+		return nil, err
+	}
+	pkt := &Packet{Nbytes: len(msgBytes), Seq: seq, ID: t.id, stamp: stamp}
+	if len(t.sizes) > 0 || t.padding != nil {
+		pkt.Size = len(data)
+	}
+	if t.padding != nil {
+		pkt.Pattern = t.padding.pattern(seq)
+	}
+	_, err = t.sock.conn.WriteTo(msgBytes, t.dst)
+	return pkt, err
+}
+
+// receive waits until an echo reply to one of our probes arrives.
+func (t *icmpTransport) receive() (*reply, error) {
+	for {
+		in, ok := <-t.in
+		if !ok {
+			return nil, t.sock.error()
+		}
+		r, m, hdr := in.r, in.m, in.hdr
+		if rep := t.errorReply(m, r); rep != nil {
+			return rep, nil
+		}
+		if m.Type != ipv4.ICMPTypeEchoReply && m.Type != ipv6.ICMPTypeEchoReply {
+			// Not an echo reply, ignore it
+			continue
+		}
+		echo, ok := m.Body.(*icmp.Echo)
+		if !ok || !t.matchID(echo.ID) {
+			continue
+		}
+		if len(echo.Data) < minPayloadSize || string(echo.Data[timeSliceLength:minPayloadSize]) != string(t.tracker[:]) {
+			// a reply to some other process' probe
+			continue
+		}
+		rep := &reply{
+			seq:        echo.Seq,
+			receivedAt: r.receivedAt,
+			stamp:      getTime(echo.Data),
+			pkt: &Packet{
+				Nbytes:       r.nbytes,
+				TTL:          r.ttl,
+				ID:           echo.ID,
+				Timestamping: r.timestamping,
+				From:         addrIP(r.src),
+				Payload:      t.checkPayload(echo.Data, echo.Seq),
+			},
+		}
+		if len(t.sizes) > 0 || t.padding != nil {
+			rep.pkt.Size = t.sizeOf(echo.Seq)
+		}
+		if t.padding != nil {
+			rep.pkt.Pattern = t.padding.pattern(echo.Seq)
+		}
+		if t.verbose {
+			rep.pkt.Detail = icmpDetail(r.bytes[:r.nbytes], echo.ID, r, hdr, t.ipv4)
+		}
+		return rep, nil
+	}
+}
+
+// errorReply turns an ICMP error quoting one of our probes into the failed
+// reply to it, nil for anything else. Only raw sockets see these, the
+// kernel keeps them from datagram sockets.
+func (t *icmpTransport) errorReply(m *icmp.Message, r *recvPacket) *reply {
+	var data []byte
+	var kind string
+	switch body := m.Body.(type) {
+	case *icmp.DstUnreach:
+		data, kind = body.Data, icmpUnreachable(t.ipv4, m.Code)
+	case *icmp.TimeExceeded:
+		data, kind = body.Data, failTTLExceeded
+	case *icmp.PacketTooBig:
+		data, kind = body.Data, failFragNeeded
+	default:
+		return nil
+	}
+	id, seq, payload, ok := quotedEcho(data, t.ipv4)
+	if !ok || !t.matchID(id) {
+		return nil
+	}
+	if len(payload) >= minPayloadSize && string(payload[timeSliceLength:minPayloadSize]) != string(t.tracker[:]) {
+		// about some other process' probe
+		return nil
+	}
+	// From is left unset: the router reporting it is no foreign reply
+	return &reply{seq: seq, receivedAt: r.receivedAt, err: icmpError(kind, r.src),
+		pkt: &Packet{ID: id, TTL: r.ttl, Timestamping: r.timestamping}}
+}
+
+// pad writes the padding of probe seq past the send time and the tracker;
+// ones, unless -random-padding draws another pattern or -payload-file
+// gives the body.
+func (t *icmpTransport) pad(seq int, b []byte) {
+	if t.body != nil {
+		n := copy(b, t.body)
+		for i := n; i < len(b); i++ {
+			b[i] = 0
+		}
+		return
+	}
+	if t.padding != nil {
+		t.padding.fill(seq, b)
+		return
+	}
+	for i := range b {
+		b[i] = 1
+	}
+}
+
+// checkPayload compares the echoed payload of probe seq with what was sent,
+// which some broken middleboxes cut short, pad or mangle.
+func (t *icmpTransport) checkPayload(data []byte, seq int) string {
+	size := t.sizeOf(seq)
+	switch {
+	case len(data) < size:
+		return payloadTruncated
+	case len(data) > size:
+		return payloadOversized
+	}
+	want := make([]byte, size-minPayloadSize)
+	t.pad(seq, want)
+	if string(data[minPayloadSize:]) != string(want) {
+		return payloadCorrupted
+	}
+	return ""
+}
+
+type recvPacket struct {
+	bytes        []byte
+	nbytes       int
+	ttl          int
+	src          net.Addr
+	receivedAt   time.Time
+	timestamping string
+	// ifIndex, dst and tclass are the interface, local address and IPv6
+	// traffic class of the packet, when asked for by enableDetail; 0, nil
+	// and -1 when unknown
+	ifIndex int
+	dst     net.IP
+	tclass  int
+}
+
+// addrIP returns the IP of a raw or datagram socket peer address.
+func addrIP(a net.Addr) *net.IPAddr {
+	switch a := a.(type) {
+	case *net.IPAddr:
+		return a
+	case *net.UDPAddr:
+		return &net.IPAddr{IP: a.IP, Zone: a.Zone}
+	}
+	return nil
+}
+
+func putTime(b []byte, t time.Time) {
+	nsec := t.UnixNano()
+	for i := uint8(0); i < 8; i++ {
+		b[i] = byte((nsec >> ((7 - i) * 8)) & 0xff)
+	}
+}
+
+// getTime reads what putTime wrote.
+func getTime(b []byte) time.Time {
+	var nsec int64
+	for _, c := range b[:timeSliceLength] {
+		nsec = nsec<<8 | int64(c)
+	}
+	return time.Unix(0, nsec)
+}
+
+// stripIPv4Header strips IPv4 header bytes if present
+// https://github.com/golang/go/commit/3b5be4522a21df8ce52a06a0c4ba005c89a8590f
+func stripIPv4Header(n int, b []byte) int {
+	if len(b) < 20 {
+		return n
+	}
+	l := int(b[0]&0x0f) << 2
+	if 20 > l || l > len(b) {
+		return n
+	}
+	if b[0]>>4 != 4 {
+		return n
+	}
+	copy(b, b[l:])
+	return n - l
+}
@@ -0,0 +1,13 @@
+//go:build linux
+
+package main
+
+// matchID reports whether an echo reply carries our ICMP identifier. On Linux
+// the kernel rewrites the identifier of unprivileged (datagram) pings and
+// already demultiplexes replies per socket, so only raw sockets are checked.
+func (t *icmpTransport) matchID(id int) bool {
+	if t.privileged {
+		return id == t.id
+	}
+	return true
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package main
+
+// matchID reports whether an echo reply carries our ICMP identifier.
+func (t *icmpTransport) matchID(id int) bool {
+	return id == t.id
+}
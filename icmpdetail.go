@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// ICMPDetail is what -v shows of an echo reply as it came in, the ICMP and
+// IP header fields, for chasing middleboxes that rewrite them.
+type ICMPDetail struct {
+	ID       int    `json:"icmp_id"`
+	Checksum uint16 `json:"icmp_checksum"`
+	// ChecksumOK is left out when the checksum can't be checked here, for
+	// an IPv6 reply whose destination address isn't known
+	ChecksumOK *bool `json:"icmp_checksum_ok,omitempty"`
+	// Interface and Dst are the interface and local address the reply
+	// came in on, where the system tells them
+	Interface string `json:"interface,omitempty"`
+	Dst       string `json:"dst,omitempty"`
+	// TrafficClass is that of an IPv6 reply
+	TrafficClass *int `json:"traffic_class,omitempty"`
+	// IPv4 is the header of an IPv4 reply, which only raw sockets see
+	IPv4 *IPv4Header `json:"ipv4,omitempty"`
+}
+
+// IPv4Header are the fields of an IPv4 header.
+type IPv4Header struct {
+	TOS        int  `json:"tos"`
+	TotalLen   int  `json:"total_len"`
+	ID         int  `json:"id"`
+	DF         bool `json:"df"`
+	MF         bool `json:"mf"`
+	FragOffset int  `json:"frag_offset"`
+	TTL        int  `json:"ttl"`
+	ChecksumOK bool `json:"checksum_ok"`
+	OptionsLen int  `json:"options_len"`
+}
+
+// parseIPv4Header reads the header b starts with, nil if it doesn't.
+func parseIPv4Header(b []byte) *IPv4Header {
+	if len(b) < ipv4.HeaderLen || b[0]>>4 != 4 {
+		return nil
+	}
+	hl := int(b[0]&0x0f) << 2
+	if hl < ipv4.HeaderLen || hl > len(b) {
+		return nil
+	}
+	flags := binary.BigEndian.Uint16(b[6:8])
+	return &IPv4Header{
+		TOS:        int(b[1]),
+		TotalLen:   int(binary.BigEndian.Uint16(b[2:4])),
+		ID:         int(binary.BigEndian.Uint16(b[4:6])),
+		DF:         flags&0x4000 != 0,
+		MF:         flags&0x2000 != 0,
+		FragOffset: int(flags&0x1fff) * 8,
+		TTL:        int(b[8]),
+		ChecksumOK: inetChecksum(0, b[:hl]) == 0,
+		OptionsLen: hl - ipv4.HeaderLen,
+	}
+}
+
+// inetChecksum is the Internet checksum of b, starting from sum.
+func inetChecksum(sum uint32, b []byte) uint16 {
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
+
+// icmpDetail describes the ICMP message msg of r; hdr is the IPv4 header it
+// came with, if any.
+func icmpDetail(msg []byte, id int, r *recvPacket, hdr *IPv4Header, v4 bool) *ICMPDetail {
+	d := &ICMPDetail{ID: id, IPv4: hdr}
+	if len(msg) >= 4 {
+		d.Checksum = binary.BigEndian.Uint16(msg[2:4])
+	}
+	var ok bool
+	switch src := addrIP(r.src); {
+	case v4:
+		ok = inetChecksum(0, msg) == 0
+		d.ChecksumOK = &ok
+	case r.dst != nil && src != nil:
+		// over the pseudo-header of the addresses, length and next header
+		var sum uint32
+		pseudo := make([]byte, 0, 40)
+		pseudo = append(append(pseudo, src.IP.To16()...), r.dst.To16()...)
+		pseudo = binary.BigEndian.AppendUint32(pseudo, uint32(len(msg)))
+		pseudo = append(pseudo, 0, 0, 0, ianaProtocolIPv6ICMP)
+		for i := 0; i < len(pseudo); i += 2 {
+			sum += uint32(pseudo[i])<<8 | uint32(pseudo[i+1])
+		}
+		ok = inetChecksum(sum, msg) == 0
+		d.ChecksumOK = &ok
+	}
+	if r.ifIndex > 0 {
+		if ifi, err := net.InterfaceByIndex(r.ifIndex); err == nil {
+			d.Interface = ifi.Name
+		} else {
+			d.Interface = fmt.Sprint(r.ifIndex)
+		}
+	}
+	if r.dst != nil {
+		d.Dst = r.dst.String()
+	}
+	if !v4 && r.tclass >= 0 {
+		tc := r.tclass
+		d.TrafficClass = &tc
+	}
+	return d
+}
+
+// enableDetail asks for the control messages ICMPDetail needs; where the
+// system has none, what they tell is left out.
+func (c *icmpConn) enableDetail() {
+	if c.p4 != nil {
+		c.ipHeaders = recvmsgHeaders
+		_ = c.p4.SetControlMessage(ipv4.FlagInterface|ipv4.FlagDst, true)
+		return
+	}
+	_ = c.p6.SetControlMessage(ipv6.FlagInterface|ipv6.FlagDst|ipv6.FlagTrafficClass, true)
+}
+
+// String is the detail as -v appends it to the reply line.
+func (d *ICMPDetail) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "id=%d cksum=0x%04x", d.ID, d.Checksum)
+	if d.ChecksumOK != nil && !*d.ChecksumOK {
+		b.WriteString(" (BAD)")
+	}
+	if d.Interface != "" {
+		fmt.Fprintf(&b, " if=%s", d.Interface)
+	}
+	if d.Dst != "" {
+		fmt.Fprintf(&b, " dst=%s", d.Dst)
+	}
+	if d.TrafficClass != nil {
+		fmt.Fprintf(&b, " tclass=0x%02x", *d.TrafficClass)
+	}
+	if h := d.IPv4; h != nil {
+		fmt.Fprintf(&b, " tos=0x%02x len=%d ipid=%d ttl=%d", h.TOS, h.TotalLen, h.ID, h.TTL)
+		if h.DF {
+			b.WriteString(" DF")
+		}
+		if h.MF || h.FragOffset > 0 {
+			fmt.Fprintf(&b, " frag=%d", h.FragOffset)
+			if h.MF {
+				b.WriteString("+MF")
+			}
+		}
+		if h.OptionsLen > 0 {
+			fmt.Fprintf(&b, " options=%dB", h.OptionsLen)
+		}
+		if !h.ChecksumOK {
+			b.WriteString(" (BAD IP checksum)")
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"net"
+	"sync"
+
+	"golang.org/x/net/icmp"
+)
+
+// icmpSocketKey is what ICMP probes need of their socket. Targets agreeing
+// on it share one, and one receive loop: the socket can send to any address
+// of its family and the tracker in every payload tells whose a reply is.
+// ICMP and ICMPv6 are protocols of their own, each with its own socket, so
+// the IPv4 and IPv6 probes of a dual-stack target never share one; they
+// share the code of the socket and its loop only.
+type icmpSocketKey struct {
+	v4, privileged bool
+	source         string
+	// ttl is the TTL or hop limit the probes go out with
+	ttl, tos, mark int
+	device         string
+	timestamping   string
+	verbose        bool
+}
+
+// icmpPacket is a packet the receive loop read, parsed, for the transport
+// whose probe it answers or quotes.
+type icmpPacket struct {
+	r   *recvPacket
+	m   *icmp.Message
+	hdr *IPv4Header
+}
+
+// icmpInbox is how many packets wait for a transport before the loop drops
+// them, as a full socket buffer would.
+const icmpInbox = 256
+
+// icmpSocket is an ICMP socket shared by the transports of its key.
+type icmpSocket struct {
+	key  icmpSocketKey
+	conn *icmpConn
+	// private sockets are a transport's own, for options that can't be
+	// shared, the IPv6 flow label leased for one destination
+	private bool
+
+	mu        sync.Mutex
+	byTracker map[[trackerLength]byte]chan *icmpPacket
+	// byID finds the transport of an ICMP error quoting too little of the
+	// payload to hold the tracker, by the echo identifier
+	byID map[int]chan *icmpPacket
+	err  error
+}
+
+var icmpSockets = struct {
+	sync.Mutex
+	m map[icmpSocketKey]*icmpSocket
+}{m: make(map[icmpSocketKey]*icmpSocket)}
+
+// hopLimit is the TTL (IPv4) or hop limit (IPv6) probes to p go out with.
+func (p *Pinger) hopLimit() int {
+	if !p.ipv4 && p.HopLimit > 0 {
+		return p.HopLimit
+	}
+	return p.TTL
+}
+
+// joinICMPSocket returns the socket for the probes of p, opening it if no
+// other target shares it yet, and the inbox of p's packets.
+func joinICMPSocket(p *Pinger) (*icmpSocket, <-chan *icmpPacket, error) {
+	key := icmpSocketKey{v4: p.ipv4, privileged: p.privileged, source: p.Source, ttl: p.hopLimit(), tos: p.TOS,
+		mark: p.Mark, device: p.Device, timestamping: p.Timestamping, verbose: p.Verbose}
+	private := p.FlowLabel != 0 && !p.ipv4
+	icmpSockets.Lock()
+	defer icmpSockets.Unlock()
+	s := icmpSockets.m[key]
+	if s == nil || private {
+		conn, err := listenICMP(p.ipv4, p.privileged, p.Source)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := configureICMP(conn, p, key); err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+		s = &icmpSocket{key: key, conn: conn, private: private,
+			byTracker: make(map[[trackerLength]byte]chan *icmpPacket), byID: make(map[int]chan *icmpPacket)}
+		if !private {
+			icmpSockets.m[key] = s
+		}
+		go s.loop()
+	}
+	in := make(chan *icmpPacket, icmpInbox)
+	s.mu.Lock()
+	s.byTracker[p.tracker] = in
+	s.byID[p.id] = in
+	s.mu.Unlock()
+	return s, in, nil
+}
+
+// configureICMP sets the options of key, and the flow label of p, on a new
+// socket.
+func configureICMP(conn *icmpConn, p *Pinger, key icmpSocketKey) error {
+	if err := conn.SetTTL(key.ttl); err != nil {
+		return err
+	}
+	if key.tos != 0 {
+		if err := conn.setTOS(key.tos); err != nil {
+			return err
+		}
+	}
+	if p.FlowLabel != 0 && !p.ipv4 {
+		if err := conn.setFlowLabel(p.ipaddr.IP, p.FlowLabel); err != nil {
+			return err
+		}
+	}
+	if err := conn.setRouting(key.mark, key.device); err != nil {
+		return err
+	}
+	if key.timestamping == timestampKernel {
+		if err := conn.enableKernelTimestamps(); err != nil {
+			return err
+		}
+	}
+	if key.verbose {
+		conn.enableDetail()
+	}
+	return nil
+}
+
+// leave stops delivering the packets of tracker and id, closing the socket
+// once no transport is left on it.
+func (s *icmpSocket) leave(tracker [trackerLength]byte, id int) error {
+	icmpSockets.Lock()
+	defer icmpSockets.Unlock()
+	s.mu.Lock()
+	if in := s.byTracker[tracker]; in != nil {
+		delete(s.byTracker, tracker)
+		if s.byID[id] == in {
+			delete(s.byID, id)
+		}
+		close(in)
+	}
+	left := len(s.byTracker)
+	s.mu.Unlock()
+	if left > 0 {
+		return nil
+	}
+	if !s.private && icmpSockets.m[s.key] == s {
+		delete(icmpSockets.m, s.key)
+	}
+	return s.conn.Close()
+}
+
+// error is why the receive loop stopped, net.ErrClosed once the socket is.
+func (s *icmpSocket) error() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err == nil {
+		return net.ErrClosed
+	}
+	return s.err
+}
+
+// loop reads the socket until it is closed, handing every echo reply and
+// ICMP error to the transport of the probe it is about.
+func (s *icmpSocket) loop() {
+	proto := ianaProtocolIPv6ICMP
+	if s.key.v4 {
+		proto = ianaProtocolICMP
+	}
+	// room for the largest probe and replies longer than it
+	buf := make([]byte, maxPaddingSize+8+60+payloadSlack)
+	for {
+		r, err := s.conn.read(buf)
+		if err != nil {
+			if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
+				continue
+			}
+			s.stop(err)
+			return
+		}
+		r.bytes = append([]byte(nil), r.bytes[:r.nbytes]...)
+		var hdr *IPv4Header
+		if s.key.v4 {
+			if s.key.verbose {
+				hdr = parseIPv4Header(r.bytes)
+			}
+			r.nbytes = stripIPv4Header(r.nbytes, r.bytes)
+		}
+		m, err := icmp.ParseMessage(proto, r.bytes[:r.nbytes])
+		if err != nil {
+			continue
+		}
+		s.deliver(&icmpPacket{r: r, m: m, hdr: hdr})
+	}
+}
+
+// deliver hands pkt to the transport whose tracker, or else identifier, it
+// carries or quotes.
+func (s *icmpSocket) deliver(pkt *icmpPacket) {
+	var id int
+	var payload []byte
+	switch body := pkt.m.Body.(type) {
+	case *icmp.Echo:
+		id, payload = body.ID, body.Data
+	case *icmp.DstUnreach:
+		id, _, payload, _ = quotedEcho(body.Data, s.key.v4)
+	case *icmp.TimeExceeded:
+		id, _, payload, _ = quotedEcho(body.Data, s.key.v4)
+	case *icmp.PacketTooBig:
+		id, _, payload, _ = quotedEcho(body.Data, s.key.v4)
+	default:
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var in chan *icmpPacket
+	if len(payload) >= minPayloadSize {
+		var tracker [trackerLength]byte
+		copy(tracker[:], payload[timeSliceLength:minPayloadSize])
+		in = s.byTracker[tracker]
+	} else {
+		in = s.byID[id]
+	}
+	if in == nil {
+		// a reply to some other process' probe
+		return
+	}
+	select {
+	case in <- pkt:
+	default:
+	}
+}
+
+// stop ends the deliveries with err, the transports failing with it; the
+// targets joining later get a socket of their own.
+func (s *icmpSocket) stop(err error) {
+	icmpSockets.Lock()
+	defer icmpSockets.Unlock()
+	if icmpSockets.m[s.key] == s {
+		delete(icmpSockets.m, s.key)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err
+	for tracker, in := range s.byTracker {
+		close(in)
+		delete(s.byTracker, tracker)
+	}
+	s.byID = make(map[int]chan *icmpPacket)
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// incidentResults and incidentEvents are the latest results of a target
+// and events of the run an incident snapshot shows.
+const (
+	incidentResults = 60
+	incidentEvents  = 20
+)
+
+// incidentSink writes a snapshot of the run to a text file of -incident-dir
+// when a target goes down: every target as a table, then the latest results
+// of this one as -table rows and the latest events, for the moment of the
+// failure to outlive the scrollback of the terminal.
+type incidentSink struct {
+	dir    string
+	health *healthTracker
+	// targets in the order they showed up
+	targets []string
+	status  map[string]*incidentTarget
+	events  []*Event
+}
+
+// incidentTarget is what a snapshot shows of a target.
+type incidentTarget struct {
+	group      string
+	state      string
+	sent, lost int
+	lastReply  time.Time
+	lastRttMs  float64
+	interval   *IntervalStats
+	// results is a ring of the latest, next the oldest once it is full
+	results []*Result
+	next    int
+}
+
+func newIncidentSink(dir string, slowMs float64) (*incidentSink, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &incidentSink{dir: dir, health: newHealthTracker(slowMs), status: make(map[string]*incidentTarget)}, nil
+}
+
+// unsampled: a snapshot shows every probe up to the failure.
+func (s *incidentSink) unsampled() {}
+
+func (s *incidentSink) target(name, group string) *incidentTarget {
+	t := s.status[name]
+	if t == nil {
+		t = &incidentTarget{group: group, state: "unknown"}
+		s.status[name] = t
+		s.targets = append(s.targets, name)
+	}
+	return t
+}
+
+func (s *incidentSink) HandleResult(r *Result) error {
+	t := s.target(r.Target, r.Group)
+	switch r.Status {
+	case resultOK:
+		t.sent++
+		t.lastReply, t.lastRttMs = r.Time, r.RttMs
+	case resultTimeout, resultError:
+		t.sent++
+		t.lost++
+	}
+	if len(t.results) < incidentResults {
+		t.results = append(t.results, r)
+	} else {
+		t.results[t.next] = r
+		t.next = (t.next + 1) % incidentResults
+	}
+	return s.update(r.Target, s.health.result(r), r.Time)
+}
+
+func (s *incidentSink) HandleInterval(st *IntervalStats) error {
+	s.target(st.Target, st.Group).interval = st
+	return s.update(st.Target, s.health.interval(st), st.Time)
+}
+
+func (s *incidentSink) HandleEvent(e *Event) error {
+	if e.Type == eventExpired && e.Target != "" {
+		delete(s.status, e.Target)
+		for i, name := range s.targets {
+			if name == e.Target {
+				s.targets = append(s.targets[:i], s.targets[i+1:]...)
+				break
+			}
+		}
+	}
+	if len(s.events) == incidentEvents {
+		s.events = append(s.events[:0], s.events[1:]...)
+	}
+	s.events = append(s.events, e)
+	return nil
+}
+
+func (s *incidentSink) Flush() error { return nil }
+
+func (s *incidentSink) update(target, state string, now time.Time) error {
+	if state == "" {
+		return nil
+	}
+	s.health.set(target, state)
+	s.status[target].state = state
+	if state != "down" {
+		return nil
+	}
+	path := filepath.Join(s.dir, output.Time(now, "20060102-150405", time.Local)+"-"+fileName.Replace(target)+".txt")
+	if err := os.WriteFile(path, []byte(s.snapshot(target, now)), 0o644); err != nil {
+		return err
+	}
+	fmt.Printf(tr("=== %s incident snapshot of %s: %s\n"), output.Time(now, "15:04:05", time.Local), target, path)
+	return nil
+}
+
+// snapshot renders the run as it stands when target went down.
+func (s *incidentSink) snapshot(target string, now time.Time) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "keeping incident: %s down at %s\n", target, output.Time(now, time.RFC3339, time.Local))
+	if host, err := os.Hostname(); err == nil {
+		fmt.Fprintf(&b, "host %s, pid %d\n", host, os.Getpid())
+	}
+
+	b.WriteString("\n--- targets ---\n")
+	names := append([]string(nil), s.targets...)
+	// the ones down first, the way an operator scans it
+	sort.SliceStable(names, func(i, j int) bool {
+		return s.status[names[i]].state == "down" && s.status[names[j]].state != "down"
+	})
+	tw := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "target\tstate\tsent\tlost\tloss\tlast rtt\tlast reply\tinterval loss\tinterval avg")
+	for _, name := range names {
+		t := s.status[name]
+		loss, last, reply, iloss, iavg := "-", "-", "-", "-", "-"
+		if t.sent > 0 {
+			loss = strconv.FormatFloat(float64(t.lost)/float64(t.sent)*100, 'f', 1, 64) + "%"
+		}
+		if !t.lastReply.IsZero() {
+			last = output.Ms(t.lastRttMs, 3)
+			reply = now.Sub(t.lastReply).Round(time.Second).String() + " ago"
+		}
+		if st := t.interval; st != nil {
+			iloss = strconv.FormatFloat(st.LossPct, 'f', 1, 64) + "%"
+			if st.Count > 0 {
+				iavg = output.Ms(st.AvgMs, 3)
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%s\t%s\t%s\t%s\t%s\n", name, t.state, t.sent, t.lost, loss, last, reply, iloss, iavg)
+	}
+	tw.Flush()
+
+	t := s.status[target]
+	fmt.Fprintf(&b, "\n--- last %d results of %s ---\n", len(t.results), target)
+	tb := newTable([]string{target})
+	b.WriteString(tb.headerLine() + "\n")
+	for i := range t.results {
+		r := t.results[(t.next+i)%len(t.results)]
+		b.WriteString(tb.line(r.Time, r.Target, r.Seq, time.Duration(r.RttMs*float64(time.Millisecond)), r.TTL+r.HopLimit, resultFlags(r)) + "\n")
+	}
+
+	if len(s.events) > 0 {
+		fmt.Fprintf(&b, "\n--- last %d events ---\n", len(s.events))
+		for _, e := range s.events {
+			name := e.Target
+			if name == "" {
+				name = "*"
+			}
+			fmt.Fprintf(&b, "%s  %s  %s: %s\n", output.Time(e.Time, "15:04:05.000", time.Local), name, e.Type, e.Message)
+		}
+	}
+	return b.String()
+}
+
+// resultFlags are the -table flags of a recorded result.
+func resultFlags(r *Result) []string {
+	var flags []string
+	if r.Method != "" && r.Method != protocolICMP {
+		flags = append(flags, r.Method)
+	}
+	if r.HTTPStatus != 0 {
+		flags = append(flags, "status="+strconv.Itoa(r.HTTPStatus))
+	}
+	if r.Payload != "" {
+		flags = append(flags, r.Payload)
+	}
+	if r.Reordered {
+		flags = append(flags, "REORDERED")
+	}
+	switch r.Status {
+	case resultOK:
+	case resultDuplicate:
+		flags = append(flags, "DUP")
+	default:
+		flags = append(flags, strings.ToUpper(r.Status))
+	}
+	if r.Failure != "" && r.Failure != failTimeout {
+		flags = append(flags, r.Failure)
+	}
+	if r.Error != "" {
+		flags = append(flags, r.Error)
+	}
+	return flags
+}
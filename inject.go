@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// faults are the troubles -inject simulates on the replies, to see the loss
+// accounting, outage detection and alerts at work without breaking a
+// network for it.
+type faults struct {
+	// Loss and Corrupt are the fractions of the replies dropped and
+	// flagged as corrupted
+	Loss, Corrupt float64
+	// Delay, give or take up to Jitter, is added to every reply
+	Delay, Jitter time.Duration
+	// every OutageEvery, all replies are dropped for OutageFor
+	OutageFor, OutageEvery time.Duration
+	start                  time.Time
+}
+
+// parseFaults parses -inject, KEY=VALUE separated by commas.
+func parseFaults(s string) (*faults, error) {
+	f := &faults{start: time.Now()}
+	for _, kv := range strings.Split(s, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(kv), "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid -inject %q, want KEY=VALUE", kv)
+		}
+		var err error
+		switch k {
+		case "loss":
+			f.Loss, err = parseFraction(v)
+		case "corrupt":
+			f.Corrupt, err = parseFraction(v)
+		case "delay":
+			f.Delay, err = time.ParseDuration(v)
+		case "jitter":
+			f.Jitter, err = time.ParseDuration(v)
+		case "outage":
+			d, every, ok := strings.Cut(v, "/")
+			if !ok {
+				return nil, fmt.Errorf("invalid -inject outage %q, want DURATION/EVERY", v)
+			}
+			if f.OutageFor, err = time.ParseDuration(d); err == nil {
+				f.OutageEvery, err = time.ParseDuration(every)
+			}
+			if err == nil && (f.OutageFor <= 0 || f.OutageEvery <= f.OutageFor) {
+				return nil, fmt.Errorf("invalid -inject outage %q, want 0 < DURATION < EVERY", v)
+			}
+		default:
+			return nil, fmt.Errorf("unknown -inject %q, want loss, corrupt, delay, jitter or outage", k)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid -inject %s: %w", kv, err)
+		}
+	}
+	if f.Delay < 0 || f.Jitter < 0 || f.Jitter > f.Delay {
+		return nil, fmt.Errorf("invalid -inject %q, want 0 <= jitter <= delay", s)
+	}
+	return f, nil
+}
+
+// parseFraction parses 5% or 0.05.
+func parseFraction(s string) (float64, error) {
+	pct := strings.HasSuffix(s, "%")
+	v, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+	if err != nil {
+		return 0, err
+	}
+	if pct {
+		v /= 100
+	}
+	if v < 0 || v > 1 {
+		return 0, fmt.Errorf("%s is not within 0 to 100%%", s)
+	}
+	return v, nil
+}
+
+func (f *faults) String() string {
+	var parts []string
+	if f.Loss > 0 {
+		parts = append(parts, fmt.Sprintf("%g%% loss", f.Loss*100))
+	}
+	if f.Corrupt > 0 {
+		parts = append(parts, fmt.Sprintf("%g%% corrupted", f.Corrupt*100))
+	}
+	if f.Delay > 0 || f.Jitter > 0 {
+		parts = append(parts, fmt.Sprintf("%v±%v delay", f.Delay, f.Jitter))
+	}
+	if f.OutageFor > 0 {
+		parts = append(parts, fmt.Sprintf("%v outage every %v", f.OutageFor, f.OutageEvery))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// apply decides the fate of the reply r: whether it is kept, flagging it
+// corrupted on the way, and how much later it is to arrive. Replies that
+// are errors are left alone.
+func (f *faults) apply(r *reply) (keep bool, delay time.Duration) {
+	if r.err != nil {
+		return true, 0
+	}
+	if since := time.Since(f.start); f.OutageFor > 0 && since >= f.OutageEvery && since%f.OutageEvery < f.OutageFor {
+		return false, 0
+	}
+	if f.Loss > 0 && rand.Float64() < f.Loss {
+		return false, 0
+	}
+	if f.Corrupt > 0 && r.pkt != nil && rand.Float64() < f.Corrupt {
+		r.pkt.Payload = payloadCorrupted
+	}
+	delay = f.Delay
+	if f.Jitter > 0 {
+		delay += time.Duration(rand.Int63n(int64(2*f.Jitter))) - f.Jitter
+	}
+	return true, delay
+}
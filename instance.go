@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// instanceInfo is what a running instance registers about itself, for the
+// next one to see.
+type instanceInfo struct {
+	PID     int       `json:"pid"`
+	Start   time.Time `json:"start"`
+	Ctl     string    `json:"ctl,omitempty"`
+	Args    []string  `json:"args"`
+	Targets []string  `json:"targets"`
+}
+
+// instance is the registration of this process, its file locked for as
+// long as it runs: a file nobody holds the lock of is left by a dead one.
+type instance struct {
+	f    *os.File
+	info *instanceInfo
+}
+
+// instancesDir is where instances register, next to the control socket.
+func instancesDir() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "keeping")
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("keeping-%d", os.Getuid()))
+}
+
+// errDuplicate is another instance probing some of the same targets.
+var errDuplicate = errors.New("already probed")
+
+// registerInstance registers info, unless a running instance probes some of
+// its targets already, which would skew the statistics of both and send
+// every alert twice.
+func registerInstance(info *instanceInfo, allowDuplicate bool) (*instance, error) {
+	if !instanceLocking {
+		return nil, nil
+	}
+	dir := instancesDir()
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	// one instance registering at a time
+	dirLock, err := os.OpenFile(filepath.Join(dir, ".lock"), os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	defer dirLock.Close()
+	if err := lockFile(dirLock, true); err != nil {
+		return nil, err
+	}
+	if !allowDuplicate {
+		others, err := runningInstances()
+		if err != nil {
+			return nil, err
+		}
+		mine := make(map[string]bool, len(info.Targets))
+		for _, t := range info.Targets {
+			mine[t] = true
+		}
+		for _, o := range others {
+			var shared []string
+			for _, t := range o.Targets {
+				if mine[t] {
+					shared = append(shared, t)
+				}
+			}
+			if len(shared) > 0 {
+				return nil, fmt.Errorf("%s %w by keeping pid %d, running since %s: see keeping status, or -allow-duplicate to probe them twice",
+					strings.Join(shared, ", "), errDuplicate, o.PID, output.Time(o.Start, "2006-01-02 15:04:05", time.Local))
+			}
+		}
+	}
+	f, err := os.OpenFile(filepath.Join(dir, fmt.Sprintf("%d.json", info.PID)), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(f, false); err != nil {
+		f.Close()
+		return nil, err
+	}
+	in := &instance{f: f, info: info}
+	if err := in.write(); err != nil {
+		in.Close()
+		return nil, err
+	}
+	return in, nil
+}
+
+func (in *instance) write() error {
+	b, err := json.Marshal(in.info)
+	if err != nil {
+		return err
+	}
+	if err := in.f.Truncate(0); err != nil {
+		return err
+	}
+	_, err = in.f.WriteAt(append(b, '\n'), 0)
+	return err
+}
+
+// SetCtl records the control socket the instance ended up with, none when
+// it couldn't listen.
+func (in *instance) SetCtl(path string) {
+	if in == nil {
+		return
+	}
+	in.info.Ctl = path
+	_ = in.write()
+}
+
+// Close unregisters the instance.
+func (in *instance) Close() {
+	if in == nil {
+		return
+	}
+	os.Remove(in.f.Name())
+	in.f.Close()
+}
+
+// runningInstances returns the instances registered and still running,
+// oldest first, removing what dead ones left.
+func runningInstances() ([]*instanceInfo, error) {
+	paths, err := filepath.Glob(filepath.Join(instancesDir(), "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var infos []*instanceInfo
+	for _, path := range paths {
+		f, err := os.OpenFile(path, os.O_RDWR, 0)
+		if err != nil {
+			continue
+		}
+		if lockFile(f, false) == nil {
+			// nobody holds it
+			os.Remove(path)
+			f.Close()
+			continue
+		}
+		var info instanceInfo
+		err = json.NewDecoder(f).Decode(&info)
+		f.Close()
+		if err == nil && info.PID != os.Getpid() {
+			infos = append(infos, &info)
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Start.Before(infos[j].Start) })
+	return infos, nil
+}
+
+// statusMain implements `keeping status`, showing the running instances and
+// what their control sockets tell.
+func statusMain(args []string) int {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Println("Usage: keeping status")
+		fmt.Println("Shows the running instances of keeping, and the status of their targets.")
+	}
+	fs.Parse(args)
+	if !instanceLocking {
+		fmt.Println("ERROR: instances can't be listed on this system, try keeping ctl status")
+		return 1
+	}
+	infos, err := runningInstances()
+	if err != nil {
+		fmt.Println("ERROR:", err)
+		return 1
+	}
+	if len(infos) == 0 {
+		fmt.Println("no instance running")
+		return 1
+	}
+	for i, info := range infos {
+		if i > 0 {
+			fmt.Println()
+		}
+		fmt.Printf("pid %d, running for %v: keeping %s\n", info.PID,
+			time.Since(info.Start).Round(time.Second), strings.Join(info.Args, " "))
+		if info.Ctl == "" {
+			fmt.Printf("  targets: %s (no control socket)\n", strings.Join(info.Targets, ", "))
+			continue
+		}
+		out, err := ctlRequest(info.Ctl, "status", "")
+		if err != nil {
+			fmt.Println("  WARN:", err)
+			continue
+		}
+		for _, line := range strings.Split(strings.TrimRight(out, "\n"), "\n") {
+			fmt.Println("  " + line)
+		}
+	}
+	return 0
+}
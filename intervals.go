@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// intervalColumns is the schema of interval rows, in CSV column order. It
+// only ever grows at the end, dashboards built on it keep working.
+var intervalColumns = []string{
+	"time", "target", "group", "sent", "lost", "loss_pct",
+	"min_ms", "avg_ms", "max_ms", "stddev_ms", "baseline_ms", "anomaly",
+	"send_rate", "gap_avg_ms", "gap_max_ms", "send_lag_max_ms", "pop",
+	"median_ms", "jitter_ms", "spikes", "score", "throughput_mbps",
+	"router_in_errors", "router_out_errors", "router_in_discards", "router_out_discards",
+	"sig", "late", "late_avg_ms", "reordered", "reorder_pct",
+}
+
+// sigColumn is the index of the sig column.
+var sigColumn = func() int {
+	for i, name := range intervalColumns {
+		if name == "sig" {
+			return i
+		}
+	}
+	panic("no sig column")
+}()
+
+// intervalRow is an interval summary flattened to intervalColumns. Unlike
+// IntervalStats nothing is left out when zero.
+type intervalRow struct {
+	Time       time.Time `json:"time"`
+	Target     string    `json:"target"`
+	Group      string    `json:"group"`
+	Sent       int64     `json:"sent"`
+	Lost       int64     `json:"lost"`
+	LossPct    float64   `json:"loss_pct"`
+	MinMs      float64   `json:"min_ms"`
+	AvgMs      float64   `json:"avg_ms"`
+	MaxMs      float64   `json:"max_ms"`
+	StdDevMs   float64   `json:"stddev_ms"`
+	BaselineMs float64   `json:"baseline_ms"`
+	Anomaly    bool      `json:"anomaly"`
+	SendRate   float64   `json:"send_rate"`
+	GapAvgMs   float64   `json:"gap_avg_ms"`
+	GapMaxMs   float64   `json:"gap_max_ms"`
+	SendLagMax float64   `json:"send_lag_max_ms"`
+	POP        string    `json:"pop"`
+	MedianMs   float64   `json:"median_ms"`
+	JitterMs   float64   `json:"jitter_ms"`
+	Spikes     int       `json:"spikes"`
+	Score      float64   `json:"score"`
+	// ThroughputMbps is 0 but in the intervals of -speedtest samples
+	ThroughputMbps float64 `json:"throughput_mbps"`
+	// Router is zero without -snmp
+	Router     RouterCounters `json:"router"`
+	Late       int            `json:"late"`
+	LateAvgMs  float64        `json:"late_avg_ms"`
+	Reordered  int            `json:"reordered"`
+	ReorderPct float64        `json:"reorder_pct"`
+	// Sig is the signature of the row with -sign-key, see sign.go; it
+	// stays the last field
+	Sig string `json:"sig,omitempty"`
+}
+
+func newIntervalRow(st *IntervalStats) *intervalRow {
+	r := &intervalRow{
+		Time: output.Zone(st.Time), Target: st.Target, Group: st.Group,
+		Sent: st.Sent, Lost: st.Lost, LossPct: st.LossPct,
+		MinMs: st.MinMs, AvgMs: st.AvgMs, MaxMs: st.MaxMs, StdDevMs: st.StdDevMs,
+		BaselineMs: st.BaselineMs, Anomaly: st.Anomaly,
+		SendRate: st.SendRate, GapAvgMs: st.GapAvgMs, GapMaxMs: st.GapMaxMs, SendLagMax: st.SendLagMaxMs,
+		POP:      st.POP,
+		MedianMs: st.MedianMs, JitterMs: st.JitterMs, Spikes: st.Spikes, Score: st.Score,
+		ThroughputMbps: st.ThroughputMbps,
+		Late:           st.Late, LateAvgMs: st.LateAvgMs,
+		Reordered: st.Reordered, ReorderPct: st.ReorderPct,
+	}
+	if st.Router != nil {
+		r.Router = *st.Router
+	}
+	return r
+}
+
+func (r *intervalRow) record() []string {
+	f := func(v float64) string { return strconv.FormatFloat(v, 'f', 3, 64) }
+	m := func(v float64) string { return output.MsField(v, 3) }
+	u := func(v uint64) string { return strconv.FormatUint(v, 10) }
+	return []string{
+		output.Time(r.Time, time.RFC3339, time.UTC), r.Target, r.Group,
+		strconv.FormatInt(r.Sent, 10), strconv.FormatInt(r.Lost, 10), f(r.LossPct),
+		m(r.MinMs), m(r.AvgMs), m(r.MaxMs), m(r.StdDevMs), m(r.BaselineMs),
+		strconv.FormatBool(r.Anomaly),
+		f(r.SendRate), m(r.GapAvgMs), m(r.GapMaxMs), m(r.SendLagMax), r.POP,
+		m(r.MedianMs), m(r.JitterMs), strconv.Itoa(r.Spikes), f(r.Score),
+		f(r.ThroughputMbps),
+		u(r.Router.InErrors), u(r.Router.OutErrors), u(r.Router.InDiscards), u(r.Router.OutDiscards),
+		r.Sig, strconv.Itoa(r.Late), m(r.LateAvgMs), strconv.Itoa(r.Reordered), f(r.ReorderPct),
+	}
+}
+
+// writeIntervalRows writes rows as CSV with a header, or as a JSON array.
+func writeIntervalRows(w io.Writer, rows []*intervalRow, asCSV bool) error {
+	if !asCSV {
+		if rows == nil {
+			rows = []*intervalRow{}
+		}
+		return json.NewEncoder(w).Encode(rows)
+	}
+	cw := csv.NewWriter(w)
+	_ = cw.Write(intervalColumns)
+	for _, r := range rows {
+		_ = cw.Write(r.record())
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// intervalFile is the sink appending one row per target and statistics
+// interval to a file, leaving single probes out. Files named .csv get CSV
+// with a header when new, anything else JSON lines. A CSV file with other
+// columns, from another version of keeping, is moved aside first.
+type intervalFile struct {
+	f   *os.File
+	w   *bufio.Writer
+	csv *csv.Writer
+	enc *json.Encoder
+	// key signs the rows when set, prev is the signature of the last
+	key  *signKey
+	prev string
+}
+
+func newIntervalFile(path string, key *signKey) (*intervalFile, error) {
+	if strings.HasSuffix(path, ".csv") {
+		if err := moveOtherColumns(path); err != nil {
+			return nil, err
+		}
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	s := &intervalFile{f: f, w: bufio.NewWriter(f), key: key}
+	if key != nil {
+		// the rows appended carry on the chain of those in the file
+		if s.prev, err = lastSignature(f, strings.HasSuffix(path, ".csv")); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	if !strings.HasSuffix(path, ".csv") {
+		s.enc = json.NewEncoder(s.w)
+		return s, nil
+	}
+	s.csv = csv.NewWriter(s.w)
+	if fi, err := f.Stat(); err == nil && fi.Size() == 0 {
+		_ = s.csv.Write(intervalColumns)
+	}
+	return s, nil
+}
+
+// moveOtherColumns renames the CSV file at path to one with the time in its
+// name when its header is not intervalColumns, for the rows appended not to
+// go under the wrong columns.
+func moveOtherColumns(path string) error {
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	cr := csv.NewReader(f)
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	f.Close()
+	if err == io.EOF || (err == nil && strings.Join(header, ",") == strings.Join(intervalColumns, ",")) {
+		return nil
+	}
+	old := strings.TrimSuffix(path, ".csv") + "." + time.Now().Format("20060102-150405") + ".csv"
+	if err := os.Rename(path, old); err != nil {
+		return err
+	}
+	fmt.Printf("WARN: %s has other columns than this version of keeping writes, moved to %s\n", path, old)
+	return nil
+}
+
+func (s *intervalFile) HandleResult(*Result) error { return nil }
+func (s *intervalFile) HandleEvent(*Event) error   { return nil }
+
+func (s *intervalFile) HandleInterval(st *IntervalStats) error {
+	row := newIntervalRow(st)
+	if s.enc != nil {
+		if s.key != nil {
+			b, err := json.Marshal(row)
+			if err != nil {
+				return err
+			}
+			row.Sig = s.key.sign(s.prev, b)
+			s.prev = row.Sig
+		}
+		if err := s.enc.Encode(row); err != nil {
+			return err
+		}
+	} else {
+		rec := row.record()
+		if s.key != nil {
+			unsigned := append(rec[:sigColumn:sigColumn], rec[sigColumn+1:]...)
+			rec[sigColumn] = s.key.sign(s.prev, csvLine(unsigned))
+			s.prev = rec[sigColumn]
+		}
+		_ = s.csv.Write(rec)
+		s.csv.Flush()
+		if err := s.csv.Error(); err != nil {
+			return err
+		}
+	}
+	return s.w.Flush()
+}
+
+func (s *intervalFile) Flush() error { return s.w.Flush() }
+
+func (s *intervalFile) Close() error {
+	return s.f.Close()
+}
+
+// intervalExec is the sink running a command for every interval row, with
+// the row as JSON on its stdin and as KEEPING_<COLUMN> variables, e.g.
+// KEEPING_TARGET and KEEPING_AVG_MS, in its environment.
+type intervalExec struct {
+	command []string
+}
+
+// newIntervalExec runs command, split on blanks.
+func newIntervalExec(command string) *intervalExec {
+	return &intervalExec{command: strings.Fields(command)}
+}
+
+func (s *intervalExec) HandleResult(*Result) error { return nil }
+func (s *intervalExec) HandleEvent(*Event) error   { return nil }
+func (s *intervalExec) Flush() error               { return nil }
+
+// unredacted: the command runs on this host, for its scripts.
+func (s *intervalExec) unredacted() {}
+
+func (s *intervalExec) HandleInterval(st *IntervalStats) error {
+	row := newIntervalRow(st)
+	b, err := json.Marshal(row)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, s.command[0], s.command[1:]...)
+	cmd.Stdin = bytes.NewReader(append(b, '\n'))
+	cmd.Env = os.Environ()
+	for i, v := range row.record() {
+		cmd.Env = append(cmd.Env, "KEEPING_"+strings.ToUpper(intervalColumns[i])+"="+v)
+	}
+	return commandError(s.command[0], cmd.CombinedOutput)
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Kinds of journal entries.
+const (
+	journalNote       = "note"
+	journalAnnotation = "annotation"
+	journalDown       = "down"
+	journalUp         = "up"
+)
+
+// journalEntry is a line of the incident journal: a target going down or
+// up again, an annotation of the moment or a note on a target.
+type journalEntry struct {
+	Time   time.Time `json:"time"`
+	Target string    `json:"target,omitempty"`
+	Kind   string    `json:"kind"`
+	Text   string    `json:"text,omitempty"`
+	// DurationMs is how long the outage an up entry ends lasted
+	DurationMs int64 `json:"duration_ms,omitempty"`
+}
+
+// journalPath is the default journal file, kept across runs with the past
+// ones.
+func journalPath() (string, error) {
+	dir, err := stateDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "journal.jsonl"), nil
+}
+
+// openJournal opens path for appending entries, creating it and its
+// directory.
+func openJournal(path string) (*os.File, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, err
+	}
+	return os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+}
+
+func writeJournal(f *os.File, e *journalEntry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(b, '\n'))
+	return err
+}
+
+// readJournal returns the entries of path in time order, those of the
+// targets given and the annotations, or all of them without targets.
+func readJournal(path string, targets []string) ([]*journalEntry, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var entries []*journalEntry
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var e journalEntry
+		if json.Unmarshal(sc.Bytes(), &e) != nil {
+			continue
+		}
+		if len(targets) == 0 || e.Target == "" || contains(targets, e.Target) {
+			entries = append(entries, &e)
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Time.Before(entries[j].Time) })
+	return entries, sc.Err()
+}
+
+// journalSink is the sink keeping the journal: the outages of the targets,
+// judged as -on-state-change does, and the annotations and notes.
+type journalSink struct {
+	f      *os.File
+	health *healthTracker
+	// down is since when each target down is
+	down map[string]time.Time
+}
+
+func newJournalSink(path string, slowMs float64) (*journalSink, error) {
+	f, err := openJournal(path)
+	if err != nil {
+		return nil, err
+	}
+	return &journalSink{f: f, health: newHealthTracker(slowMs), down: make(map[string]time.Time)}, nil
+}
+
+func (s *journalSink) HandleResult(r *Result) error {
+	return s.update(r.Target, s.health.result(r), r.Time)
+}
+
+func (s *journalSink) HandleInterval(st *IntervalStats) error {
+	return s.update(st.Target, s.health.interval(st), st.Time)
+}
+
+func (s *journalSink) HandleEvent(e *Event) error {
+	switch e.Type {
+	case eventAnnotation:
+		return writeJournal(s.f, &journalEntry{Time: e.Time, Kind: journalAnnotation, Text: e.Message})
+	case eventNote:
+		return writeJournal(s.f, &journalEntry{Time: e.Time, Target: e.Target, Kind: journalNote, Text: e.Message})
+	}
+	return nil
+}
+
+func (s *journalSink) Flush() error { return nil }
+func (s *journalSink) unsampled()   {}
+
+// unredacted: the journal is this host's, keeping journal shows the names.
+func (s *journalSink) unredacted() {}
+
+func (s *journalSink) update(target, state string, at time.Time) error {
+	if state == "" {
+		return nil
+	}
+	prev := s.health.state[target]
+	s.health.set(target, state)
+	e := &journalEntry{Time: at, Target: target, Kind: state}
+	switch {
+	case state == journalDown:
+		s.down[target] = at
+		e.Text = fmt.Sprintf("%d probes lost in a row", downAfter)
+		if s.health.slow[target] {
+			e.Text = fmt.Sprintf("average RTT above %vms", s.health.SlowMs)
+		}
+	case prev == "":
+		// up from the start is no incident
+		return nil
+	default:
+		d := at.Sub(s.down[target])
+		delete(s.down, target)
+		e.DurationMs = d.Milliseconds()
+		e.Text = "after " + slaDur(d.Round(100*time.Millisecond))
+	}
+	return writeJournal(s.f, e)
+}
+
+// note records a note on a target of the running instance, to the journal
+// and the other outputs.
+func (m *monitor) note(target, text string) error {
+	target, text = strings.TrimSpace(target), strings.TrimSpace(text)
+	if target == "" || text == "" {
+		return errors.New("usage: note target text")
+	}
+	fmt.Printf("=== %s note on %s: %s\n", output.Time(time.Now(), time.DateTime, time.Local), target, text)
+	m.event(eventNote, target, text)
+	return nil
+}
+
+// journalMain implements `keeping journal`, which shows the incident
+// journal of targets or adds a note to it.
+func journalMain(args []string) int {
+	fs := flag.NewFlagSet("journal", flag.ExitOnError)
+	defPath, _ := journalPath()
+	path := fs.String("file", defPath, "journal file, the one of -journal")
+	note := fs.String("note", "", "add this note to the target instead of showing the journal")
+	since := fs.Duration("since", 0, "only the entries of this long ago and since, e.g. 720h")
+	asJSON := fs.Bool("json", false, "write the entries as JSON lines")
+	fs.Usage = func() {
+		fmt.Println("Usage: keeping journal [-since 720h] [-json] [target...]")
+		fmt.Println("       keeping journal -note text target")
+		fmt.Println("Shows the outages of the targets, the annotations and the notes on them, oldest first.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *note != "" {
+		if fs.NArg() != 1 {
+			fs.Usage()
+			return 2
+		}
+		f, err := openJournal(*path)
+		if err == nil {
+			err = writeJournal(f, &journalEntry{Time: time.Now(), Target: fs.Arg(0), Kind: journalNote, Text: *note})
+			f.Close()
+		}
+		if err != nil {
+			fmt.Println("ERROR:", err)
+			return 1
+		}
+		return 0
+	}
+	entries, err := readJournal(*path, fs.Args())
+	if err != nil {
+		fmt.Println("ERROR:", err)
+		return 1
+	}
+	if *since > 0 {
+		from := time.Now().Add(-*since)
+		kept := entries[:0]
+		for _, e := range entries {
+			if !e.Time.Before(from) {
+				kept = append(kept, e)
+			}
+		}
+		entries = kept
+	}
+	if len(entries) == 0 {
+		fmt.Println("nothing in the journal")
+		return 1
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		for _, e := range entries {
+			_ = enc.Encode(e)
+		}
+		return 0
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, e := range entries {
+		target := e.Target
+		if target == "" {
+			target = "*"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", output.Time(e.Time, time.DateTime, time.Local), target, e.Kind, e.Text)
+	}
+	tw.Flush()
+	return 0
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// k8sStatusVersion is the schema_version of the -k8s-status document. Fields
+// are only ever added to it; one changing or going away bumps the version.
+const k8sStatusVersion = 1
+
+// serviceAccountDir is where Kubernetes mounts the token of a pod.
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// k8sStatus is the -k8s-status document, the health of every target for
+// operators and controllers to read without a metrics stack.
+type k8sStatus struct {
+	SchemaVersion int               `json:"schema_version"`
+	Instance      string            `json:"instance"`
+	Updated       time.Time         `json:"updated"`
+	Targets       []*k8sTargetState `json:"targets"`
+}
+
+// k8sTargetState is a target in the -k8s-status document. State is "up" or
+// "down", as -state-file has it, or "unknown" before the first verdict.
+type k8sTargetState struct {
+	Name     string     `json:"name"`
+	Group    string     `json:"group,omitempty"`
+	State    string     `json:"state"`
+	Since    *time.Time `json:"since,omitempty"`
+	LastSeen *time.Time `json:"last_seen,omitempty"`
+	// the latest interval summary
+	LossPct *float64 `json:"loss_pct,omitempty"`
+	AvgMs   *float64 `json:"avg_ms,omitempty"`
+	Score   *float64 `json:"score,omitempty"`
+}
+
+// k8sStatusSink keeps the -k8s-status document, writing it at most every
+// so often: to a file, replaced in one go, or to the status.json key of a
+// ConfigMap with configmap:[NAMESPACE/]NAME.
+type k8sStatusSink struct {
+	health  *healthTracker
+	every   time.Duration
+	doc     k8sStatus
+	targets map[string]*k8sTargetState
+	written time.Time
+
+	file string
+	cm   *k8sConfigMap
+}
+
+func newK8sStatusSink(dest string, every time.Duration, slowMs float64) (*k8sStatusSink, error) {
+	host, _ := os.Hostname()
+	s := &k8sStatusSink{health: newHealthTracker(slowMs), every: every, targets: make(map[string]*k8sTargetState),
+		doc: k8sStatus{SchemaVersion: k8sStatusVersion, Instance: host}}
+	if name, ok := strings.CutPrefix(dest, "configmap:"); ok {
+		cm, err := newK8sConfigMap(name)
+		if err != nil {
+			return nil, err
+		}
+		s.cm = cm
+		return s, nil
+	}
+	s.file = dest
+	return s, nil
+}
+
+func (s *k8sStatusSink) unsampled() {}
+
+func (s *k8sStatusSink) target(name, group string) *k8sTargetState {
+	t := s.targets[name]
+	if t == nil {
+		t = &k8sTargetState{Name: name, Group: group, State: "unknown"}
+		s.targets[name] = t
+	}
+	return t
+}
+
+func (s *k8sStatusSink) HandleResult(r *Result) error {
+	t := s.target(r.Target, r.Group)
+	if r.Status == resultOK {
+		at := r.Time
+		t.LastSeen = &at
+	}
+	s.update(t, s.health.result(r), r.Time)
+	return s.maybeWrite(r.Time)
+}
+
+func (s *k8sStatusSink) HandleInterval(st *IntervalStats) error {
+	t := s.target(st.Target, st.Group)
+	loss, avg, score := st.LossPct, st.AvgMs, st.Score
+	t.LossPct, t.AvgMs, t.Score = &loss, &avg, &score
+	if st.Count == 0 {
+		t.AvgMs, t.Score = nil, nil
+	}
+	s.update(t, s.health.interval(st), st.Time)
+	return s.maybeWrite(st.Time)
+}
+
+func (s *k8sStatusSink) HandleEvent(e *Event) error {
+	if e.Type == eventExpired && e.Target != "" {
+		delete(s.targets, e.Target)
+	}
+	return nil
+}
+
+func (s *k8sStatusSink) Flush() error {
+	return s.write(time.Now())
+}
+
+func (s *k8sStatusSink) update(t *k8sTargetState, state string, now time.Time) {
+	if state == "" {
+		return
+	}
+	s.health.set(t.Name, state)
+	t.State, t.Since = state, &now
+	// a state change is worth writing at once
+	s.written = time.Time{}
+}
+
+func (s *k8sStatusSink) maybeWrite(now time.Time) error {
+	if now.Sub(s.written) < s.every {
+		return nil
+	}
+	return s.write(now)
+}
+
+func (s *k8sStatusSink) write(now time.Time) error {
+	s.written = now
+	s.doc.Updated = now
+	s.doc.Targets = s.doc.Targets[:0]
+	for _, t := range s.targets {
+		s.doc.Targets = append(s.doc.Targets, t)
+	}
+	sort.Slice(s.doc.Targets, func(i, j int) bool { return s.doc.Targets[i].Name < s.doc.Targets[j].Name })
+	b, err := json.MarshalIndent(&s.doc, "", "  ")
+	if err != nil {
+		return err
+	}
+	if s.cm != nil {
+		return s.cm.patch("status.json", string(b)+"\n")
+	}
+	return writeFileAtomic(s.file, append(b, '\n'), 0o644)
+}
+
+// writeFileAtomic replaces path with b in one go, a reader never sees it
+// half written.
+func writeFileAtomic(path string, b []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".keeping-status-*")
+	if err != nil {
+		return err
+	}
+	_ = tmp.Chmod(perm)
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// k8sConfigMap is a ConfigMap of the cluster keeping runs in, written with
+// the service account of its pod, which needs to create and patch it.
+type k8sConfigMap struct {
+	url, namespace, name string
+	token                string
+	client               *http.Client
+}
+
+// newK8sConfigMap finds the API server and credentials of the pod for the
+// ConfigMap [NAMESPACE/]NAME, the namespace by default the pod's own.
+func newK8sConfigMap(spec string) (*k8sConfigMap, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("-k8s-status configmap: not running in Kubernetes, KUBERNETES_SERVICE_HOST is not set")
+	}
+	ns, name, ok := strings.Cut(spec, "/")
+	if !ok {
+		b, err := os.ReadFile(filepath.Join(serviceAccountDir, "namespace"))
+		if err != nil {
+			return nil, err
+		}
+		ns, name = strings.TrimSpace(string(b)), spec
+	}
+	if ns == "" || name == "" {
+		return nil, fmt.Errorf("invalid -k8s-status configmap:%s, want configmap:[NAMESPACE/]NAME", spec)
+	}
+	token, err := os.ReadFile(filepath.Join(serviceAccountDir, "token"))
+	if err != nil {
+		return nil, err
+	}
+	pem, err := os.ReadFile(filepath.Join(serviceAccountDir, "ca.crt"))
+	if err != nil {
+		return nil, err
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no certificate in " + filepath.Join(serviceAccountDir, "ca.crt"))
+	}
+	return &k8sConfigMap{
+		url:       "https://" + net.JoinHostPort(host, port),
+		namespace: ns,
+		name:      name,
+		token:     strings.TrimSpace(string(token)),
+		client: &http.Client{Timeout: 10 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}},
+	}, nil
+}
+
+// patch sets key of the ConfigMap to value, creating the ConfigMap when
+// there is none yet.
+func (c *k8sConfigMap) patch(key, value string) error {
+	path := "/api/v1/namespaces/" + c.namespace + "/configmaps"
+	body, _ := json.Marshal(map[string]any{"data": map[string]string{key: value}})
+	status, err := c.do("PATCH", path+"/"+c.name, "application/merge-patch+json", body)
+	if err != nil || status != http.StatusNotFound {
+		return err
+	}
+	body, _ = json.Marshal(map[string]any{
+		"apiVersion": "v1", "kind": "ConfigMap",
+		"metadata": map[string]string{"name": c.name, "namespace": c.namespace},
+		"data":     map[string]string{key: value},
+	})
+	if status, err = c.do("POST", path, "application/json", body); err == nil && status == http.StatusNotFound {
+		err = fmt.Errorf("no namespace %s", c.namespace)
+	}
+	return err
+}
+
+// do sends a request to the API server, failing on any status but 2xx and,
+// returned without an error, 404.
+func (c *k8sConfigMap) do(method, path, contentType string, body []byte) (int, error) {
+	req, err := http.NewRequest(method, c.url+path, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	req.Header.Set("Content-Type", contentType)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if resp.StatusCode/100 == 2 || resp.StatusCode == http.StatusNotFound {
+		return resp.StatusCode, nil
+	}
+	return resp.StatusCode, fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, bytes.TrimSpace(msg))
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+var errLinkChangesUnsupported = errors.New("link change notifications are not supported on this platform")
+
+// localLinkPoll is how often links are rechecked without a change
+// notification.
+const localLinkPoll = 30 * time.Second
+
+// egressLink returns the interface this host would send to ip through. A
+// connected UDP socket makes the kernel pick the route without sending
+// anything.
+func egressLink(ip *net.IPAddr) (*net.Interface, error) {
+	c, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: ip.IP, Zone: ip.Zone, Port: 9})
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	local := c.LocalAddr().(*net.UDPAddr).IP
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	for i := range ifaces {
+		addrs, _ := ifaces[i].Addrs()
+		for _, a := range addrs {
+			if n, ok := a.(*net.IPNet); ok && n.IP.Equal(local) {
+				return &ifaces[i], nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("no interface has address %s", local)
+}
+
+// localDown tells why ip can't be reached from this host, or "" if the link
+// towards it is up.
+func localDown(ip *net.IPAddr) string {
+	ifi, err := egressLink(ip)
+	switch {
+	case err != nil:
+		return err.Error()
+	case ifi.Flags&net.FlagUp == 0:
+		return ifi.Name + " is down"
+	case ifi.Flags&net.FlagRunning == 0:
+		return ifi.Name + " has no carrier"
+	}
+	return ""
+}
+
+// watchLocalLinks marks targets whose way out of this host is down, so that
+// their losses can be told apart from the network's. With ignore the
+// targets are paused for the duration and the probes they had in flight are
+// left out of the loss.
+func (m *monitor) watchLocalLinks(ignore bool, stop <-chan struct{}) {
+	changes, err := linkChanges(stop)
+	if err != nil && err != errLinkChangesUnsupported {
+		fmt.Println("WARN: link changes:", err)
+	}
+	poll := time.NewTicker(localLinkPoll)
+	defer poll.Stop()
+	downSince := make(map[string]time.Time)
+	pausedByUs := make(map[string]bool)
+	for {
+		for _, t := range m.list("") {
+			ip := t.pinger.IPAddr()
+			if ip == nil {
+				continue
+			}
+			why := localDown(ip)
+			since, down := downSince[t.host]
+			switch {
+			case why != "" && !down:
+				downSince[t.host] = time.Now()
+				t.setLocalDown(true)
+				msg := fmt.Sprintf("local link towards %s is down: %s", t.host, why)
+				fmt.Println("WARN:", msg)
+				m.event(eventLinkDown, t.host, msg)
+				if paused, _ := t.pinger.Paused(); ignore && !paused {
+					if t.pinger.Pause() == nil {
+						pausedByUs[t.host] = true
+						_ = t.pinger.Excuse()
+					}
+				}
+			case why == "" && down:
+				delete(downSince, t.host)
+				t.setLocalDown(false)
+				msg := fmt.Sprintf("local link towards %s is up again after %v", t.host, time.Since(since).Round(time.Second))
+				fmt.Println(msg)
+				m.event(eventLinkUp, t.host, msg)
+				if pausedByUs[t.host] {
+					delete(pausedByUs, t.host)
+					_ = t.pinger.Resume()
+				}
+			}
+		}
+		select {
+		case _, ok := <-changes:
+			if !ok {
+				changes = nil
+			}
+			// let a burst of changes, say link and then addresses, settle
+			time.Sleep(100 * time.Millisecond)
+		case <-poll.C:
+		case <-stop:
+			return
+		}
+	}
+}
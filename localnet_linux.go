@@ -0,0 +1,63 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// rtnetlink multicast groups, from linux/rtnetlink.h
+const (
+	rtmgrpLink       = 0x1
+	rtmgrpIPv4Ifaddr = 0x10
+	rtmgrpIPv4Route  = 0x40
+	rtmgrpIPv6Ifaddr = 0x100
+	rtmgrpIPv6Route  = 0x400
+)
+
+// linkChanges signals every interface, address or route change the kernel
+// reports over rtnetlink. The messages themselves are not decoded, the state
+// is reread through the net package on each signal.
+func linkChanges(stop <-chan struct{}) (<-chan struct{}, error) {
+	s, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	sa := &syscall.SockaddrNetlink{
+		Family: syscall.AF_NETLINK,
+		Groups: rtmgrpLink | rtmgrpIPv4Ifaddr | rtmgrpIPv4Route | rtmgrpIPv6Ifaddr | rtmgrpIPv6Route,
+	}
+	if err := syscall.Bind(s, sa); err != nil {
+		syscall.Close(s)
+		return nil, os.NewSyscallError("bind", err)
+	}
+	// non-blocking, so reads go through the runtime poller and closing the
+	// file ends them
+	if err := syscall.SetNonblock(s, true); err != nil {
+		syscall.Close(s)
+		return nil, os.NewSyscallError("setnonblock", err)
+	}
+	f := os.NewFile(uintptr(s), "rtnetlink")
+	ch := make(chan struct{}, 1)
+	go func() {
+		<-stop
+		f.Close()
+	}()
+	go func() {
+		defer close(ch)
+		buf := make([]byte, 1<<16)
+		for {
+			// ENOBUFS means messages were dropped, which is still a change
+			if _, err := f.Read(buf); err != nil && !errors.Is(err, syscall.ENOBUFS) {
+				return
+			}
+			select {
+			case ch <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return ch, nil
+}
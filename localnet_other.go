@@ -0,0 +1,8 @@
+//go:build !linux
+
+package main
+
+// linkChanges is only implemented on Linux, elsewhere the links are polled.
+func linkChanges(stop <-chan struct{}) (<-chan struct{}, error) {
+	return nil, errLinkChangesUnsupported
+}
@@ -0,0 +1,15 @@
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// instanceLocking tells whether instances can register, see registerInstance.
+const instanceLocking = false
+
+func lockFile(f *os.File, wait bool) error {
+	return errors.New("file locks are not supported")
+}
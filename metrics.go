@@ -0,0 +1,248 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultMetricBuckets are the upper bounds of the RTT histogram buckets
+// unless -metric-buckets says otherwise.
+const defaultMetricBuckets = "1ms,2ms,5ms,10ms,20ms,50ms,100ms,200ms,500ms,1s,2s,5s"
+
+// metricQuantiles are the quantiles of the RTT summary, of the replies of
+// the last quantileWindow.
+var metricQuantiles = []float64{0.5, 0.9, 0.95, 0.99}
+
+const quantileWindow = 10 * time.Minute
+
+// parseMetricBuckets parses -metric-buckets, increasing durations separated
+// by commas.
+func parseMetricBuckets(s string) ([]time.Duration, error) {
+	var bounds []time.Duration
+	for _, f := range strings.Split(s, ",") {
+		d, err := time.ParseDuration(strings.TrimSpace(f))
+		if err != nil || d <= 0 || len(bounds) > 0 && d <= bounds[len(bounds)-1] {
+			return nil, fmt.Errorf("invalid -metric-buckets %q, want increasing durations separated by commas", s)
+		}
+		bounds = append(bounds, d)
+	}
+	return bounds, nil
+}
+
+// rttHistogram counts the RTTs of a target by bucket, the last one
+// unbounded, t.mu held.
+type rttHistogram struct {
+	bounds []time.Duration
+	counts []uint64
+	sum    time.Duration
+}
+
+func newRTTHistogram(bounds []time.Duration) *rttHistogram {
+	return &rttHistogram{bounds: bounds, counts: make([]uint64, len(bounds)+1)}
+}
+
+func (h *rttHistogram) observe(rtt time.Duration) {
+	h.counts[sort.Search(len(h.bounds), func(i int) bool { return rtt <= h.bounds[i] })]++
+	h.sum += rtt
+}
+
+// writeHistogram writes the buckets, sum and count of h, a copy taken under
+// the lock of its target.
+func (mw *metricsWriter) writeHistogram(name string, h *rttHistogram, labels ...string) {
+	var n uint64
+	for i, c := range h.counts {
+		n += c
+		le := "+Inf"
+		if i < len(h.bounds) {
+			le = strconv.FormatFloat(h.bounds[i].Seconds(), 'g', -1, 64)
+		}
+		mw.sample(name+"_bucket", float64(n), append(labels, "le", le)...)
+	}
+	mw.sample(name+"_sum", h.sum.Seconds(), labels...)
+	mw.sample(name+"_count", float64(n), labels...)
+}
+
+// writeSummary writes the metricQuantiles of the RTTs, in seconds, with
+// their sum and count; a quantile of none is NaN.
+func (mw *metricsWriter) writeSummary(name string, rtts []float64, labels ...string) {
+	sort.Float64s(rtts)
+	var sum float64
+	for _, v := range rtts {
+		sum += v
+	}
+	for _, q := range metricQuantiles {
+		v := math.NaN()
+		if len(rtts) > 0 {
+			v = rtts[int(math.Ceil(q*float64(len(rtts))))-1]
+		}
+		mw.sample(name, v, append(labels, "quantile", strconv.FormatFloat(q, 'g', -1, 64))...)
+	}
+	mw.sample(name+"_sum", sum, labels...)
+	mw.sample(name+"_count", float64(len(rtts)), labels...)
+}
+
+// metricsWriter writes the Prometheus text exposition format. The samples of
+// a metric have to be written one after the other.
+type metricsWriter struct {
+	w    io.Writer
+	seen map[string]bool
+}
+
+func newMetricsWriter(w io.Writer) *metricsWriter {
+	return &metricsWriter{w: w, seen: make(map[string]bool)}
+}
+
+// header declares name, once however often it is called.
+func (mw *metricsWriter) header(name, typ, help string) {
+	if mw.seen[name] {
+		return
+	}
+	mw.seen[name] = true
+	fmt.Fprintf(mw.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// sample writes one value of name, labels alternating names and values.
+func (mw *metricsWriter) sample(name string, v float64, labels ...string) {
+	var b strings.Builder
+	b.WriteString(name)
+	if len(labels) > 0 {
+		b.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			fmt.Fprintf(&b, "%s=\"%s\"", labels[i], escapeLabel(labels[i+1]))
+		}
+		b.WriteByte('}')
+	}
+	fmt.Fprintf(mw.w, "%s %s\n", b.String(), strconv.FormatFloat(v, 'g', -1, 64))
+}
+
+// gauge and counter write a metric with a single sample.
+func (mw *metricsWriter) gauge(name, help string, v float64, labels ...string) {
+	mw.header(name, "gauge", help)
+	mw.sample(name, v, labels...)
+}
+
+func (mw *metricsWriter) counter(name, help string, v float64, labels ...string) {
+	mw.header(name, "counter", help)
+	mw.sample(name, v, labels...)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+// writeMetrics exposes the counters of every target, of the sinks and of the
+// process itself.
+func (m *monitor) writeMetrics(mw *metricsWriter) {
+	ts := m.list("")
+	stats := make([]*Statistics, len(ts))
+	for i, t := range ts {
+		stats[i] = t.pinger.Statistics()
+	}
+	for _, f := range []struct {
+		name, typ, help string
+		value           func(*Statistics) float64
+	}{
+		{"keeping_probes_sent_total", "counter", "Probes sent.", func(s *Statistics) float64 { return float64(s.PacketsSent) }},
+		{"keeping_replies_total", "counter", "Replies received.", func(s *Statistics) float64 { return float64(s.PacketsRecv) }},
+		{"keeping_probes_timed_out_total", "counter", "Probes whose reply did not arrive in time.", func(s *Statistics) float64 { return float64(s.PacketsTimedOut) }},
+		{"keeping_replies_duplicate_total", "counter", "Duplicate replies.", func(s *Statistics) float64 { return float64(s.PacketsRecvDuplicates) }},
+		{"keeping_replies_discarded_total", "counter", "Replies discarded for an implausible RTT.", func(s *Statistics) float64 { return float64(s.PacketsDiscarded) }},
+		{"keeping_replies_mangled_total", "counter", "Replies whose payload came back truncated, oversized or corrupted.", func(s *Statistics) float64 {
+			return float64(s.PacketsTruncated + s.PacketsOversized + s.PacketsCorrupted)
+		}},
+		{"keeping_replies_late_total", "counter", "Replies that came after the reply timeout, their probe counted lost.", func(s *Statistics) float64 { return float64(s.PacketsLate) }},
+		{"keeping_replies_reordered_total", "counter", "Replies that came after the reply to a later probe.", func(s *Statistics) float64 { return float64(s.PacketsReordered) }},
+		{"keeping_rtt_avg_seconds", "gauge", "Average RTT since start.", func(s *Statistics) float64 { return s.AvgRtt.Seconds() }},
+	} {
+		mw.header(f.name, f.typ, f.help)
+		for i, t := range ts {
+			mw.sample(f.name, f.value(stats[i]), "target", t.host, "group", t.group)
+		}
+	}
+	mw.header("keeping_quality_score", "gauge", "Quality score of the last interval, 0 to 100, see -score-weights.")
+	for _, t := range ts {
+		t.mu.Lock()
+		score := t.score
+		t.mu.Unlock()
+		if score >= 0 {
+			mw.sample("keeping_quality_score", score, "target", t.host, "group", t.group)
+		}
+	}
+	mw.header("keeping_rtt_seconds", "histogram", "RTT of the replies since start, in the buckets of -metric-buckets.")
+	for _, t := range ts {
+		t.mu.Lock()
+		h := *t.rtts
+		h.counts = append([]uint64(nil), h.counts...)
+		t.mu.Unlock()
+		mw.writeHistogram("keeping_rtt_seconds", &h, "target", t.host, "group", t.group)
+	}
+	mw.header("keeping_rtt_quantile_seconds", "summary", "RTT quantiles of the replies of the last 10 minutes.")
+	from := time.Now().Add(-quantileWindow)
+	for _, t := range ts {
+		var rtts []float64
+		for _, s := range m.history.Samples(t.host) {
+			if !s.Lost && !s.At.Before(from) {
+				rtts = append(rtts, s.Rtt.Seconds())
+			}
+		}
+		mw.writeSummary("keeping_rtt_quantile_seconds", rtts, "target", t.host, "group", t.group)
+	}
+	if m.geo != nil {
+		mw.header("keeping_target_info", "gauge", "The AS, country and reverse DNS of the address of the target, from -geoip.")
+		for _, t := range ts {
+			if g := t.geo; g != nil {
+				asn := ""
+				if g.ASN != 0 {
+					asn = strconv.FormatUint(g.ASN, 10)
+				}
+				mw.sample("keeping_target_info", 1, "target", t.host, "group", t.group, "asn", asn,
+					"org", g.Org, "country", g.Country, "rdns", g.RDNS)
+			}
+		}
+	}
+	mw.header("keeping_probe_failures_total", "counter", "Failed probes by kind of failure, lookups failing before a target starts included.")
+	m.mu.Lock()
+	early := make(map[string]int, len(m.resolveFailures))
+	for host, n := range m.resolveFailures {
+		early[host] = n
+	}
+	m.mu.Unlock()
+	writeFailures := func(host, group string, fs map[string]int) {
+		kinds := make([]string, 0, len(fs))
+		for kind := range fs {
+			kinds = append(kinds, kind)
+		}
+		sort.Strings(kinds)
+		for _, kind := range kinds {
+			mw.sample("keeping_probe_failures_total", float64(fs[kind]), "target", host, "group", group, "kind", kind)
+		}
+	}
+	for i, t := range ts {
+		fs := stats[i].Failures
+		if n, ok := early[t.host]; ok {
+			fs[failResolve] += n
+			delete(early, t.host)
+		}
+		writeFailures(t.host, t.group, fs)
+	}
+	hosts := make([]string, 0, len(early))
+	for host := range early {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	for _, host := range hosts {
+		writeFailures(host, host, map[string]int{failResolve: early[host]})
+	}
+	m.out.writeMetrics(mw)
+	m.writeSelfMetrics(mw)
+}
@@ -0,0 +1,1287 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// probeSettings are the options every target of a run is probed with.
+type probeSettings struct {
+	Interval          time.Duration
+	Jitter            float64
+	Verbose           bool
+	Timeout           time.Duration
+	ReplyTimeout      time.Duration
+	StatisticInterval time.Duration
+	MaxSaneRtt        time.Duration
+	Count             int
+	Preload           int
+	Size              int
+	Sizes             []int
+	Padding           *randomPadding
+	Body              []byte
+	TTL               int
+	HopLimit          int
+	FlowLabel         int
+	Privileged        bool
+	Timestamping      string
+	// AllIPs probes every address a name resolves to as its own target.
+	AllIPs bool
+	// Methods are the probe methods hosts fall back through, unless the
+	// target lists its own.
+	Methods []string
+	// Proxy is the proxy TCP and HTTP probes go through.
+	Proxy string
+	// Mark and Device steer the probes to a routing table or an interface.
+	Mark   int
+	Device string
+	// Sample keeps the console lines and the results of one probe in
+	// Sample, the statistics still count every probe.
+	Sample int
+	// TTLSweep, when above 0, traces the path to every target up to that
+	// many hops before probing it.
+	TTLSweep int
+	// Profiles and Sources probe every target once for each, see
+	// -profiles and -sources.
+	Profiles []probeProfile
+	Sources  []probeSource
+	// Faults are injected into the replies of every target, see -inject.
+	Faults *faults
+	// POPEvery, when above 0, is how often the anycast POP serving every
+	// target is identified, by DNS.
+	POPEvery time.Duration
+	// MTUCheck looks for a path MTU blackhole towards the tcp:PORT
+	// targets as they start, see checkMTU
+	MTUCheck bool
+	// MaxBandwidth refuses targets and intervals which would take more, in
+	// bits per second both ways, zero for no limit.
+	MaxBandwidth float64
+	// Coalesce probes targets resolving to a target's address as that
+	// target, instead of warning about them.
+	Coalesce bool
+	// MetricBuckets are the upper bounds of the RTT histogram of /metrics.
+	MetricBuckets []time.Duration
+	// ScoreWeights weigh the components of the quality score of the
+	// intervals.
+	ScoreWeights scoreWeights
+}
+
+// target is one probed host together with its interval counter.
+type target struct {
+	// host names the target, for --all-ips it is "name@address"
+	host string
+	// group is the name the target was configured as, shared by all
+	// addresses of an --all-ips target
+	group   string
+	pinger  *Pinger
+	counter *Counter
+	// phases breaks the interval down for HTTP targets
+	phases phaseCounter
+	// sweep gathers the RTTs by payload size of a -size-sweep, padding
+	// those by size class and pattern of -random-padding
+	sweep   *sizeSweep
+	padding *paddingStats
+	// path is the route found by -ttl-sweep at the start
+	path []Hop
+	// geo is what -geoip knows of the address
+	geo *Geo
+	// mtu is the outcome of -mtu-check
+	mtu *MTUCheck
+	// source and profile are the ones of the -sources and -profiles the
+	// target probes with
+	source  *probeSource
+	profile *probeProfile
+	// pop is the anycast POP last seen serving the target, pops all of
+	// them in order, see -pop
+	pop  string
+	pops []string
+	// proxySum and proxyN average the proxy connect time of the interval
+	proxySum time.Duration
+	proxyN   int64
+	// directional is the loss each way at the start of the interval
+	directional DirectionalLoss
+	// rtts counts the RTTs of the replies for the metrics
+	rtts *rttHistogram
+	// intervalRtts are the RTTs of the interval in the order they came, for
+	// its quality score; score is that of the last interval, -1 before one
+	intervalRtts []time.Duration
+	score        float64
+	// throughput is the Mbit/s of the -speedtest sample that ended in the
+	// interval, 0 when none did
+	throughput float64
+	// router are the -snmp counters at the start of the interval
+	router RouterCounters
+	// lost counts the probes lost since the last reply
+	lost int
+	// intervalLost counts the probes lost in the current statistics
+	// interval
+	intervalLost int
+	// intervalLate and lateSum are the late replies of the interval and
+	// the sum of their RTTs
+	intervalLate int
+	lateSum      time.Duration
+	// intervalReordered counts the replies of the interval out of order
+	intervalReordered int
+	// sends, gapSum and gapMax measure the sends of the interval begun at
+	// intervalStart, lastSend is the latest send and sendInterval the
+	// interval it was sent at; slowGaps counts the gaps beyond twice the
+	// interval, which ctl set-interval may have changed in between
+	sends         int
+	gapSum        time.Duration
+	gapMax        time.Duration
+	sendLagMax    time.Duration
+	slowGaps      int
+	lastSend      time.Time
+	sendInterval  time.Duration
+	intervalStart time.Time
+	// localDown is set while the link towards the target is down here
+	localDown bool
+	// ttl is the TTL of the latest reply
+	ttl int
+	// aliases are the targets coalesced into this one, m.mu held
+	aliases []string
+	// probe identifies what is probed, see probeKey
+	probe string
+	mu    sync.Mutex
+	done  chan struct{}
+	// segment ends the current statistics interval early, at a suspend
+	segment chan struct{}
+	// expires is when an ephemeral target is removed, zero for none;
+	// expired is set once it was, t.mu held
+	expires time.Time
+	expired bool
+}
+
+// monitor runs the targets of an instance; targets can be added and removed
+// while it runs.
+type monitor struct {
+	settings probeSettings
+
+	mu      sync.Mutex
+	targets map[string]*target
+	// probes are the running targets by probeKey, to spot two probing the
+	// same thing
+	probes map[string]*target
+	// groups keeps the targets of multi-address names, also once finished,
+	// for the comparison summary
+	groups map[string][]*target
+	// profiled and sourced keep the targets of -profiles and -sources by
+	// the name they probe
+	profiled map[string][]*target
+	sourced  map[string][]*target
+	wg       sync.WaitGroup
+	// out feeds the records of the run to the sinks
+	out      dispatcher
+	history  *history
+	baseline *baseline
+	// summaries are the final statistics of the finished targets
+	summaries []*Summary
+	// table, when set, prints the probes as its rows
+	table *table
+	// sched ticks the sends of all targets
+	sched *scheduler
+	// resolveFailures counts the failed lookups of the targets not
+	// started yet, by target
+	resolveFailures map[string]int
+	// geo, when set, labels the targets with the AS and country of their
+	// address
+	geo *geoIP
+	// pcap, when set, captures the packets of the targets, see -pcap
+	pcap *capture
+	// snmp, when set, polls the router counters of -snmp
+	snmp *snmpPoller
+}
+
+func newMonitor(settings probeSettings) *monitor {
+	m := &monitor{
+		settings: settings,
+		targets:  make(map[string]*target),
+		probes:   make(map[string]*target),
+		groups:   make(map[string][]*target),
+		profiled: make(map[string][]*target),
+		sourced:  make(map[string][]*target),
+		history:  newHistory(historyKeep),
+		baseline: newBaseline(),
+		sched:    newScheduler(runtime.GOMAXPROCS(0)),
+	}
+	m.out.Add("history", m.history)
+	return m
+}
+
+var errUnknownTarget = errors.New("unknown target")
+
+// Add resolves host and starts probing it. With AllIPs every address of host
+// is started as a target of its own. A failing resolution is retried for up
+// to wait, as happens at boot before the network is up. A ttl above 0 makes
+// the targets ephemeral, removed once it has passed.
+func (m *monitor) Add(host string, wait, ttl time.Duration) error {
+	p, err := New(host)
+	if err != nil {
+		return err
+	}
+	// host=methods targets go by the host
+	spec, host := host, p.Addr()
+	if !m.settings.AllIPs {
+		if err := m.resolve(host, wait, p.Resolve); err != nil {
+			return err
+		}
+		return m.addSources(host, host, spec, p, ttl)
+	}
+	var ips []net.IP
+	err = m.resolve(host, wait, func() (err error) {
+		ips, err = resolver.LookupIP(p.Host())
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	for _, ip := range ips {
+		name := host
+		if len(ips) > 1 {
+			name = host + "@" + ip.String()
+		}
+		p, _ := New(spec)
+		p.SetIPAddr(&net.IPAddr{IP: ip})
+		if err := m.addSources(name, host, spec, p, ttl); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resolve runs lookup, retrying it with backoff until wait has passed.
+func (m *monitor) resolve(host string, wait time.Duration, lookup func() error) error {
+	err := lookup()
+	deadline := time.Now().Add(wait)
+	for backoff := time.Second; err != nil; backoff *= 2 {
+		left := time.Until(deadline)
+		if left <= 0 {
+			return err
+		}
+		if backoff > 30*time.Second {
+			backoff = 30 * time.Second
+		}
+		if backoff > left {
+			backoff = left
+		}
+		m.mu.Lock()
+		if m.resolveFailures == nil {
+			m.resolveFailures = make(map[string]int)
+		}
+		m.resolveFailures[host]++
+		m.mu.Unlock()
+		msg := fmt.Sprintf("waiting for resolution of %s: %v, retrying in %v", host, err, backoff.Round(time.Millisecond))
+		fmt.Println("WARN:", msg)
+		m.event(eventResolving, host, msg)
+		time.Sleep(backoff)
+		err = lookup()
+	}
+	return nil
+}
+
+func (m *monitor) add(name, host string, pinger *Pinger, src *probeSource, pr *probeProfile, ttl time.Duration) error {
+	var path []Hop
+	if m.settings.TTLSweep > 0 && pinger.IPAddr() != nil {
+		var err error
+		if path, err = sweepTTL(pinger.IPAddr(), m.settings, m.settings.TTLSweep); err != nil {
+			fmt.Println("WARN: ttl sweep of", name+":", err)
+		} else {
+			fmt.Print(formatPath(name, pinger.IPAddr(), path))
+		}
+	}
+	var geo *Geo
+	if m.geo != nil && pinger.IPAddr() != nil {
+		if geo = m.geo.lookup(pinger.IPAddr().IP); geo.String() != "" {
+			fmt.Printf("%s (%s): %s\n", name, pinger.IPAddr(), geo)
+		}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.targets[name]; ok {
+		return fmt.Errorf("%s is already probed", name)
+	}
+	key := probeKey(pinger)
+	if src != nil {
+		key += " from " + src.name
+	}
+	if pr != nil {
+		key += " " + pr.name
+	}
+	if other, ok := m.probes[key]; ok {
+		if m.settings.Coalesce {
+			other.aliases = append(other.aliases, name)
+			m.targets[name] = other
+			fmt.Printf(tr("%s resolves to %s like %s, probing them as one\n"), name, pinger.IPAddr(), other.host)
+			return nil
+		}
+		msg := fmt.Sprintf("%s resolves to %s like %s, probing it twice (-coalesce to probe them as one)", name, pinger.IPAddr(), other.host)
+		fmt.Println("WARN:", msg)
+		m.event(eventDuplicateAddr, name, msg)
+	}
+	t := &target{host: name, group: host, pinger: pinger, counter: &Counter{},
+		done: make(chan struct{}), segment: make(chan struct{}, 1), probe: key, path: path, geo: geo, source: src, profile: pr,
+		rtts: newRTTHistogram(m.settings.MetricBuckets), score: -1}
+	if m.snmp != nil {
+		t.router = m.snmp.totals()
+	}
+	if ttl > 0 {
+		t.expires = time.Now().Add(ttl)
+	}
+	m.setup(t)
+	if err := m.checkBandwidth(pinger.bandwidth(), nil); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	if err := pinger.Open(); err != nil {
+		return err
+	}
+	if m.pcap != nil && pinger.IPAddr() != nil {
+		if err := m.pcap.Watch(pinger.IPAddr().IP); err != nil {
+			fmt.Println("WARN:", err)
+		}
+	}
+	m.targets[name] = t
+	if _, ok := m.probes[key]; !ok {
+		m.probes[key] = t
+	}
+	if src != nil {
+		base := strings.Replace(name, "%"+src.name, "", 1)
+		m.sourced[base] = append(m.sourced[base], t)
+	}
+	if pr != nil {
+		base := strings.TrimSuffix(name, "#"+pr.name)
+		m.profiled[base] = append(m.profiled[base], t)
+	} else if name != host && src == nil {
+		m.groups[host] = append(m.groups[host], t)
+	}
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		m.run(t)
+		m.mu.Lock()
+		delete(m.targets, name)
+		for _, a := range t.aliases {
+			delete(m.targets, a)
+		}
+		if m.probes[key] == t {
+			delete(m.probes, key)
+		}
+		m.mu.Unlock()
+	}()
+	return nil
+}
+
+// probeKey tells targets apart by what goes on the wire: the address, the
+// probe methods and, for HTTP, the URL.
+func probeKey(p *Pinger) string {
+	key := p.IPAddr().String() + " " + strings.Join(p.Methods(), ",")
+	if p.url != nil {
+		key += " " + p.url.String()
+	}
+	return key
+}
+
+// label names t with its aliases, for the final statistics; m.mu held.
+func (t *target) label() string {
+	if len(t.aliases) == 0 {
+		return t.host
+	}
+	return t.host + " (also " + strings.Join(t.aliases, ", ") + ")"
+}
+
+// Remove stops probing host, its final statistics are printed as usual. A
+// target coalesced into another is just dropped from its aliases.
+func (m *monitor) Remove(host string) error {
+	t, err := m.get(host)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	if t.host != host {
+		delete(m.targets, host)
+		for i, a := range t.aliases {
+			if a == host {
+				t.aliases = append(t.aliases[:i], t.aliases[i+1:]...)
+				break
+			}
+		}
+		m.mu.Unlock()
+		return nil
+	}
+	m.mu.Unlock()
+	t.pinger.Stop()
+	<-t.done
+	return nil
+}
+
+// Stop stops every target.
+func (m *monitor) Stop() {
+	for _, t := range m.list("") {
+		t.pinger.Stop()
+	}
+}
+
+// Wait blocks until every target has finished.
+func (m *monitor) Wait() {
+	m.wg.Wait()
+}
+
+func (m *monitor) get(host string) (*target, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.targets[host]
+	if !ok {
+		return nil, fmt.Errorf("%w %s", errUnknownTarget, host)
+	}
+	return t, nil
+}
+
+// list returns the target named host, or all targets sorted by name when
+// host is empty.
+func (m *monitor) list(host string) []*target {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if host != "" {
+		if t, ok := m.targets[host]; ok {
+			return []*target{t}
+		}
+		return nil
+	}
+	ts := make([]*target, 0, len(m.targets))
+	for name, t := range m.targets {
+		if name == t.host {
+			// once, not under its aliases too
+			ts = append(ts, t)
+		}
+	}
+	sort.Slice(ts, func(i, j int) bool { return ts[i].host < ts[j].host })
+	return ts
+}
+
+func (m *monitor) setup(t *target) {
+	pinger := t.pinger
+	if len(m.settings.Sizes) > 0 {
+		t.sweep = newSizeSweep(m.settings.Sizes)
+	}
+	if m.settings.Padding != nil {
+		t.padding = newPaddingStats(m.settings.Padding)
+	}
+	t.intervalStart = time.Now()
+	pinger.OnSend = func(pkt *Packet) {
+		t.sent(pkt)
+		if t.sweep != nil {
+			t.sweep.send(pkt)
+		}
+		if t.padding != nil {
+			t.padding.send(pkt)
+		}
+	}
+	pinger.OnRecv = func(pkt *Packet) {
+		t.counter.UpdateSync(&t.mu, pkt.Rtt)
+		t.mu.Lock()
+		t.rtts.observe(pkt.Rtt)
+		t.intervalRtts = append(t.intervalRtts, pkt.Rtt)
+		if pkt.Reordered {
+			t.intervalReordered++
+		}
+		t.mu.Unlock()
+		if t.sweep != nil {
+			t.sweep.recv(pkt)
+		}
+		if t.padding != nil {
+			t.padding.recv(pkt)
+		}
+		t.setLost(0)
+		m.result(t, newResult(t.host, resultOK, pkt))
+		m.checkTTL(t, pkt)
+		via := ""
+		if pkt.ProxyConnect > 0 {
+			t.mu.Lock()
+			t.proxySum += pkt.ProxyConnect
+			t.proxyN++
+			t.mu.Unlock()
+			via = " proxy=" + output.Dur(pkt.ProxyConnect)
+		}
+		if pkt.Phases != nil {
+			t.mu.Lock()
+			t.phases.Update(pkt.Phases)
+			t.mu.Unlock()
+		}
+		if !sampled(pkt.Seq, m.settings.Sample) {
+			return
+		}
+		if m.table != nil {
+			m.table.row(t.host, pkt.Seq, pkt.Rtt, pkt.TTL, packetFlags(pkt)...)
+			return
+		}
+		if pkt.Phases != nil {
+			fmt.Printf("%d bytes from %s: seq=%d status=%d time=%s%s\n",
+				pkt.Nbytes, pkt.Addr, pkt.Seq, pkt.StatusCode, output.Dur(pkt.Rtt), via)
+			return
+		}
+		if strings.HasPrefix(pkt.Method, protocolTCP) {
+			fmt.Printf("%s from %s: seq=%d time=%s%s\n", pkt.Method, pkt.IPAddr, pkt.Seq, output.Dur(pkt.Rtt), via)
+			return
+		}
+		note := ""
+		if pkt.Payload != "" {
+			note = " (" + pkt.Payload + " payload)"
+		}
+		if pkt.Detail != nil {
+			note += " " + pkt.Detail.String()
+		}
+		if pkt.Reordered {
+			note += tr(" (out of order)")
+		}
+		fmt.Printf("%d bytes from %s: icmp_seq=%d time=%s %s=%v%s\n",
+			pkt.Nbytes, pkt.IPAddr, pkt.Seq, output.Dur(pkt.Rtt), ttlName(pkt), pkt.TTL, note)
+	}
+	pinger.OnDuplicateRecv = func(pkt *Packet) {
+		m.result(t, newResult(t.host, resultDuplicate, pkt))
+		if !sampled(pkt.Seq, m.settings.Sample) {
+			return
+		}
+		if m.table != nil {
+			m.table.row(t.host, pkt.Seq, pkt.Rtt, pkt.TTL, append(packetFlags(pkt), "DUP")...)
+			return
+		}
+		note := ""
+		if pkt.Detail != nil {
+			note = " " + pkt.Detail.String()
+		}
+		fmt.Printf("%d bytes from %s: icmp_seq=%d time=%s %s=%v (DUP!)%s\n",
+			pkt.Nbytes, pkt.IPAddr, pkt.Seq, output.Dur(pkt.Rtt), ttlName(pkt), pkt.TTL, note)
+	}
+	pinger.OnLateRecv = func(pkt *Packet) {
+		t.mu.Lock()
+		t.intervalLate++
+		t.lateSum += pkt.Rtt
+		t.mu.Unlock()
+		m.result(t, newResult(t.host, resultLate, pkt))
+		if !sampled(pkt.Seq, m.settings.Sample) {
+			return
+		}
+		if m.table != nil {
+			m.table.row(t.host, pkt.Seq, pkt.Rtt, pkt.TTL, append(packetFlags(pkt), "LATE")...)
+			return
+		}
+		fmt.Printf(tr("Late reply for icmp_seq=%d time=%s, after the timeout, counted lost\n"), pkt.Seq, output.Dur(pkt.Rtt))
+	}
+	pinger.OnForeignRecv = func(pkt *Packet) {
+		m.result(t, newResult(t.host, resultForeign, pkt))
+		if m.table != nil {
+			m.table.row(t.host, pkt.Seq, pkt.Rtt, pkt.TTL, append(packetFlags(pkt), "FOREIGN", "from="+pkt.From.String())...)
+			return
+		}
+		fmt.Printf("WARN: %d bytes from %s: icmp_seq=%d time=%s, reply from other address than %s\n",
+			pkt.Nbytes, pkt.From, pkt.Seq, output.Dur(pkt.Rtt), pkt.IPAddr)
+	}
+	pinger.OnTimeout = func(pkt *Packet) {
+		t.addLost()
+		r := newResult(t.host, resultTimeout, pkt)
+		r.Failure = failTimeout
+		m.result(t, r)
+		if !sampled(pkt.Seq, m.settings.Sample) {
+			return
+		}
+		if m.table != nil {
+			m.table.row(t.host, pkt.Seq, 0, 0, append(packetFlags(pkt), "TIMEOUT")...)
+			return
+		}
+		fmt.Printf(tr("Request timeout for icmp_seq=%d\n"), pkt.Seq)
+	}
+	pinger.OnSendError = func(pkt *Packet, err error) {
+		t.addLost()
+		r := newResult(t.host, resultError, pkt)
+		r.Error, r.Failure = err.Error(), failureKind(err, failOther)
+		m.result(t, r)
+		if m.table != nil {
+			m.table.row(t.host, pkt.Seq, 0, 0, append(packetFlags(pkt), "ERROR", err.Error())...)
+			return
+		}
+		fmt.Printf(tr("Probe failed for seq=%d (%s): %v\n"), pkt.Seq, r.Failure, err)
+	}
+	pinger.OnDiscard = func(pkt *Packet, err error) {
+		r := newResult(t.host, resultDiscarded, pkt)
+		r.Error = err.Error()
+		m.result(t, r)
+		if m.table != nil {
+			m.table.row(t.host, pkt.Seq, pkt.Rtt, pkt.TTL, append(packetFlags(pkt), "DISCARDED", err.Error())...)
+			return
+		}
+		fmt.Printf("WARN: discarded reply icmp_seq=%d time=%s: %v\n", pkt.Seq, output.Dur(pkt.Rtt), err)
+	}
+	pinger.OnMethodChange = func(from, to, reason string) {
+		msg := fmt.Sprintf("%s: probing with %s instead of %s, %s", t.host, to, from, reason)
+		fmt.Println("WARN:", msg)
+		m.event(eventMethodChange, t.host, msg)
+	}
+	pinger.OnFinish = func(stats *Statistics) {
+		t.mu.Lock()
+		pops := append([]string(nil), t.pops...)
+		mtu := t.mtu
+		t.mu.Unlock()
+		m.mu.Lock()
+		s := newSummary(t.host, stats)
+		s.Aliases = append([]string(nil), t.aliases...)
+		s.Geo, s.POPs, s.MTU = t.geo, pops, mtu
+		var cmp string
+		if t.sweep != nil {
+			s.Sizes, cmp = t.sweep.Stats(), t.sweep.Compare()
+		}
+		var padCmp []string
+		if t.padding != nil {
+			s.Padding, padCmp = t.padding.Stats(), t.padding.Compare()
+		}
+		m.summaries = append(m.summaries, s)
+		label := t.label()
+		m.mu.Unlock()
+		fmt.Print("\n" + formatStatistics(label, stats))
+		fmt.Print(formatSizeSweep(label, s.Sizes, cmp))
+		fmt.Print(formatPadding(label, s.Padding, padCmp))
+		t.mu.Lock()
+		expired := t.expired
+		t.mu.Unlock()
+		if expired {
+			m.event(eventExpired, t.host, fmt.Sprintf("%s expired and removed: %d sent, %d received, %.1f%% loss, avg %v",
+				t.host, stats.PacketsSent, stats.PacketsRecv, stats.PacketLoss, stats.AvgRtt))
+		}
+	}
+
+	if err := m.settings.apply(pinger); err != nil {
+		fmt.Printf("WARN: %s: %v\n", t.host, err)
+	}
+	if t.profile != nil {
+		t.profile.apply(pinger)
+	}
+	if t.source != nil {
+		t.source.apply(pinger)
+	}
+	pinger.scheduler = m.sched
+}
+
+// apply configures p with the settings.
+func (s probeSettings) apply(p *Pinger) error {
+	p.Count = s.Count
+	p.Size = s.Size
+	p.Sizes = s.Sizes
+	p.Padding = s.Padding
+	p.Body = s.Body
+	p.Interval = s.Interval
+	p.Jitter = s.Jitter
+	p.Verbose = s.Verbose
+	p.Timeout = s.Timeout
+	p.ReplyTimeout = s.ReplyTimeout
+	p.Preload = s.Preload
+	p.MaxSaneRtt = s.MaxSaneRtt
+	p.Timestamping = s.Timestamping
+	p.TTL = s.TTL
+	p.HopLimit, p.FlowLabel = s.HopLimit, s.FlowLabel
+	p.SetPrivileged(s.Privileged)
+	p.Proxy = s.Proxy
+	p.Faults = s.Faults
+	p.Mark, p.Device = s.Mark, s.Device
+	if len(s.Methods) > 0 && p.url == nil && len(p.methods) == 0 {
+		return p.SetMethods(s.Methods)
+	}
+	return nil
+}
+
+// lostInARow returns the number of probes lost since the last reply.
+func (t *target) lostInARow() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.lost
+}
+
+// ttlName is what the TTL of pkt is called, hlim for the hop limit of IPv6.
+func ttlName(pkt *Packet) string {
+	if pkt.IPAddr != nil && pkt.IPAddr.IP.To4() == nil {
+		return "hlim"
+	}
+	return "ttl"
+}
+
+// checkTTL reports replies arriving with another TTL than the one before,
+// the path or the responder changed.
+func (m *monitor) checkTTL(t *target, pkt *Packet) {
+	if pkt.TTL <= 0 {
+		return
+	}
+	t.mu.Lock()
+	prev := t.ttl
+	t.ttl = pkt.TTL
+	t.mu.Unlock()
+	if prev == 0 || prev == pkt.TTL {
+		return
+	}
+	msg := fmt.Sprintf("reply TTL of %s changed from %d to %d at icmp_seq=%d", t.host, prev, pkt.TTL, pkt.Seq)
+	fmt.Println("WARN:", msg)
+	m.event(eventTTLChange, t.host, msg)
+}
+
+func (t *target) setLocalDown(down bool) {
+	t.mu.Lock()
+	t.localDown = down
+	t.mu.Unlock()
+}
+
+func (t *target) setLost(n int) {
+	t.mu.Lock()
+	t.lost = n
+	t.mu.Unlock()
+}
+
+// addLost counts a lost probe.
+func (t *target) addLost() {
+	t.mu.Lock()
+	t.lost++
+	t.intervalLost++
+	t.mu.Unlock()
+}
+
+// run probes t until its pinger finishes, printing interval statistics every
+// StatisticInterval.
+func (m *monitor) run(t *target) {
+	defer close(t.done)
+	if m.table == nil {
+		name := t.pinger.Addr()
+		if t.profile != nil || t.source != nil {
+			name = t.host
+		}
+		fmt.Printf(tr("PING %s (%s):\n"), name, t.pinger.IPAddr())
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := t.pinger.Run(); err != nil {
+			fmt.Println(tr("Failed to ping target host:"), err)
+		}
+	}()
+	if !t.expires.IsZero() {
+		expire := time.AfterFunc(time.Until(t.expires), func() {
+			t.mu.Lock()
+			t.expired = true
+			t.mu.Unlock()
+			t.pinger.Stop()
+		})
+		defer expire.Stop()
+	}
+	if m.settings.MTUCheck {
+		go m.checkMTU(t)
+	}
+	if m.settings.POPEvery > 0 && t.pinger.IPAddr() != nil {
+		stop := make(chan struct{})
+		defer close(stop)
+		go m.watchPOP(t, stop)
+	}
+
+	// wait for stop
+	if m.settings.StatisticInterval == time.Duration(0) {
+		<-done
+		return
+	}
+	statisticAndReset := func(exit bool) {
+		// 	统计一波并清除
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		defer t.counter.Reset()
+		defer t.phases.Reset()
+		if exit && t.counter.Count == int64(t.pinger.Statistics().PacketsRecv) {
+			return
+		}
+		fmt.Println(m.prefix(t) + t.counter.String())
+		fmt.Print(t.phases.String())
+		st := t.intervalStats(m.settings.ScoreWeights)
+		if st.ProxyConnectMs > 0 {
+			fmt.Printf(tr("%sproxy connect avg %s of %s end-to-end\n"), m.prefix(t), output.Ms(st.ProxyConnectMs, 2), output.Ms(st.AvgMs, 2))
+		}
+		if st.Sent > 0 {
+			fmt.Printf(tr("%squality score %.1f, median %s, jitter %s, %d spikes\n"), m.prefix(t), st.Score, output.Ms(st.MedianMs, 3), output.Ms(st.JitterMs, 3), st.Spikes)
+		}
+		if m.snmp != nil {
+			cur := m.snmp.totals()
+			d := cur.sub(t.router)
+			t.router, st.Router = cur, &d
+			if !d.zero() {
+				fmt.Printf(tr("%srouter counted %d/%d errors and %d/%d discards in/out\n"), m.prefix(t), d.InErrors, d.OutErrors, d.InDiscards, d.OutDiscards)
+			}
+		}
+		if st.Reordered > 0 {
+			fmt.Printf(tr("%s%d replies out of order, %.1f%% reordering\n"), m.prefix(t), st.Reordered, st.ReorderPct)
+		}
+		if st.Late > 0 {
+			fmt.Printf(tr("%s%d late replies, avg %s: a queue filling up rather than loss\n"), m.prefix(t), st.Late, output.Ms(st.LateAvgMs, 3))
+		}
+		if st.ForwardLossPct != nil {
+			fmt.Printf(tr("%sforward loss %.1f%%, reverse loss %.1f%%\n"), m.prefix(t), *st.ForwardLossPct, *st.ReverseLossPct)
+		}
+		if paused, _ := t.pinger.Paused(); !paused && t.slowGaps > 0 {
+			fmt.Printf(tr("%ssent %.2f probes/s, gap avg/max %s/%s, send lag max %s: this host is falling behind\n"),
+				m.prefix(t), st.SendRate, output.Ms(st.GapAvgMs, 2), output.Ms(st.GapMaxMs, 2), output.Ms(st.SendLagMaxMs, 2))
+		}
+		t.intervalLost = 0
+		t.intervalLate, t.lateSum, t.intervalReordered = 0, 0, 0
+		t.proxySum, t.proxyN = 0, 0
+		t.intervalRtts = t.intervalRtts[:0]
+		t.throughput = 0
+		if st.Sent > 0 {
+			t.score = st.Score
+		}
+		if d := t.pinger.Statistics().Directional; d != nil {
+			t.directional = *d
+		}
+		t.sends, t.gapSum, t.gapMax, t.sendLagMax, t.slowGaps = 0, 0, 0, 0, 0
+		t.intervalStart = st.Time
+		var anomaly string
+		st.BaselineMs, anomaly = m.baseline.Observe(st)
+		if anomaly != "" {
+			st.Anomaly = true
+			fmt.Printf("WARN: %s%s\n", m.prefix(t), anomaly)
+			m.event(eventAnomaly, t.host, anomaly)
+		}
+		m.out.Interval(st)
+	}
+	defer statisticAndReset(true)
+
+	logIntervalTimer := time.NewTicker(m.settings.StatisticInterval)
+	defer logIntervalTimer.Stop()
+	for exit := false; !exit; {
+		select {
+		case <-logIntervalTimer.C:
+			statisticAndReset(false)
+		case <-t.segment:
+			statisticAndReset(false)
+			logIntervalTimer.Reset(m.settings.StatisticInterval)
+		case <-done:
+			exit = true
+		}
+	}
+}
+
+// intervalStats returns the record of the current interval, scored with w,
+// t.mu held.
+func (t *target) intervalStats(w scoreWeights) *IntervalStats {
+	c := t.counter
+	st := &IntervalStats{
+		Time:     time.Now(),
+		Target:   t.host,
+		Group:    t.group,
+		Count:    c.Count,
+		Sent:     c.Count + int64(t.intervalLost),
+		Lost:     int64(t.intervalLost),
+		MinMs:    ms(c.Min),
+		AvgMs:    ms(c.Avg()),
+		MaxMs:    ms(c.Max),
+		StdDevMs: ms(c.StdDev()),
+		Phases:   phasesMs(t.phases.Avg()),
+		POP:      t.pop,
+		// a sample in the interval taking the link's capacity
+		ThroughputMbps: t.throughput,
+	}
+	if t.proxyN > 0 {
+		st.ProxyConnectMs = ms(t.proxySum / time.Duration(t.proxyN))
+	}
+	if t.intervalReordered > 0 && c.Count > 0 {
+		st.Reordered, st.ReorderPct = t.intervalReordered, float64(t.intervalReordered)/float64(c.Count)*100
+	}
+	if t.intervalLate > 0 {
+		st.Late, st.LateAvgMs = t.intervalLate, ms(t.lateSum/time.Duration(t.intervalLate))
+	}
+	if d := t.pinger.Statistics().Directional; d != nil && d.Sent > t.directional.Sent {
+		in := d.sub(t.directional)
+		fwd, rev := in.Forward(), in.Reverse()
+		st.ForwardLossPct, st.ReverseLossPct = &fwd, &rev
+	}
+	if st.Sent > 0 {
+		st.LossPct = float64(st.Lost) / float64(st.Sent) * 100
+	}
+	median, jitter, spikes := rttQuality(t.intervalRtts)
+	st.MedianMs, st.JitterMs, st.Spikes = ms(median), ms(jitter), spikes
+	st.Score = w.score(st.LossPct, median, jitter, spikes, len(t.intervalRtts))
+	if d := st.Time.Sub(t.intervalStart); d > 0 {
+		st.SendRate = float64(t.sends) / d.Seconds()
+	}
+	if t.sends > 0 {
+		st.GapAvgMs = ms(t.gapSum / time.Duration(t.sends))
+	}
+	st.GapMaxMs, st.SendLagMaxMs = ms(t.gapMax), ms(t.sendLagMax)
+	return st
+}
+
+// sent measures the gap to the send before pkt.
+func (t *target) sent(pkt *Packet) {
+	now := time.Now()
+	_, interval := t.pinger.Paused()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.lastSend.IsZero() {
+		gap := now.Sub(t.lastSend)
+		t.sends++
+		t.gapSum += gap
+		if gap > t.gapMax {
+			t.gapMax = gap
+		}
+		// the gap spanning a change of interval may be as long as either
+		if gap > 2*interval && gap > 2*t.sendInterval {
+			t.slowGaps++
+		}
+	}
+	if pkt.SendLag > t.sendLagMax {
+		t.sendLagMax = pkt.SendLag
+	}
+	t.lastSend, t.sendInterval = now, interval
+}
+
+// result records the outcome of a probe of t.
+func (m *monitor) result(t *target, r *Result) {
+	t.mu.Lock()
+	r.LocalDown, r.POP = t.localDown, t.pop
+	t.mu.Unlock()
+	r.Group = t.group
+	m.out.Result(r)
+}
+
+// event records a warning or note.
+func (m *monitor) event(typ, host, msg string) {
+	e := &Event{Time: time.Now(), Type: typ, Target: host, Message: msg}
+	m.out.Event(e)
+}
+
+// prefix names the target on interval lines once several targets share the
+// output.
+func (m *monitor) prefix(t *target) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.targets) > 1 {
+		return t.host + ": "
+	}
+	return ""
+}
+
+func formatStatistics(name string, stats *Statistics) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, tr("--- %s ping statistics ---\n"), name)
+	fmt.Fprintf(&b, tr("%d packets transmitted, %d packets received, %d duplicates, %v%% packet loss\n"),
+		stats.PacketsSent, stats.PacketsRecv, stats.PacketsRecvDuplicates, stats.PacketLoss)
+	fmt.Fprintf(&b, tr("round-trip min/avg/max/stddev = %s/%s/%s/%s\n"),
+		output.Dur(stats.MinRtt), output.Dur(stats.AvgRtt), output.Dur(stats.MaxRtt), output.Dur(stats.StdDevRtt))
+	if stats.BytesSent > 0 {
+		fmt.Fprintf(&b, tr("%s sent, %s received, headers included (estimated)\n"),
+			formatBytes(stats.BytesSent), formatBytes(stats.BytesRecv))
+	}
+	if stats.Directional != nil {
+		b.WriteString(stats.Directional.String() + "\n")
+	}
+	if stats.PacketsDiscarded > 0 {
+		fmt.Fprintf(&b, tr("%d replies discarded with implausible RTT\n"), stats.PacketsDiscarded)
+	}
+	if len(stats.TTLs) > 1 {
+		ttls := make([]int, 0, len(stats.TTLs))
+		for ttl := range stats.TTLs {
+			ttls = append(ttls, ttl)
+		}
+		sort.Ints(ttls)
+		fmt.Fprintf(&b, tr("%d distinct reply TTLs:"), len(ttls))
+		for _, ttl := range ttls {
+			fmt.Fprintf(&b, " %d (%d)", ttl, stats.TTLs[ttl])
+		}
+		b.WriteString("\n")
+	}
+	if stats.PacketsReordered > 0 {
+		fmt.Fprintf(&b, tr("%d replies out of order, %.1f%% reordering\n"),
+			stats.PacketsReordered, float64(stats.PacketsReordered)/float64(stats.PacketsRecv)*100)
+	}
+	if stats.PacketsLate > 0 {
+		fmt.Fprintf(&b, tr("%d late replies after the reply timeout, counted lost, rtt avg/max = %s/%s\n"),
+			stats.PacketsLate, output.Dur(stats.LateAvgRtt), output.Dur(stats.LateMaxRtt))
+	}
+	if stats.PacketsForeign > 0 {
+		fmt.Fprintf(&b, tr("%d replies from other addresses than %s, not counted as received\n"), stats.PacketsForeign, stats.IPAddr)
+	}
+	if stats.PacketsStale > 0 {
+		fmt.Fprintf(&b, tr("%d replies not matching the send time of their probe (stale or replayed), not counted as received\n"), stats.PacketsStale)
+	}
+	if n := stats.PacketsTruncated + stats.PacketsOversized + stats.PacketsCorrupted; n > 0 {
+		fmt.Fprintf(&b, tr("%d replies with a mangled payload: %d truncated, %d oversized, %d corrupted\n"),
+			n, stats.PacketsTruncated, stats.PacketsOversized, stats.PacketsCorrupted)
+	}
+	if len(stats.Failures) > 0 {
+		fmt.Fprintf(&b, tr("failures: %s\n"), formatFailures(stats.Failures))
+	}
+	if stats.PacketsExcused > 0 {
+		fmt.Fprintf(&b, tr("%d probes excused, left out of the loss (local link down, suspend or method recheck)\n"), stats.PacketsExcused)
+	}
+	return b.String()
+}
+
+// Summaries returns the final statistics of every finished target, sorted
+// by name.
+func (m *monitor) Summaries() []*Summary {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ss := append([]*Summary(nil), m.summaries...)
+	sort.Slice(ss, func(i, j int) bool { return ss[i].Target < ss[j].Target })
+	return ss
+}
+
+// Comparison returns, for every name probed on several addresses, a table
+// of the per-address statistics and which address did best.
+func (m *monitor) Comparison() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	names := make([]string, 0, len(m.groups))
+	for name := range m.groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range names {
+		ts := m.groups[name]
+		fmt.Fprintf(&b, tr("\n--- %s per-address comparison ---\n"), name)
+		tw := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "address\tsent\trecv\tloss\tmin\tavg\t95% ci\tmax\tstddev")
+		var best, worst *Statistics
+		var bestT, worstT *target
+		for _, t := range ts {
+			s := t.pinger.Statistics()
+			ci := time.Duration(ci95(float64(s.StdDevRtt), s.PacketsRecv))
+			fmt.Fprintf(tw, "%s\t%d\t%d\t%.1f%%\t%v\t%v\t±%v\t%v\t%v\n", s.IPAddr, s.PacketsSent, s.PacketsRecv,
+				s.PacketLoss, s.MinRtt, s.AvgRtt, ci, s.MaxRtt, s.StdDevRtt)
+			if s.PacketsRecv == 0 {
+				continue
+			}
+			if best == nil || s.AvgRtt < best.AvgRtt {
+				best, bestT = s, t
+			}
+			if worst == nil || s.AvgRtt > worst.AvgRtt {
+				worst, worstT = s, t
+			}
+		}
+		tw.Flush()
+		if best != nil && best != worst {
+			fmt.Fprintf(&b, tr("fastest %s avg %v, slowest %s avg %v (+%v)\n"),
+				best.IPAddr, best.AvgRtt, worst.IPAddr, worst.AvgRtt, worst.AvgRtt-best.AvgRtt)
+			// on the raw samples the history still holds
+			fast, slow := sampleRtts(m.history.Samples(bestT.host)), sampleRtts(m.history.Samples(worstT.host))
+			if len(fast) >= 2 && len(slow) >= 2 {
+				fmt.Fprintln(&b, compareRtts(best.IPAddr.String(), fast, worst.IPAddr.String(), slow))
+			}
+		}
+	}
+	return b.String()
+}
+
+// handleCtl registers the runtime control commands on the control socket.
+func (m *monitor) handleCtl(s *ctlServer) {
+	for cmd, h := range m.ctlHandlers() {
+		s.Handle(cmd, h)
+	}
+}
+
+// ctlHandlers are the runtime control commands by name, those of the
+// control socket and of the keys of -tui.
+func (m *monitor) ctlHandlers() map[string]ctlHandler {
+	return map[string]ctlHandler{
+		"annotate": func(text string) (string, error) {
+			printAnnotation(text)
+			m.event(eventAnnotation, "", text)
+			return "", nil
+		},
+		"note": func(arg string) (string, error) {
+			host, text, _ := strings.Cut(arg, " ")
+			return "", m.note(host, text)
+		},
+		"status": func(host string) (string, error) {
+			ts, err := m.ctlTargets(host)
+			if err != nil {
+				return "", err
+			}
+			var b strings.Builder
+			for _, t := range ts {
+				stats := t.pinger.Statistics()
+				paused, interval := t.pinger.Paused()
+				state := "running"
+				if paused {
+					state = "paused"
+				}
+				fmt.Fprintf(&b, "%s (%s) %s interval=%v sent=%d recv=%d loss=%.1f%% avg=%v",
+					t.host, stats.IPAddr, state, interval, stats.PacketsSent, stats.PacketsRecv,
+					stats.PacketLoss, stats.AvgRtt)
+				if !t.expires.IsZero() {
+					fmt.Fprintf(&b, " expires in %v", time.Until(t.expires).Round(time.Second))
+				}
+				b.WriteString("\n")
+			}
+			return b.String(), nil
+		},
+		"dump-stats": func(host string) (string, error) {
+			ts, err := m.ctlTargets(host)
+			if err != nil {
+				return "", err
+			}
+			var b strings.Builder
+			for _, t := range ts {
+				b.WriteString(formatStatistics(t.host, t.pinger.Statistics()))
+			}
+			return b.String(), nil
+		},
+		"add-target": func(arg string) (string, error) {
+			// an ephemeral target is given for how long to probe it
+			host, ttls, _ := strings.Cut(arg, " ")
+			var ttl time.Duration
+			if ttls != "" {
+				var err error
+				if ttl, err = time.ParseDuration(strings.TrimSpace(ttls)); err != nil || ttl <= 0 {
+					return "", errors.New("usage: add-target host [duration]")
+				}
+			}
+			if host == "" {
+				return "", errors.New("usage: add-target host [duration]")
+			}
+			targets, err := expandTarget(host)
+			if err != nil {
+				return "", err
+			}
+			for _, t := range targets {
+				if err := m.Add(t, 0, ttl); err != nil {
+					return "", err
+				}
+			}
+			if ttl > 0 {
+				return fmt.Sprintf("probing %s for %v\n", host, ttl), nil
+			}
+			return "", nil
+		},
+		"remove-target": func(host string) (string, error) {
+			if host == "" {
+				return "", errors.New("usage: remove-target host")
+			}
+			targets, err := expandTarget(host)
+			if err != nil {
+				return "", err
+			}
+			for _, t := range targets {
+				if err := m.Remove(t); err != nil {
+					return "", err
+				}
+			}
+			return "", nil
+		},
+		"reset-stats": func(host string) (string, error) { return "", m.resetStats(host) },
+		"pause":       m.eachCtl(func(t *target) error { return t.pinger.Pause() }),
+		"resume":      m.eachCtl(func(t *target) error { return t.pinger.Resume() }),
+		"set-interval": func(arg string) (string, error) {
+			ds, host, _ := strings.Cut(arg, " ")
+			d, err := time.ParseDuration(ds)
+			if err != nil {
+				return "", errors.New("usage: set-interval duration [host]")
+			}
+			ts, err := m.ctlTargets(host)
+			if err != nil {
+				return "", err
+			}
+			intervals := make(map[*target]time.Duration, len(ts))
+			for _, t := range ts {
+				intervals[t] = d
+			}
+			m.mu.Lock()
+			err = m.checkBandwidth(0, intervals)
+			m.mu.Unlock()
+			if err != nil {
+				return "", err
+			}
+			return m.eachCtl(func(t *target) error { return t.pinger.SetInterval(d) })(host)
+		},
+		"traceroute": func(host string) (string, error) {
+			if host == "" {
+				return "", errors.New("usage: traceroute host")
+			}
+			t, err := m.get(host)
+			if err != nil {
+				return "", err
+			}
+			ip := t.pinger.IPAddr()
+			if ip == nil {
+				return "", fmt.Errorf("%s has no address to trace", host)
+			}
+			hops := m.settings.TTLSweep
+			if hops == 0 {
+				hops = traceHops
+			}
+			path, err := sweepTTL(ip, m.settings, hops)
+			if err != nil {
+				return "", err
+			}
+			return formatPath(t.host, ip, path), nil
+		},
+	}
+}
+
+// ctlTargets is list for control commands, where naming an unknown host is
+// an error.
+func (m *monitor) ctlTargets(host string) ([]*target, error) {
+	ts := m.list(host)
+	if host != "" && len(ts) == 0 {
+		return nil, fmt.Errorf("%w %s", errUnknownTarget, host)
+	}
+	return ts, nil
+}
+
+// resetStats starts the statistics of the named target, or of all targets,
+// over from now, marking the moment with a reset event.
+func (m *monitor) resetStats(host string) error {
+	ts, err := m.ctlTargets(host)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, t := range ts {
+		if err := t.pinger.ResetStatistics(); err != nil && !errors.Is(err, errNotRunning) {
+			return fmt.Errorf("%s: %w", t.host, err)
+		}
+		t.mu.Lock()
+		t.counter.Reset()
+		t.phases.Reset()
+		t.intervalLost = 0
+		t.intervalLate, t.lateSum, t.intervalReordered = 0, 0, 0
+		t.intervalRtts = t.intervalRtts[:0]
+		t.proxySum, t.proxyN = 0, 0
+		t.directional = DirectionalLoss{}
+		t.rtts = newRTTHistogram(t.rtts.bounds)
+		t.sends, t.gapSum, t.gapMax, t.sendLagMax, t.slowGaps = 0, 0, 0, 0, 0
+		t.intervalStart = now
+		t.mu.Unlock()
+	}
+	msg := tr("statistics reset")
+	if host != "" {
+		msg = fmt.Sprintf(tr("statistics of %s reset"), host)
+	}
+	fmt.Printf("=== %s %s\n", output.Time(now, time.DateTime, time.Local), msg)
+	m.out.Event(&Event{Time: now, Type: eventReset, Target: host, Message: msg})
+	return nil
+}
+
+// eachCtl returns a handler applying fn to the named target, or to all
+// targets when no host is given.
+func (m *monitor) eachCtl(fn func(t *target) error) ctlHandler {
+	return func(host string) (string, error) {
+		ts, err := m.ctlTargets(host)
+		if err != nil {
+			return "", err
+		}
+		for _, t := range ts {
+			if err := fn(t); err != nil {
+				return "", fmt.Errorf("%s: %w", t.host, err)
+			}
+		}
+		return "", nil
+	}
+}
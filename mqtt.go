@@ -0,0 +1,374 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A minimal MQTT 3.1.1 client, publishing only, at QoS 0: enough to feed a
+// broker without pulling in a client library.
+
+const (
+	mqttKeepAlive = 60 * time.Second
+	// mqttRetry is how long publishing is given up between reconnects
+	mqttRetry = 10 * time.Second
+)
+
+var errMQTTDown = errors.New("mqtt broker unreachable, retrying later")
+
+// mqttClient keeps a connection to a broker, reconnecting as needed.
+type mqttClient struct {
+	addr     string
+	tls      *tls.Config
+	clientID string
+	user     string
+	password string
+	hasPass  bool
+	// willTopic is set "online" once connected, and "offline" by the
+	// broker should the connection be lost, both retained
+	willTopic string
+
+	mu      sync.Mutex
+	conn    net.Conn
+	w       *bufio.Writer
+	retryAt time.Time
+	closed  chan struct{}
+}
+
+// newMQTTClient connects to rawurl, tcp:// or mqtt:// for plain TCP, ssl://,
+// tls:// or mqtts:// for TLS, with the user and password of the URL. caFile
+// replaces the system roots for TLS.
+func newMQTTClient(rawurl, caFile, willTopic string) (*mqttClient, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	c := &mqttClient{willTopic: willTopic, closed: make(chan struct{})}
+	port := "1883"
+	switch u.Scheme {
+	case "tcp", "mqtt":
+	case "ssl", "tls", "mqtts":
+		port = "8883"
+		c.tls = &tls.Config{ServerName: u.Hostname()}
+		if caFile != "" {
+			pem, err := os.ReadFile(caFile)
+			if err != nil {
+				return nil, err
+			}
+			c.tls.RootCAs = x509.NewCertPool()
+			if !c.tls.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("%s: no certificates", caFile)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unsupported MQTT scheme %q, want tcp, mqtt, ssl, tls or mqtts", u.Scheme)
+	}
+	if u.Port() != "" {
+		port = u.Port()
+	}
+	c.addr = net.JoinHostPort(u.Hostname(), port)
+	if u.User != nil {
+		c.user = u.User.Username()
+		c.password, c.hasPass = u.User.Password()
+	}
+	var b [4]byte
+	_, _ = rand.Read(b[:])
+	c.clientID = "keeping-" + hex.EncodeToString(b[:])
+	return c, nil
+}
+
+// Publish sends payload to topic, connecting first if needed.
+func (c *mqttClient) Publish(topic string, payload []byte, retain bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.connectLocked(); err != nil {
+		return err
+	}
+	flags := byte(0x30)
+	if retain {
+		flags |= 0x01
+	}
+	var body []byte
+	body = mqttString(body, topic)
+	body = append(body, payload...)
+	if err := c.writeLocked(flags, body); err != nil {
+		c.dropLocked()
+		return err
+	}
+	return nil
+}
+
+func (c *mqttClient) connectLocked() error {
+	if c.conn != nil {
+		return nil
+	}
+	if time.Now().Before(c.retryAt) {
+		return errMQTTDown
+	}
+	if err := c.dialLocked(); err != nil {
+		c.retryAt = time.Now().Add(mqttRetry)
+		return err
+	}
+	if c.willTopic != "" {
+		var body []byte
+		body = mqttString(body, c.willTopic)
+		body = append(body, "online"...)
+		if err := c.writeLocked(0x31, body); err != nil {
+			c.dropLocked()
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *mqttClient) dialLocked() error {
+	d := net.Dialer{Timeout: 10 * time.Second}
+	var conn net.Conn
+	var err error
+	if c.tls != nil {
+		conn, err = tls.DialWithDialer(&d, "tcp", c.addr, c.tls)
+	} else {
+		conn, err = d.Dial("tcp", c.addr)
+	}
+	if err != nil {
+		return err
+	}
+	// CONNECT, clean session
+	flags := byte(0x02)
+	var payload []byte
+	payload = mqttString(payload, c.clientID)
+	if c.willTopic != "" {
+		flags |= 0x04 | 0x20
+		payload = mqttString(payload, c.willTopic)
+		payload = mqttString(payload, "offline")
+	}
+	if c.user != "" {
+		flags |= 0x80
+		payload = mqttString(payload, c.user)
+		if c.hasPass {
+			flags |= 0x40
+			payload = mqttString(payload, c.password)
+		}
+	}
+	body := mqttString(nil, "MQTT")
+	body = append(body, 4, flags)
+	body = binary.BigEndian.AppendUint16(body, uint16(mqttKeepAlive/time.Second))
+	body = append(body, payload...)
+	c.conn, c.w = conn, bufio.NewWriter(conn)
+	if err := c.writeLocked(0x10, body); err != nil {
+		c.dropLocked()
+		return err
+	}
+
+	// CONNACK
+	_ = conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	var ack [4]byte
+	if _, err := io.ReadFull(conn, ack[:]); err != nil {
+		c.dropLocked()
+		return fmt.Errorf("mqtt connect: %w", err)
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+	if ack[0] != 0x20 || ack[1] != 2 {
+		c.dropLocked()
+		return errors.New("mqtt connect: unexpected reply")
+	}
+	if ack[3] != 0 {
+		c.dropLocked()
+		return fmt.Errorf("mqtt connect refused: %s", mqttConnectCode(ack[3]))
+	}
+	go c.keepAlive(conn)
+	return nil
+}
+
+// keepAlive pings the broker while conn is in use and reads what it sends,
+// noticing when it goes away.
+func (c *mqttClient) keepAlive(conn net.Conn) {
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		_, _ = io.Copy(io.Discard, conn)
+	}()
+	ping := time.NewTicker(mqttKeepAlive / 2)
+	defer ping.Stop()
+	for {
+		select {
+		case <-ping.C:
+			c.mu.Lock()
+			if c.conn == conn && c.writeLocked(0xc0, nil) != nil {
+				c.dropLocked()
+			}
+			c.mu.Unlock()
+		case <-gone:
+			c.mu.Lock()
+			if c.conn == conn {
+				c.dropLocked()
+			}
+			c.mu.Unlock()
+			return
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+func (c *mqttClient) writeLocked(header byte, body []byte) error {
+	_ = c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	c.w.WriteByte(header)
+	// remaining length, 7 bits at a time
+	n := len(body)
+	for {
+		b := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			b |= 0x80
+		}
+		c.w.WriteByte(b)
+		if n == 0 {
+			break
+		}
+	}
+	c.w.Write(body)
+	return c.w.Flush()
+}
+
+func (c *mqttClient) dropLocked() {
+	c.conn.Close()
+	c.conn, c.w = nil, nil
+}
+
+// Close says goodbye to the broker, marking the instance offline first.
+func (c *mqttClient) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	close(c.closed)
+	if c.conn == nil {
+		return nil
+	}
+	if c.willTopic != "" {
+		body := mqttString(nil, c.willTopic)
+		_ = c.writeLocked(0x31, append(body, "offline"...))
+	}
+	_ = c.writeLocked(0xe0, nil)
+	c.dropLocked()
+	return nil
+}
+
+func mqttString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+func mqttConnectCode(rc byte) string {
+	switch rc {
+	case 1:
+		return "unacceptable protocol version"
+	case 2:
+		return "client identifier rejected"
+	case 3:
+		return "server unavailable"
+	case 4:
+		return "bad user name or password"
+	case 5:
+		return "not authorized"
+	}
+	return fmt.Sprintf("code %d", rc)
+}
+
+// mqttTopicName makes a target name usable as a single topic level.
+var mqttTopicName = strings.NewReplacer("/", "_", "+", "_", "#", "_")
+
+// mqttSink publishes the interval summaries of every target to
+// <topic>/interval, as the rows of -intervals, and its state, "up" or
+// "down" once downAfter probes were lost in a row, retained to
+// <topic>/state. {target} in the topic is replaced by the target name.
+// With a discovery prefix the targets are announced to Home Assistant too.
+type mqttSink struct {
+	c         *mqttClient
+	topic     string
+	discovery string
+	announced map[string]bool
+	health    *healthTracker
+}
+
+func newMQTTSink(rawurl, topic, caFile, discovery string) (*mqttSink, error) {
+	c, err := newMQTTClient(rawurl, caFile, mqttStatusTopic(topic))
+	if err != nil {
+		return nil, err
+	}
+	return &mqttSink{c: c, topic: topic, discovery: discovery, announced: make(map[string]bool),
+		health: newHealthTracker(0)}, nil
+}
+
+// mqttStatusTopic is where the instance announces itself online or
+// offline: the topic without its {target} level, plus /status.
+func mqttStatusTopic(topic string) string {
+	base := strings.Trim(strings.ReplaceAll(topic, "{target}", ""), "/")
+	if base == "" {
+		return "status"
+	}
+	return base + "/status"
+}
+
+func (s *mqttSink) targetTopic(target string) string {
+	return strings.ReplaceAll(s.topic, "{target}", mqttTopicName.Replace(target))
+}
+
+// unsampled keeps the up/down state judged from every result.
+func (s *mqttSink) unsampled() {}
+
+func (s *mqttSink) HandleResult(r *Result) error {
+	if err := s.announce(r.Target); err != nil {
+		return err
+	}
+	state := s.health.result(r)
+	if state == "" {
+		return nil
+	}
+	// only a published state counts, otherwise it is sent again with the
+	// next result
+	if err := s.c.Publish(s.targetTopic(r.Target)+"/state", []byte(state), true); err != nil {
+		return err
+	}
+	s.health.set(r.Target, state)
+	return nil
+}
+
+func (s *mqttSink) HandleInterval(st *IntervalStats) error {
+	if err := s.announce(st.Target); err != nil {
+		return err
+	}
+	b, err := json.Marshal(newIntervalRow(st))
+	if err != nil {
+		return err
+	}
+	return s.c.Publish(s.targetTopic(st.Target)+"/interval", b, false)
+}
+
+// HandleEvent publishes the run record, retained, next to the status.
+func (s *mqttSink) HandleEvent(e *Event) error {
+	if e.Type != eventRun {
+		return nil
+	}
+	b, err := json.Marshal(e.Run)
+	if err != nil {
+		return err
+	}
+	return s.c.Publish(strings.TrimSuffix(mqttStatusTopic(s.topic), "status")+"run", b, true)
+}
+
+func (s *mqttSink) Flush() error { return nil }
+func (s *mqttSink) Close() error { return s.c.Close() }
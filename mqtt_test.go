@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewMQTTClient(t *testing.T) {
+	for _, tt := range []struct {
+		url, addr, user, password string
+		tls, hasPass              bool
+	}{
+		{url: "tcp://broker", addr: "broker:1883"},
+		{url: "mqtt://broker:1884", addr: "broker:1884"},
+		{url: "mqtts://u:p@broker", addr: "broker:8883", user: "u", password: "p", tls: true, hasPass: true},
+		{url: "ssl://u@[2001:db8::1]", addr: "[2001:db8::1]:8883", user: "u", tls: true},
+		{url: "tls://u:@broker:9999", addr: "broker:9999", user: "u", tls: true, hasPass: true},
+	} {
+		c, err := newMQTTClient(tt.url, "", "")
+		if err != nil {
+			t.Errorf("%s: %v", tt.url, err)
+			continue
+		}
+		if c.addr != tt.addr || c.user != tt.user || c.password != tt.password || c.hasPass != tt.hasPass || (c.tls != nil) != tt.tls {
+			t.Errorf("%s: got %+v", tt.url, c)
+		}
+		if !strings.HasPrefix(c.clientID, "keeping-") || len(c.clientID) != len("keeping-")+8 {
+			t.Errorf("%s: client id %q", tt.url, c.clientID)
+		}
+	}
+	if _, err := newMQTTClient("ws://broker", "", ""); err == nil {
+		t.Error("ws: no error")
+	}
+	if _, err := newMQTTClient("mqtts://broker", "/nonexistent/ca.pem", ""); err == nil {
+		t.Error("missing CA file: no error")
+	}
+}
+
+func TestMQTTStatusTopic(t *testing.T) {
+	for topic, want := range map[string]string{
+		"keeping/{target}":      "keeping/status",
+		"home/{target}/ping":    "home//ping/status",
+		"{target}":              "status",
+		"keeping":               "keeping/status",
+		"/site/{target}/":       "site/status",
+		"net/{target}/{target}": "net/status",
+	} {
+		if got := mqttStatusTopic(topic); got != want {
+			t.Errorf("mqttStatusTopic(%q) = %q, want %q", topic, got, want)
+		}
+	}
+	s := &mqttSink{topic: "keeping/{target}"}
+	if got := s.targetTopic("http://a/b+#"); got != "keeping/http:__a_b__" {
+		t.Errorf("targetTopic = %q", got)
+	}
+}
+
+// readMQTTPacket reads a packet's fixed header byte and its body.
+func readMQTTPacket(r *bufio.Reader) (byte, []byte, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	n, mult := 0, 1
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		n += int(b&0x7f) * mult
+		if b&0x80 == 0 {
+			break
+		}
+		mult *= 128
+	}
+	body := make([]byte, n)
+	_, err = io.ReadFull(r, body)
+	return header, body, err
+}
+
+// mqttField reads a length-prefixed string off b.
+func mqttField(t *testing.T, b *[]byte) string {
+	t.Helper()
+	if len(*b) < 2 {
+		t.Fatalf("short field in % x", *b)
+	}
+	n := int(binary.BigEndian.Uint16(*b))
+	s := string((*b)[2 : 2+n])
+	*b = (*b)[2+n:]
+	return s
+}
+
+type mqttPacket struct {
+	header byte
+	body   []byte
+}
+
+// startMQTTBroker accepts one connection, answers its CONNECT with code and
+// hands over every packet read.
+func startMQTTBroker(t *testing.T, code byte) (string, <-chan mqttPacket) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	packets := make(chan mqttPacket, 16)
+	go func() {
+		defer close(packets)
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		r := bufio.NewReader(c)
+		for {
+			header, body, err := readMQTTPacket(r)
+			if err != nil {
+				return
+			}
+			packets <- mqttPacket{header, body}
+			if header == 0x10 {
+				_, _ = c.Write([]byte{0x20, 2, 0, code})
+			}
+		}
+	}()
+	return "tcp://u:secret@" + l.Addr().String(), packets
+}
+
+func nextMQTTPacket(t *testing.T, packets <-chan mqttPacket) mqttPacket {
+	t.Helper()
+	select {
+	case p, ok := <-packets:
+		if !ok {
+			t.Fatal("connection closed")
+		}
+		return p
+	case <-time.After(5 * time.Second):
+		t.Fatal("no packet")
+	}
+	return mqttPacket{}
+}
+
+func TestMQTTPublish(t *testing.T) {
+	url, packets := startMQTTBroker(t, 0)
+	c, err := newMQTTClient(url, "", "keeping/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := bytes.Repeat([]byte("x"), 200)
+	if err := c.Publish("keeping/1.1.1.1/interval", payload, false); err != nil {
+		t.Fatal(err)
+	}
+
+	connect := nextMQTTPacket(t, packets)
+	if connect.header != 0x10 {
+		t.Fatalf("first packet %#x, want CONNECT", connect.header)
+	}
+	b := connect.body
+	if proto := mqttField(t, &b); proto != "MQTT" || b[0] != 4 {
+		t.Errorf("protocol %q level %d", proto, b[0])
+	}
+	// clean session, will retained, user name and password
+	if flags := b[1]; flags != 0x02|0x04|0x20|0x80|0x40 {
+		t.Errorf("connect flags %#x", flags)
+	}
+	if keepAlive := binary.BigEndian.Uint16(b[2:]); keepAlive != 60 {
+		t.Errorf("keep alive %d", keepAlive)
+	}
+	b = b[4:]
+	fields := []string{mqttField(t, &b), mqttField(t, &b), mqttField(t, &b), mqttField(t, &b), mqttField(t, &b)}
+	if want := []string{c.clientID, "keeping/status", "offline", "u", "secret"}; strings.Join(fields, " ") != strings.Join(want, " ") {
+		t.Errorf("connect payload %q, want %q", fields, want)
+	}
+
+	online := nextMQTTPacket(t, packets)
+	b = online.body
+	if online.header != 0x31 || mqttField(t, &b) != "keeping/status" || string(b) != "online" {
+		t.Errorf("online: %#x % x", online.header, online.body)
+	}
+	pub := nextMQTTPacket(t, packets)
+	b = pub.body
+	if pub.header != 0x30 || mqttField(t, &b) != "keeping/1.1.1.1/interval" || !bytes.Equal(b, payload) {
+		t.Errorf("publish: %#x, %d bytes", pub.header, len(pub.body))
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	offline := nextMQTTPacket(t, packets)
+	b = offline.body
+	if offline.header != 0x31 || mqttField(t, &b) != "keeping/status" || string(b) != "offline" {
+		t.Errorf("offline: %#x % x", offline.header, offline.body)
+	}
+	if p := nextMQTTPacket(t, packets); p.header != 0xe0 || len(p.body) != 0 {
+		t.Errorf("last packet %#x, want DISCONNECT", p.header)
+	}
+}
+
+func TestMQTTConnectRefused(t *testing.T) {
+	url, _ := startMQTTBroker(t, 5)
+	c, err := newMQTTClient(url, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Publish("t", nil, false); err == nil || !strings.Contains(err.Error(), "not authorized") {
+		t.Errorf("refused: %v", err)
+	}
+	// the broker is not tried again before mqttRetry
+	if err := c.Publish("t", nil, false); err != errMQTTDown {
+		t.Errorf("retry: %v, want %v", err, errMQTTDown)
+	}
+}
+
+func TestMQTTRemainingLength(t *testing.T) {
+	for _, n := range []int{0, 127, 128, 16383, 16384, 300000} {
+		var buf bytes.Buffer
+		c := &mqttClient{w: bufio.NewWriter(&buf), conn: nopConn{}}
+		if err := c.writeLocked(0x30, make([]byte, n)); err != nil {
+			t.Fatal(err)
+		}
+		header, body, err := readMQTTPacket(bufio.NewReader(&buf))
+		if err != nil || header != 0x30 || len(body) != n {
+			t.Errorf("%d bytes: read %#x, %d bytes, %v", n, header, len(body), err)
+		}
+	}
+}
+
+// nopConn is a net.Conn taking deadlines and nothing else.
+type nopConn struct{ net.Conn }
+
+func (nopConn) SetWriteDeadline(time.Time) error { return nil }
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"time"
+)
+
+// -mtu-check looks for a path MTU discovery blackhole on the way to a TCP
+// target: a router dropping the segments too large for the next link
+// while the ICMP fragmentation needed it sends back is filtered, so the
+// sender never learns to send smaller ones. The connect and small writes
+// then work, full-size segments stall.
+const (
+	// mtuCheckSmall is the write that must get through for the check to
+	// tell anything
+	mtuCheckSmall = 64
+	// mtuCheckSegments is how many full-size segments the large write is
+	mtuCheckSegments = 4
+	// mtuCheckWait is how long the writes have to be acknowledged, the
+	// retransmissions with a lowered MSS included
+	mtuCheckWait = 10 * time.Second
+)
+
+// MTUCheck is the outcome of -mtu-check on a tcp:PORT target.
+type MTUCheck struct {
+	Port int `json:"port"`
+	// MSS is that of the connection, PathMSS what path MTU discovery
+	// lowered it to during the large write, if it did
+	MSS     int  `json:"mss"`
+	PathMSS int  `json:"path_mss,omitempty"`
+	Bytes   int  `json:"bytes"`
+	SmallOK bool `json:"small_ok"`
+	LargeOK bool `json:"large_ok"`
+	// Blackhole is set when the small write got through and the large one
+	// didn't
+	Blackhole bool   `json:"blackhole"`
+	Error     string `json:"error,omitempty"`
+}
+
+// tcpDelivery is what a write of tcpDeliver came to.
+type tcpDelivery struct {
+	mss, endMSS int
+	acked       bool
+}
+
+// tcpDeliver connects to addr, writes size bytes, or mtuCheckSegments
+// full-size segments when size is 0, and waits for the peer to acknowledge
+// them. A reset counts as delivered: the peer got data it didn't want.
+func tcpDeliver(d *net.Dialer, addr string, size int) (*tcpDelivery, error) {
+	conn, err := d.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	rc, err := conn.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	mss, _, err := tcpQueue(rc)
+	if err != nil {
+		return nil, err
+	}
+	res := &tcpDelivery{mss: mss, endMSS: mss}
+	if size == 0 {
+		size = mtuCheckSegments * mss
+	}
+	deadline := time.Now().Add(mtuCheckWait)
+	_ = conn.SetWriteDeadline(deadline)
+	if _, err := conn.Write(make([]byte, size)); err != nil {
+		res.acked = isReset(err)
+		if !res.acked && !errors.Is(err, os.ErrDeadlineExceeded) {
+			return nil, err
+		}
+		return res, nil
+	}
+	for time.Now().Before(deadline) {
+		var unacked int
+		res.endMSS, unacked, err = tcpQueue(rc)
+		if err != nil {
+			return nil, err
+		}
+		if unacked == 0 {
+			res.acked = true
+			return res, nil
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return res, nil
+}
+
+func isReset(err error) bool {
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE)
+}
+
+// checkMTU runs the check on the tcp:PORT methods of t, reporting a
+// blackhole as an event of its own.
+func (m *monitor) checkMTU(t *target) {
+	for i, tp := range t.pinger.transports {
+		tt, ok := tp.(*tcpTransport)
+		if !ok {
+			continue
+		}
+		port, _ := parseMethod(t.pinger.methods[i])
+		res := &MTUCheck{Port: port}
+		if tt.proxy != nil {
+			res.Error = "the probes go through a proxy, whose own path would be checked"
+		} else {
+			mtuCheck(&tt.dialer, tt.addr, res)
+		}
+		t.mu.Lock()
+		t.mtu = res
+		t.mu.Unlock()
+		switch {
+		case res.Error != "":
+			fmt.Printf("WARN: %s: MTU check on port %d: %s\n", t.host, port, res.Error)
+		case res.Blackhole:
+			msg := fmt.Sprintf("%s: path MTU blackhole on port %d: connects and small writes get through, %d bytes in segments of %d stall: "+
+				"ICMP fragmentation needed is dropped on the way, lower the MTU or clamp the MSS", t.host, port, res.Bytes, res.MSS)
+			fmt.Println("WARN:", msg)
+			m.event(eventMTUBlackhole, t.host, msg)
+		case res.PathMSS > 0:
+			fmt.Printf(tr("%s: MTU check on port %d passed, path MTU discovery lowered the MSS from %d to %d\n"), t.host, port, res.MSS, res.PathMSS)
+		default:
+			fmt.Printf(tr("%s: MTU check on port %d passed, %d bytes in segments of %d acknowledged\n"), t.host, port, res.Bytes, res.MSS)
+		}
+	}
+}
+
+// mtuCheck fills res from a small and a large write to addr.
+func mtuCheck(d *net.Dialer, addr string, res *MTUCheck) {
+	small, err := tcpDeliver(d, addr, mtuCheckSmall)
+	if err != nil {
+		res.Error = err.Error()
+		return
+	}
+	res.MSS, res.SmallOK = small.mss, small.acked
+	if !small.acked {
+		res.Error = "even a small write is not acknowledged, nothing to tell"
+		return
+	}
+	large, err := tcpDeliver(d, addr, 0)
+	if err != nil {
+		res.Error = err.Error()
+		return
+	}
+	res.Bytes, res.LargeOK, res.Blackhole = mtuCheckSegments*large.mss, large.acked, !large.acked
+	if large.endMSS < large.mss {
+		res.PathMSS = large.endMSS
+	}
+}
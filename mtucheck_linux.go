@@ -0,0 +1,30 @@
+//go:build linux
+
+package main
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// tcpQueue returns the MSS of a connected TCP socket and the bytes written
+// to it but not yet acknowledged.
+func tcpQueue(c syscall.RawConn) (mss, unacked int, err error) {
+	cerr := c.Control(func(fd uintptr) {
+		if mss, err = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_MAXSEG); err != nil {
+			err = os.NewSyscallError("getsockopt TCP_MAXSEG", err)
+			return
+		}
+		// SIOCOUTQ, which is TIOCOUTQ on sockets
+		var n int32
+		if _, _, e := syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TIOCOUTQ, uintptr(unsafe.Pointer(&n))); e != 0 {
+			err = os.NewSyscallError("ioctl SIOCOUTQ", e)
+		}
+		unacked = int(n)
+	})
+	if cerr != nil {
+		return 0, 0, cerr
+	}
+	return mss, unacked, err
+}
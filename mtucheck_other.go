@@ -0,0 +1,12 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+func tcpQueue(syscall.RawConn) (mss, unacked int, err error) {
+	return 0, 0, errors.New("-mtu-check is only supported on Linux")
+}
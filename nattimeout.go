@@ -0,0 +1,201 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NAT state timeouts are measured against a peer running `keeping nat-echo`.
+// Each test opens a fresh UDP socket, so a fresh NAT mapping, and asks the
+// peer to answer only after the flow has been idle for the tested delay. The
+// answer makes it back only if the NAT/firewall still holds the mapping.
+//
+// Requests are "KNAT1 <id> <delay ms>", replies "KNAT1 <id>".
+
+const (
+	natMagic    = "KNAT1"
+	natMaxDelay = time.Hour
+	// natMaxPending bounds the replies a nat-echo peer is holding
+	natMaxPending = 1024
+)
+
+// natEchoMain implements `keeping nat-echo`, the peer side of nat-timeout
+// and of peer:PORT probes.
+func natEchoMain(args []string) int {
+	fs := flag.NewFlagSet("nat-echo", flag.ExitOnError)
+	listen := fs.String("listen", ":7777", "UDP address to answer on")
+	fs.Parse(args)
+
+	conn, err := net.ListenPacket("udp", *listen)
+	if err != nil {
+		fmt.Println("ERROR:", err)
+		return 1
+	}
+	defer conn.Close()
+	fmt.Printf("answering NAT timeout and peer probes on %s\n", conn.LocalAddr())
+
+	sessions := make(peerSessions)
+	var mu sync.Mutex
+	pending := 0
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			fmt.Println("ERROR:", err)
+			return 1
+		}
+		fields := strings.Fields(string(buf[:n]))
+		if len(fields) > 0 && fields[0] == peerMagic {
+			if answer := sessions.answer(fields); answer != nil {
+				_, _ = conn.WriteTo(answer, addr)
+			}
+			continue
+		}
+		if len(fields) != 3 || fields[0] != natMagic {
+			continue
+		}
+		ms, err := strconv.ParseInt(fields[2], 10, 64)
+		delay := time.Duration(ms) * time.Millisecond
+		if err != nil || delay < 0 || delay > natMaxDelay {
+			continue
+		}
+		mu.Lock()
+		if pending >= natMaxPending {
+			mu.Unlock()
+			continue
+		}
+		pending++
+		mu.Unlock()
+		answer := []byte(natMagic + " " + fields[1])
+		time.AfterFunc(delay, func() {
+			_, _ = conn.WriteTo(answer, addr)
+			mu.Lock()
+			pending--
+			mu.Unlock()
+		})
+	}
+}
+
+// natTimeoutMain implements `keeping nat-timeout`, which binary-searches the
+// idle time after which the path stops delivering replies of a UDP flow.
+func natTimeoutMain(args []string) int {
+	fs := flag.NewFlagSet("nat-timeout", flag.ExitOnError)
+	min := fs.Duration("min", 10*time.Second, "idle time expected to work")
+	max := fs.Duration("max", 10*time.Minute, "longest idle time to try")
+	resolution := fs.Duration("resolution", 5*time.Second, "stop once the timeout is known this precisely")
+	fs.Usage = func() {
+		fmt.Println("Usage: keeping nat-timeout [-min 10s] [-max 10m] [-resolution 5s] host:port")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 || *min <= 0 || *max <= *min || *max > natMaxDelay {
+		fs.Usage()
+		return 2
+	}
+	peer, err := net.ResolveUDPAddr("udp", fs.Arg(0))
+	if err != nil {
+		fmt.Println("ERROR:", err)
+		return 1
+	}
+
+	test := func(idle time.Duration) (bool, error) {
+		fmt.Printf("idle %v ... ", idle)
+		ok, err := natTest(peer, idle)
+		switch {
+		case err != nil:
+			fmt.Println("error")
+		case ok:
+			fmt.Println("reply received")
+		default:
+			fmt.Println("no reply")
+		}
+		return ok, err
+	}
+
+	ok, err := test(*min)
+	if err != nil {
+		fmt.Println("ERROR:", err)
+		return 1
+	}
+	if !ok {
+		fmt.Printf("no reply even after %v idle: the state timeout is shorter, or %s is not answering\n", *min, peer)
+		return 1
+	}
+	if ok, err = test(*max); err != nil {
+		fmt.Println("ERROR:", err)
+		return 1
+	} else if ok {
+		fmt.Printf("flow state survives at least %v idle\n", *max)
+		return 0
+	}
+	lo, hi := *min, *max
+	for hi-lo > *resolution {
+		mid := lo + (hi-lo)/2
+		ok, err := test(mid)
+		if err != nil {
+			fmt.Println("ERROR:", err)
+			return 1
+		}
+		if ok {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	fmt.Printf("flow state timeout is between %v and %v, keep keepalives below %v\n", lo, hi, lo)
+	return 0
+}
+
+// natTest reports whether a reply held back by the peer for idle still
+// reaches a fresh socket. The request is sent a few times since losing it
+// would otherwise look like an expired mapping.
+func natTest(peer *net.UDPAddr, idle time.Duration) (bool, error) {
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return false, err
+	}
+	id := hex.EncodeToString(b[:])
+	req := []byte(fmt.Sprintf("%s %s %d", natMagic, id, idle.Milliseconds()))
+	const tries = 3
+	for i := 0; i < tries; i++ {
+		if _, err := conn.WriteToUDP(req, peer); err != nil {
+			return false, err
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	want := natMagic + " " + id
+	deadline := time.Now().Add(idle + 5*time.Second)
+	buf := make([]byte, 512)
+	for {
+		if err := conn.SetReadDeadline(deadline); err != nil {
+			return false, err
+		}
+		n, _, err := conn.ReadFromUDP(buf)
+		var neterr net.Error
+		if errors.As(err, &neterr) && neterr.Timeout() {
+			return false, nil
+		}
+		if err != nil {
+			// e.g. ICMP port unreachable: nobody answers there
+			return false, err
+		}
+		if string(buf[:n]) == want {
+			return true, nil
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"time"
+)
+
+// notifyTimeout bounds showing a desktop notification.
+const notifyTimeout = 10 * time.Second
+
+// desktopNotifier is the sink of -notify, a desktop notification whenever a
+// target goes down or comes back up, for whoever watches their connection
+// from their workstation: notify-send, the Notification Center of macOS or
+// a Windows toast.
+type desktopNotifier struct {
+	health *healthTracker
+	down   map[string]time.Time
+}
+
+func newDesktopNotifier(slowMs float64) (*desktopNotifier, error) {
+	if _, err := exec.LookPath(notifyTool); err != nil {
+		return nil, fmt.Errorf("-notify needs %s: %w", notifyTool, err)
+	}
+	return &desktopNotifier{health: newHealthTracker(slowMs), down: make(map[string]time.Time)}, nil
+}
+
+func (s *desktopNotifier) HandleResult(r *Result) error {
+	return s.update(r.Target, s.health.result(r), r.Time)
+}
+
+func (s *desktopNotifier) HandleInterval(st *IntervalStats) error {
+	return s.update(st.Target, s.health.interval(st), st.Time)
+}
+
+func (s *desktopNotifier) HandleEvent(*Event) error { return nil }
+func (s *desktopNotifier) Flush() error             { return nil }
+func (s *desktopNotifier) unsampled()               {}
+
+// unredacted: the notification shows on this host.
+func (s *desktopNotifier) unredacted() {}
+
+func (s *desktopNotifier) update(target, state string, now time.Time) error {
+	if state == "" {
+		return nil
+	}
+	first := s.health.state[target] == ""
+	s.health.set(target, state)
+	var title, body string
+	switch {
+	case state == "down":
+		s.down[target] = now
+		title = fmt.Sprintf(tr("%s is down"), target)
+		body = fmt.Sprintf(tr("%d probes lost in a row"), s.health.lost[target])
+		if s.health.slow[target] {
+			body = fmt.Sprintf(tr("average RTT above %s"), output.Ms(s.health.SlowMs, 0))
+		}
+	case first:
+		// up from the start is no news
+		return nil
+	default:
+		title = fmt.Sprintf(tr("%s is back up"), target)
+		body = fmt.Sprintf(tr("after %s down"), now.Sub(s.down[target]).Round(time.Second))
+		delete(s.down, target)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+	defer cancel()
+	return commandError(notifyTool, notifyCommand(ctx, "keeping: "+title, body).CombinedOutput)
+}
@@ -0,0 +1,21 @@
+//go:build darwin
+
+package main
+
+import (
+	"context"
+	"os/exec"
+)
+
+// notifyTool shows the notifications in the Notification Center.
+const notifyTool = "osascript"
+
+// notifyCommand passes the texts as arguments of the script, which doesn't
+// have to quote them then.
+func notifyCommand(ctx context.Context, title, body string) *exec.Cmd {
+	return exec.CommandContext(ctx, notifyTool,
+		"-e", "on run argv",
+		"-e", "display notification (item 2 of argv) with title (item 1 of argv)",
+		"-e", "end run",
+		title, body)
+}
@@ -0,0 +1,15 @@
+//go:build !darwin && !windows
+
+package main
+
+import (
+	"context"
+	"os/exec"
+)
+
+// notifyTool shows the notifications, from libnotify on Linux and the BSDs.
+const notifyTool = "notify-send"
+
+func notifyCommand(ctx context.Context, title, body string) *exec.Cmd {
+	return exec.CommandContext(ctx, notifyTool, "--app-name=keeping", title, body)
+}
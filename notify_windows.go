@@ -0,0 +1,28 @@
+//go:build windows
+
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+)
+
+// notifyTool shows the notifications as toasts.
+const notifyTool = "powershell"
+
+// notifyToast is the script showing a toast of $env:KEEPING_NOTIFY_TITLE
+// and $env:KEEPING_NOTIFY_BODY, passed in the environment to need no
+// quoting.
+const notifyToast = `[Windows.UI.Notifications.ToastNotificationManager, Windows.UI.Notifications, ContentType = WindowsRuntime] > $null
+$xml = [Windows.UI.Notifications.ToastNotificationManager]::GetTemplateContent([Windows.UI.Notifications.ToastTemplateType]::ToastText02)
+$text = $xml.GetElementsByTagName('text')
+$text.Item(0).AppendChild($xml.CreateTextNode($env:KEEPING_NOTIFY_TITLE)) > $null
+$text.Item(1).AppendChild($xml.CreateTextNode($env:KEEPING_NOTIFY_BODY)) > $null
+[Windows.UI.Notifications.ToastNotificationManager]::CreateToastNotifier('keeping').Show([Windows.UI.Notifications.ToastNotification]::new($xml))`
+
+func notifyCommand(ctx context.Context, title, body string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, notifyTool, "-NoProfile", "-NonInteractive", "-Command", notifyToast)
+	cmd.Env = append(os.Environ(), "KEEPING_NOTIFY_TITLE="+title, "KEEPING_NOTIFY_BODY="+body)
+	return cmd
+}
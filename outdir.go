@@ -0,0 +1,113 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// fileName makes a target name usable as a file name.
+var fileName = strings.NewReplacer("/", "_", "\\", "_", ":", "_", "*", "_", "?", "_")
+
+// outDir is the sink writing the records of each target to a file of its
+// own in dir, as JSON lines like -json, named after a template where
+// {target}, {group} and {date}, the day the run started, are filled in.
+// Events not about a target stay out, but for the run record which every
+// file gets.
+type outDir struct {
+	dir      string
+	name     string
+	compress string
+	start    time.Time
+	files    map[string]*jsonSink
+	run      *Event
+}
+
+func newOutDir(dir, name, compress string) (*outDir, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &outDir{dir: dir, name: name, compress: compress, start: time.Now(), files: make(map[string]*jsonSink)}, nil
+}
+
+// file returns the sink of target, opening it the first time.
+func (s *outDir) file(target, group string) (*jsonSink, error) {
+	if f, ok := s.files[target]; ok {
+		return f, nil
+	}
+	if group == "" {
+		group = target
+	}
+	name := strings.NewReplacer(
+		"{target}", fileName.Replace(target),
+		"{group}", fileName.Replace(group),
+		"{date}", output.Time(s.start, "2006-01-02", time.Local),
+	).Replace(s.name)
+	f, err := newJSONSink(logPath(filepath.Join(s.dir, name), s.compress), s.compress)
+	if err != nil {
+		return nil, err
+	}
+	s.files[target] = f
+	if s.run != nil {
+		if err := f.HandleEvent(s.run); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+func (s *outDir) HandleResult(r *Result) error {
+	f, err := s.file(r.Target, r.Group)
+	if err != nil {
+		return err
+	}
+	return f.HandleResult(r)
+}
+
+func (s *outDir) HandleInterval(st *IntervalStats) error {
+	f, err := s.file(st.Target, st.Group)
+	if err != nil {
+		return err
+	}
+	return f.HandleInterval(st)
+}
+
+func (s *outDir) HandleEvent(e *Event) error {
+	if e.Type == eventRun {
+		s.run = e
+		for _, f := range s.files {
+			if err := f.HandleEvent(e); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if e.Target == "" {
+		return nil
+	}
+	f, err := s.file(e.Target, "")
+	if err != nil {
+		return err
+	}
+	return f.HandleEvent(e)
+}
+
+func (s *outDir) Flush() error {
+	for _, f := range s.files {
+		if err := f.Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *outDir) Close() error {
+	var first error
+	for _, f := range s.files {
+		if err := f.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// Payload patterns of -random-padding, what the bytes past the send time
+// and the tracker are: ones is what a probe carries otherwise.
+const (
+	patternOnes   = "ones"
+	patternZeros  = "zeros"
+	patternFF     = "0xff"
+	patternRandom = "random"
+)
+
+var paddingPatterns = []string{patternOnes, patternZeros, patternFF, patternRandom}
+
+// maxPaddingSize bounds the payload of -random-padding, beyond it an IPv4
+// packet won't fit.
+const maxPaddingSize = 65507
+
+// readPayloadFile reads the body of -payload-file, what the probes carry
+// past the send time and the tracker instead of the padding; it is cut to
+// the payload size of every probe, or padded with zeros to it.
+func readPayloadFile(path string) ([]byte, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > maxPaddingSize-minPayloadSize {
+		b = b[:maxPaddingSize-minPayloadSize]
+	}
+	return b, nil
+}
+
+// randomPadding draws the payload size and pattern of every probe from its
+// sequence number, for routers treating small fixed ICMP packets apart not
+// to bias the RTTs; the reply is checked against the same draw.
+type randomPadding struct {
+	min, max int
+	seed     uint64
+}
+
+// parseRandomPadding parses -random-padding, MIN:MAX payload bytes.
+func parseRandomPadding(s string) (*randomPadding, error) {
+	lo, hi, ok := strings.Cut(s, ":")
+	min, err1 := strconv.Atoi(lo)
+	max, err2 := strconv.Atoi(hi)
+	switch {
+	case !ok || err1 != nil || err2 != nil || max < min:
+		return nil, fmt.Errorf("invalid -random-padding %q, want MIN:MAX payload bytes", s)
+	case min < minPayloadSize:
+		return nil, fmt.Errorf("-random-padding starts below the minimum size %d", minPayloadSize)
+	case max > maxPaddingSize:
+		return nil, fmt.Errorf("-random-padding goes above the largest payload, %d", maxPaddingSize)
+	}
+	return &randomPadding{min: min, max: max, seed: rand.Uint64()}, nil
+}
+
+func (rp *randomPadding) String() string {
+	return fmt.Sprintf("%d:%d", rp.min, rp.max)
+}
+
+// splitmix64 is a step of the SplitMix64 generator, spreading the bits of x.
+func splitmix64(x uint64) uint64 {
+	x += 0x9e3779b97f4a7c15
+	x = (x ^ x>>30) * 0xbf58476d1ce4e5b9
+	x = (x ^ x>>27) * 0x94d049bb133111eb
+	return x ^ x>>31
+}
+
+func (rp *randomPadding) draw(seq int) uint64 {
+	return splitmix64(rp.seed ^ uint64(seq))
+}
+
+// size is the payload size of probe seq.
+func (rp *randomPadding) size(seq int) int {
+	return rp.min + int(rp.draw(seq)%uint64(rp.max-rp.min+1))
+}
+
+// pattern is the padding pattern of probe seq.
+func (rp *randomPadding) pattern(seq int) string {
+	return paddingPatterns[rp.draw(seq)>>32%uint64(len(paddingPatterns))]
+}
+
+// fill writes the padding of probe seq to b.
+func (rp *randomPadding) fill(seq int, b []byte) {
+	var v byte
+	switch rp.pattern(seq) {
+	case patternOnes:
+		v = 1
+	case patternFF:
+		v = 0xff
+	case patternRandom:
+		x := rp.draw(seq)
+		for i := range b {
+			if i%8 == 0 {
+				x = splitmix64(x)
+			}
+			b[i] = byte(x >> (8 * (i % 8)))
+		}
+		return
+	}
+	for i := range b {
+		b[i] = v
+	}
+}
+
+var sizeClasses = []string{"small", "medium", "large"}
+
+// classBounds are the smallest and largest size of class i, a third of the
+// range.
+func (rp *randomPadding) classBounds(i int) (lo, hi int) {
+	span := rp.max - rp.min + 1
+	return rp.min + (i*span+2)/3, rp.min + ((i+1)*span+2)/3 - 1
+}
+
+// class is the size class a payload size is in.
+func (rp *randomPadding) class(size int) string {
+	i := (size - rp.min) * 3 / (rp.max - rp.min + 1)
+	lo, hi := rp.classBounds(i)
+	return fmt.Sprintf("%s %d-%dB", sizeClasses[i], lo, hi)
+}
+
+// ClassStats is the RTT of the probes of one size class or pattern of
+// -random-padding.
+type ClassStats struct {
+	Class   string  `json:"class"`
+	Sent    int     `json:"sent"`
+	Recv    int     `json:"recv"`
+	LossPct float64 `json:"loss_pct"`
+	MinMs   float64 `json:"min_ms,omitempty"`
+	AvgMs   float64 `json:"avg_ms,omitempty"`
+	MaxMs   float64 `json:"max_ms,omitempty"`
+}
+
+// paddingStats gathers the RTTs of a target by size class and by pattern.
+type paddingStats struct {
+	mu sync.Mutex
+	rp *randomPadding
+	// classes are those the range has sizes in, smallest first
+	classes []string
+	sent    map[string]int
+	rtts    map[string][]time.Duration
+}
+
+func newPaddingStats(rp *randomPadding) *paddingStats {
+	ps := &paddingStats{rp: rp, sent: make(map[string]int), rtts: make(map[string][]time.Duration)}
+	for i := range sizeClasses {
+		if lo, hi := rp.classBounds(i); lo <= hi {
+			ps.classes = append(ps.classes, rp.class(lo))
+		}
+	}
+	return ps
+}
+
+func (ps *paddingStats) send(pkt *Packet) {
+	if pkt.Size == 0 {
+		return
+	}
+	ps.mu.Lock()
+	ps.sent[ps.rp.class(pkt.Size)]++
+	ps.sent[pkt.Pattern]++
+	ps.mu.Unlock()
+}
+
+func (ps *paddingStats) recv(pkt *Packet) {
+	if pkt.Size == 0 {
+		return
+	}
+	ps.mu.Lock()
+	class := ps.rp.class(pkt.Size)
+	ps.rtts[class] = append(ps.rtts[class], pkt.Rtt)
+	ps.rtts[pkt.Pattern] = append(ps.rtts[pkt.Pattern], pkt.Rtt)
+	ps.mu.Unlock()
+}
+
+// Stats returns the size classes, smallest first, then the patterns.
+func (ps *paddingStats) Stats() []ClassStats {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	var out []ClassStats
+	for _, class := range append(append([]string(nil), ps.classes...), paddingPatterns...) {
+		st := ClassStats{Class: class, Sent: ps.sent[class], Recv: len(ps.rtts[class])}
+		if st.Sent == 0 {
+			continue
+		}
+		st.LossPct = float64(st.Sent-st.Recv) / float64(st.Sent) * 100
+		if st.LossPct < 0 {
+			st.LossPct = 0
+		}
+		var sum, lo, hi time.Duration
+		for i, rtt := range ps.rtts[class] {
+			if i == 0 || rtt < lo {
+				lo = rtt
+			}
+			if rtt > hi {
+				hi = rtt
+			}
+			sum += rtt
+		}
+		if st.Recv > 0 {
+			st.MinMs, st.AvgMs, st.MaxMs = ms(lo), ms(sum/time.Duration(st.Recv)), ms(hi)
+		}
+		out = append(out, st)
+	}
+	return out
+}
+
+// Compare tells whether the large probes fare differently from the small
+// ones beyond the noise, and the patterns from the usual one.
+func (ps *paddingStats) Compare() []string {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	var out []string
+	small, large := ps.classes[0], ps.classes[len(ps.classes)-1]
+	if small != large && len(ps.rtts[small]) >= 2 && len(ps.rtts[large]) >= 2 {
+		out = append(out, compareRtts(small, durationsMs(ps.rtts[small]), large, durationsMs(ps.rtts[large])))
+	}
+	for _, pat := range paddingPatterns[1:] {
+		if len(ps.rtts[patternOnes]) >= 2 && len(ps.rtts[pat]) >= 2 {
+			out = append(out, compareRtts(patternOnes, durationsMs(ps.rtts[patternOnes]), pat, durationsMs(ps.rtts[pat])))
+		}
+	}
+	return out
+}
+
+// formatPadding is the table of a target's statistics by size class and
+// pattern, with cmp, the significance of their differences.
+func formatPadding(name string, stats []ClassStats, cmp []string) string {
+	if len(stats) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, tr("\n--- %s RTT by size class and pattern ---\n"), name)
+	tw := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "class\tsent\trecv\tloss\tmin\tavg\tmax")
+	for _, st := range stats {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%.1f%%\t%s\t%s\t%s\n",
+			st.Class, st.Sent, st.Recv, st.LossPct, output.Ms(st.MinMs, 3), output.Ms(st.AvgMs, 3), output.Ms(st.MaxMs, 3))
+	}
+	tw.Flush()
+	for _, c := range cmp {
+		fmt.Fprintln(&b, c)
+	}
+	return b.String()
+}
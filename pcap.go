@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// pcapSnapLen is the most of a packet kept, all of a probe
+	pcapSnapLen = 65535
+	// pcapLinkTypeRaw is LINKTYPE_RAW, packets starting with their IPv4 or
+	// IPv6 header
+	pcapLinkTypeRaw = 101
+)
+
+// pcapWriter writes packets to a pcap file with nanosecond timestamps, as
+// Wireshark and tcpdump read it.
+type pcapWriter struct {
+	mu sync.Mutex
+	f  *os.File
+	w  *bufio.Writer
+	n  int
+}
+
+func createPcap(path string) (*pcapWriter, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	pw := &pcapWriter{f: f, w: bufio.NewWriter(f)}
+	var hdr [24]byte
+	binary.LittleEndian.PutUint32(hdr[0:], 0xa1b23c4d)
+	binary.LittleEndian.PutUint16(hdr[4:], 2)
+	binary.LittleEndian.PutUint16(hdr[6:], 4)
+	binary.LittleEndian.PutUint32(hdr[16:], pcapSnapLen)
+	binary.LittleEndian.PutUint32(hdr[20:], pcapLinkTypeRaw)
+	if _, err := pw.w.Write(hdr[:]); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return pw, nil
+}
+
+// write adds the packet pkt, seen at t.
+func (pw *pcapWriter) write(t time.Time, pkt []byte) error {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	var hdr [16]byte
+	binary.LittleEndian.PutUint32(hdr[0:], uint32(t.Unix()))
+	binary.LittleEndian.PutUint32(hdr[4:], uint32(t.Nanosecond()))
+	binary.LittleEndian.PutUint32(hdr[8:], uint32(len(pkt)))
+	binary.LittleEndian.PutUint32(hdr[12:], uint32(len(pkt)))
+	if _, err := pw.w.Write(hdr[:]); err != nil {
+		return err
+	}
+	_, err := pw.w.Write(pkt)
+	pw.n++
+	return err
+}
+
+func (pw *pcapWriter) Close() error {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	if err := pw.w.Flush(); err != nil {
+		pw.f.Close()
+		return err
+	}
+	return pw.f.Close()
+}
@@ -0,0 +1,178 @@
+//go:build linux && !nopcap
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/bpf"
+)
+
+// ethPAll is ETH_P_ALL in network order, all protocols.
+const ethPAll = 0x0300
+
+// capture writes the packets to and from the targets' addresses to a pcap
+// file, read off an AF_PACKET socket the kernel filters by a BPF program of
+// those addresses, rebuilt as targets come.
+type capture struct {
+	fd   int
+	pw   *pcapWriter
+	mu   sync.Mutex
+	ips  []net.IP
+	seen map[string]bool
+	// loopback are the indexes of loopback interfaces, where every packet
+	// is seen going out and coming in
+	loopback map[int]bool
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// openCapture starts capturing to path, nothing until Watch adds an
+// address. It needs CAP_NET_RAW.
+func openCapture(path string) (*capture, error) {
+	// protocol 0 receives nothing until bound, once the filter is on
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("-pcap: %w", err)
+	}
+	c := &capture{fd: fd, seen: make(map[string]bool), loopback: make(map[int]bool),
+		stop: make(chan struct{}), done: make(chan struct{})}
+	if err := c.setFilter(); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	// so reads return now and then to see whether to stop
+	tv := syscall.NsecToTimeval(int64(200 * time.Millisecond))
+	if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("-pcap: %w", err)
+	}
+	if err := syscall.Bind(fd, &syscall.SockaddrLinklayer{Protocol: ethPAll}); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("-pcap: %w", err)
+	}
+	if ifs, err := net.Interfaces(); err == nil {
+		for _, ifi := range ifs {
+			if ifi.Flags&net.FlagLoopback != 0 {
+				c.loopback[ifi.Index] = true
+			}
+		}
+	}
+	if c.pw, err = createPcap(path); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	go c.run()
+	return c, nil
+}
+
+// Watch captures the packets to and from ip too.
+func (c *capture) Watch(ip net.IP) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.seen[ip.String()] {
+		return nil
+	}
+	c.seen[ip.String()] = true
+	c.ips = append(c.ips, ip)
+	return c.setFilter()
+}
+
+// setFilter attaches the filter of c.ips; c.mu held or not shared yet.
+func (c *capture) setFilter() error {
+	raw, err := bpf.Assemble(captureFilter(c.ips))
+	if err != nil {
+		return fmt.Errorf("-pcap filter: %w", err)
+	}
+	prog := make([]syscall.SockFilter, len(raw))
+	for i, r := range raw {
+		prog[i] = syscall.SockFilter{Code: r.Op, Jt: r.Jt, Jf: r.Jf, K: r.K}
+	}
+	if err := syscall.AttachLsf(c.fd, prog); err != nil {
+		return fmt.Errorf("-pcap filter: %w", err)
+	}
+	return nil
+}
+
+// captureFilter is a BPF program accepting the IPv4 and IPv6 packets from
+// or to ips. The conditional jumps of BPF go 255 instructions at most, so
+// every match returns right away.
+func captureFilter(ips []net.IP) []bpf.Instruction {
+	accept, drop := bpf.RetConstant{Val: pcapSnapLen}, bpf.RetConstant{Val: 0}
+	var v4, v6 []bpf.Instruction
+	for _, off := range []uint32{12, 16} {
+		// the source, then the destination address
+		v4 = append(v4, bpf.LoadAbsolute{Off: off, Size: 4})
+		for _, ip := range ips {
+			if ip4 := ip.To4(); ip4 != nil {
+				v4 = append(v4, bpf.JumpIf{Cond: bpf.JumpNotEqual, Val: beUint32(ip4), SkipTrue: 1}, accept)
+			}
+		}
+	}
+	v4 = append(v4, drop)
+	for _, off := range []uint32{8, 24} {
+		for _, ip := range ips {
+			if ip.To4() != nil {
+				continue
+			}
+			ip16 := ip.To16()
+			for k := uint32(0); k < 4; k++ {
+				v6 = append(v6, bpf.LoadAbsolute{Off: off + 4*k, Size: 4},
+					bpf.JumpIf{Cond: bpf.JumpNotEqual, Val: beUint32(ip16[4*k:]), SkipTrue: uint8((3-k)*2 + 1)})
+			}
+			v6 = append(v6, accept)
+		}
+	}
+	v6 = append(v6, drop)
+	prog := []bpf.Instruction{
+		bpf.LoadExtension{Num: bpf.ExtProto},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: syscall.ETH_P_IPV6, SkipFalse: 1},
+		bpf.Jump{Skip: uint32(len(v4) + 2)},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: syscall.ETH_P_IP, SkipTrue: 1},
+		drop,
+	}
+	return append(append(prog, v4...), v6...)
+}
+
+func beUint32(b []byte) uint32 {
+	return uint32(b[0])<<24 | uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3])
+}
+
+func (c *capture) run() {
+	defer close(c.done)
+	buf := make([]byte, pcapSnapLen)
+	for {
+		select {
+		case <-c.stop:
+			return
+		default:
+		}
+		n, from, err := syscall.Recvfrom(c.fd, buf, 0)
+		if err == syscall.EAGAIN || err == syscall.EINTR {
+			continue
+		} else if err != nil {
+			fmt.Println("WARN: -pcap:", err)
+			return
+		}
+		if ll, ok := from.(*syscall.SockaddrLinklayer); ok && ll.Pkttype == syscall.PACKET_OUTGOING && c.loopback[ll.Ifindex] {
+			// seen again coming in
+			continue
+		}
+		if err := c.pw.write(time.Now(), buf[:n]); err != nil {
+			fmt.Println("WARN: -pcap:", err)
+			return
+		}
+	}
+}
+
+// Close stops capturing and returns the packets written.
+func (c *capture) Close() (int, error) {
+	close(c.stop)
+	<-c.done
+	syscall.Close(c.fd)
+	return c.pw.n, c.pw.Close()
+}
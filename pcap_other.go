@@ -0,0 +1,19 @@
+//go:build !linux || nopcap
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// capture is only implemented on Linux builds without the nopcap tag.
+type capture struct{}
+
+func openCapture(path string) (*capture, error) {
+	return nil, errors.New("-pcap needs Linux, and a build without the nopcap tag")
+}
+
+func (c *capture) Watch(ip net.IP) error { return nil }
+
+func (c *capture) Close() (int, error) { return 0, nil }
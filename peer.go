@@ -0,0 +1,202 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// peer:PORT probes are UDP datagrams to a host running `keeping nat-echo`,
+// which answers each at once with how many probes of the session it got and
+// the highest send count among them. That tells a lost probe from a lost
+// reply, the loss of each direction, which an ICMP echo can't.
+//
+// Requests are "KPEER1 <session> <seq> <n>", n counting the probes sent,
+// replies "KPEER1 <session> <seq> <received> <highest n>".
+
+const (
+	protocolPeer = "peer"
+	peerMagic    = "KPEER1"
+	// peerMaxSessions bounds the sessions a nat-echo peer keeps count of,
+	// the longest idle ones are forgotten first
+	peerMaxSessions = 1024
+	// peerMessage is about the size of a request or reply, UDP header
+	// included
+	peerMessage = 8 + 48
+)
+
+// DirectionalLoss is what the replies of peer probes tell: of Sent probes
+// the peer received PeerRecv, answering every one of them, and Recv of its
+// replies came back.
+type DirectionalLoss struct {
+	Sent     int
+	PeerRecv int
+	Recv     int
+}
+
+// Forward is the percentage of probes lost on the way to the peer.
+func (d DirectionalLoss) Forward() float64 {
+	if d.Sent <= 0 {
+		return 0
+	}
+	return float64(d.Sent-d.PeerRecv) / float64(d.Sent) * 100
+}
+
+// Reverse is the percentage of replies lost on the way back.
+func (d DirectionalLoss) Reverse() float64 {
+	if d.PeerRecv <= 0 {
+		return 0
+	}
+	return float64(d.PeerRecv-d.Recv) / float64(d.PeerRecv) * 100
+}
+
+func (d DirectionalLoss) sub(prev DirectionalLoss) DirectionalLoss {
+	return DirectionalLoss{Sent: d.Sent - prev.Sent, PeerRecv: d.PeerRecv - prev.PeerRecv, Recv: d.Recv - prev.Recv}
+}
+
+// String is the loss each way as the statistics show it.
+func (d DirectionalLoss) String() string {
+	return fmt.Sprintf(tr("forward/reverse loss = %.1f%%/%.1f%%, the peer got %d of %d probes and %d of its replies came back"),
+		d.Forward(), d.Reverse(), d.PeerRecv, d.Sent, d.Recv)
+}
+
+// peerTransport probes a nat-echo peer over UDP.
+type peerTransport struct {
+	conn    net.Conn
+	session string
+
+	mu sync.Mutex
+	// sent counts the probes, highest and peerRecv are the latest counts
+	// the peer replied with and recv the replies counted in them
+	sent, highest, peerRecv, recv int
+}
+
+func newPeerTransport(p *Pinger, port int) (*peerTransport, error) {
+	if p.Proxy != "" {
+		return nil, fmt.Errorf("%s: peer probes are UDP, which can't go through a proxy", p.addr)
+	}
+	d := net.Dialer{Control: routingControl(p.Mark, p.Device)}
+	if p.Source != "" {
+		ip := net.ParseIP(p.Source)
+		if ip == nil {
+			return nil, errors.New("invalid source address " + p.Source)
+		}
+		d.LocalAddr = &net.UDPAddr{IP: ip}
+	}
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return nil, err
+	}
+	conn, err := d.Dial("udp", net.JoinHostPort(p.ipaddr.String(), strconv.Itoa(port)))
+	if err != nil {
+		return nil, err
+	}
+	return &peerTransport{conn: conn, session: hex.EncodeToString(b[:])}, nil
+}
+
+func (t *peerTransport) Close() error {
+	return t.conn.Close()
+}
+
+func (t *peerTransport) send(seq int) (*Packet, error) {
+	t.mu.Lock()
+	t.sent++
+	n := t.sent
+	t.mu.Unlock()
+	_, err := fmt.Fprintf(t.conn, "%s %s %d %d", peerMagic, t.session, seq, n)
+	return &Packet{Seq: seq}, err
+}
+
+func (t *peerTransport) receive() (*reply, error) {
+	buf := make([]byte, 512)
+	for {
+		n, err := t.conn.Read(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return nil, err
+		} else if err != nil {
+			// a port unreachable for an earlier probe, which times out
+			continue
+		}
+		now := time.Now()
+		f := strings.Fields(string(buf[:n]))
+		if len(f) != 5 || f[0] != peerMagic || f[1] != t.session {
+			continue
+		}
+		seq, err1 := strconv.Atoi(f[2])
+		recv, err2 := strconv.Atoi(f[3])
+		highest, err3 := strconv.Atoi(f[4])
+		if err1 != nil || err2 != nil || err3 != nil {
+			continue
+		}
+		t.mu.Lock()
+		t.recv++
+		if recv > t.peerRecv {
+			t.peerRecv = recv
+		}
+		if highest > t.highest {
+			t.highest = highest
+		}
+		t.mu.Unlock()
+		return &reply{seq: seq, receivedAt: now, pkt: &Packet{TTL: -1, Nbytes: n}}, nil
+	}
+}
+
+// directional is the loss each way so far. The probes and replies still in
+// flight are left out: only the probes up to the highest the peer saw
+// count, and only its replies up to the latest that came back.
+func (t *peerTransport) directional() DirectionalLoss {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	recv := t.recv
+	if recv > t.peerRecv {
+		recv = t.peerRecv
+	}
+	return DirectionalLoss{Sent: t.highest, PeerRecv: t.peerRecv, Recv: recv}
+}
+
+// peerSession is the count a nat-echo peer keeps of a session.
+type peerSession struct {
+	recv, highest int
+	last          time.Time
+}
+
+// peerSessions are the sessions a nat-echo peer answers.
+type peerSessions map[string]*peerSession
+
+// answer counts the request f and returns the reply to it, nil when it is
+// not a valid one.
+func (ss peerSessions) answer(f []string) []byte {
+	if len(f) != 4 {
+		return nil
+	}
+	n, err := strconv.Atoi(f[3])
+	if err != nil || n < 1 {
+		return nil
+	}
+	s := ss[f[1]]
+	if s == nil {
+		if len(ss) >= peerMaxSessions {
+			var oldest string
+			for id, s := range ss {
+				if oldest == "" || s.last.Before(ss[oldest].last) {
+					oldest = id
+				}
+			}
+			delete(ss, oldest)
+		}
+		s = &peerSession{}
+		ss[f[1]] = s
+	}
+	s.recv++
+	if n > s.highest {
+		s.highest = n
+	}
+	s.last = time.Now()
+	return []byte(fmt.Sprintf("%s %s %s %d %d", peerMagic, f[1], f[2], s.recv, s.highest))
+}
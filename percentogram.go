@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// percentogramColumns is the schema of -percentogram rows, one per target
+// and minute: the RTT percentiles of the replies of that minute. Far smaller
+// than a log of every probe, it keeps the shape of the distribution that
+// min/avg/max lose.
+var percentogramColumns = []string{"time", "target", "group", "sent", "lost", "p1_ms", "p25_ms", "p50_ms", "p75_ms", "p99_ms"}
+
+var percentogramRanks = []float64{1, 25, 50, 75, 99}
+
+// percentogramRow is a -percentogram row, the percentiles nil in a minute
+// without replies.
+type percentogramRow struct {
+	Time   time.Time `json:"time"`
+	Target string    `json:"target"`
+	Group  string    `json:"group"`
+	Sent   int       `json:"sent"`
+	Lost   int       `json:"lost"`
+	P1     *float64  `json:"p1_ms"`
+	P25    *float64  `json:"p25_ms"`
+	P50    *float64  `json:"p50_ms"`
+	P75    *float64  `json:"p75_ms"`
+	P99    *float64  `json:"p99_ms"`
+}
+
+// percentogramMinute gathers the results of a target in the current minute.
+type percentogramMinute struct {
+	start      time.Time
+	group      string
+	sent, lost int
+	rtts       []float64
+}
+
+// percentogram is the sink appending -percentogram rows to a file, CSV if
+// it ends in .csv, JSON lines otherwise, as -intervals does.
+type percentogram struct {
+	f       *os.File
+	w       *bufio.Writer
+	csv     *csv.Writer
+	enc     *json.Encoder
+	minutes map[string]*percentogramMinute
+}
+
+func newPercentogram(path string) (*percentogram, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	s := &percentogram{f: f, w: bufio.NewWriter(f), minutes: make(map[string]*percentogramMinute)}
+	if !strings.HasSuffix(path, ".csv") {
+		s.enc = json.NewEncoder(s.w)
+		return s, nil
+	}
+	s.csv = csv.NewWriter(s.w)
+	if fi, err := f.Stat(); err == nil && fi.Size() == 0 {
+		_ = s.csv.Write(percentogramColumns)
+	}
+	return s, nil
+}
+
+// unsampled: the percentiles are of every reply, whatever -sample keeps.
+func (s *percentogram) unsampled() {}
+
+func (s *percentogram) HandleInterval(*IntervalStats) error { return nil }
+func (s *percentogram) HandleEvent(*Event) error            { return nil }
+
+func (s *percentogram) HandleResult(r *Result) error {
+	lost := false
+	switch r.Status {
+	case resultOK:
+	case resultTimeout, resultError:
+		lost = true
+	default:
+		return nil
+	}
+	start := r.Time.Truncate(time.Minute)
+	cur := s.minutes[r.Target]
+	if cur != nil && start.After(cur.start) {
+		if err := s.write(r.Target, cur); err != nil {
+			return err
+		}
+		cur = nil
+	}
+	if cur == nil {
+		cur = &percentogramMinute{start: start, group: r.Group}
+		s.minutes[r.Target] = cur
+	}
+	cur.sent++
+	if lost {
+		cur.lost++
+	} else {
+		cur.rtts = append(cur.rtts, r.RttMs)
+	}
+	return nil
+}
+
+// percentile is the nearest-rank p-th percentile of sorted.
+func percentile(sorted []float64, p float64) float64 {
+	i := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
+
+// write appends the row of the minute m of target.
+func (s *percentogram) write(target string, m *percentogramMinute) error {
+	row := &percentogramRow{Time: output.Zone(m.start), Target: target, Group: m.group, Sent: m.sent, Lost: m.lost}
+	rec := []string{output.Time(row.Time, time.RFC3339, time.UTC), target, m.group,
+		strconv.Itoa(m.sent), strconv.Itoa(m.lost)}
+	sort.Float64s(m.rtts)
+	for i, dst := range []**float64{&row.P1, &row.P25, &row.P50, &row.P75, &row.P99} {
+		if len(m.rtts) == 0 {
+			rec = append(rec, "")
+			continue
+		}
+		v := percentile(m.rtts, percentogramRanks[i])
+		*dst = &v
+		rec = append(rec, output.MsField(v, 3))
+	}
+	if s.enc != nil {
+		if err := s.enc.Encode(row); err != nil {
+			return err
+		}
+	} else {
+		_ = s.csv.Write(rec)
+		s.csv.Flush()
+		if err := s.csv.Error(); err != nil {
+			return err
+		}
+	}
+	return s.w.Flush()
+}
+
+// Flush writes the minutes under way, the last of the run.
+func (s *percentogram) Flush() error {
+	targets := make([]string, 0, len(s.minutes))
+	for target := range s.minutes {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+	for _, target := range targets {
+		if err := s.write(target, s.minutes[target]); err != nil {
+			return err
+		}
+		delete(s.minutes, target)
+	}
+	return s.w.Flush()
+}
+
+func (s *percentogram) Close() error {
+	return s.f.Close()
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/gob"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// stateSaveEvery is how often -history-file is written while running, what
+// a crash loses at most.
+const stateSaveEvery = 5 * time.Minute
+
+// savedState is what -history-file keeps across restarts: the history, as
+// far back as it reaches, and the baselines, which take weeks to learn.
+type savedState struct {
+	Saved     time.Time
+	Series    map[string]savedSeries
+	Intervals []*IntervalStats
+	Events    []*Event
+	Profiles  map[string]savedProfile
+}
+
+type savedSeries struct {
+	Group   string
+	Minutes []minute
+	Samples []sample
+}
+
+type savedProfile struct {
+	Week, Day []savedWelford
+}
+
+type savedWelford struct {
+	N        int
+	Mean, M2 float64
+}
+
+// SaveState writes the history and baselines to path, replacing it in one
+// go.
+func (m *monitor) SaveState(path string) error {
+	st := &savedState{Saved: time.Now()}
+	m.history.save(st)
+	m.baseline.save(st)
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".keeping-history-*")
+	if err != nil {
+		return err
+	}
+	if err := gob.NewEncoder(tmp).Encode(st); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// LoadState picks up what SaveState left in path, nothing if there is no
+// such file yet. History older than what the history keeps is left out.
+func (m *monitor) LoadState(path string) (time.Time, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer f.Close()
+	var st savedState
+	if err := gob.NewDecoder(f).Decode(&st); err != nil {
+		return time.Time{}, err
+	}
+	m.history.restore(&st, time.Now())
+	m.baseline.restore(&st)
+	return st.Saved, nil
+}
+
+func (h *history) save(st *savedState) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	st.Series = make(map[string]savedSeries, len(h.series))
+	for name, se := range h.series {
+		st.Series[name] = savedSeries{Group: se.group,
+			Minutes: append([]minute(nil), se.minutes...), Samples: append([]sample(nil), se.samples...)}
+	}
+	st.Intervals = append([]*IntervalStats(nil), h.intervals...)
+	st.Events = append([]*Event(nil), h.events...)
+}
+
+func (h *history) restore(st *savedState, now time.Time) {
+	since := now.Add(-h.keep)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for name, ss := range st.Series {
+		se := &series{group: ss.Group, samples: trimSamples(ss.Samples, since)}
+		for _, mi := range ss.Minutes {
+			if !mi.At.Add(time.Minute).Before(since) {
+				se.minutes = append(se.minutes, mi)
+			}
+		}
+		h.series[name] = se
+	}
+	for _, iv := range st.Intervals {
+		if !iv.Time.Before(since) {
+			h.intervals = append(h.intervals, iv)
+		}
+	}
+	for _, e := range st.Events {
+		if !e.Time.Before(since) {
+			h.events = append(h.events, e)
+		}
+	}
+}
+
+func (b *baseline) save(st *savedState) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	st.Profiles = make(map[string]savedProfile, len(b.profiles))
+	conv := func(ws []welford) []savedWelford {
+		out := make([]savedWelford, len(ws))
+		for i, w := range ws {
+			out[i] = savedWelford{N: w.n, Mean: w.mean, M2: w.m2}
+		}
+		return out
+	}
+	for name, p := range b.profiles {
+		st.Profiles[name] = savedProfile{Week: conv(p.week[:]), Day: conv(p.day[:])}
+	}
+}
+
+func (b *baseline) restore(st *savedState) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for name, sp := range st.Profiles {
+		p := &profile{}
+		for i, w := range sp.Week {
+			if i < len(p.week) {
+				p.week[i] = welford{n: w.N, mean: w.Mean, m2: w.M2}
+			}
+		}
+		for i, w := range sp.Day {
+			if i < len(p.day) {
+				p.day[i] = welford{n: w.N, mean: w.Mean, m2: w.M2}
+			}
+		}
+		b.profiles[name] = p
+	}
+}
@@ -0,0 +1,1329 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Packet represents a sent or received probe; for ICMP an echo packet.
+type Packet struct {
+	// Rtt is the round-trip time it took to ping.
+	Rtt time.Duration
+	// IPAddr is the address of the host being pinged.
+	IPAddr *net.IPAddr
+	// Addr is the string address of the host being pinged.
+	Addr string
+	// Nbytes is the number of bytes in the message.
+	Nbytes int
+	// Seq is the ICMP sequence number.
+	Seq int
+	// TTL is the Time To Live on the packet.
+	TTL int
+	// ID is the ICMP identifier.
+	ID int
+	// Timestamping tells where the receive time came from, "kernel" or
+	// "user".
+	Timestamping string
+	// StatusCode is the HTTP status of the response to an HTTP probe.
+	StatusCode int
+	// Phases is the timing breakdown of an HTTP probe.
+	Phases *HTTPPhases
+	// ProxyConnect is how long connecting to the proxy took, for probes
+	// through one; Rtt is the end-to-end time.
+	ProxyConnect time.Duration
+	// From is the address a reply came from, when the transport knows it.
+	From *net.IPAddr
+	// Method is the probe method that produced the packet, e.g. "icmp" or
+	// "tcp:443".
+	Method string
+	// Size is the payload size of the probe, set for ICMP size sweeps, and
+	// Pattern its padding with -random-padding.
+	Size    int
+	Pattern string
+	// Payload tells how an echoed payload differs from the one sent:
+	// "truncated", "oversized" or "corrupted", empty when it is intact.
+	Payload string
+	// SendLag is how late a probe went out after its scheduled time.
+	SendLag time.Duration
+	// Detail is the ICMP and IP header fields of an echo reply, with
+	// Pinger.Verbose
+	Detail *ICMPDetail
+	// Reordered is set on a reply that came after the reply to a probe
+	// sent later.
+	Reordered bool
+	// stamp is the send time written into an ICMP probe
+	stamp time.Time
+}
+
+// Statistics represent the stats of a currently running or finished pinger.
+type Statistics struct {
+	PacketsRecv           int
+	PacketsSent           int
+	PacketsRecvDuplicates int
+	// PacketsTimedOut is the number of probes whose reply did not arrive
+	// within the per-probe reply timeout.
+	PacketsTimedOut int
+	// PacketsDiscarded is the number of replies whose RTT failed the sanity
+	// checks; they count as received but are kept out of the RTT figures.
+	PacketsDiscarded int
+	// PacketsExcused is the number of probes left out of the loss, having
+	// been in flight while the local link went down, or being unanswered
+	// rechecks of a preferred probe method.
+	PacketsExcused int
+	// PacketsForeign is the number of replies that came from another
+	// address than the probed one; they don't count as received.
+	PacketsForeign int
+	// PacketsStale is the number of replies carrying our identity but not
+	// the send time of the probe of their sequence number: copies of older
+	// probes or junk made to look like ours. They don't count as received.
+	PacketsStale int
+	// SendErrors is the number of probes that failed to go out.
+	SendErrors int
+	// PacketsTruncated, PacketsOversized and PacketsCorrupted count the
+	// replies whose payload came back shorter, longer or altered. They
+	// still count as received.
+	PacketsTruncated int
+	PacketsOversized int
+	PacketsCorrupted int
+	// PacketsLate is the number of replies that came after the reply
+	// timeout of their probe, which still counts as lost; LateAvgRtt and
+	// LateMaxRtt are their RTTs, kept out of the others. Chronic late
+	// replies point at bufferbloat rather than loss.
+	PacketsLate int
+	LateAvgRtt  time.Duration
+	LateMaxRtt  time.Duration
+	// PacketsReordered is the number of replies that came out of order,
+	// after the reply to a probe sent later: load-balanced paths and some
+	// VPNs reorder.
+	PacketsReordered int
+	// PacketLoss is the percentage of packets lost.
+	PacketLoss float64
+	IPAddr     *net.IPAddr
+	Addr       string
+	MinRtt     time.Duration
+	MaxRtt     time.Duration
+	AvgRtt     time.Duration
+	StdDevRtt  time.Duration
+	// Timestamping is the receive timestamping mode in use, "kernel" or
+	// "user".
+	Timestamping string
+	// TTLs counts the replies by the TTL they arrived with, when known.
+	TTLs map[int]int
+	// BytesSent and BytesRecv estimate the traffic, headers included.
+	BytesSent int64
+	BytesRecv int64
+	// Failures counts the probes which failed by why, see failureKind.
+	Failures map[string]int
+	// Directional is the loss each way, for peer:PORT probes.
+	Directional *DirectionalLoss
+}
+
+// probe is the bookkeeping kept for every sequence number sent.
+type probe struct {
+	seq      int
+	sentAt   time.Time
+	deadline time.Time
+	// received/expired are set once the probe has been resolved; later
+	// replies for the same sequence are then duplicates, or late once
+	// timedOut, late being set after the first.
+	received bool
+	expired  bool
+	timedOut bool
+	late     bool
+	// method indexes the Pinger's methods; recheck marks a probe of a
+	// preferred method sent while falling back, whose loss doesn't count
+	method  int
+	recheck bool
+	// stamp is the send time in the payload, for transports writing one
+	stamp time.Time
+}
+
+// transport carries the probes of a Pinger, ICMP echo or one of the
+// connection based protocols. send starts the probe for seq, and receive
+// returns the replies already matched to their sequence number.
+type transport interface {
+	send(seq int) (*Packet, error)
+	receive() (*reply, error)
+	Close() error
+}
+
+// reply is the outcome of one probe as seen by its transport.
+type reply struct {
+	seq        int
+	receivedAt time.Time
+	// rtt is set by transports which time the probe themselves, otherwise
+	// it is taken from the send and receive times
+	rtt time.Duration
+	// err is set when the probe failed outright, e.g. connection refused
+	err error
+	// pkt carries the transport specific fields of the reply
+	pkt *Packet
+	// stamp is the send time echoed in the payload, for transports
+	// writing one
+	stamp time.Time
+	// method is the index of the method whose transport got the reply
+	method int
+}
+
+const (
+	protocolICMP = "icmp"
+	protocolHTTP = "http"
+	protocolTCP  = "tcp"
+)
+
+const (
+	// fallbackAfter is the number of probes lost in a row after which the
+	// next method is tried.
+	fallbackAfter = 3
+	// fallbackRecheck is every how many probes a preferred method is tried
+	// again while falling back.
+	fallbackRecheck = 60
+)
+
+// Pinger probes one host and matches the replies by sequence number. Probes
+// are pipelined: the send schedule never waits for a reply, so any number of
+// probes may be outstanding at once, and every sequence carries its own reply
+// deadline. This is what makes probing a 600ms-RTT link at 100ms intervals
+// work.
+//
+// Addresses are probed with ICMP echo, http:// and https:// URLs with HTTP
+// GET requests and tcp://host:port with TCP connects. An address can instead
+// list methods to fall back through, see SetMethods. The public surface
+// deliberately mirrors pro-bing's Pinger, which this replaces.
+type Pinger struct {
+	// Interval is the wait time between each packet send. Default is 1s.
+	Interval time.Duration
+	// Verbose describes the headers of every ICMP echo reply in its
+	// Packet.Detail.
+	Verbose bool
+	// Jitter holds every scheduled send back by a random part of up to
+	// that fraction of the Interval, so probes of many instances don't
+	// line up with each other or with periodic queueing.
+	Jitter float64
+	// Timeout specifies a timeout before ping exits, regardless of how many
+	// packets have been received.
+	Timeout time.Duration
+	// ReplyTimeout is how long each probe waits for its reply before it is
+	// counted as lost. Zero means probes never time out individually.
+	ReplyTimeout time.Duration
+	// Count tells pinger to stop after sending (and resolving) Count echo
+	// packets. Negative means run until stopped.
+	Count int
+	// Preload sends that many probes back to back at start, like ping -l.
+	Preload int
+	// Size of the echo payload.
+	Size int
+	// Sizes, when set, are the payload sizes ICMP probes cycle through
+	// instead, one probe each in turn.
+	Sizes []int
+	// Padding, when set, draws the payload size and pattern of every ICMP
+	// probe at random.
+	Padding *randomPadding
+	// Body, when set, is what ICMP probes carry past the send time and the
+	// tracker, cut or padded with zeros to the payload size.
+	Body []byte
+	// TTL of outgoing packets.
+	TTL int
+	// HopLimit of outgoing IPv6 packets, TTL when zero.
+	HopLimit int
+	// FlowLabel is the IPv6 flow label of ICMP probes, none when zero
+	// (Linux only).
+	FlowLabel int
+	// TOS is the TOS byte (IPv4) or traffic class (IPv6) of ICMP probes,
+	// the DSCP shifted left by 2, left to the system when zero.
+	TOS int
+	// Source is the source IP address.
+	Source string
+	// Proxy is the socks5:// or http:// proxy TCP and HTTP probes go
+	// through. ICMP can't.
+	Proxy string
+	// Faults, when set, drops, delays or mangles replies on purpose, see
+	// -inject.
+	Faults *faults
+	// Mark is the fwmark (SO_MARK) of the probes, to steer them by policy
+	// routing, and Device the interface or VRF they are bound to
+	// (SO_BINDTODEVICE). Linux only.
+	Mark   int
+	Device string
+	// Timestamping selects where receive times come from: "user" takes
+	// time.Now after the read returns, "kernel" uses SO_TIMESTAMPNS which
+	// isn't skewed by scheduling delays under load (Linux only). Send times
+	// are taken with time.Now before the write either way.
+	Timestamping string
+	// MaxSaneRtt is the largest RTT accepted as genuine, anything above it
+	// is discarded as a clock artefact. Zero disables the check.
+	MaxSaneRtt time.Duration
+
+	// OnSend is called when Pinger sends a packet.
+	OnSend func(*Packet)
+	// OnRecv is called when Pinger receives and matches a reply.
+	OnRecv func(*Packet)
+	// OnDuplicateRecv is called when a reply for an already answered
+	// sequence is received.
+	OnDuplicateRecv func(*Packet)
+	// OnTimeout is called when a probe's reply deadline passes.
+	OnTimeout func(*Packet)
+	// OnLateRecv is called for the first reply to a probe after its reply
+	// timeout.
+	OnLateRecv func(*Packet)
+	// OnForeignRecv is called for a reply that came from another address
+	// than the probed one.
+	OnForeignRecv func(*Packet)
+	// OnDiscard is called with the reason when a reply's RTT is rejected.
+	OnDiscard func(*Packet, error)
+	// OnSendError is called when sending a packet fails, or a connection
+	// based probe fails outright.
+	OnSendError func(*Packet, error)
+	// OnMethodChange is called when probing falls back from one method to
+	// the next, or returns to a preferred one.
+	OnMethodChange func(from, to, reason string)
+	// OnFinish is called when Pinger exits.
+	OnFinish func(*Statistics)
+
+	PacketsSent           int
+	PacketsRecv           int
+	PacketsRecvDuplicates int
+	PacketsTimedOut       int
+	PacketsDiscarded      int
+	PacketsExcused        int
+	PacketsForeign        int
+	PacketsStale          int
+	// SendErrors is the number of probes the transport failed to send.
+	SendErrors       int
+	PacketsTruncated int
+	PacketsOversized int
+	PacketsCorrupted int
+	PacketsLate      int
+	lateRttSum       time.Duration
+	maxLateRtt       time.Duration
+	PacketsReordered int
+	// BytesSent and BytesRecv estimate the traffic both ways, headers
+	// included, see probeBytes.
+	BytesSent int64
+	BytesRecv int64
+	// failed counts failed probes by kind
+	failed map[string]int
+
+	// sendLag* measure how late the scheduled sends go out
+	sendLagSum   time.Duration
+	sendLagMax   time.Duration
+	sendLagCount int
+
+	// sentBefore counts the probes sent before ResetStatistics, which
+	// Count still counts, directionalBase the peer's counts then
+	sentBefore      int
+	directionalBase DirectionalLoss
+
+	// rtt keeps the mean and variance of the replies that made it into the
+	// RTT figures in float64 nanoseconds: squared deviations summed in an
+	// int64 overflow within hours at a high rate, and a running mean in
+	// integer nanoseconds stops moving once the count outgrows the deltas.
+	rtt     welford
+	minRtt  time.Duration
+	maxRtt  time.Duration
+	ttls    map[int]int
+	statsMu sync.RWMutex
+
+	addr     string
+	protocol string
+	url      *url.URL
+	ipaddr   *net.IPAddr
+	ipv4     bool
+	// pinned is set when the address was given with SetIPAddr
+	pinned     bool
+	privileged bool
+	id         int
+	tracker    [trackerLength]byte
+	sequence   int
+
+	// probes holds one entry per 16-bit sequence number, so memory stays
+	// bounded however long the run is; inflight lists unresolved probes in
+	// send order, which is also deadline order. A probe still unresolved
+	// when its sequence number comes round again, with -W 0, is lost then,
+	// so inflight holds 65536 probes at most.
+	probes   map[int]*probe
+	inflight []*probe
+	// lastRecvAt is the timestamp of the previous reply, receive timestamps
+	// going backwards mean the clock can't be trusted
+	lastRecvAt time.Time
+	// newestAnswered is the send time of the latest probe answered, a reply
+	// to one sent before it is out of order; send times, unlike sequence
+	// numbers, don't wrap
+	newestAnswered time.Time
+
+	// methods are the probe methods in order of preference, transports
+	// their open transports once Open is done, current the one in use
+	methods      []string
+	transports   []transport
+	current      int
+	failures     int
+	sinceRecheck int
+
+	// ctrl carries runtime changes into the run loop, which owns the
+	// send ticker
+	ctrl   chan func(interval sendTicker)
+	paused bool
+
+	done     chan struct{}
+	stopOnce sync.Once
+
+	// scheduler, when set, ticks the sends instead of a ticker of their
+	// own
+	scheduler *scheduler
+}
+
+// NewPinger returns a new Pinger and resolves the address.
+func NewPinger(addr string) (*Pinger, error) {
+	p, err := New(addr)
+	if err != nil {
+		return nil, err
+	}
+	return p, p.Resolve()
+}
+
+// New returns a new Pinger for addr without resolving it yet.
+func New(addr string) (*Pinger, error) {
+	var b [2]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return nil, err
+	}
+	p := &Pinger{
+		Interval:     time.Second,
+		Timeout:      time.Duration(math.MaxInt64),
+		Count:        -1,
+		Size:         minPayloadSize,
+		Timestamping: timestampUser,
+		TTL:          64,
+		MaxSaneRtt:   time.Minute,
+		addr:         addr,
+		protocol:     protocolICMP,
+		id:           int(binary.BigEndian.Uint16(b[:2])),
+		probes:       make(map[int]*probe),
+		ctrl:         make(chan func(sendTicker)),
+		done:         make(chan struct{}),
+		tracker:      newTracker(),
+	}
+	if strings.HasPrefix(addr, "http://") || strings.HasPrefix(addr, "https://") {
+		u, err := url.Parse(addr)
+		if err != nil {
+			return nil, err
+		}
+		p.protocol, p.url = protocolHTTP, u
+	} else if strings.HasPrefix(addr, "tcp://") {
+		u, err := url.Parse(addr)
+		if err != nil {
+			return nil, err
+		}
+		if u.Port() == "" {
+			return nil, fmt.Errorf("%s: missing port", addr)
+		}
+		p.protocol, p.url = protocolTCP, u
+	} else if host, methods, ok := strings.Cut(addr, "="); ok {
+		p.addr = host
+		if err := p.SetMethods(strings.Split(methods, ",")); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// SetMethods sets the methods a host is probed with, in order of
+// preference: "icmp", "tcp:PORT", "peer:PORT", "http" or "https". After fallbackAfter
+// probes lost in a row the next method takes over, and the preferred ones
+// are retried every fallbackRecheck probes. This is also what a target
+// written as host=icmp,tcp:443,http asks for. URL targets have their one
+// method.
+func (p *Pinger) SetMethods(methods []string) error {
+	if p.url != nil {
+		return fmt.Errorf("%s: methods are for hosts, not URLs", p.addr)
+	}
+	for _, m := range methods {
+		if _, err := parseMethod(m); err != nil {
+			return err
+		}
+	}
+	p.methods = methods
+	return nil
+}
+
+// Methods returns the probe methods in order of preference.
+func (p *Pinger) Methods() []string {
+	if len(p.methods) > 0 {
+		return p.methods
+	}
+	switch p.protocol {
+	case protocolHTTP:
+		return []string{p.url.Scheme}
+	case protocolTCP:
+		return []string{protocolTCP + ":" + p.url.Port()}
+	}
+	return []string{protocolICMP}
+}
+
+// parseMethod checks a probe method, returning the port of a TCP or peer
+// one.
+func parseMethod(m string) (port int, err error) {
+	switch m {
+	case protocolICMP, "http", "https":
+		return 0, nil
+	}
+	v, ok := strings.CutPrefix(m, protocolTCP+":")
+	if !ok {
+		v, ok = strings.CutPrefix(m, protocolPeer+":")
+	}
+	if ok {
+		port, err := strconv.Atoi(v)
+		if err == nil && port > 0 && port < 1<<16 {
+			return port, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid probe method %q, want icmp, tcp:PORT, peer:PORT, http or https", m)
+}
+
+// parseMethods splits a -methods list, checking every method.
+func parseMethods(list string) ([]string, error) {
+	methods := strings.Split(list, ",")
+	for _, m := range methods {
+		if _, err := parseMethod(m); err != nil {
+			return nil, err
+		}
+	}
+	return methods, nil
+}
+
+// Resolve does the DNS lookup for the Pinger address, through the shared
+// cache.
+func (p *Pinger) Resolve() error {
+	if len(p.addr) == 0 {
+		return errors.New("addr cannot be empty")
+	}
+	ipaddr, err := resolver.ResolveIPAddr(p.Host())
+	if err != nil {
+		return err
+	}
+	p.ipaddr = ipaddr
+	p.ipv4 = ipaddr.IP.To4() != nil
+	return nil
+}
+
+// SetIPAddr sets the address to probe, overriding name resolution. HTTP
+// probes then connect to it whatever the URL host resolves to.
+func (p *Pinger) SetIPAddr(ipaddr *net.IPAddr) {
+	p.ipaddr = ipaddr
+	p.ipv4 = ipaddr.IP.To4() != nil
+	p.pinned = true
+}
+
+// Host returns the name resolved to find the address to probe.
+func (p *Pinger) Host() string {
+	if p.url != nil {
+		return p.url.Hostname()
+	}
+	return p.addr
+}
+
+// Addr returns the string ip address of the target host.
+func (p *Pinger) Addr() string {
+	return p.addr
+}
+
+// IPAddr returns the ip address of the target host.
+func (p *Pinger) IPAddr() *net.IPAddr {
+	return p.ipaddr
+}
+
+// SetPrivileged sets the type of ping pinger will send.
+// false means pinger will send an "unprivileged" UDP ping.
+// true means pinger will send a "privileged" raw ICMP ping.
+func (p *Pinger) SetPrivileged(privileged bool) {
+	p.privileged = privileged
+}
+
+// Stop stops a running pinger. It is safe to call more than once.
+func (p *Pinger) Stop() {
+	p.stopOnce.Do(func() { close(p.done) })
+}
+
+var errNotRunning = errors.New("pinger is not running")
+
+// control runs fn inside the run loop.
+func (p *Pinger) control(fn func(interval sendTicker)) error {
+	select {
+	case p.ctrl <- fn:
+		return nil
+	case <-p.done:
+		return errNotRunning
+	}
+}
+
+// Pause stops sending probes until Resume is called. Replies to probes
+// already in flight are still processed.
+func (p *Pinger) Pause() error {
+	return p.control(func(interval sendTicker) {
+		interval.Stop()
+		p.statsMu.Lock()
+		p.paused = true
+		p.statsMu.Unlock()
+	})
+}
+
+// Resume restarts sending after Pause.
+func (p *Pinger) Resume() error {
+	return p.control(func(interval sendTicker) {
+		p.statsMu.Lock()
+		defer p.statsMu.Unlock()
+		if p.paused && !p.sentAll() {
+			interval.Reset(p.Interval)
+		}
+		p.paused = false
+	})
+}
+
+// Excuse gives up on the probes in flight without counting them as lost,
+// for when their replies cannot come back through no fault of the target.
+func (p *Pinger) Excuse() error {
+	return p.control(func(sendTicker) {
+		for _, pr := range p.inflight {
+			pr.expired = true
+		}
+		p.excuse(len(p.inflight))
+		p.inflight = p.inflight[:0]
+	})
+}
+
+// SetInterval changes the send interval of a running pinger.
+func (p *Pinger) SetInterval(d time.Duration) error {
+	if d <= 0 {
+		return fmt.Errorf("invalid interval %v", d)
+	}
+	return p.control(func(interval sendTicker) {
+		p.statsMu.Lock()
+		defer p.statsMu.Unlock()
+		p.Interval = d
+		if !p.paused && !p.sentAll() {
+			interval.Reset(d)
+		}
+	})
+}
+
+// ResetStatistics starts the statistics over, as if the pinger started
+// now. The probes in flight count as sent since, their replies or timeouts
+// still to come. It returns once the statistics are reset.
+func (p *Pinger) ResetStatistics() error {
+	done := make(chan struct{})
+	err := p.control(func(sendTicker) {
+		defer close(done)
+		p.statsMu.Lock()
+		defer p.statsMu.Unlock()
+		p.sentBefore += p.PacketsSent - len(p.inflight)
+		p.PacketsSent = len(p.inflight)
+		p.PacketsRecv, p.PacketsRecvDuplicates, p.PacketsTimedOut = 0, 0, 0
+		p.PacketsDiscarded, p.PacketsExcused, p.PacketsForeign, p.PacketsStale = 0, 0, 0, 0
+		p.SendErrors, p.PacketsTruncated, p.PacketsOversized, p.PacketsCorrupted = 0, 0, 0, 0
+		p.PacketsLate, p.lateRttSum, p.maxLateRtt = 0, 0, 0
+		p.PacketsReordered = 0
+		p.BytesSent, p.BytesRecv = 0, 0
+		p.failed, p.ttls = nil, nil
+		p.sendLagSum, p.sendLagMax, p.sendLagCount = 0, 0, 0
+		p.rtt, p.minRtt, p.maxRtt = welford{}, 0, 0
+		for _, t := range p.transports {
+			if t, ok := t.(*peerTransport); ok {
+				p.directionalBase = t.directional()
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	<-done
+	return nil
+}
+
+// Paused reports whether sending is paused, and the current send interval.
+func (p *Pinger) Paused() (bool, time.Duration) {
+	p.statsMu.RLock()
+	defer p.statsMu.RUnlock()
+	return p.paused, p.Interval
+}
+
+// Open sets up the pinger's sockets ahead of Run, which otherwise does it
+// itself. Opening early lets a privileged process drop its privileges
+// before probing starts.
+func (p *Pinger) Open() error {
+	if p.transports != nil {
+		return nil
+	}
+	methods := p.Methods()
+	ts := make([]transport, 0, len(methods))
+	for _, m := range methods {
+		t, err := p.openTransport(m)
+		if err != nil {
+			for _, t := range ts {
+				t.Close()
+			}
+			if len(methods) > 1 {
+				err = fmt.Errorf("%s: %w", m, err)
+			}
+			return err
+		}
+		ts = append(ts, t)
+	}
+	p.methods, p.transports = methods, ts
+	return nil
+}
+
+// Run runs the pinger. This is a blocking function that will exit when it's
+// done.
+func (p *Pinger) Run() error {
+	if err := p.Open(); err != nil {
+		return err
+	}
+	defer p.finish()
+
+	recv := make(chan *reply, 16)
+	recvErr := make(chan error, len(p.transports))
+	var readers sync.WaitGroup
+	for i, t := range p.transports {
+		readers.Add(1)
+		go func(i int, t transport) {
+			defer readers.Done()
+			recvErr <- p.receive(i, t, recv)
+		}(i, t)
+	}
+	// closing the transports is what unblocks the readers
+	defer func() {
+		p.Stop()
+		for _, t := range p.transports {
+			_ = t.Close()
+		}
+		readers.Wait()
+	}()
+
+	return p.runLoop(recv, recvErr)
+}
+
+func (p *Pinger) openTransport(method string) (transport, error) {
+	switch {
+	case method == protocolICMP:
+		if p.Proxy != "" {
+			return nil, fmt.Errorf("%s: icmp can't go through a proxy, probe with tcp:PORT or http", p.addr)
+		}
+		return newICMPTransport(p)
+	case p.TOS != 0:
+		return nil, fmt.Errorf("%s: only icmp probes are marked with a DSCP, not %s", p.addr, method)
+	case p.url != nil && p.protocol == protocolHTTP:
+		return newHTTPTransport(p, p.addr)
+	case method == "http" || method == "https":
+		host := p.addr
+		if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		return newHTTPTransport(p, method+"://"+host+"/")
+	}
+	port, err := parseMethod(method)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(method, protocolPeer+":") {
+		return newPeerTransport(p, port)
+	}
+	return newTCPTransport(p, port)
+}
+
+func (p *Pinger) runLoop(recv <-chan *reply, recvErr <-chan error) error {
+	timeout := time.NewTimer(p.Timeout)
+	defer timeout.Stop()
+	var interval sendTicker
+	if p.scheduler != nil {
+		interval = p.scheduler.ticker(p.Interval)
+	} else {
+		interval = timeTicker{time.NewTicker(p.Interval)}
+	}
+	defer interval.Stop()
+	// expiry fires at the deadline of the oldest in-flight probe
+	expiry := time.NewTimer(time.Hour)
+	expiry.Stop()
+	defer expiry.Stop()
+
+	resetExpiry := func() {
+		expiry.Stop()
+		select {
+		case <-expiry.C:
+		default:
+		}
+		if len(p.inflight) > 0 && p.ReplyTimeout > 0 {
+			expiry.Reset(time.Until(p.inflight[0].deadline))
+		}
+	}
+
+	for i := 0; i < 1+p.Preload && !p.sentAll(); i++ {
+		if err := p.send(0); err != nil {
+			return err
+		}
+	}
+	resetExpiry()
+
+	// jitter holds the send of a tick back until jittered, zero for none
+	jitter := time.NewTimer(time.Hour)
+	jitter.Stop()
+	defer jitter.Stop()
+	var jittered time.Time
+
+	for {
+		if p.sentAll() && len(p.inflight) == 0 {
+			return nil
+		}
+		select {
+		case <-p.done:
+			return nil
+		case <-timeout.C:
+			return nil
+		case err := <-recvErr:
+			return err
+		case r := <-recv:
+			p.process(r)
+			resetExpiry()
+		case now := <-expiry.C:
+			p.expire(now)
+			resetExpiry()
+		case fn := <-p.ctrl:
+			fn(interval)
+		case tick := <-interval.Chan():
+			if p.sentAll() {
+				interval.Stop()
+				continue
+			}
+			if p.Jitter > 0 {
+				if !jittered.IsZero() {
+					// the previous one is still held back, late as it is
+					if err := p.sendDue(jittered); err != nil {
+						return err
+					}
+					resetExpiry()
+				}
+				jittered = tick.Add(jitterOffset(p.Interval, p.Jitter))
+				jitter.Reset(time.Until(jittered))
+				continue
+			}
+			if err := p.sendDue(tick); err != nil {
+				return err
+			}
+			resetExpiry()
+		case <-jitter.C:
+			due := jittered
+			jittered = time.Time{}
+			if p.paused || p.sentAll() {
+				continue
+			}
+			if err := p.sendDue(due); err != nil {
+				return err
+			}
+			resetExpiry()
+		}
+	}
+}
+
+// sendDue sends the probe scheduled for due, how late it goes out counted
+// as its send lag.
+func (p *Pinger) sendDue(due time.Time) error {
+	lag := time.Since(due)
+	p.recordSendLag(lag)
+	if err := p.send(lag); err != nil {
+		// a failed send is reported and the schedule carries on
+		if p.OnSendError == nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *Pinger) recordSendLag(lag time.Duration) {
+	p.statsMu.Lock()
+	defer p.statsMu.Unlock()
+	p.sendLagSum += lag
+	p.sendLagCount++
+	if lag > p.sendLagMax {
+		p.sendLagMax = lag
+	}
+}
+
+// SendLag returns how late, on average and at most, scheduled probes were
+// sent, a measure of how far the RTTs can be trusted under load.
+func (p *Pinger) SendLag() (avg, max time.Duration) {
+	p.statsMu.RLock()
+	defer p.statsMu.RUnlock()
+	if p.sendLagCount == 0 {
+		return 0, 0
+	}
+	return p.sendLagSum / time.Duration(p.sendLagCount), p.sendLagMax
+}
+
+func (p *Pinger) sentAll() bool {
+	return p.Count >= 0 && p.sentBefore+p.PacketsSent >= p.Count
+}
+
+// receive passes on the replies of the transport of method i.
+func (p *Pinger) receive(i int, t transport, recv chan<- *reply) error {
+	for {
+		r, err := t.receive()
+		if err != nil {
+			select {
+			case <-p.done:
+				return nil
+			default:
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		r.method = i
+		if p.Faults != nil {
+			keep, delay := p.Faults.apply(r)
+			if !keep {
+				continue
+			}
+			if delay > 0 {
+				r.receivedAt = r.receivedAt.Add(delay)
+				if r.rtt > 0 {
+					r.rtt += delay
+				}
+				time.AfterFunc(delay, func() {
+					select {
+					case <-p.done:
+					case recv <- r:
+					}
+				})
+				continue
+			}
+		}
+		select {
+		case <-p.done:
+			return nil
+		case recv <- r:
+		}
+	}
+}
+
+// send sends the next probe, lag after its time.
+func (p *Pinger) send(lag time.Duration) error {
+	seq := p.sequence
+	p.sequence = (p.sequence + 1) & 0xffff
+	p.reuse(seq)
+	p.statsMu.Lock()
+	p.PacketsSent++
+	p.statsMu.Unlock()
+
+	method, recheck := p.current, false
+	if p.current > 0 {
+		if p.sinceRecheck++; p.sinceRecheck >= fallbackRecheck {
+			p.sinceRecheck = 0
+			method, recheck = 0, true
+		}
+	}
+	now := time.Now()
+	outPkt, err := p.transports[method].send(seq)
+	if outPkt == nil {
+		outPkt = &Packet{Seq: seq}
+	}
+	outPkt.Method, outPkt.SendLag = p.methods[method], lag
+	if err != nil && recheck {
+		p.excuse(1)
+		return nil
+	}
+	if err != nil {
+		err = &probeError{failureKind(err, failSend), err}
+		p.statsMu.Lock()
+		p.SendErrors++
+		p.countFailure(err)
+		p.statsMu.Unlock()
+		// the probe still counts as sent so the loss it causes is visible
+		if p.OnSendError != nil {
+			p.OnSendError(outPkt, err)
+		}
+		p.methodFailed(method)
+		return err
+	}
+	size := p.Size
+	if outPkt.Size > 0 {
+		size = outPkt.Size
+	}
+	sent, _ := probeBytes(p.methods[method], p.ipv4, size)
+	p.statsMu.Lock()
+	p.BytesSent += int64(sent)
+	p.statsMu.Unlock()
+	pr := &probe{seq: seq, sentAt: now, method: method, recheck: recheck, stamp: outPkt.stamp}
+	if p.ReplyTimeout > 0 {
+		pr.deadline = now.Add(p.ReplyTimeout)
+	}
+	p.probes[seq] = pr
+	p.inflight = append(p.inflight, pr)
+	if p.OnSend != nil {
+		p.OnSend(outPkt)
+	}
+	return nil
+}
+
+func (p *Pinger) process(r *reply) {
+	pr, known := p.probes[r.seq]
+	if !known || pr.method != r.method {
+		return
+	}
+	if pr.expired {
+		// too late to count, the probe was already reported lost
+		if pr.timedOut && !pr.late && r.err == nil {
+			p.lateReply(pr, r)
+		}
+		return
+	}
+	inPkt := r.pkt
+	if r.err == nil {
+		size := p.Size
+		if inPkt.Size > 0 {
+			size = inPkt.Size
+		}
+		_, recv := probeBytes(p.methods[pr.method], p.ipv4, size)
+		if inPkt.Phases != nil {
+			// the body of an HTTP response
+			recv += inPkt.Nbytes
+		}
+		p.statsMu.Lock()
+		p.BytesRecv += int64(recv)
+		p.statsMu.Unlock()
+	}
+	inPkt.IPAddr, inPkt.Addr, inPkt.Seq = p.ipaddr, p.addr, r.seq
+	inPkt.Method = p.methods[pr.method]
+	inPkt.Rtt = r.rtt
+	if inPkt.Rtt == 0 {
+		inPkt.Rtt = r.receivedAt.Sub(pr.sentAt)
+	}
+	if r.err == nil && !r.stamp.IsZero() && !r.stamp.Equal(pr.stamp) {
+		// ours, but not the probe sent last with this sequence number
+		p.statsMu.Lock()
+		p.PacketsStale++
+		p.statsMu.Unlock()
+		if p.OnDiscard != nil {
+			p.OnDiscard(inPkt, errStaleReply)
+		}
+		return
+	}
+	if inPkt.From != nil && !inPkt.From.IP.Equal(p.ipaddr.IP) {
+		// some middlebox answering for the target, which has not
+		// answered yet as far as we know
+		p.statsMu.Lock()
+		p.PacketsForeign++
+		p.statsMu.Unlock()
+		if p.OnForeignRecv != nil {
+			p.OnForeignRecv(inPkt)
+		}
+		return
+	}
+	if r.err != nil {
+		if pr.received {
+			return
+		}
+		pr.expired = true
+		p.removeInflight(pr)
+		if pr.recheck {
+			p.excuse(1)
+			return
+		}
+		p.statsMu.Lock()
+		p.countFailure(r.err)
+		p.statsMu.Unlock()
+		if p.OnSendError != nil {
+			p.OnSendError(inPkt, r.err)
+		}
+		p.methodFailed(pr.method)
+		return
+	}
+	if pr.received {
+		p.statsMu.Lock()
+		p.PacketsRecvDuplicates++
+		p.statsMu.Unlock()
+		if p.OnDuplicateRecv != nil {
+			p.OnDuplicateRecv(inPkt)
+		}
+		return
+	}
+	pr.received = true
+	p.removeInflight(pr)
+	p.methodAnswered(pr.method)
+	if pr.sentAt.Before(p.newestAnswered) {
+		inPkt.Reordered = true
+		p.statsMu.Lock()
+		p.PacketsReordered++
+		p.statsMu.Unlock()
+	} else {
+		p.newestAnswered = pr.sentAt
+	}
+	if inPkt.Payload != "" {
+		p.statsMu.Lock()
+		switch inPkt.Payload {
+		case payloadTruncated:
+			p.PacketsTruncated++
+		case payloadOversized:
+			p.PacketsOversized++
+		default:
+			p.PacketsCorrupted++
+		}
+		p.statsMu.Unlock()
+	}
+	if err := p.checkRtt(inPkt, r.receivedAt); err != nil {
+		p.statsMu.Lock()
+		p.PacketsRecv++
+		p.PacketsDiscarded++
+		p.statsMu.Unlock()
+		if p.OnDiscard != nil {
+			p.OnDiscard(inPkt, err)
+		}
+		return
+	}
+	p.updateStatistics(inPkt)
+	if p.OnRecv != nil {
+		p.OnRecv(inPkt)
+	}
+}
+
+// lateReply counts the reply r to pr, which timed out, when it is the
+// target's answer to that very probe.
+func (p *Pinger) lateReply(pr *probe, r *reply) {
+	pkt := r.pkt
+	if (!r.stamp.IsZero() && !r.stamp.Equal(pr.stamp)) || (pkt.From != nil && !pkt.From.IP.Equal(p.ipaddr.IP)) {
+		return
+	}
+	pkt.IPAddr, pkt.Addr, pkt.Seq = p.ipaddr, p.addr, r.seq
+	pkt.Method = p.methods[pr.method]
+	pkt.Rtt = r.rtt
+	if pkt.Rtt == 0 {
+		pkt.Rtt = r.receivedAt.Sub(pr.sentAt)
+	}
+	if pkt.Rtt < 0 || (p.MaxSaneRtt > 0 && pkt.Rtt > p.MaxSaneRtt) {
+		return
+	}
+	pr.late = true
+	p.statsMu.Lock()
+	p.PacketsLate++
+	p.lateRttSum += pkt.Rtt
+	if pkt.Rtt > p.maxLateRtt {
+		p.maxLateRtt = pkt.Rtt
+	}
+	p.statsMu.Unlock()
+	if p.OnLateRecv != nil {
+		p.OnLateRecv(pkt)
+	}
+}
+
+var (
+	errNegativeRtt    = errors.New("negative rtt")
+	errAbsurdRtt      = errors.New("implausibly large rtt")
+	errClockBackwards = errors.New("receive timestamp went backwards")
+	errStaleReply     = errors.New("the reply is not to the probe last sent with its sequence number")
+)
+
+// checkRtt rejects RTTs that can only come from a misbehaving clock, which
+// some VMs produce; averaging them in would skew every figure.
+func (p *Pinger) checkRtt(pkt *Packet, receivedAt time.Time) error {
+	last := p.lastRecvAt
+	if receivedAt.After(last) {
+		p.lastRecvAt = receivedAt
+	}
+	switch {
+	case pkt.Rtt < 0:
+		return errNegativeRtt
+	case p.MaxSaneRtt > 0 && pkt.Rtt > p.MaxSaneRtt:
+		return errAbsurdRtt
+	case receivedAt.Before(last):
+		return errClockBackwards
+	}
+	return nil
+}
+
+// expire resolves every in-flight probe whose deadline has passed as lost.
+func (p *Pinger) expire(now time.Time) {
+	for len(p.inflight) > 0 && !p.inflight[0].deadline.After(now) {
+		pr := p.inflight[0]
+		p.inflight = p.inflight[1:]
+		p.timeOut(pr)
+	}
+}
+
+// reuse is called as seq is sent again. A probe of seq still in flight, the
+// oldest or nearly, is lost then: its reply could no longer be told from the
+// new probe's.
+func (p *Pinger) reuse(seq int) {
+	if old := p.probes[seq]; old != nil && !old.expired && !old.received {
+		p.removeInflight(old)
+		p.timeOut(old)
+	}
+}
+
+// timeOut resolves pr, taken off inflight, as lost for want of a reply.
+func (p *Pinger) timeOut(pr *probe) {
+	pr.expired, pr.timedOut = true, true
+	if pr.recheck {
+		p.excuse(1)
+		return
+	}
+	p.statsMu.Lock()
+	p.PacketsTimedOut++
+	p.countFailure(&probeError{failTimeout, errProbeTimeout})
+	p.statsMu.Unlock()
+	if p.OnTimeout != nil {
+		p.OnTimeout(&Packet{IPAddr: p.ipaddr, Addr: p.addr, Seq: pr.seq, ID: p.id, Method: p.methods[pr.method]})
+	}
+	p.methodFailed(pr.method)
+}
+
+var errProbeTimeout = errors.New("timeout")
+
+// countFailure counts a failed probe by its kind. p.statsMu held.
+func (p *Pinger) countFailure(err error) {
+	if p.failed == nil {
+		p.failed = make(map[string]int)
+	}
+	p.failed[failureKind(err, failOther)]++
+}
+
+func (p *Pinger) excuse(n int) {
+	p.statsMu.Lock()
+	p.PacketsExcused += n
+	p.statsMu.Unlock()
+}
+
+// methodFailed counts a probe of method i lost, falling back to the next
+// method once the current one lost fallbackAfter in a row.
+func (p *Pinger) methodFailed(i int) {
+	if i != p.current {
+		return
+	}
+	p.failures++
+	if p.failures >= fallbackAfter && i+1 < len(p.methods) {
+		p.switchMethod(i+1, fmt.Sprintf("%d probes lost in a row", p.failures))
+	}
+}
+
+// methodAnswered returns to method i when it is preferred over the current.
+func (p *Pinger) methodAnswered(i int) {
+	switch {
+	case i == p.current:
+		p.failures = 0
+	case i < p.current:
+		p.switchMethod(i, "it answers again")
+	}
+}
+
+func (p *Pinger) switchMethod(i int, reason string) {
+	from := p.methods[p.current]
+	p.current, p.failures, p.sinceRecheck = i, 0, 0
+	if p.OnMethodChange != nil {
+		p.OnMethodChange(from, p.methods[i], reason)
+	}
+}
+
+func (p *Pinger) removeInflight(pr *probe) {
+	for i, v := range p.inflight {
+		if v == pr {
+			p.inflight = append(p.inflight[:i], p.inflight[i+1:]...)
+			return
+		}
+	}
+}
+
+func (p *Pinger) updateStatistics(pkt *Packet) {
+	p.statsMu.Lock()
+	defer p.statsMu.Unlock()
+
+	p.PacketsRecv++
+	if pkt.TTL > 0 {
+		if p.ttls == nil {
+			p.ttls = make(map[int]int)
+		}
+		p.ttls[pkt.TTL]++
+	}
+	// ref: pro-bing/ping.go#Pinger.updateStatistics
+	p.rtt.add(float64(pkt.Rtt))
+	if p.rtt.n == 1 || pkt.Rtt < p.minRtt {
+		p.minRtt = pkt.Rtt
+	}
+	if pkt.Rtt > p.maxRtt {
+		p.maxRtt = pkt.Rtt
+	}
+}
+
+func (p *Pinger) finish() {
+	if p.OnFinish != nil {
+		p.OnFinish(p.Statistics())
+	}
+}
+
+// Statistics returns the statistics of the pinger. This can be run while the
+// pinger is running or after it is finished.
+func (p *Pinger) Statistics() *Statistics {
+	p.statsMu.RLock()
+	defer p.statsMu.RUnlock()
+	sent := p.PacketsSent
+	ttls := make(map[int]int, len(p.ttls))
+	for ttl, n := range p.ttls {
+		ttls[ttl] = n
+	}
+	failures := make(map[string]int, len(p.failed))
+	for kind, n := range p.failed {
+		failures[kind] = n
+	}
+	var loss float64
+	if counted := sent - p.PacketsExcused; counted > 0 {
+		loss = float64(counted-p.PacketsRecv) / float64(counted) * 100
+	}
+	var lateAvg time.Duration
+	if p.PacketsLate > 0 {
+		lateAvg = p.lateRttSum / time.Duration(p.PacketsLate)
+	}
+	var dir *DirectionalLoss
+	for _, t := range p.transports {
+		if t, ok := t.(*peerTransport); ok {
+			d := t.directional().sub(p.directionalBase)
+			dir = &d
+		}
+	}
+	return &Statistics{
+		PacketsSent:           sent,
+		PacketsRecv:           p.PacketsRecv,
+		PacketsRecvDuplicates: p.PacketsRecvDuplicates,
+		PacketsTimedOut:       p.PacketsTimedOut,
+		PacketsDiscarded:      p.PacketsDiscarded,
+		PacketsExcused:        p.PacketsExcused,
+		PacketsForeign:        p.PacketsForeign,
+		PacketsStale:          p.PacketsStale,
+		SendErrors:            p.SendErrors,
+		PacketsTruncated:      p.PacketsTruncated,
+		PacketsOversized:      p.PacketsOversized,
+		PacketsCorrupted:      p.PacketsCorrupted,
+		PacketsLate:           p.PacketsLate,
+		LateAvgRtt:            lateAvg,
+		LateMaxRtt:            p.maxLateRtt,
+		PacketsReordered:      p.PacketsReordered,
+		PacketLoss:            loss,
+		Addr:                  p.addr,
+		IPAddr:                p.ipaddr,
+		MaxRtt:                p.maxRtt,
+		MinRtt:                p.minRtt,
+		AvgRtt:                time.Duration(math.Round(p.rtt.mean)),
+		StdDevRtt:             time.Duration(math.Round(p.rtt.popStddev())),
+		Timestamping:          p.Timestamping,
+		TTLs:                  ttls,
+		BytesSent:             p.BytesSent,
+		BytesRecv:             p.BytesRecv,
+		Failures:              failures,
+		Directional:           dir,
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeTransport records the probes sent and answers those answer lets
+// through, at once, with the send time echoed as an ICMP reply does.
+type fakeTransport struct {
+	answer func(seq int) bool
+	err    error
+
+	mu      sync.Mutex
+	sent    []int
+	replies chan *reply
+	once    sync.Once
+}
+
+func newFakeTransport(answer func(seq int) bool) *fakeTransport {
+	return &fakeTransport{answer: answer, replies: make(chan *reply, 1024)}
+}
+
+func (t *fakeTransport) send(seq int) (*Packet, error) {
+	if t.err != nil {
+		return nil, t.err
+	}
+	now := time.Now()
+	t.mu.Lock()
+	t.sent = append(t.sent, seq)
+	t.mu.Unlock()
+	if t.answer != nil && t.answer(seq) {
+		t.replies <- &reply{seq: seq, receivedAt: now.Add(time.Millisecond), pkt: &Packet{}, stamp: now}
+	}
+	return &Packet{Seq: seq, stamp: now}, nil
+}
+
+func (t *fakeTransport) receive() (*reply, error) {
+	r, ok := <-t.replies
+	if !ok {
+		return nil, net.ErrClosed
+	}
+	return r, nil
+}
+
+func (t *fakeTransport) Close() error {
+	t.once.Do(func() { close(t.replies) })
+	return nil
+}
+
+// fakePinger is a Pinger probing over t alone.
+func fakePinger(t *testing.T, ft *fakeTransport) *Pinger {
+	p, err := New("192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.SetIPAddr(&net.IPAddr{IP: net.ParseIP("192.0.2.1")})
+	p.methods, p.transports = []string{protocolICMP}, []transport{ft}
+	return p
+}
+
+// echo is the reply to the probe of seq last sent.
+func echo(p *Pinger, seq int, after time.Duration) *reply {
+	pr := p.probes[seq]
+	return &reply{seq: seq, receivedAt: pr.sentAt.Add(after), pkt: &Packet{}, stamp: pr.stamp}
+}
+
+func TestPingerReplies(t *testing.T) {
+	p := fakePinger(t, newFakeTransport(nil))
+	var rtts []time.Duration
+	p.OnRecv = func(pkt *Packet) { rtts = append(rtts, pkt.Rtt) }
+	for i := 0; i < 3; i++ {
+		if err := p.send(0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(p.inflight) != 3 {
+		t.Fatalf("%d probes in flight, want 3", len(p.inflight))
+	}
+	// out of order, pipelined as they are
+	p.process(echo(p, 1, 30*time.Millisecond))
+	p.process(echo(p, 0, 40*time.Millisecond))
+	p.process(echo(p, 0, 41*time.Millisecond))
+	// unknown sequence numbers are not ours
+	p.process(&reply{seq: 7, receivedAt: time.Now(), pkt: &Packet{}})
+	if p.PacketsRecv != 2 || p.PacketsRecvDuplicates != 1 || p.PacketsReordered != 1 || len(p.inflight) != 1 {
+		t.Errorf("recv %d, duplicates %d, reordered %d, in flight %d", p.PacketsRecv, p.PacketsRecvDuplicates, p.PacketsReordered, len(p.inflight))
+	}
+	if len(rtts) != 2 || rtts[0] != 30*time.Millisecond || rtts[1] != 40*time.Millisecond {
+		t.Errorf("rtts %v", rtts)
+	}
+
+	// a reply from someone else is no answer of the target
+	r := echo(p, 2, time.Millisecond)
+	r.pkt.From = &net.IPAddr{IP: net.ParseIP("198.51.100.1")}
+	p.process(r)
+	if p.PacketsForeign != 1 || p.probes[2].received {
+		t.Errorf("foreign reply: foreign %d, received %v", p.PacketsForeign, p.probes[2].received)
+	}
+}
+
+func TestPingerReplyTimeout(t *testing.T) {
+	p := fakePinger(t, newFakeTransport(nil))
+	p.ReplyTimeout = 100 * time.Millisecond
+	var timedOut, late []int
+	p.OnTimeout = func(pkt *Packet) { timedOut = append(timedOut, pkt.Seq) }
+	p.OnLateRecv = func(pkt *Packet) { late = append(late, pkt.Seq) }
+	for i := 0; i < 3; i++ {
+		if err := p.send(0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p.process(echo(p, 1, 50*time.Millisecond))
+	for _, pr := range p.inflight {
+		if pr.deadline != pr.sentAt.Add(p.ReplyTimeout) {
+			t.Errorf("seq %d: deadline %v after the send", pr.seq, pr.deadline.Sub(pr.sentAt))
+		}
+	}
+	// nothing is due yet
+	p.expire(p.probes[0].sentAt.Add(99 * time.Millisecond))
+	if p.PacketsTimedOut != 0 {
+		t.Fatalf("%d timed out before the deadline", p.PacketsTimedOut)
+	}
+	p.expire(p.probes[2].deadline)
+	if p.PacketsTimedOut != 2 || len(p.inflight) != 0 || len(timedOut) != 2 || timedOut[0] != 0 || timedOut[1] != 2 {
+		t.Fatalf("timed out %d %v, in flight %d", p.PacketsTimedOut, timedOut, len(p.inflight))
+	}
+	if s := p.Statistics(); s.PacketLoss == 0 || s.PacketsRecv != 1 {
+		t.Errorf("loss %.1f%%, recv %d", s.PacketLoss, s.PacketsRecv)
+	}
+
+	// the reply after the deadline counts as late, once, and not as received
+	p.process(echo(p, 0, 300*time.Millisecond))
+	p.process(echo(p, 0, 301*time.Millisecond))
+	if p.PacketsLate != 1 || p.PacketsRecv != 1 || p.PacketsRecvDuplicates != 0 || len(late) != 1 {
+		t.Errorf("late %d, recv %d, duplicates %d", p.PacketsLate, p.PacketsRecv, p.PacketsRecvDuplicates)
+	}
+	if s := p.Statistics(); s.LateAvgRtt != 300*time.Millisecond {
+		t.Errorf("late average %v", s.LateAvgRtt)
+	}
+}
+
+func TestPingerSequenceReuse(t *testing.T) {
+	p := fakePinger(t, newFakeTransport(nil))
+	var timedOut []int
+	p.OnTimeout = func(pkt *Packet) { timedOut = append(timedOut, pkt.Seq) }
+	// -W 0, probes wait for their replies until their sequence number
+	// comes round again
+	for i := 0; i < 0x10000; i++ {
+		if err := p.send(0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p.process(echo(p, 1, time.Millisecond))
+	if len(p.inflight) != 0xffff || p.PacketsTimedOut != 0 {
+		t.Fatalf("in flight %d, timed out %d", len(p.inflight), p.PacketsTimedOut)
+	}
+	first := p.probes[0]
+	for i := 0; i < 2; i++ {
+		if err := p.send(0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 0 is lost to the new probe, 1 was answered already
+	if p.PacketsTimedOut != 1 || len(timedOut) != 1 || timedOut[0] != 0 || len(p.inflight) != 0x10000 {
+		t.Fatalf("timed out %d %v, in flight %d", p.PacketsTimedOut, timedOut, len(p.inflight))
+	}
+	if p.probes[0] == first || p.inflight[len(p.inflight)-1] != p.probes[1] {
+		t.Error("the new probes are not the ones in flight")
+	}
+	// the reply to the old probe is told from the new one's by its stamp
+	p.process(&reply{seq: 0, receivedAt: time.Now(), pkt: &Packet{}, stamp: first.stamp.Add(-time.Second)})
+	if p.PacketsStale != 1 || p.probes[0].received {
+		t.Errorf("stale %d, received %v", p.PacketsStale, p.probes[0].received)
+	}
+	p.process(echo(p, 0, time.Millisecond))
+	if !p.probes[0].received || p.PacketsRecv != 2 {
+		t.Errorf("new probe: received %v, recv %d", p.probes[0].received, p.PacketsRecv)
+	}
+}
+
+func TestPingerSendError(t *testing.T) {
+	ft := newFakeTransport(nil)
+	ft.err = errors.New("network is unreachable")
+	p := fakePinger(t, ft)
+	var failed error
+	p.OnSendError = func(_ *Packet, err error) { failed = err }
+	if err := p.send(0); err == nil || failed == nil {
+		t.Fatalf("send: %v, reported %v", err, failed)
+	}
+	// the probe counts as sent, and lost
+	if s := p.Statistics(); s.PacketsSent != 1 || s.PacketLoss != 100 || p.SendErrors != 1 || len(p.inflight) != 0 {
+		t.Errorf("sent %d, loss %.0f%%, send errors %d", s.PacketsSent, s.PacketLoss, p.SendErrors)
+	}
+}
+
+func TestPingerRun(t *testing.T) {
+	// every third probe goes unanswered
+	ft := newFakeTransport(func(seq int) bool { return seq%3 != 2 })
+	p := fakePinger(t, ft)
+	p.Count, p.Interval, p.ReplyTimeout, p.Preload = 6, 5*time.Millisecond, 50*time.Millisecond, 2
+	var stats *Statistics
+	p.OnFinish = func(s *Statistics) { stats = s }
+	done := make(chan error)
+	go func() { done <- p.Run() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		p.Stop()
+		t.Fatal("Run did not return")
+	}
+	if stats == nil || stats.PacketsSent != 6 || stats.PacketsRecv != 4 || stats.PacketsTimedOut != 2 {
+		t.Fatalf("statistics %+v", stats)
+	}
+	if len(ft.sent) != 6 || ft.sent[5] != 5 {
+		t.Errorf("sent %v", ft.sent)
+	}
+}
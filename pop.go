@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// popQueries identify the anycast POP, or the resolver instance, an address
+// answers DNS from: id.server and hostname.bind of the CHAOS class, which
+// Cloudflare, Quad9 and most name servers answer, and o-o.myaddr of Google,
+// which resolvers Google's included answer with the address they resolve
+// from.
+var popQueries = []struct {
+	name  string
+	class dnsmessage.Class
+}{
+	{"id.server.", dnsmessage.ClassCHAOS},
+	{"hostname.bind.", dnsmessage.ClassCHAOS},
+	{"o-o.myaddr.l.google.com.", dnsmessage.ClassINET},
+}
+
+// identifyPOP asks ip which POP it serves from with the popQueries from
+// the one at *query on, leaving *query at the one that answered.
+func identifyPOP(ip net.IP, query *int) (string, error) {
+	var err error
+	for ; *query < len(popQueries); *query++ {
+		var pop string
+		q := popQueries[*query]
+		if pop, err = queryTXT(ip, q.name, q.class); err == nil {
+			return pop, nil
+		}
+	}
+	*query = 0
+	return "", err
+}
+
+// queryTXT returns the first TXT answer of ip for name.
+func queryTXT(ip net.IP, name string, class dnsmessage.Class) (string, error) {
+	q := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: uint16(time.Now().UnixNano()), RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName(name),
+			Type: dnsmessage.TypeTXT, Class: class}},
+	}
+	b, err := q.Pack()
+	if err != nil {
+		return "", err
+	}
+	conn, err := net.DialTimeout("udp", net.JoinHostPort(ip.String(), "53"), 2*time.Second)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Write(b); err != nil {
+		return "", err
+	}
+	buf := make([]byte, 1500)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return "", err
+		}
+		var resp dnsmessage.Message
+		if resp.Unpack(buf[:n]) != nil || resp.ID != q.ID || !resp.Response {
+			continue
+		}
+		if resp.RCode != dnsmessage.RCodeSuccess {
+			return "", fmt.Errorf("%s: %v", name, resp.RCode)
+		}
+		for _, a := range resp.Answers {
+			if txt, ok := a.Body.(*dnsmessage.TXTResource); ok && len(txt.TXT) > 0 {
+				return strings.Join(txt.TXT, ""), nil
+			}
+		}
+		return "", errors.New(name + ": no TXT answer")
+	}
+}
+
+// watchPOP identifies the POP serving t every m.settings.POPEvery, warning
+// when it changes, until stop is closed. It gives up on targets that never
+// tell.
+func (m *monitor) watchPOP(t *target, stop <-chan struct{}) {
+	ip := t.pinger.IPAddr().IP
+	query := 0
+	ticker := time.NewTicker(m.settings.POPEvery)
+	defer ticker.Stop()
+	for {
+		pop, err := identifyPOP(ip, &query)
+		t.mu.Lock()
+		prev, known := t.pop, len(t.pops) > 0
+		if err == nil {
+			t.pop = pop
+			if !contains(t.pops, pop) {
+				t.pops = append(t.pops, pop)
+			}
+		}
+		t.mu.Unlock()
+		switch {
+		case err != nil && !known:
+			fmt.Printf("WARN: %s tells no anycast POP: %v\n", t.host, err)
+			return
+		case err != nil:
+			// keep the last known, a lost query is just that
+		case prev == "":
+			fmt.Printf("%s is served by POP %s\n", t.host, pop)
+		case prev != pop:
+			msg := fmt.Sprintf("anycast POP of %s changed from %s to %s", t.host, prev, pop)
+			fmt.Println("WARN:", msg)
+			m.event(eventPOPChange, t.host, msg)
+		}
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+func contains(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
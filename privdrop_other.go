@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+func dropPrivileges(name string) error {
+	return errors.New("dropping privileges is only supported on Linux")
+}
+
+func applySeccomp() error {
+	return errors.New("seccomp is only supported on Linux")
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// probeProfile is one of the -profiles a target is probed with at once, each
+// by a Pinger of its own: its own identifier, sequence numbers and
+// statistics, so the loss of one can't be mistaken for that of another.
+type probeProfile struct {
+	name     string
+	size     int
+	interval time.Duration
+	// dscp marks the probes of a -dscp-classes class, -1 for the profiles
+	// of -profiles
+	dscp int
+}
+
+// parseProfiles parses -profiles, SIZE[:INTERVAL] separated by commas.
+func parseProfiles(s string) ([]probeProfile, error) {
+	var ps []probeProfile
+	seen := make(map[string]bool)
+	for _, spec := range strings.Split(s, ",") {
+		sizeS, intervalS, _ := strings.Cut(strings.TrimSpace(spec), ":")
+		size, err := strconv.Atoi(sizeS)
+		if err != nil || size < minPayloadSize {
+			return nil, fmt.Errorf("invalid profile %q, want SIZE[:INTERVAL] with a size of at least %d", spec, minPayloadSize)
+		}
+		pr := probeProfile{name: sizeS + "B", size: size, dscp: -1}
+		if intervalS != "" {
+			if pr.interval, err = time.ParseDuration(intervalS); err != nil || pr.interval <= 0 {
+				return nil, fmt.Errorf("invalid interval of profile %q", spec)
+			}
+			pr.name += "-" + intervalS
+		}
+		if seen[pr.name] {
+			return nil, fmt.Errorf("profile %q given twice", spec)
+		}
+		seen[pr.name] = true
+		ps = append(ps, pr)
+	}
+	return ps, nil
+}
+
+// dscpNames are the DSCP values of the per-hop behaviours, RFC 2474, 2597
+// and 3246.
+var dscpNames = map[string]int{
+	"BE": 0, "EF": 46, "VA": 44,
+	"AF11": 10, "AF12": 12, "AF13": 14, "AF21": 18, "AF22": 20, "AF23": 22,
+	"AF31": 26, "AF32": 28, "AF33": 30, "AF41": 34, "AF42": 36, "AF43": 38,
+	"CS0": 0, "CS1": 8, "CS2": 16, "CS3": 24, "CS4": 32, "CS5": 40, "CS6": 48, "CS7": 56,
+}
+
+// parseDSCPClasses parses -dscp-classes, DSCP names or values from 0 to 63
+// separated by commas, into a profile each.
+func parseDSCPClasses(s string) ([]probeProfile, error) {
+	var ps []probeProfile
+	seen := make(map[int]bool)
+	for _, spec := range strings.Split(s, ",") {
+		name := strings.ToUpper(strings.TrimSpace(spec))
+		dscp, ok := dscpNames[name]
+		if !ok {
+			v, err := strconv.Atoi(name)
+			if err != nil || v < 0 || v > 63 {
+				return nil, fmt.Errorf("invalid DSCP class %q, want a name such as EF, AF41 or CS1, or 0 to 63", spec)
+			}
+			dscp = v
+		}
+		if seen[dscp] {
+			return nil, fmt.Errorf("DSCP %d given twice", dscp)
+		}
+		seen[dscp] = true
+		ps = append(ps, probeProfile{name: name, dscp: dscp})
+	}
+	if len(ps) < 2 {
+		return nil, fmt.Errorf("-dscp-classes compares two classes or more, e.g. BE,EF")
+	}
+	return ps, nil
+}
+
+// apply sets the payload size, interval and DSCP of p to those of the
+// profile.
+func (pr *probeProfile) apply(p *Pinger) {
+	if pr.size > 0 {
+		p.Size = pr.size
+	}
+	if pr.interval > 0 {
+		p.Interval = pr.interval
+	}
+	if pr.dscp >= 0 {
+		p.TOS = pr.dscp << 2
+	}
+}
+
+// addProfiles starts name, probing pinger's address, once for each of the
+// -profiles as NAME#PROFILE, or just once without.
+func (m *monitor) addProfiles(name, host, spec string, pinger *Pinger, src *probeSource, ttl time.Duration) error {
+	if len(m.settings.Profiles) == 0 {
+		return m.add(name, host, pinger, src, nil, ttl)
+	}
+	for i := range m.settings.Profiles {
+		pr := &m.settings.Profiles[i]
+		p := pinger
+		if i > 0 {
+			p, _ = New(spec)
+			if pinger.pinned {
+				p.SetIPAddr(pinger.IPAddr())
+			} else if err := p.Resolve(); err != nil {
+				return err
+			}
+		}
+		if err := m.add(name+"#"+pr.name, host, p, src, pr, ttl); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ProfileComparison returns, for every target probed with -profiles, a
+// table of the statistics by profile, and whether the largest payload
+// loses more or takes longer than the smallest.
+func (m *monitor) ProfileComparison() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	names := make([]string, 0, len(m.profiled))
+	for name := range m.profiled {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range names {
+		ts := m.profiled[name]
+		if ts[0].profile.dscp >= 0 {
+			b.WriteString(m.dscpComparison(name, ts))
+			continue
+		}
+		fmt.Fprintf(&b, tr("\n--- %s by profile ---\n"), name)
+		tw := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "profile\tsize\tinterval\tsent\trecv\tloss\tmin\tavg\tmax\tstddev")
+		var small, large *target
+		stats := make(map[*target]*Statistics, len(ts))
+		for _, t := range ts {
+			s := t.pinger.Statistics()
+			stats[t] = s
+			fmt.Fprintf(tw, "%s\t%d\t%v\t%d\t%d\t%.1f%%\t%v\t%v\t%v\t%v\n", t.profile.name, t.pinger.Size, t.pinger.Interval,
+				s.PacketsSent, s.PacketsRecv, s.PacketLoss, s.MinRtt, s.AvgRtt, s.MaxRtt, s.StdDevRtt)
+			if small == nil || t.pinger.Size < small.pinger.Size {
+				small = t
+			}
+			if large == nil || t.pinger.Size > large.pinger.Size {
+				large = t
+			}
+		}
+		tw.Flush()
+		if small.pinger.Size == large.pinger.Size {
+			continue
+		}
+		ss, ls := stats[small], stats[large]
+		p, largeMore := lossTest(lossOf(ls), float64(ls.PacketsSent-ls.PacketsExcused),
+			lossOf(ss), float64(ss.PacketsSent-ss.PacketsExcused))
+		switch {
+		case p >= significant:
+			fmt.Fprintf(&b, tr("no size-dependent loss between %s and %s (%s)\n"), small.profile.name, large.profile.name, formatP(p))
+		case largeMore:
+			fmt.Fprintf(&b, tr("%s loses more than %s (%s): size-dependent loss, as of an MTU or fragmentation trouble\n"),
+				large.profile.name, small.profile.name, formatP(p))
+		default:
+			fmt.Fprintf(&b, tr("%s loses more than %s (%s)\n"), small.profile.name, large.profile.name, formatP(p))
+		}
+		a, c := sampleRtts(m.history.Samples(small.host)), sampleRtts(m.history.Samples(large.host))
+		if len(a) >= 2 && len(c) >= 2 {
+			fmt.Fprintln(&b, compareRtts(small.profile.name, a, large.profile.name, c))
+		}
+	}
+	return b.String()
+}
+
+// dscpComparison is the table of the statistics of a target by DSCP class,
+// with whether each class fares differently from the best effort one, or
+// the lowest class without it: the network honours the markings where the
+// higher classes lose less or are faster. m.mu is held.
+func (m *monitor) dscpComparison(name string, ts []*target) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, tr("\n--- %s by DSCP class ---\n"), name)
+	tw := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "class\tdscp\tsent\trecv\tloss\tmin\tavg\tmax\tstddev")
+	var base *target
+	stats := make(map[*target]*Statistics, len(ts))
+	for _, t := range ts {
+		s := t.pinger.Statistics()
+		stats[t] = s
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%.1f%%\t%v\t%v\t%v\t%v\n", t.profile.name, t.profile.dscp,
+			s.PacketsSent, s.PacketsRecv, s.PacketLoss, s.MinRtt, s.AvgRtt, s.MaxRtt, s.StdDevRtt)
+		if base == nil || t.profile.dscp < base.profile.dscp {
+			base = t
+		}
+	}
+	tw.Flush()
+	bs := stats[base]
+	baseRtts := sampleRtts(m.history.Samples(base.host))
+	differ := false
+	for _, t := range ts {
+		if t == base {
+			continue
+		}
+		s := stats[t]
+		p, more := lossTest(lossOf(s), float64(s.PacketsSent-s.PacketsExcused), lossOf(bs), float64(bs.PacketsSent-bs.PacketsExcused))
+		switch {
+		case p >= significant:
+			fmt.Fprintf(&b, tr("no loss difference between %s and %s (%s)\n"), base.profile.name, t.profile.name, formatP(p))
+		case more:
+			differ = true
+			fmt.Fprintf(&b, tr("%s loses more than %s (%s)\n"), t.profile.name, base.profile.name, formatP(p))
+		default:
+			differ = true
+			fmt.Fprintf(&b, tr("%s loses more than %s (%s)\n"), base.profile.name, t.profile.name, formatP(p))
+		}
+		if rtts := sampleRtts(m.history.Samples(t.host)); len(baseRtts) >= 2 && len(rtts) >= 2 {
+			if p, _ := mannWhitney(baseRtts, rtts); p < significant {
+				differ = true
+			}
+			fmt.Fprintln(&b, compareRtts(base.profile.name, baseRtts, t.profile.name, rtts))
+		}
+	}
+	if !differ {
+		fmt.Fprintf(&b, tr("the classes fare alike: the markings are not honoured on the way, or it was never congested\n"))
+	}
+	return b.String()
+}
+
+func lossOf(s *Statistics) float64 {
+	return float64(s.PacketsSent - s.PacketsExcused - s.PacketsRecv)
+}
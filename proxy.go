@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// proxyDialer connects TCP and HTTP probes through a SOCKS5 proxy or an
+// HTTP proxy, with CONNECT, telling how long reaching the proxy took from
+// the end-to-end time of the probe.
+type proxyDialer struct {
+	u      *url.URL
+	dialer net.Dialer
+}
+
+func newProxyDialer(rawurl string, local net.Addr) (*proxyDialer, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "socks5", "socks5h", "http":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q, want socks5 or http", u.Scheme)
+	}
+	if u.Port() == "" {
+		port := "1080"
+		if u.Scheme == "http" {
+			port = "8080"
+		}
+		u.Host = net.JoinHostPort(u.Hostname(), port)
+	}
+	return &proxyDialer{u: u, dialer: net.Dialer{LocalAddr: local}}, nil
+}
+
+type proxyTimeKey struct{}
+
+// withProxyTime returns a context the dialer reports the proxy connect time
+// of the probe through, atomically: an HTTP dial may outlive its request.
+func withProxyTime(ctx context.Context) (context.Context, *atomic.Int64) {
+	d := new(atomic.Int64)
+	return context.WithValue(ctx, proxyTimeKey{}, d), d
+}
+
+// DialContext connects to addr through the proxy.
+func (d *proxyDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	start := time.Now()
+	conn, err := d.dialer.DialContext(ctx, "tcp", d.u.Host)
+	if err != nil {
+		return nil, fmt.Errorf("proxy: %w", err)
+	}
+	if pt, ok := ctx.Value(proxyTimeKey{}).(*atomic.Int64); ok {
+		pt.Store(int64(time.Since(start)))
+	}
+	if d.u.Scheme == "http" {
+		conn, err = d.connect(ctx, conn, addr)
+	} else {
+		conn, err = d.socks(ctx, conn, network, addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("proxy %s: %w", d.u.Host, err)
+	}
+	return conn, nil
+}
+
+func (d *proxyDialer) socks(ctx context.Context, conn net.Conn, network, addr string) (net.Conn, error) {
+	var auth *proxy.Auth
+	if d.u.User != nil {
+		auth = &proxy.Auth{User: d.u.User.Username()}
+		auth.Password, _ = d.u.User.Password()
+	}
+	s, err := proxy.SOCKS5("tcp", d.u.Host, auth, connDialer{conn})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	c, err := s.(proxy.ContextDialer).DialContext(ctx, network, addr)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// connect asks an HTTP proxy for a tunnel to addr.
+func (d *proxyDialer) connect(ctx context.Context, conn net.Conn, addr string) (net.Conn, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if d.u.User != nil {
+		pass, _ := d.u.User.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+
+			base64.StdEncoding.EncodeToString([]byte(d.u.User.Username()+":"+pass)))
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("CONNECT %s: %s", addr, resp.Status)
+	}
+	_ = conn.SetDeadline(time.Time{})
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// connDialer hands the SOCKS5 client the connection already made to the
+// proxy.
+type connDialer struct{ conn net.Conn }
+
+func (c connDialer) Dial(string, string) (net.Conn, error) { return c.conn, nil }
+
+// bufferedConn is a connection part of whose input was read ahead.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) { return c.r.Read(b) }
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"time"
+)
+
+// The records below are what machine-readable outputs are fed: one Result
+// per probe, one IntervalStats per target and statistics interval, and
+// Events for everything else worth noting. Durations are float
+// milliseconds.
+
+// Result statuses.
+const (
+	resultOK        = "ok"
+	resultTimeout   = "timeout"
+	resultDuplicate = "duplicate"
+	resultError     = "error"
+	resultDiscarded = "discarded"
+	resultForeign   = "foreign"
+	// resultLate is a reply that came after its probe timed out, which
+	// stays lost
+	resultLate = "late"
+)
+
+// Result is the outcome of one probe.
+type Result struct {
+	Time   time.Time `json:"time"`
+	Target string    `json:"target"`
+	// Group is the name the target was configured as, for --all-ips
+	Group string `json:"group,omitempty"`
+	Addr  string `json:"addr,omitempty"`
+	// From is the source of a reply that didn't come from Addr
+	From   string  `json:"from,omitempty"`
+	Seq    int     `json:"seq"`
+	Status string  `json:"status"`
+	RttMs  float64 `json:"rtt_ms,omitempty"`
+	Bytes  int     `json:"bytes,omitempty"`
+	TTL    int     `json:"ttl,omitempty"`
+	// HopLimit replaces TTL for IPv6 replies.
+	HopLimit int `json:"hop_limit,omitempty"`
+	// Size is the payload size of the probe, in a -size-sweep or with
+	// -random-padding, Pattern its padding with the latter.
+	Size    int    `json:"size,omitempty"`
+	Pattern string `json:"pattern,omitempty"`
+	// ProxyConnectMs is the part of RttMs spent connecting to the proxy.
+	ProxyConnectMs float64 `json:"proxy_connect_ms,omitempty"`
+	// Method is the probe method, "icmp", "tcp:PORT", "peer:PORT", "http"
+	// or "https".
+	Method string `json:"method,omitempty"`
+	// Payload is set when the echoed payload was "truncated", "oversized"
+	// or "corrupted".
+	Payload string `json:"payload,omitempty"`
+	// HTTPStatus and Phases are set for HTTP probes.
+	HTTPStatus   int       `json:"http_status,omitempty"`
+	Phases       *PhasesMs `json:"phases,omitempty"`
+	Timestamping string    `json:"timestamping,omitempty"`
+	Error        string    `json:"error,omitempty"`
+	// Failure is the kind of failure of a timed out or failed probe, e.g.
+	// "timeout", "refused" or "host-unreachable".
+	Failure string `json:"failure,omitempty"`
+	// LocalDown is set while the link towards the target is down on this
+	// host.
+	LocalDown bool `json:"local_down,omitempty"`
+	// POP is the anycast POP serving the target, with -pop
+	POP string `json:"pop,omitempty"`
+	// ICMP is the ICMP and IP header fields of the reply, with -v
+	ICMP *ICMPDetail `json:"icmp,omitempty"`
+	// Reordered is set on a reply that came after the reply to a later
+	// probe
+	Reordered bool `json:"reordered,omitempty"`
+}
+
+// PhasesMs is HTTPPhases in milliseconds.
+type PhasesMs struct {
+	DNS      float64 `json:"dns_ms"`
+	Connect  float64 `json:"connect_ms"`
+	TLS      float64 `json:"tls_ms"`
+	TTFB     float64 `json:"ttfb_ms"`
+	Transfer float64 `json:"transfer_ms"`
+}
+
+// IntervalStats summarises one statistics interval of a target. Count is
+// the replies in the RTT figures, Sent those and the probes lost in the
+// interval.
+type IntervalStats struct {
+	Time     time.Time `json:"time"`
+	Target   string    `json:"target"`
+	Group    string    `json:"group,omitempty"`
+	Count    int64     `json:"count"`
+	Sent     int64     `json:"sent"`
+	Lost     int64     `json:"lost"`
+	LossPct  float64   `json:"loss_pct"`
+	MinMs    float64   `json:"min_ms"`
+	AvgMs    float64   `json:"avg_ms"`
+	MaxMs    float64   `json:"max_ms"`
+	StdDevMs float64   `json:"stddev_ms"`
+	Phases   *PhasesMs `json:"phases,omitempty"`
+	// ProxyConnectMs is the average time to connect to the proxy, for
+	// targets probed through one.
+	ProxyConnectMs float64 `json:"proxy_connect_ms,omitempty"`
+	// BaselineMs is the usual average for this time of day and week, once
+	// known, and Anomaly is set when the interval stands out against it.
+	BaselineMs float64 `json:"baseline_ms,omitempty"`
+	Anomaly    bool    `json:"anomaly,omitempty"`
+	// SendRate is the probes sent per second in the interval, GapAvgMs and
+	// GapMaxMs the time between them and SendLagMaxMs how late the latest
+	// went out after its schedule: an overloaded host sends slower than
+	// asked, which the network is not to blame for.
+	SendRate     float64 `json:"send_rate"`
+	GapAvgMs     float64 `json:"gap_avg_ms,omitempty"`
+	GapMaxMs     float64 `json:"gap_max_ms,omitempty"`
+	SendLagMaxMs float64 `json:"send_lag_max_ms,omitempty"`
+	// MedianMs, JitterMs, the mean difference between consecutive RTTs,
+	// and Spikes, the replies slower than twice the median, make the
+	// quality Score from 0 to 100 with the loss, see score.go
+	MedianMs float64 `json:"median_ms"`
+	JitterMs float64 `json:"jitter_ms"`
+	Spikes   int     `json:"spikes"`
+	Score    float64 `json:"score"`
+	// POP is the anycast POP serving the target at the end of the
+	// interval, with -pop
+	POP string `json:"pop,omitempty"`
+	// ForwardLossPct and ReverseLossPct are the loss towards the target
+	// and back, for peer:PORT probes
+	ForwardLossPct *float64 `json:"forward_loss_pct,omitempty"`
+	ReverseLossPct *float64 `json:"reverse_loss_pct,omitempty"`
+	// ThroughputMbps is the -speedtest sample that ended in the interval,
+	// whose latency is then that of a loaded link
+	ThroughputMbps float64 `json:"throughput_mbps,omitempty"`
+	// Router is what the router of -snmp counted in the interval
+	Router *RouterCounters `json:"router,omitempty"`
+	// Late counts the replies of the interval that came after the reply
+	// timeout, LateAvgMs is their RTT
+	Late      int     `json:"late,omitempty"`
+	LateAvgMs float64 `json:"late_avg_ms,omitempty"`
+	// Reordered counts the replies of the interval that came out of
+	// order, ReorderPct of those in the RTT figures
+	Reordered  int     `json:"reordered,omitempty"`
+	ReorderPct float64 `json:"reorder_pct,omitempty"`
+}
+
+// Event types.
+const (
+	eventAnnotation = "annotation"
+	eventWarning    = "warning"
+	eventResolving  = "resolving"
+	eventLinkDown   = "link-down"
+	eventLinkUp     = "link-up"
+	eventSleep      = "sleep"
+	eventAnomaly    = "anomaly"
+	eventTTLChange  = "ttl-change"
+	// eventDuplicateAddr is a target probing what another already does
+	eventDuplicateAddr = "duplicate-address"
+	// eventMethodChange is a target falling back to another probe method,
+	// or back to a preferred one
+	eventMethodChange = "method-change"
+	// eventPOPChange is another anycast POP serving a target
+	eventPOPChange = "pop-change"
+	// eventExpired is an ephemeral target removed, its duration over
+	eventExpired = "expired"
+	// eventNote is a note on a target, as `keeping ctl note` adds
+	eventNote = "note"
+	// eventMTUBlackhole is a path MTU blackhole found by -mtu-check
+	eventMTUBlackhole = "mtu-blackhole"
+	// eventThroughput is a -speedtest sample
+	eventThroughput = "throughput"
+	// eventReset marks the statistics starting over, with `keeping ctl
+	// reset-stats` or SIGUSR1
+	eventReset = "reset"
+)
+
+// Event is anything worth recording that is neither a probe result nor an
+// interval summary: annotations, warnings, state changes.
+type Event struct {
+	Time    time.Time `json:"time"`
+	Type    string    `json:"type"`
+	Target  string    `json:"target,omitempty"`
+	Message string    `json:"message"`
+	// Run is set on the run event
+	Run *RunMeta `json:"run,omitempty"`
+	// Throughput is set on the throughput event
+	Throughput *Throughput `json:"throughput,omitempty"`
+}
+
+// Summary is the final statistics of a target.
+type Summary struct {
+	Target     string `json:"target"`
+	Addr       string `json:"addr,omitempty"`
+	Sent       int    `json:"sent"`
+	Recv       int    `json:"recv"`
+	Duplicates int    `json:"duplicates"`
+	TimedOut   int    `json:"timed_out"`
+	Discarded  int    `json:"discarded"`
+	Excused    int    `json:"excused"`
+	Foreign    int    `json:"foreign"`
+	// Stale counts the replies with our identity but another send time
+	// than their probe's
+	Stale int `json:"stale"`
+	// Truncated, Oversized and Corrupted count the replies whose payload
+	// was cut short, longer or altered
+	Truncated int `json:"truncated"`
+	Oversized int `json:"oversized"`
+	Corrupted int `json:"corrupted"`
+	// Late counts the replies after the reply timeout, the probes lost
+	// all the same, LateAvgMs and LateMaxMs their RTT
+	Late      int     `json:"late"`
+	LateAvgMs float64 `json:"late_avg_ms,omitempty"`
+	LateMaxMs float64 `json:"late_max_ms,omitempty"`
+	// Reordered counts the replies out of order, ReorderPct of all
+	Reordered  int     `json:"reordered"`
+	ReorderPct float64 `json:"reorder_pct"`
+	LossPct    float64 `json:"loss_pct"`
+	MinMs      float64 `json:"min_ms"`
+	AvgMs      float64 `json:"avg_ms"`
+	MaxMs      float64 `json:"max_ms"`
+	StdDevMs   float64 `json:"stddev_ms"`
+	// TTLs counts the replies by their TTL, more than one key hints at a
+	// route change during the run
+	TTLs map[int]int `json:"ttls,omitempty"`
+	// Aliases are the targets coalesced into this one, see -coalesce
+	Aliases []string `json:"aliases,omitempty"`
+	// Geo is the AS, country and reverse DNS of the address, with -geoip
+	Geo *Geo `json:"geo,omitempty"`
+	// POPs are the anycast POPs seen serving the target, with -pop
+	POPs []string `json:"pops,omitempty"`
+	// BytesSent and BytesRecv estimate the traffic, headers included
+	BytesSent int64 `json:"bytes_sent"`
+	BytesRecv int64 `json:"bytes_recv"`
+	// Padding is the RTT by size class and pattern of -random-padding
+	Padding []ClassStats `json:"padding,omitempty"`
+	// Sizes is the RTT by payload size of a -size-sweep
+	Sizes []SizeStats `json:"sizes,omitempty"`
+	// Failures counts the failed probes by kind
+	Failures map[string]int `json:"failures,omitempty"`
+	// MTU is the outcome of -mtu-check
+	MTU *MTUCheck `json:"mtu_check,omitempty"`
+	// ForwardLossPct and ReverseLossPct are the loss towards the target
+	// and back, for peer:PORT probes, with the counts they come from
+	ForwardLossPct *float64 `json:"forward_loss_pct,omitempty"`
+	ReverseLossPct *float64 `json:"reverse_loss_pct,omitempty"`
+	PeerRecv       int      `json:"peer_recv,omitempty"`
+}
+
+// RunSummary is the machine-readable summary of a whole run, as written by
+// -summary.
+type RunSummary struct {
+	Start   time.Time  `json:"start"`
+	End     time.Time  `json:"end"`
+	Args    []string   `json:"args"`
+	Targets []*Summary `json:"targets"`
+}
+
+func newSummary(target string, s *Statistics) *Summary {
+	sum := &Summary{
+		Target:     target,
+		Sent:       s.PacketsSent,
+		Recv:       s.PacketsRecv,
+		Duplicates: s.PacketsRecvDuplicates,
+		TimedOut:   s.PacketsTimedOut,
+		Discarded:  s.PacketsDiscarded,
+		Excused:    s.PacketsExcused,
+		Foreign:    s.PacketsForeign,
+		Stale:      s.PacketsStale,
+		Truncated:  s.PacketsTruncated,
+		Oversized:  s.PacketsOversized,
+		Corrupted:  s.PacketsCorrupted,
+		Late:       s.PacketsLate,
+		LateAvgMs:  ms(s.LateAvgRtt),
+		LateMaxMs:  ms(s.LateMaxRtt),
+		LossPct:    s.PacketLoss,
+		MinMs:      ms(s.MinRtt),
+		AvgMs:      ms(s.AvgRtt),
+		MaxMs:      ms(s.MaxRtt),
+		StdDevMs:   ms(s.StdDevRtt),
+		TTLs:       s.TTLs,
+		BytesSent:  s.BytesSent,
+		BytesRecv:  s.BytesRecv,
+		Failures:   s.Failures,
+	}
+	if s.IPAddr != nil {
+		sum.Addr = s.IPAddr.String()
+	}
+	if s.PacketsRecv > 0 {
+		sum.Reordered, sum.ReorderPct = s.PacketsReordered, float64(s.PacketsReordered)/float64(s.PacketsRecv)*100
+	}
+	if d := s.Directional; d != nil {
+		fwd, rev := d.Forward(), d.Reverse()
+		sum.ForwardLossPct, sum.ReverseLossPct, sum.PeerRecv = &fwd, &rev, d.PeerRecv
+	}
+	return sum
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func phasesMs(ph *HTTPPhases) *PhasesMs {
+	if ph == nil {
+		return nil
+	}
+	return &PhasesMs{
+		DNS:      ms(ph.DNS),
+		Connect:  ms(ph.Connect),
+		TLS:      ms(ph.TLS),
+		TTFB:     ms(ph.TTFB),
+		Transfer: ms(ph.Transfer),
+	}
+}
+
+// newResult fills a Result from a probe's packet.
+func newResult(target, status string, pkt *Packet) *Result {
+	r := &Result{
+		Time:         time.Now(),
+		Target:       target,
+		Seq:          pkt.Seq,
+		Status:       status,
+		Method:       pkt.Method,
+		Payload:      pkt.Payload,
+		Bytes:        pkt.Nbytes,
+		Size:         pkt.Size,
+		Pattern:      pkt.Pattern,
+		HTTPStatus:   pkt.StatusCode,
+		Phases:       phasesMs(pkt.Phases),
+		Timestamping: pkt.Timestamping,
+		ICMP:         pkt.Detail,
+		Reordered:    pkt.Reordered,
+	}
+	if pkt.IPAddr != nil {
+		r.Addr = pkt.IPAddr.String()
+	}
+	if status == resultForeign && pkt.From != nil {
+		r.From = pkt.From.String()
+	}
+	if status == resultOK || status == resultDuplicate || status == resultDiscarded || status == resultForeign || status == resultLate {
+		r.RttMs = ms(pkt.Rtt)
+		r.ProxyConnectMs = ms(pkt.ProxyConnect)
+		if pkt.TTL > 0 && ttlName(pkt) == "hlim" {
+			r.HopLimit = pkt.TTL
+		} else if pkt.TTL > 0 {
+			r.TTL = pkt.TTL
+		}
+	}
+	return r
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// redactKeys are the record fields holding a target, address or host name
+// as a whole, replaced by its hash; every other string has the names known
+// by then and any IP address in it replaced.
+var redactKeys = map[string]bool{
+	"target": true, "group": true, "addr": true, "from": true, "aliases": true,
+	"rdns": true, "host": true, "dst": true, "source": true,
+}
+
+var (
+	ipv4Literal = regexp.MustCompile(`\b(?:\d{1,3}\.){3}\d{1,3}\b`)
+	ipv6Literal = regexp.MustCompile(`[0-9A-Fa-f]{0,4}(?::[0-9A-Fa-f]{0,4}){2,7}`)
+)
+
+// redactor replaces the names and addresses of the infrastructure in the
+// records with -redact, for results to be shared: every name becomes
+// h- and 12 hex digits, an HMAC of it keyed with a salt of the mapping file.
+// The file keeps the names behind the hashes, and the salt, so they stay
+// the same from run to run and can't be brute forced by whoever lacks it.
+type redactor struct {
+	path string
+
+	mu    sync.Mutex
+	salt  []byte
+	ids   map[string]string // name → hash
+	names map[string]string // hash → name, as saved
+	// byLength is the names, the longest first, nil when one was added
+	byLength []string
+	saveErr  string
+}
+
+// redactMap is the mapping file.
+type redactMap struct {
+	Salt  string            `json:"salt"`
+	Names map[string]string `json:"names"`
+}
+
+// redactMapPath is where the mapping is kept by default.
+func redactMapPath() (string, error) {
+	dir, err := stateDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "redact.json"), nil
+}
+
+// loadRedactor reads the mapping file at path, starting one with a new salt
+// when there is none.
+func loadRedactor(path string) (*redactor, error) {
+	r := &redactor{path: path, ids: make(map[string]string), names: make(map[string]string)}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		r.salt = make([]byte, 32)
+		if _, err := rand.Read(r.salt); err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+			return nil, err
+		}
+		return r, r.save()
+	} else if err != nil {
+		return nil, err
+	}
+	var m redactMap
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if r.salt, err = hex.DecodeString(m.Salt); err != nil || len(r.salt) == 0 {
+		return nil, fmt.Errorf("%s: invalid salt", path)
+	}
+	for hash, name := range m.Names {
+		r.names[hash], r.ids[name] = name, hash
+	}
+	return r, nil
+}
+
+// save replaces the mapping file, for its owner only.
+func (r *redactor) save() error {
+	b, err := json.MarshalIndent(&redactMap{Salt: hex.EncodeToString(r.salt), Names: r.names}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(r.path, append(b, '\n'), 0o600)
+}
+
+// id returns the hash of name, adding it to the mapping; a URL's host is
+// added too, for the messages naming it alone.
+func (r *redactor) id(name string) string {
+	if name == "" {
+		return ""
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if u, err := url.Parse(name); err == nil && u.Host != "" {
+		r.add(u.Hostname())
+	}
+	return r.add(name)
+}
+
+// add is id, r.mu held.
+func (r *redactor) add(name string) string {
+	if hash, ok := r.ids[name]; ok {
+		return hash
+	}
+	mac := hmac.New(sha256.New, r.salt)
+	mac.Write([]byte(name))
+	hash := "h-" + hex.EncodeToString(mac.Sum(nil)[:6])
+	r.ids[name], r.names[hash] = hash, name
+	r.byLength = nil
+	if err := r.save(); err != nil && err.Error() != r.saveErr {
+		fmt.Println("WARN: redact mapping:", err)
+		r.saveErr = err.Error()
+	}
+	return hash
+}
+
+// text replaces the names known and the IP addresses in s.
+func (r *redactor) text(s string) string {
+	r.mu.Lock()
+	if r.byLength == nil {
+		for name := range r.ids {
+			r.byLength = append(r.byLength, name)
+		}
+		// a name holding another goes as a whole
+		sort.Slice(r.byLength, func(i, j int) bool { return len(r.byLength[i]) > len(r.byLength[j]) })
+	}
+	for _, name := range r.byLength {
+		s = replaceWord(s, name, r.ids[name])
+	}
+	r.mu.Unlock()
+	literal := func(ip string) string {
+		if net.ParseIP(ip) == nil {
+			return ip
+		}
+		return r.id(ip)
+	}
+	s = ipv4Literal.ReplaceAllStringFunc(s, literal)
+	return ipv6Literal.ReplaceAllStringFunc(s, literal)
+}
+
+// replaceWord replaces old in s by new where it is not part of a longer
+// word, a host named vm leaving vmlinuz alone.
+func replaceWord(s, old, new string) string {
+	word := func(c byte) bool {
+		return c == '-' || c == '_' || '0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+	}
+	var b strings.Builder
+	i := 0
+	for {
+		j := strings.Index(s[i:], old)
+		if j < 0 {
+			break
+		}
+		j += i
+		end := j + len(old)
+		b.WriteString(s[i:j])
+		if (j == 0 || !word(s[j-1])) && (end == len(s) || !word(s[end])) {
+			b.WriteString(new)
+		} else {
+			b.WriteString(old)
+		}
+		i = end
+	}
+	if i == 0 {
+		return s
+	}
+	b.WriteString(s[i:])
+	return b.String()
+}
+
+// record returns a redacted copy of rec, a pointer to a record of records.go,
+// made by way of its JSON. On errors there is no copy, and rec must not go
+// out unredacted instead.
+func (r *redactor) record(rec any) (any, error) {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	// the names first, for the messages naming them
+	r.walk("", v, func(key, s string) string {
+		if redactKeys[key] {
+			r.id(s)
+		}
+		return s
+	})
+	v = r.walk("", v, func(key, s string) string {
+		if redactKeys[key] {
+			return r.id(s)
+		}
+		return r.text(s)
+	})
+	if b, err = json.Marshal(v); err != nil {
+		return nil, err
+	}
+	out := reflect.New(reflect.TypeOf(rec).Elem()).Interface()
+	if err := json.Unmarshal(b, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// walk applies fn to the strings in v with the key of the field or array
+// holding them.
+func (r *redactor) walk(key string, v any, fn func(key, s string) string) any {
+	switch v := v.(type) {
+	case string:
+		return fn(key, v)
+	case []any:
+		for i := range v {
+			v[i] = r.walk(key, v[i], fn)
+		}
+	case map[string]any:
+		for k := range v {
+			v[k] = r.walk(k, v[k], fn)
+		}
+	}
+	return v
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"runtime"
+	"strings"
+)
+
+// remoteDir is where `keeping remote` keeps the binaries it copies, on the
+// remote host; they are named after their hash, so a binary is only sent
+// once.
+const remoteDir = `"${XDG_CACHE_HOME:-$HOME/.cache}/keeping"`
+
+// remote runs keeping on another host over SSH, with the system's ssh
+// command, so its configuration, keys and agent apply.
+type remote struct {
+	ssh  []string
+	host string
+}
+
+// command runs script with the remote shell.
+func (r *remote) command(script string) *exec.Cmd {
+	args := append(append([]string(nil), r.ssh[1:]...), r.host, script)
+	cmd := exec.Command(r.ssh[0], args...)
+	cmd.Stderr = os.Stderr
+	return cmd
+}
+
+// platform is the GOOS/GOARCH of the remote host, from uname, and whether
+// the binary named path is already there.
+func (r *remote) platform(path string) (string, bool, error) {
+	out, err := r.command("uname -sm; if [ -x " + path + " ]; then echo present; fi").Output()
+	if err != nil {
+		return "", false, fmt.Errorf("ssh %s: %w", r.host, err)
+	}
+	lines := strings.Fields(string(out))
+	if len(lines) < 2 {
+		return "", false, fmt.Errorf("%s: unexpected uname output %q", r.host, out)
+	}
+	goos := strings.ToLower(lines[0])
+	arch := map[string]string{
+		"x86_64": "amd64", "amd64": "amd64", "aarch64": "arm64", "arm64": "arm64",
+		"i386": "386", "i686": "386", "armv6l": "arm", "armv7l": "arm",
+		"ppc64le": "ppc64le", "riscv64": "riscv64", "s390x": "s390x",
+	}[lines[1]]
+	if arch == "" {
+		arch = lines[1]
+	}
+	return goos + "/" + arch, len(lines) > 2 && lines[2] == "present", nil
+}
+
+// copy sends the binary at local to path on the remote host.
+func (r *remote) copy(local, path string) error {
+	f, err := os.Open(local)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	cmd := r.command("mkdir -p " + remoteDir + " && cat > " + path + ".tmp && chmod 755 " + path + ".tmp && mv " + path + ".tmp " + path)
+	cmd.Stdin = f
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("copying %s to %s: %w", local, r.host, err)
+	}
+	return nil
+}
+
+// runScript is what runs path with args on the remote host, its records
+// streamed as JSON lines to stdout. Without a terminal ssh passes no
+// interrupt on, so the remote run is interrupted, and prints its
+// statistics, when its standard input closes.
+func runScript(path string, args []string) string {
+	var b strings.Builder
+	b.WriteString("exec 3<&0; (read _ <&3; kill -INT $$) >/dev/null 2>&1 & exec " + path + " -json -")
+	for _, a := range args {
+		b.WriteString(" " + shellQuote(a))
+	}
+	b.WriteString(" 3<&-")
+	return b.String()
+}
+
+// fileHash is the start of the SHA-256 of the file at path, naming it on the
+// remote host.
+func fileHash(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16], nil
+}
+
+// remoteRecord decodes a line of the remote -json stream, nil for the
+// console output in between.
+func remoteRecord(line []byte) any {
+	var msg struct {
+		Type string          `json:"type"`
+		Data json.RawMessage `json:"data"`
+	}
+	if len(line) == 0 || line[0] != '{' || json.Unmarshal(line, &msg) != nil {
+		return nil
+	}
+	var rec any
+	switch msg.Type {
+	case "result":
+		rec = new(Result)
+	case "interval":
+		rec = new(IntervalStats)
+	case "event":
+		rec = new(Event)
+	default:
+		return nil
+	}
+	if json.Unmarshal(msg.Data, rec) != nil {
+		return nil
+	}
+	return rec
+}
+
+// remoteMain implements `keeping remote user@host -- args`, which copies
+// this keeping, or the one of -binary, to the host over SSH, runs it there
+// with the ping arguments args and merges the records it streams back into
+// the local outputs, its targets named NAME/target.
+func remoteMain(args []string) int {
+	fs := flag.NewFlagSet("remote", flag.ExitOnError)
+	binary := fs.String("binary", "", "copy this prebuilt keeping instead of this one, for a host of another OS or architecture")
+	sshCmd := fs.String("ssh", "ssh", "the ssh command and its options, e.g. \"ssh -p 2222 -i key\"")
+	name := fs.String("name", "", "name the remote targets NAME/target, the host by default")
+	jsonPath := fs.String("json", "", "append every remote result, interval and event as a JSON line to this file, - for stdout")
+	compress := fs.String("compress", compressNone, "compress the -json and -out-dir logs: none or gzip")
+	outDirPath := fs.String("out-dir", "", "write the records of each remote target to a file of its own in this directory")
+	outName := fs.String("out-name", "{target}.jsonl", "file names in -out-dir, {target}, {group} and {date} are filled in")
+	intervalsPath := fs.String("intervals", "", "append one row per remote target and interval to this file, CSV if it ends in .csv")
+	journal := fs.String("journal", "", "record the outages of the remote targets in this journal file")
+	fs.Usage = func() {
+		fmt.Println("Usage: keeping remote [flags] [user@]host -- [ping flags] target...")
+		fmt.Println("Runs keeping on the host over SSH, copying it there first, and records what it measures here.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if err := applyEnv(fs, "compress", "journal", "out-name"); err != nil {
+		fmt.Println("ERROR:", err)
+		return 2
+	}
+	rest := fs.Args()
+	if len(rest) < 2 || rest[1] != "--" || len(rest) < 3 {
+		fs.Usage()
+		return 2
+	}
+	host, pingArgs := rest[0], rest[2:]
+	for _, a := range pingArgs {
+		if a == "-json" || a == "--json" || strings.HasPrefix(a, "-json=") || strings.HasPrefix(a, "--json=") {
+			fmt.Println("ERROR: the remote run streams its records with -json, give -json before the host to keep them")
+			return 2
+		}
+	}
+	if *compress != compressNone && *compress != compressGzip {
+		fmt.Println("ERROR: -compress is none or gzip")
+		return 2
+	}
+	r := &remote{ssh: strings.Fields(*sshCmd), host: host}
+	if len(r.ssh) == 0 {
+		fmt.Println("ERROR: -ssh is empty")
+		return 2
+	}
+	if *name == "" {
+		_, h, ok := strings.Cut(host, "@")
+		if !ok {
+			h = host
+		}
+		*name = h
+	}
+
+	local := *binary
+	if local == "" {
+		self, err := os.Executable()
+		if err != nil {
+			fmt.Println("ERROR:", err)
+			return 1
+		}
+		local = self
+	}
+	hash, err := fileHash(local)
+	if err != nil {
+		fmt.Println("ERROR:", err)
+		return 1
+	}
+	path := remoteDir + "/keeping-" + hash
+	platform, present, err := r.platform(path)
+	if err != nil {
+		fmt.Println("ERROR:", err)
+		return 1
+	}
+	if here := runtime.GOOS + "/" + runtime.GOARCH; *binary == "" && platform != here {
+		goos, goarch, _ := strings.Cut(platform, "/")
+		fmt.Printf("ERROR: %s is %s and this keeping %s, build one for it with GOOS=%s GOARCH=%s go build and give it with -binary\n",
+			host, platform, here, goos, goarch)
+		return 1
+	}
+	if !present {
+		fmt.Printf("copying %s to %s\n", local, host)
+		if err := r.copy(local, path); err != nil {
+			fmt.Println("ERROR:", err)
+			return 1
+		}
+	}
+
+	var out dispatcher
+	// the records come as fast as the remote host sends them, none are to
+	// be lost to a slow sink
+	out.Overflow = overflowBlock
+	defer out.Close()
+	if *jsonPath != "" {
+		sink, err := newJSONSink(logPath(*jsonPath, *compress), *compress)
+		if err != nil {
+			fmt.Println("ERROR:", err)
+			return 1
+		}
+		out.Add("json", sink)
+	}
+	if *outDirPath != "" {
+		sink, err := newOutDir(*outDirPath, *outName, *compress)
+		if err != nil {
+			fmt.Println("ERROR:", err)
+			return 1
+		}
+		out.Add("out-dir", sink)
+	}
+	if *intervalsPath != "" {
+		sink, err := newIntervalFile(*intervalsPath, nil)
+		if err != nil {
+			fmt.Println("ERROR:", err)
+			return 1
+		}
+		out.Add("intervals", sink)
+	}
+	if *journal != "" {
+		sink, err := newJournalSink(*journal, 0)
+		if err != nil {
+			fmt.Println("WARN: journal disabled:", err)
+		} else {
+			out.Add("journal", sink)
+		}
+	}
+
+	cmd := r.command(runScript(path, pingArgs))
+	separateSignals(cmd)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		fmt.Println("ERROR:", err)
+		return 1
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		fmt.Println("ERROR:", err)
+		return 1
+	}
+	if err := cmd.Start(); err != nil {
+		fmt.Println("ERROR:", err)
+		return 1
+	}
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt)
+	defer signal.Stop(c)
+	go func() {
+		<-c
+		// the remote run stops and prints its statistics
+		stdin.Close()
+	}()
+	sc := bufio.NewScanner(stdout)
+	sc.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	prefix := *name + "/"
+	for sc.Scan() {
+		switch rec := remoteRecord(sc.Bytes()).(type) {
+		case *Result:
+			rec.Target = prefix + rec.Target
+			if rec.Group != "" {
+				rec.Group = prefix + rec.Group
+			}
+			out.Result(rec)
+		case *IntervalStats:
+			rec.Target = prefix + rec.Target
+			if rec.Group != "" {
+				rec.Group = prefix + rec.Group
+			}
+			out.Interval(rec)
+		case *Event:
+			if rec.Target != "" {
+				rec.Target = prefix + rec.Target
+			}
+			out.Event(rec)
+		default:
+			fmt.Printf("%s| %s\n", *name, sc.Bytes())
+		}
+	}
+	if err := sc.Err(); err != nil {
+		fmt.Println("WARN: reading from", host+":", err)
+	}
+	err = cmd.Wait()
+	var exit *exec.ExitError
+	if errors.As(err, &exit) {
+		return exit.ExitCode()
+	} else if err != nil {
+		fmt.Println("ERROR:", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,712 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"html/template"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// slaPeriod is the availability and latency of a target over one calendar
+// month, as an ISP's SLA puts them: uptime is of the time monitored, gaps
+// in the data are coverage lost, not downtime.
+type slaPeriod struct {
+	Month   time.Time
+	Target  string
+	Covered time.Duration
+	Down    time.Duration
+	Sent    int64
+	Lost    int64
+	// rttSum and recv average the interval averages weighted by replies,
+	// avgs are the interval averages for the 95th percentile
+	rttSum float64
+	recv   int64
+	avgs   []float64
+	// Samples counts the intervals with a -speedtest sample, loadRttSum,
+	// loadRecv and mbpsSum average their RTT and throughput
+	Samples    int
+	loadRttSum float64
+	loadRecv   int64
+	mbpsSum    float64
+	days       map[time.Time]*slaDay
+	// Outages are the runs of down intervals starting in the month
+	Outages []outage
+	// Journal are the notes on the target and the annotations of the
+	// month, from the -journal file
+	Journal []*journalEntry
+}
+
+type slaDay struct {
+	Covered, Down time.Duration
+	Sent, Lost    int64
+}
+
+type outage struct {
+	Start, End time.Time
+}
+
+// CoveragePct is the share of the month there is data for.
+func (p *slaPeriod) CoveragePct() float64 {
+	end := p.Month.AddDate(0, 1, 0)
+	return 100 * float64(p.Covered) / float64(end.Sub(p.Month))
+}
+
+func (p *slaPeriod) UptimePct() float64 {
+	if p.Covered == 0 {
+		return 0
+	}
+	return 100 * float64(p.Covered-p.Down) / float64(p.Covered)
+}
+
+func (p *slaPeriod) LossPct() float64 {
+	if p.Sent == 0 {
+		return 0
+	}
+	return 100 * float64(p.Lost) / float64(p.Sent)
+}
+
+func (p *slaPeriod) AvgMs() float64 {
+	if p.recv == 0 {
+		return math.NaN()
+	}
+	return p.rttSum / float64(p.recv)
+}
+
+func (p *slaPeriod) P95Ms() float64 {
+	if len(p.avgs) == 0 {
+		return math.NaN()
+	}
+	avgs := append([]float64(nil), p.avgs...)
+	sort.Float64s(avgs)
+	return avgs[int(math.Ceil(0.95*float64(len(avgs))))-1]
+}
+
+// LoadAvgMs is the average RTT of the intervals with a throughput sample,
+// IdleAvgMs that of the others.
+func (p *slaPeriod) LoadAvgMs() float64 {
+	if p.loadRecv == 0 {
+		return math.NaN()
+	}
+	return p.loadRttSum / float64(p.loadRecv)
+}
+
+func (p *slaPeriod) IdleAvgMs() float64 {
+	if p.recv == p.loadRecv {
+		return math.NaN()
+	}
+	return (p.rttSum - p.loadRttSum) / float64(p.recv-p.loadRecv)
+}
+
+func (p *slaPeriod) AvgMbps() float64 {
+	if p.Samples == 0 {
+		return math.NaN()
+	}
+	return p.mbpsSum / float64(p.Samples)
+}
+
+// WorstDay is the day with the least uptime, the most loss among equals.
+func (p *slaPeriod) WorstDay() (day time.Time, uptimePct float64) {
+	uptimePct = math.Inf(1)
+	var lossPct float64
+	for d, st := range p.days {
+		if st.Covered == 0 {
+			continue
+		}
+		up := 100 * float64(st.Covered-st.Down) / float64(st.Covered)
+		var loss float64
+		if st.Sent > 0 {
+			loss = float64(st.Lost) / float64(st.Sent)
+		}
+		if up < uptimePct || up == uptimePct && (loss > lossPct || loss == lossPct && d.Before(day)) {
+			day, uptimePct, lossPct = d, up, loss
+		}
+	}
+	return day, uptimePct
+}
+
+// slaReport adds up the interval rows into periods, by month in loc and by
+// target. An interval is down when it loses downLoss of its probes or more.
+func slaReport(rows []*intervalRow, loc *time.Location, downLoss float64) []*slaPeriod {
+	byTarget := make(map[string][]*intervalRow)
+	for _, r := range rows {
+		byTarget[r.Target] = append(byTarget[r.Target], r)
+	}
+	periods := make(map[string]*slaPeriod)
+	for target, rs := range byTarget {
+		sort.Slice(rs, func(i, j int) bool { return rs[i].Time.Before(rs[j].Time) })
+		step := intervalStep(rs)
+		var cur *outage
+		var curPeriod *slaPeriod
+		var last time.Time
+		for _, r := range rs {
+			if r.Sent == 0 || r.Time.Equal(last) {
+				// paused, or the same row read twice
+				continue
+			}
+			t := r.Time.In(loc)
+			month := time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, loc)
+			key := month.Format("2006-01") + " " + target
+			p := periods[key]
+			if p == nil {
+				p = &slaPeriod{Month: month, Target: target, days: make(map[time.Time]*slaDay)}
+				periods[key] = p
+			}
+			day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+			d := p.days[day]
+			if d == nil {
+				d = &slaDay{}
+				p.days[day] = d
+			}
+			p.Covered += step
+			d.Covered += step
+			p.Sent += r.Sent
+			p.Lost += r.Lost
+			d.Sent += r.Sent
+			d.Lost += r.Lost
+			if recv := r.Sent - r.Lost; recv > 0 {
+				p.rttSum += r.AvgMs * float64(recv)
+				p.recv += recv
+				p.avgs = append(p.avgs, r.AvgMs)
+				if r.ThroughputMbps > 0 {
+					p.loadRttSum += r.AvgMs * float64(recv)
+					p.loadRecv += recv
+				}
+			}
+			if r.ThroughputMbps > 0 {
+				p.Samples++
+				p.mbpsSum += r.ThroughputMbps
+			}
+			down := float64(r.Lost) >= downLoss*float64(r.Sent)
+			if down {
+				p.Down += step
+				d.Down += step
+			}
+			gap := r.Time.Sub(last) > step*3/2
+			switch {
+			case down && cur != nil && !gap:
+				cur.End = r.Time
+			case down:
+				if cur != nil {
+					curPeriod.Outages = append(curPeriod.Outages, *cur)
+				}
+				cur, curPeriod = &outage{Start: r.Time.Add(-step), End: r.Time}, p
+			case cur != nil:
+				curPeriod.Outages = append(curPeriod.Outages, *cur)
+				cur = nil
+			}
+			last = r.Time
+		}
+		if cur != nil {
+			curPeriod.Outages = append(curPeriod.Outages, *cur)
+		}
+	}
+	out := make([]*slaPeriod, 0, len(periods))
+	for _, p := range periods {
+		out = append(out, p)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if !out[i].Month.Equal(out[j].Month) {
+			return out[i].Month.Before(out[j].Month)
+		}
+		return out[i].Target < out[j].Target
+	})
+	return out
+}
+
+// intervalStep is the -k the rows were written at: the most common time
+// between them, a minute when there are too few to tell.
+func intervalStep(rs []*intervalRow) time.Duration {
+	gaps := make(map[time.Duration]int)
+	for i := 1; i < len(rs); i++ {
+		if g := rs[i].Time.Sub(rs[i-1].Time).Round(time.Second); g > 0 {
+			gaps[g]++
+		}
+	}
+	step, n := time.Minute, 0
+	for g, c := range gaps {
+		if c > n || c == n && g < step {
+			step, n = g, c
+		}
+	}
+	return step
+}
+
+// readIntervalRows reads the interval rows of a file written by -intervals,
+// CSV or JSON lines, or the intervals of a -json or -out-dir log. Files
+// ending in .gz are gunzipped.
+func readIntervalRows(path string) ([]*intervalRow, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		defer gz.Close()
+		r = gz
+	}
+	br := bufio.NewReader(r)
+	if b, _ := br.Peek(1); len(b) == 1 && b[0] != '{' {
+		return readIntervalCSV(path, br)
+	}
+	var rows []*intervalRow
+	sc := bufio.NewScanner(br)
+	sc.Buffer(nil, 16<<20)
+	for line := 1; sc.Scan(); line++ {
+		if len(strings.TrimSpace(sc.Text())) == 0 {
+			continue
+		}
+		var msg struct {
+			Type string          `json:"type"`
+			Data json.RawMessage `json:"data"`
+		}
+		if err := json.Unmarshal(sc.Bytes(), &msg); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		switch msg.Type {
+		case "":
+			var row intervalRow
+			if err := json.Unmarshal(sc.Bytes(), &row); err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+			}
+			rows = append(rows, &row)
+		case "interval":
+			var st IntervalStats
+			if err := json.Unmarshal(msg.Data, &st); err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+			}
+			rows = append(rows, newIntervalRow(&st))
+		}
+	}
+	return rows, sc.Err()
+}
+
+func readIntervalCSV(path string, r io.Reader) ([]*intervalRow, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	col := make(map[string]int, len(header))
+	for i, name := range header {
+		col[name] = i
+	}
+	for _, name := range []string{"time", "target", "sent", "lost", "avg_ms"} {
+		if _, ok := col[name]; !ok {
+			return nil, fmt.Errorf("%s: no %s column, not a file of -intervals", path, name)
+		}
+	}
+	var rows []*intervalRow
+	for line := 2; ; line++ {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			return rows, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		field := func(name string) string {
+			if i := col[name]; i < len(rec) {
+				return rec[i]
+			}
+			return ""
+		}
+		row := &intervalRow{Target: field("target"), Group: field("group")}
+		if row.Time, err = parseRowTime(field("time")); err == nil {
+			if row.Sent, err = strconv.ParseInt(field("sent"), 10, 64); err == nil {
+				if row.Lost, err = strconv.ParseInt(field("lost"), 10, 64); err == nil {
+					row.AvgMs, err = strconv.ParseFloat(field("avg_ms"), 64)
+				}
+			}
+		}
+		if i, ok := col["throughput_mbps"]; ok && err == nil && i < len(rec) && rec[i] != "" {
+			row.ThroughputMbps, err = strconv.ParseFloat(rec[i], 64)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		rows = append(rows, row)
+	}
+}
+
+// parseRowTime reads the timestamps -timefmt writes, but for Go layouts of
+// its own.
+func parseRowTime(s string) (time.Time, error) {
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		if len(s) > 11 {
+			return time.UnixMilli(n), nil
+		}
+		return time.Unix(n, 0), nil
+	}
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02 15:04:05"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unreadable time %q, write the intervals with the default -timefmt", s)
+}
+
+// reportMain implements `keeping report`, the SLA report of interval files.
+func reportMain(args []string) int {
+	fs := flag.NewFlagSet("report", flag.ExitOnError)
+	monthly := fs.Bool("monthly", false, "by calendar month")
+	format := fs.String("format", "text", "text, csv or html")
+	outPath := fs.String("o", "", "write the report to this file instead of stdout")
+	tz := fs.String("tz", "", "time zone of the months and days, the local one by default")
+	targets := fs.String("target", "", "only these targets, separated by commas")
+	downLossFlag := fs.String("down-loss", "100%", "an interval losing this many of its probes or more counts as down")
+	defJournal, _ := journalPath()
+	journal := fs.String("journal", defJournal, "add the notes and annotations of this journal file to the months, empty for none")
+	redact := fs.Bool("redact", false, "replace the names and addresses of the targets with the stable hashes of -redact")
+	redactMapFlag := fs.String("redact-map", "", "the -redact mapping file, by default redact.json in the state directory")
+	precision := fs.String("precision", "", "write latencies in us, ms or auto, with :DIGITS decimals, as the -precision of a run")
+	fs.Usage = func() {
+		fmt.Println("Usage: keeping report -monthly [-format text|csv|html] [-o FILE] FILE...")
+		fmt.Println("Reports the availability and latency of every target by calendar month, with its worst day, outages and journal,")
+		fmt.Println("from files of -intervals, -json or -out-dir, gzipped or not. Uptime is of the time there is data for.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if !*monthly || fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+	if err := output.setPrecision(*precision); err != nil {
+		fmt.Println("ERROR:", err)
+		return 2
+	}
+	downLoss, err := parseFraction(*downLossFlag)
+	if err != nil || downLoss == 0 {
+		fmt.Printf("ERROR: invalid -down-loss %q, want above 0 up to 100%%\n", *downLossFlag)
+		return 2
+	}
+	loc := time.Local
+	if *tz != "" {
+		if loc, err = time.LoadLocation(*tz); err != nil {
+			fmt.Println("ERROR:", err)
+			return 2
+		}
+	}
+	var rows []*intervalRow
+	for _, path := range fs.Args() {
+		rs, err := readIntervalRows(path)
+		if err != nil {
+			fmt.Println("ERROR:", err)
+			return 1
+		}
+		rows = append(rows, rs...)
+	}
+	if *targets != "" {
+		only := strings.Split(*targets, ",")
+		kept := rows[:0]
+		for _, r := range rows {
+			if contains(only, r.Target) {
+				kept = append(kept, r)
+			}
+		}
+		rows = kept
+	}
+	var red *redactor
+	if *redact {
+		path := *redactMapFlag
+		if path == "" {
+			if path, err = redactMapPath(); err != nil {
+				fmt.Println("ERROR:", err)
+				return 1
+			}
+		}
+		if red, err = loadRedactor(path); err != nil {
+			fmt.Println("ERROR:", err)
+			return 1
+		}
+		for _, r := range rows {
+			r.Target, r.Group = red.id(r.Target), red.id(r.Group)
+		}
+	}
+	periods := slaReport(rows, loc, downLoss)
+	if len(periods) == 0 {
+		fmt.Println("ERROR: no intervals in", strings.Join(fs.Args(), ", "))
+		return 1
+	}
+	if *journal != "" {
+		entries, err := readJournal(*journal, nil)
+		if err != nil {
+			fmt.Println("WARN: journal left out:", err)
+		}
+		if red != nil {
+			for _, e := range entries {
+				e.Target, e.Text = red.id(e.Target), red.text(e.Text)
+			}
+		}
+		addJournal(periods, entries)
+	}
+	var w io.Writer = os.Stdout
+	if *outPath != "" {
+		f, err := os.Create(*outPath)
+		if err != nil {
+			fmt.Println("ERROR:", err)
+			return 1
+		}
+		defer f.Close()
+		w = f
+	}
+	switch *format {
+	case "text":
+		err = writeSLAText(w, periods)
+	case "csv":
+		err = writeSLACSV(w, periods)
+	case "html":
+		err = writeSLAHTML(w, periods)
+	default:
+		err = fmt.Errorf("unknown -format %q, want text, csv or html", *format)
+	}
+	if err != nil {
+		fmt.Println("ERROR:", err)
+		return 1
+	}
+	return 0
+}
+
+// addJournal adds the notes and annotations of entries to the periods of
+// their month, an annotation to every target's.
+func addJournal(periods []*slaPeriod, entries []*journalEntry) {
+	for _, e := range entries {
+		if e.Kind != journalNote && e.Kind != journalAnnotation {
+			continue
+		}
+		for _, p := range periods {
+			if (e.Target == "" || e.Target == p.Target) && !e.Time.Before(p.Month) && e.Time.Before(p.Month.AddDate(0, 1, 0)) {
+				p.Journal = append(p.Journal, e)
+			}
+		}
+	}
+}
+
+// monthJournal is the journal of the periods of a month, an annotation
+// once.
+func monthJournal(periods []*slaPeriod) []*journalEntry {
+	var entries []*journalEntry
+	seen := make(map[*journalEntry]bool)
+	for _, p := range periods {
+		for _, e := range p.Journal {
+			if !seen[e] {
+				seen[e] = true
+				entries = append(entries, e)
+			}
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Time.Before(entries[j].Time) })
+	return entries
+}
+
+// journalTarget is the target of e on a report, * for an annotation.
+func journalTarget(e *journalEntry) string {
+	if e.Target == "" {
+		return "*"
+	}
+	return e.Target
+}
+
+// slaMs writes a latency, - when nothing was received.
+func slaMs(v float64) string {
+	if math.IsNaN(v) {
+		return "-"
+	}
+	return output.MsIn(v, 1)
+}
+
+// slaLatency is slaMs with the unit.
+func slaLatency(v float64) string {
+	if math.IsNaN(v) {
+		return "-"
+	}
+	return output.Ms(v, 1)
+}
+
+func slaDur(d time.Duration) string {
+	if d >= time.Minute {
+		d = d.Round(time.Minute)
+	}
+	return d.String()
+}
+
+func (p *slaPeriod) worstDay() string {
+	day, up := p.WorstDay()
+	if day.IsZero() {
+		return "-"
+	}
+	return fmt.Sprintf("%s (%.2f%%)", day.Format("2006-01-02"), up)
+}
+
+func writeSLAText(w io.Writer, periods []*slaPeriod) error {
+	var month time.Time
+	var tw *tabwriter.Writer
+	var outages, load strings.Builder
+	var inMonth []*slaPeriod
+	flush := func() {
+		if tw == nil {
+			return
+		}
+		tw.Flush()
+		if outages.Len() > 0 {
+			fmt.Fprintf(w, "\noutages:\n%s", outages.String())
+			outages.Reset()
+		}
+		if load.Len() > 0 {
+			fmt.Fprintf(w, "\nunder load:\n%s", load.String())
+			load.Reset()
+		}
+		if entries := monthJournal(inMonth); len(entries) > 0 {
+			fmt.Fprintln(w, "\njournal:")
+			for _, e := range entries {
+				fmt.Fprintf(w, "  %s  %s  %s: %s\n", journalTarget(e), e.Time.In(month.Location()).Format("2006-01-02 15:04"), e.Kind, e.Text)
+			}
+		}
+		inMonth = inMonth[:0]
+	}
+	for _, p := range periods {
+		if !p.Month.Equal(month) {
+			flush()
+			if !month.IsZero() {
+				fmt.Fprintln(w)
+			}
+			month = p.Month
+			fmt.Fprintf(w, "--- %s ---\n", month.Format("January 2006"))
+			tw = tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+			fmt.Fprintf(tw, "target\tcoverage\tuptime\tdowntime\toutages\tloss\t%s\t%s\tworst day\n", output.MsHead("avg"), output.MsHead("p95"))
+		}
+		fmt.Fprintf(tw, "%s\t%.1f%%\t%.3f%%\t%s\t%d\t%.2f%%\t%s\t%s\t%s\n", p.Target, p.CoveragePct(), p.UptimePct(),
+			slaDur(p.Down), len(p.Outages), p.LossPct(), slaMs(p.AvgMs()), slaMs(p.P95Ms()), p.worstDay())
+		inMonth = append(inMonth, p)
+		if p.Samples > 0 {
+			fmt.Fprintf(&load, "  %s  %d throughput samples, avg %.1f Mbit/s: avg %s during them, %s otherwise\n",
+				p.Target, p.Samples, p.AvgMbps(), slaLatency(p.LoadAvgMs()), slaLatency(p.IdleAvgMs()))
+		}
+		for _, o := range p.Outages {
+			fmt.Fprintf(&outages, "  %s  %s to %s  %s\n", p.Target, o.Start.In(p.Month.Location()).Format("2006-01-02 15:04"),
+				o.End.In(p.Month.Location()).Format("2006-01-02 15:04"), slaDur(o.End.Sub(o.Start)))
+		}
+	}
+	flush()
+	return nil
+}
+
+// writeSLACSV writes a row per month and target; the outages and the
+// journal are in the text and HTML reports only.
+func writeSLACSV(w io.Writer, periods []*slaPeriod) error {
+	cw := csv.NewWriter(w)
+	_ = cw.Write([]string{"month", "target", "coverage_pct", "uptime_pct", "downtime_s", "outages",
+		"sent", "lost", "loss_pct", "avg_ms", "p95_ms", "worst_day", "worst_day_uptime_pct",
+		"throughput_samples", "throughput_mbps", "load_avg_ms", "idle_avg_ms"})
+	f := func(v float64) string {
+		if math.IsNaN(v) {
+			return ""
+		}
+		return strconv.FormatFloat(v, 'f', 3, 64)
+	}
+	m := func(v float64) string {
+		if math.IsNaN(v) {
+			return ""
+		}
+		return output.MsField(v, 3)
+	}
+	for _, p := range periods {
+		day, up := p.WorstDay()
+		ds, ups := "", ""
+		if !day.IsZero() {
+			ds, ups = day.Format("2006-01-02"), f(up)
+		}
+		_ = cw.Write([]string{p.Month.Format("2006-01"), p.Target, f(p.CoveragePct()), f(p.UptimePct()),
+			strconv.FormatInt(int64(p.Down/time.Second), 10), strconv.Itoa(len(p.Outages)),
+			strconv.FormatInt(p.Sent, 10), strconv.FormatInt(p.Lost, 10), f(p.LossPct()),
+			m(p.AvgMs()), m(p.P95Ms()), ds, ups,
+			strconv.Itoa(p.Samples), f(p.AvgMbps()), m(p.LoadAvgMs()), m(p.IdleAvgMs())})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+var slaHTML = template.Must(template.New("report").Funcs(template.FuncMap{
+	"ms":      slaMs,
+	"latency": slaLatency,
+	"msHead":  func(name string) string { return output.MsHead(name) },
+	"dur":     slaDur,
+	"sub":     func(a, b time.Time) time.Duration { return a.Sub(b) },
+	"target":  journalTarget,
+	"when": func(t time.Time, loc *time.Location) string {
+		return t.In(loc).Format("2006-01-02 15:04")
+	},
+}).Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>keeping SLA report</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+th, td { border: 1px solid #ccc; padding: 0.3em 0.6em; text-align: right; }
+th:first-child, td:first-child { text-align: left; }
+</style></head><body>
+{{range .}}<h2>{{.Month.Format "January 2006"}}</h2>
+<table><tr><th>target</th><th>coverage</th><th>uptime</th><th>downtime</th><th>outages</th><th>loss</th><th>{{msHead "avg"}}</th><th>{{msHead "p95"}}</th><th>worst day</th></tr>
+{{range .Periods}}<tr><td>{{.Target}}</td><td>{{printf "%.1f%%" .CoveragePct}}</td><td>{{printf "%.3f%%" .UptimePct}}</td><td>{{dur .Down}}</td><td>{{len .Outages}}</td><td>{{printf "%.2f%%" .LossPct}}</td><td>{{ms .AvgMs}}</td><td>{{ms .P95Ms}}</td><td>{{.WorstDayText}}</td></tr>
+{{end}}</table>
+{{range .Periods}}{{if .Samples}}<p>{{.Target}}: {{.Samples}} throughput samples, avg {{printf "%.1f" .AvgMbps}} Mbit/s: avg {{latency .LoadAvgMs}} during them, {{latency .IdleAvgMs}} otherwise</p>
+{{end}}{{end}}{{if .Outages}}<table><tr><th>target</th><th>from</th><th>to</th><th>duration</th></tr>
+{{$loc := .Month.Location}}{{range .Outages}}<tr><td>{{.Target}}</td><td>{{when .Start $loc}}</td><td>{{when .End $loc}}</td><td>{{dur (sub .End .Start)}}</td></tr>
+{{end}}</table>{{end}}
+{{if .Journal}}<table><tr><th>target</th><th>when</th><th>kind</th><th>text</th></tr>
+{{$loc := .Month.Location}}{{range .Journal}}<tr><td>{{target .}}</td><td>{{when .Time $loc}}</td><td>{{.Kind}}</td><td style="text-align: left">{{.Text}}</td></tr>
+{{end}}</table>{{end}}
+{{end}}</body></html>
+`))
+
+func writeSLAHTML(w io.Writer, periods []*slaPeriod) error {
+	type htmlPeriod struct {
+		*slaPeriod
+		WorstDayText string
+	}
+	type htmlOutage struct {
+		Target string
+		outage
+	}
+	type htmlMonth struct {
+		Month   time.Time
+		Periods []htmlPeriod
+		Outages []htmlOutage
+		Journal []*journalEntry
+		periods []*slaPeriod
+	}
+	var months []*htmlMonth
+	for _, p := range periods {
+		if len(months) == 0 || !months[len(months)-1].Month.Equal(p.Month) {
+			months = append(months, &htmlMonth{Month: p.Month})
+		}
+		m := months[len(months)-1]
+		m.Periods = append(m.Periods, htmlPeriod{p, p.worstDay()})
+		m.periods = append(m.periods, p)
+		for _, o := range p.Outages {
+			m.Outages = append(m.Outages, htmlOutage{p.Target, o})
+		}
+	}
+	if len(months) == 0 {
+		return errors.New("nothing to report")
+	}
+	for _, m := range months {
+		m.Journal = monthJournal(m.periods)
+	}
+	return slaHTML.Execute(w, months)
+}
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// resetSignals: there is no SIGUSR1 here, `keeping ctl reset-stats` it is.
+var resetSignals []os.Signal
@@ -0,0 +1,12 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// resetSignals are the signals starting the statistics over, as `keeping
+// ctl reset-stats` does.
+var resetSignals = []os.Signal{syscall.SIGUSR1}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// dnsDefaultTTL is how long an answer is cached when its TTL can't be
+	// learnt, e.g. for names from /etc/hosts
+	dnsDefaultTTL = time.Minute
+	// dnsMinTTL and dnsMaxTTL clamp what the DNS says
+	dnsMinTTL = 5 * time.Second
+	dnsMaxTTL = time.Hour
+)
+
+// dnsCache resolves names for every Pinger, sharing the answers until their
+// TTL runs out and the lookups in flight, so a name repeated across hundreds
+// of targets is resolved once. At most Workers lookups run at a time.
+//
+// Addresses come from the system resolver, /etc/hosts and all; the TTL from
+// a query of our own to the first nameserver of /etc/resolv.conf, the system
+// resolver not telling it.
+type dnsCache struct {
+	Workers int
+
+	once    sync.Once
+	slots   chan struct{}
+	mu      sync.Mutex
+	entries map[string]*dnsEntry
+}
+
+type dnsEntry struct {
+	// done is closed once ips and err are set
+	done    chan struct{}
+	ips     []net.IP
+	err     error
+	expires time.Time
+}
+
+// resolver is the cache every lookup of the process goes through.
+var resolver = &dnsCache{Workers: 16}
+
+// LookupIP returns the addresses of host.
+func (c *dnsCache) LookupIP(host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	c.once.Do(func() {
+		n := c.Workers
+		if n < 1 {
+			n = 1
+		}
+		c.slots = make(chan struct{}, n)
+		c.entries = make(map[string]*dnsEntry)
+	})
+	c.mu.Lock()
+	e, ok := c.entries[host]
+	if ok {
+		select {
+		case <-e.done:
+			if e.err != nil || time.Now().After(e.expires) {
+				ok = false
+			}
+		default:
+			// in flight, wait for it
+		}
+	}
+	if !ok {
+		e = &dnsEntry{done: make(chan struct{})}
+		c.entries[host] = e
+		go c.resolve(host, e)
+	}
+	c.mu.Unlock()
+	<-e.done
+	return e.ips, e.err
+}
+
+func (c *dnsCache) resolve(host string, e *dnsEntry) {
+	c.slots <- struct{}{}
+	defer func() { <-c.slots }()
+	defer close(e.done)
+	e.ips, e.err = net.LookupIP(host)
+	if e.err != nil {
+		return
+	}
+	e.expires = time.Now().Add(dnsDefaultTTL)
+	// learning the TTL doesn't hold up the answer
+	go func() {
+		ttl, err := dnsTTL(host)
+		if err != nil {
+			return
+		}
+		c.mu.Lock()
+		e.expires = time.Now().Add(ttl)
+		c.mu.Unlock()
+	}()
+}
+
+// ResolveIPAddr returns the address to probe for host, the first IPv4 one
+// if there is any, like net.ResolveIPAddr.
+func (c *dnsCache) ResolveIPAddr(host string) (*net.IPAddr, error) {
+	if ip, zone, ok := strings.Cut(host, "%"); ok {
+		if addr := net.ParseIP(ip); addr != nil {
+			return &net.IPAddr{IP: addr, Zone: zone}, nil
+		}
+	}
+	ips, err := c.LookupIP(host)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			return &net.IPAddr{IP: ip}, nil
+		}
+	}
+	if len(ips) == 0 {
+		return nil, &net.DNSError{Err: "no suitable address found", Name: host}
+	}
+	return &net.IPAddr{IP: ips[0]}, nil
+}
+
+// Prefetch resolves hosts concurrently, within the worker limit, so that
+// starting many targets doesn't wait on one lookup after the other.
+func (c *dnsCache) Prefetch(hosts []string) {
+	var wg sync.WaitGroup
+	for _, h := range hosts {
+		wg.Add(1)
+		go func(h string) {
+			defer wg.Done()
+			_, _ = c.LookupIP(h)
+		}(h)
+	}
+	wg.Wait()
+}
+
+var errNoNameserver = errors.New("no nameserver in /etc/resolv.conf")
+
+// dnsTTL asks the first nameserver for the A records of host and returns
+// the smallest TTL of the answer, CNAMEs included.
+func dnsTTL(host string) (time.Duration, error) {
+	ns, err := firstNameserver()
+	if err != nil {
+		return 0, err
+	}
+	name, err := dnsmessage.NewName(strings.TrimSuffix(host, ".") + ".")
+	if err != nil {
+		return 0, err
+	}
+	q := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: uint16(time.Now().UnixNano()), RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}},
+	}
+	b, err := q.Pack()
+	if err != nil {
+		return 0, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", net.JoinHostPort(ns, "53"))
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	_ = conn.SetDeadline(deadline)
+	if _, err := conn.Write(b); err != nil {
+		return 0, err
+	}
+	buf := make([]byte, 1500)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return 0, err
+		}
+		var resp dnsmessage.Message
+		if resp.Unpack(buf[:n]) != nil || resp.ID != q.ID || !resp.Response {
+			continue
+		}
+		if len(resp.Answers) == 0 {
+			return 0, errors.New("no answer")
+		}
+		ttl := dnsMaxTTL
+		for _, a := range resp.Answers {
+			if t := time.Duration(a.Header.TTL) * time.Second; t < ttl {
+				ttl = t
+			}
+		}
+		if ttl < dnsMinTTL {
+			ttl = dnsMinTTL
+		}
+		return ttl, nil
+	}
+}
+
+func firstNameserver() (string, error) {
+	f, err := os.Open("/etc/resolv.conf")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			return fields[1], nil
+		}
+	}
+	return "", errNoNameserver
+}
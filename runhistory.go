@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// maxPastRuns bounds the runs kept for keeping history.
+const maxPastRuns = 100
+
+// pastRunsPath is the file of the user's past runs, one RunSummary a line.
+func pastRunsPath() (string, error) {
+	dir, err := stateDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "runs.jsonl"), nil
+}
+
+// pastRuns returns the runs recorded, most recent first.
+func pastRuns() ([]*RunSummary, error) {
+	path, err := pastRunsPath()
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var runs []*RunSummary
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 16<<20)
+	for sc.Scan() {
+		var rs RunSummary
+		if json.Unmarshal(sc.Bytes(), &rs) == nil {
+			runs = append([]*RunSummary{&rs}, runs...)
+		}
+	}
+	return runs, sc.Err()
+}
+
+// recordRun adds rs to the past runs, its URL passwords left out, dropping
+// the oldest beyond maxPastRuns.
+func recordRun(rs *RunSummary) error {
+	path, err := pastRunsPath()
+	if err != nil {
+		return err
+	}
+	runs, err := pastRuns()
+	if err != nil {
+		return err
+	}
+	r := *rs
+	r.Args = redactArgs(rs.Args)
+	runs = append([]*RunSummary{&r}, runs...)
+	if len(runs) > maxPastRuns {
+		runs = runs[:maxPastRuns]
+	}
+	var b []byte
+	for i := len(runs) - 1; i >= 0; i-- {
+		line, err := json.Marshal(runs[i])
+		if err != nil {
+			return err
+		}
+		b = append(append(b, line...), '\n')
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// historyMain implements `keeping history` and `keeping last`: listing the
+// past runs, showing the results of one by its index, 1 being the latest,
+// or running it again.
+func historyMain(cmd string, args []string) int {
+	fs := flag.NewFlagSet(cmd, flag.ExitOnError)
+	rerun := fs.Bool("rerun", false, "run it again with the same arguments")
+	n := fs.Int("n", 20, "runs listed")
+	fs.Usage = func() {
+		fmt.Println("Usage: keeping history [-n 20] [-rerun] [N]")
+		fmt.Println("       keeping last [-rerun]")
+		fmt.Println("Lists the past runs, shows the results of run N, 1 being the latest, or runs it again.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	runs, err := pastRuns()
+	if err != nil {
+		fmt.Println("ERROR:", err)
+		return 1
+	}
+	index := 0
+	switch {
+	case cmd == "last" && fs.NArg() == 0:
+		index = 1
+	case cmd == "history" && fs.NArg() == 1:
+		if index, err = strconv.Atoi(fs.Arg(0)); err != nil || index < 1 {
+			fmt.Printf("ERROR: invalid run %q, want its index in keeping history\n", fs.Arg(0))
+			return 2
+		}
+	case fs.NArg() > 0:
+		fs.Usage()
+		return 2
+	}
+	if index == 0 {
+		if *rerun {
+			fmt.Println("ERROR: -rerun needs the index of a run")
+			return 2
+		}
+		listRuns(runs, *n)
+		return 0
+	}
+	if index > len(runs) {
+		fmt.Printf("ERROR: no run %d, %d recorded\n", index, len(runs))
+		return 1
+	}
+	rs := runs[index-1]
+	if *rerun {
+		return rerunRun(rs)
+	}
+	fmt.Printf("run %d: %s, %v: %s\n", index, output.Time(rs.Start, "2006-01-02 15:04:05", time.Local),
+		rs.End.Sub(rs.Start).Round(time.Second), strings.Join(rs.Args, " "))
+	for _, s := range rs.Targets {
+		fmt.Println()
+		fmt.Print(formatSummary(s))
+	}
+	return 0
+}
+
+func listRuns(runs []*RunSummary, n int) {
+	if len(runs) == 0 {
+		fmt.Println("no runs recorded yet")
+		return
+	}
+	if n > 0 && len(runs) > n {
+		runs = runs[:n]
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "#\tstart\tduration\ttargets\targuments")
+	for i, rs := range runs {
+		var ts []string
+		for _, s := range rs.Targets {
+			ts = append(ts, fmt.Sprintf("%s %s/%.1f%%", s.Target, output.Ms(s.AvgMs, 1), s.LossPct))
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%v\t%s\t%s\n", i+1, output.Time(rs.Start, "2006-01-02 15:04", time.Local),
+			rs.End.Sub(rs.Start).Round(time.Second), strings.Join(ts, ", "), strings.Join(rs.Args, " "))
+	}
+	tw.Flush()
+}
+
+// formatSummary is the ping statistics of a recorded target.
+func formatSummary(s *Summary) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, tr("--- %s ping statistics ---\n"), s.Target)
+	fmt.Fprintf(&b, tr("%d packets transmitted, %d packets received, %d duplicates, %v%% packet loss\n"),
+		s.Sent, s.Recv, s.Duplicates, s.LossPct)
+	fmt.Fprintf(&b, tr("round-trip min/avg/max/stddev = %s/%s/%s/%s\n"),
+		output.Ms(s.MinMs, 3), output.Ms(s.AvgMs, 3), output.Ms(s.MaxMs, 3), output.Ms(s.StdDevMs, 3))
+	if s.MTU != nil && s.MTU.Blackhole {
+		fmt.Fprintf(&b, tr("path MTU blackhole on port %d: %d bytes in segments of %d stalled\n"), s.MTU.Port, s.MTU.Bytes, s.MTU.MSS)
+	}
+	if s.ForwardLossPct != nil {
+		fmt.Fprintf(&b, tr("forward/reverse loss = %.1f%%/%.1f%%\n"), *s.ForwardLossPct, *s.ReverseLossPct)
+	}
+	if len(s.Failures) > 0 {
+		fmt.Fprintf(&b, tr("failures: %s\n"), formatFailures(s.Failures))
+	}
+	return b.String()
+}
+
+// rerunRun runs keeping again with the arguments of rs.
+func rerunRun(rs *RunSummary) int {
+	for _, a := range rs.Args {
+		if strings.Contains(a, ":xxxxx@") {
+			fmt.Println("WARN: the passwords of URLs were not recorded, they are sent as xxxxx")
+			break
+		}
+	}
+	self, err := os.Executable()
+	if err != nil {
+		fmt.Println("ERROR:", err)
+		return 1
+	}
+	fmt.Printf("running %s %s\n", filepath.Base(os.Args[0]), strings.Join(rs.Args, " "))
+	cmd := exec.Command(self, rs.Args...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	// ctrl-C is for the run, which prints its statistics on it
+	signal.Notify(make(chan os.Signal, 1), os.Interrupt)
+	err = cmd.Run()
+	var exit *exec.ExitError
+	if errors.As(err, &exit) {
+		return exit.ExitCode()
+	} else if err != nil {
+		fmt.Println("ERROR:", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+// eventRun is the record a run starts with, Event.Run telling how the data
+// after it was taken.
+const eventRun = "run"
+
+// RunMeta describes a run, for data looked at long after: the build, the
+// machine, every setting and what each target resolved to.
+type RunMeta struct {
+	Version   string    `json:"version"`
+	GoVersion string    `json:"go_version"`
+	Host      string    `json:"host"`
+	Start     time.Time `json:"start"`
+	Args      []string  `json:"args"`
+	// Instance is the ID in the payload of every ICMP probe of the run
+	Instance string `json:"instance"`
+	// Settings holds every flag, defaults included; URL passwords are
+	// left out of them and of Args
+	Settings map[string]string `json:"settings"`
+	Targets  []RunTarget       `json:"targets"`
+}
+
+// RunTarget is a target as probed.
+type RunTarget struct {
+	Target  string   `json:"target"`
+	Aliases []string `json:"aliases,omitempty"`
+	Addr    string   `json:"addr,omitempty"`
+	Methods []string `json:"methods"`
+	// Socket is "raw" or "datagram" for ICMP, "tcp" for connection based
+	// probes
+	Socket string `json:"socket"`
+	// Path is the route -ttl-sweep found
+	Path []Hop `json:"path,omitempty"`
+}
+
+// version is the module version the binary was built from, with the VCS
+// revision when built in a checkout.
+func version() string {
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	v := bi.Main.Version
+	var rev, dirty string
+	for _, s := range bi.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			rev = s.Value
+			if len(rev) > 12 {
+				rev = rev[:12]
+			}
+		case "vcs.modified":
+			if s.Value == "true" {
+				dirty = "-dirty"
+			}
+		}
+	}
+	if rev != "" && (v == "" || v == "(devel)") {
+		// newer toolchains put the revision in the version themselves
+		v += " " + rev + dirty
+	}
+	return v
+}
+
+// socketMode tells how p probes: over a raw or a datagram ICMP socket, or
+// with TCP connections.
+func socketMode(p *Pinger) string {
+	for _, m := range p.Methods() {
+		if m == protocolICMP {
+			if p.privileged {
+				return "raw"
+			}
+			return "datagram"
+		}
+	}
+	return "tcp"
+}
+
+// flagSettings returns the value of every flag.
+func flagSettings() map[string]string {
+	s := make(map[string]string)
+	flag.VisitAll(func(f *flag.Flag) { s[f.Name] = redactURL(f.Value.String()) })
+	return s
+}
+
+// explicitFlags lists the flags given on the command line, as -name=value.
+func explicitFlags() []string {
+	var fs []string
+	flag.Visit(func(f *flag.Flag) { fs = append(fs, "-"+f.Name+"="+redactURL(f.Value.String())) })
+	return fs
+}
+
+// redactURL hides the password of a flag value that is a URL.
+func redactURL(v string) string {
+	if u, err := url.Parse(v); err == nil && u.User != nil {
+		return u.Redacted()
+	}
+	return v
+}
+
+// redactArgs is args with the passwords of URLs hidden.
+func redactArgs(args []string) []string {
+	out := make([]string, len(args))
+	for i, a := range args {
+		out[i] = redactURL(a)
+	}
+	return out
+}
+
+// runMeta describes the run started at start with the targets running.
+func (m *monitor) runMeta(start time.Time) *RunMeta {
+	host, _ := os.Hostname()
+	rm := &RunMeta{Version: version(), GoVersion: runtime.Version(), Host: host,
+		Start: start, Settings: flagSettings(), Args: redactArgs(os.Args[1:]),
+		Instance: instanceHex()}
+	for _, t := range m.list("") {
+		rt := RunTarget{Target: t.host, Methods: t.pinger.Methods(), Socket: socketMode(t.pinger), Path: t.path}
+		if a := t.pinger.IPAddr(); a != nil {
+			rt.Addr = a.String()
+		}
+		m.mu.Lock()
+		rt.Aliases = append([]string(nil), t.aliases...)
+		m.mu.Unlock()
+		rm.Targets = append(rm.Targets, rt)
+	}
+	return rm
+}
+
+// announceRun prints the banner of the run and hands its record to the
+// sinks.
+func (m *monitor) announceRun(start time.Time) {
+	rm := m.runMeta(start)
+	msg := fmt.Sprintf("keeping %s on %s, %d targets", rm.Version, rm.Host, len(rm.Targets))
+	if fs := explicitFlags(); len(fs) > 0 {
+		msg += ": " + strings.Join(fs, " ")
+	}
+	if m.table == nil {
+		fmt.Println(msg)
+	}
+	m.out.Event(&Event{Time: time.Now(), Type: eventRun, Message: msg, Run: rm})
+}
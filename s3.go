@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// s3Target is where run summaries and logs are uploaded, an S3 bucket or
+// any storage speaking its API, given as
+//
+//	s3://BUCKET/KEY                   AWS, in $AWS_REGION
+//	https://HOST[:PORT]/BUCKET/KEY    anything S3 compatible, path style
+//
+// KEY may hold {date}, {time}, {host} (this machine) and {target}. The
+// credentials come from $AWS_ACCESS_KEY_ID, $AWS_SECRET_ACCESS_KEY and
+// $AWS_SESSION_TOKEN, as for the aws tools.
+type s3Target struct {
+	endpoint *url.URL
+	bucket   string
+	key      string
+	region   string
+	access   string
+	secret   string
+	token    string
+	client   *http.Client
+}
+
+func parseS3Target(raw string) (*s3Target, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	t := &s3Target{
+		region: os.Getenv("AWS_REGION"),
+		access: os.Getenv("AWS_ACCESS_KEY_ID"),
+		secret: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		token:  os.Getenv("AWS_SESSION_TOKEN"),
+		client: &http.Client{Timeout: time.Minute},
+	}
+	if t.region == "" {
+		t.region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if t.region == "" {
+		t.region = "us-east-1"
+	}
+	switch u.Scheme {
+	case "s3":
+		t.endpoint = &url.URL{Scheme: "https", Host: "s3." + t.region + ".amazonaws.com"}
+		t.bucket, t.key = u.Host, strings.TrimPrefix(u.Path, "/")
+	case "http", "https":
+		t.endpoint = &url.URL{Scheme: u.Scheme, Host: u.Host}
+		t.bucket, t.key, _ = strings.Cut(strings.TrimPrefix(u.Path, "/"), "/")
+	default:
+		return nil, fmt.Errorf("unsupported upload URL %q, want s3://BUCKET/KEY or https://HOST/BUCKET/KEY", raw)
+	}
+	if t.bucket == "" || t.key == "" {
+		return nil, fmt.Errorf("upload URL %q lacks a bucket or key", raw)
+	}
+	if t.access == "" || t.secret == "" {
+		return nil, errors.New("uploading needs AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+	return t, nil
+}
+
+// perTarget tells whether the key names a target, one object per target.
+func (t *s3Target) perTarget() bool {
+	return strings.Contains(t.key, "{target}")
+}
+
+// objectKey fills in the key for a run started at start.
+func (t *s3Target) objectKey(start time.Time, target string) string {
+	host, _ := os.Hostname()
+	return strings.NewReplacer(
+		"{date}", start.UTC().Format("2006-01-02"),
+		"{time}", start.UTC().Format("150405"),
+		"{host}", host,
+		"{target}", mqttTopicName.Replace(target),
+	).Replace(t.key)
+}
+
+// uploadRunSummary uploads rs, split by target when the key asks for it.
+func (t *s3Target) uploadRunSummary(rs *RunSummary) error {
+	parts := []*RunSummary{rs}
+	if t.perTarget() {
+		parts = parts[:0]
+		for _, s := range rs.Targets {
+			p := *rs
+			p.Targets = []*Summary{s}
+			parts = append(parts, &p)
+		}
+	}
+	for _, p := range parts {
+		b, err := json.MarshalIndent(p, "", "  ")
+		if err != nil {
+			return err
+		}
+		target := ""
+		if len(p.Targets) == 1 {
+			target = p.Targets[0].Target
+		}
+		if err := t.put(t.objectKey(rs.Start, target), append(b, '\n'), "application/json"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// put stores body at key, signed with AWS Signature Version 4.
+func (t *s3Target) put(key string, body []byte, contentType string) error {
+	u := *t.endpoint
+	u.Path = "/" + t.bucket + "/" + key
+	u.RawPath = awsEscapePath(u.Path)
+	req, err := http.NewRequest(http.MethodPut, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	t.sign(req, body, time.Now())
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("upload %s: %s: %s", key, resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+func (t *s3Target) sign(req *http.Request, body []byte, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	sum := sha256.Sum256(body)
+	payloadHash := hex.EncodeToString(sum[:])
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if t.token != "" {
+		req.Header.Set("X-Amz-Security-Token", t.token)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonHeaders strings.Builder
+	for _, k := range names {
+		canonHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signed := strings.Join(names, ";")
+	canonical := strings.Join([]string{
+		req.Method, awsEscapePath(req.URL.Path), req.URL.RawQuery,
+		canonHeaders.String(), signed, payloadHash,
+	}, "\n")
+
+	scope := day + "/" + t.region + "/s3/aws4_request"
+	crSum := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(crSum[:])
+	k := hmacSHA256([]byte("AWS4"+t.secret), day)
+	k = hmacSHA256(k, t.region)
+	k = hmacSHA256(k, "s3")
+	k = hmacSHA256(k, "aws4_request")
+	sig := hex.EncodeToString(hmacSHA256(k, toSign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+t.access+"/"+scope+
+		", SignedHeaders="+signed+", Signature="+sig)
+}
+
+func hmacSHA256(key []byte, s string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(s))
+	return h.Sum(nil)
+}
+
+// awsEscapePath escapes a path the way SigV4 wants it, everything but the
+// unreserved characters and the slashes.
+func awsEscapePath(p string) string {
+	var b strings.Builder
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		if c == '/' || c == '-' || c == '_' || c == '.' || c == '~' ||
+			'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// scenario is a `keeping run` file: phases probing the targets one after
+// the other, each with settings of its own, as a link qualification
+// procedure goes.
+type scenario struct {
+	Name    string          `json:"name"`
+	Targets []string        `json:"targets"`
+	Phases  []scenarioPhase `json:"phases"`
+}
+
+// scenarioPhase is one phase of a scenario, the fields of a batch job but
+// the host besides its own. It lasts Duration, or until Count probes were
+// sent.
+type scenarioPhase struct {
+	batchJob
+	Name     string `json:"name"`
+	Duration string `json:"duration,omitempty"`
+	// Targets replace those of the scenario for the phase
+	Targets []string `json:"targets,omitempty"`
+	// MaxLoss, MaxAvg, MaxMax and MaxStdDev fail the phase as the flags
+	// of keeping assert do
+	MaxLoss   string `json:"max_loss,omitempty"`
+	MaxAvg    string `json:"max_avg,omitempty"`
+	MaxMax    string `json:"max_max,omitempty"`
+	MaxStdDev string `json:"max_stddev,omitempty"`
+
+	duration time.Duration
+	limits   assertLimits
+}
+
+// scenarioReport is the combined report of a run, as -json writes it.
+type scenarioReport struct {
+	Name   string                 `json:"name,omitempty"`
+	File   string                 `json:"file"`
+	Start  time.Time              `json:"start"`
+	End    time.Time              `json:"end"`
+	Pass   bool                   `json:"pass"`
+	Phases []*scenarioPhaseReport `json:"phases"`
+}
+
+type scenarioPhaseReport struct {
+	Name    string          `json:"name"`
+	Start   time.Time       `json:"start"`
+	End     time.Time       `json:"end"`
+	Results []*assertResult `json:"results"`
+	// Skipped is set on the phases an interrupt kept from running
+	Skipped bool `json:"skipped,omitempty"`
+}
+
+// loadScenario reads and checks a scenario file, YAML or JSON.
+func loadScenario(path string) (*scenario, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var sc scenario
+	if err := decodeYAML(b, &sc); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if len(sc.Phases) == 0 {
+		return nil, fmt.Errorf("%s: no phases", path)
+	}
+	for i := range sc.Phases {
+		ph := &sc.Phases[i]
+		if ph.Name == "" {
+			ph.Name = fmt.Sprintf("phase %d", i+1)
+		}
+		if err := ph.check(sc.Targets); err != nil {
+			return nil, fmt.Errorf("%s: %s: %w", path, ph.Name, err)
+		}
+	}
+	return &sc, nil
+}
+
+func (ph *scenarioPhase) check(targets []string) error {
+	if len(ph.Targets) == 0 {
+		ph.Targets = targets
+	}
+	if len(ph.Targets) == 0 {
+		return errors.New("no targets")
+	}
+	if ph.Host != "" {
+		return errors.New("host is not a phase setting, list targets")
+	}
+	if ph.Duration != "" {
+		d, err := time.ParseDuration(ph.Duration)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid duration %q", ph.Duration)
+		}
+		ph.duration = d
+	} else if ph.Count == nil {
+		return errors.New("a phase needs a duration or a count")
+	}
+	var err error
+	if ph.limits.Loss, err = parseLossLimit(ph.MaxLoss); err != nil {
+		return err
+	}
+	for _, l := range []struct {
+		v   string
+		dst *time.Duration
+	}{{ph.MaxAvg, &ph.limits.Avg}, {ph.MaxMax, &ph.limits.Max}, {ph.MaxStdDev, &ph.limits.StdDev}} {
+		if l.v == "" {
+			continue
+		}
+		if *l.dst, err = time.ParseDuration(l.v); err != nil || *l.dst <= 0 {
+			return fmt.Errorf("invalid limit %q", l.v)
+		}
+	}
+	// the settings of a target stand for those of all
+	job := ph.batchJob
+	job.Host = ph.Targets[0]
+	_, err = job.override(probeSettings{})
+	return err
+}
+
+// settings are the probe settings of the phase for host.
+func (ph *scenarioPhase) settings(host string, defaults probeSettings) (probeSettings, error) {
+	job := ph.batchJob
+	job.Host = host
+	if ph.duration > 0 {
+		defaults.Timeout = ph.duration
+		defaults.Count = -1
+	}
+	return job.override(defaults)
+}
+
+// run probes the targets of the phase at once until it is over or stop is
+// closed.
+func (ph *scenarioPhase) run(defaults probeSettings, stop <-chan struct{}) *scenarioPhaseReport {
+	rep := &scenarioPhaseReport{Name: ph.Name, Start: time.Now(), Results: make([]*assertResult, len(ph.Targets))}
+	done := make(chan struct{})
+	defer close(done)
+	var wg sync.WaitGroup
+	for i, host := range ph.Targets {
+		res := &assertResult{Target: host}
+		rep.Results[i] = res
+		s, err := ph.settings(host, defaults)
+		var p *Pinger
+		if err == nil {
+			p, err = NewPinger(host)
+		}
+		if err != nil {
+			res.Error = err.Error()
+			continue
+		}
+		if err := s.apply(p); err != nil {
+			res.Error = err.Error()
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := p.Run(); err != nil {
+				res.Error = err.Error()
+				return
+			}
+			res.Summary = newSummary(res.Target, p.Statistics())
+			res.Failures = ph.limits.check(res.Summary)
+			res.Pass = len(res.Failures) == 0
+		}()
+		go func() {
+			select {
+			case <-stop:
+				p.Stop()
+			case <-done:
+			}
+		}()
+	}
+	wg.Wait()
+	rep.End = time.Now()
+	return rep
+}
+
+// runMain implements `keeping run scenario.yaml`, running the phases of a
+// scenario in order and reporting on them all at the end. It exits 1 when
+// a phase limit failed and 2 when a target could not be probed.
+func runMain(args []string) int {
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	privileged := fs.Bool("privileged", false, "")
+	jsonPath := fs.String("json", "", "write the combined report as JSON to this file, - for stdout")
+	fs.Usage = func() {
+		fmt.Println("Usage: keeping run [-privileged] [-json file] scenario.yaml")
+		fmt.Println("Runs the phases of the scenario one after the other and reports on them all, e.g.:")
+		fmt.Print(`
+    name: uplink qualification
+    targets: [192.0.2.1, 1.1.1.1]
+    phases:
+      - name: idle baseline
+        duration: 60s
+      - name: large packets
+        duration: 120s
+        interval: 100ms
+        size: 1400
+        max_loss: 1%
+      - name: tcp
+        duration: 60s
+        methods: [tcp:443]
+        targets: [example.com]
+
+`)
+		fmt.Println("A phase takes count, interval, timeout, size, ttl and methods as the batch jobs read by ping - do,")
+		fmt.Println("and max_loss, max_avg, max_max and max_stddev as keeping assert does.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if err := applyEnv(fs, "privileged"); err != nil {
+		fmt.Println("ERROR:", err)
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	sc, err := loadScenario(fs.Arg(0))
+	if err != nil {
+		fmt.Println("ERROR:", err)
+		return 2
+	}
+	defaults := probeSettings{
+		Interval:     time.Second,
+		Timeout:      time.Duration(math.MaxInt64),
+		ReplyTimeout: 5 * time.Second,
+		MaxSaneRtt:   time.Minute,
+		Count:        -1,
+		Size:         24,
+		TTL:          64,
+		Privileged:   *privileged,
+		Timestamping: timestampUser,
+	}
+	stop := make(chan struct{})
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt)
+	defer signal.Stop(c)
+	go func() {
+		<-c
+		close(stop)
+	}()
+	report := &scenarioReport{Name: sc.Name, File: fs.Arg(0), Start: time.Now(), Pass: true}
+	for i := range sc.Phases {
+		ph := &sc.Phases[i]
+		select {
+		case <-stop:
+			report.Phases = append(report.Phases, &scenarioPhaseReport{Name: ph.Name, Skipped: true})
+			continue
+		default:
+		}
+		what := ph.Duration
+		if what == "" {
+			what = fmt.Sprintf("%d probes", *ph.Count)
+		}
+		fmt.Printf("=== phase %d/%d: %s, %s of %s\n", i+1, len(sc.Phases), ph.Name, what, strings.Join(ph.Targets, ", "))
+		rep := ph.run(defaults, stop)
+		for _, res := range rep.Results {
+			switch {
+			case res.Error != "":
+				fmt.Printf("ERROR: %s: %s\n", res.Target, res.Error)
+			case res.Summary != nil:
+				fmt.Printf("%s: %d sent, %d received, %.1f%% loss, avg %.3fms\n",
+					res.Target, res.Summary.Sent, res.Summary.Recv, res.Summary.LossPct, res.Summary.AvgMs)
+			}
+		}
+		report.Phases = append(report.Phases, rep)
+	}
+	report.End = time.Now()
+	code := 0
+	for _, ph := range report.Phases {
+		for _, res := range ph.Results {
+			switch {
+			case res.Error != "":
+				code = 2
+				report.Pass = false
+			case !res.Pass:
+				if code == 0 {
+					code = 1
+				}
+				report.Pass = false
+			}
+		}
+	}
+	fmt.Print("\n" + formatScenarioReport(report))
+	if *jsonPath != "" {
+		if err := writeScenarioReport(*jsonPath, report); err != nil {
+			fmt.Println("ERROR:", err)
+			return 2
+		}
+	}
+	return code
+}
+
+// formatScenarioReport is the table of every phase and target of a run.
+func formatScenarioReport(r *scenarioReport) string {
+	var b strings.Builder
+	name := r.Name
+	if name == "" {
+		name = r.File
+	}
+	fmt.Fprintf(&b, "--- %s, %v ---\n", name, r.End.Sub(r.Start).Round(time.Second))
+	tw := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "phase\ttarget\tsent\trecv\tloss\tmin\tavg\tmax\tstddev\tresult")
+	for _, ph := range r.Phases {
+		if ph.Skipped {
+			fmt.Fprintf(tw, "%s\t\t\t\t\t\t\t\t\tskipped\n", ph.Name)
+			continue
+		}
+		for _, res := range ph.Results {
+			if res.Summary == nil {
+				fmt.Fprintf(tw, "%s\t%s\t\t\t\t\t\t\t\terror\n", ph.Name, res.Target)
+				continue
+			}
+			s := res.Summary
+			result := "pass"
+			if !res.Pass {
+				var checks []string
+				for _, f := range res.Failures {
+					checks = append(checks, f.Check)
+				}
+				result = "FAIL " + strings.Join(checks, ",")
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%.1f%%\t%.3fms\t%.3fms\t%.3fms\t%.3fms\t%s\n", ph.Name, res.Target,
+				s.Sent, s.Recv, s.LossPct, s.MinMs, s.AvgMs, s.MaxMs, s.StdDevMs, result)
+		}
+	}
+	tw.Flush()
+	return b.String()
+}
+
+func writeScenarioReport(path string, r *scenarioReport) error {
+	b, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	if path == "-" {
+		_, err = os.Stdout.Write(b)
+		return err
+	}
+	return os.WriteFile(path, b, 0o644)
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"container/heap"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// sendTicker paces the sends of a pinger: a *time.Ticker of its own, or a
+// slot in the scheduler shared by the targets of a monitor.
+type sendTicker interface {
+	Chan() <-chan time.Time
+	Reset(d time.Duration)
+	Stop()
+}
+
+type timeTicker struct{ *time.Ticker }
+
+func (t timeTicker) Chan() <-chan time.Time { return t.C }
+
+// jitterOffset is how long a send is held back for -jitter: a uniformly
+// random part of up to jitter of the interval.
+func jitterOffset(interval time.Duration, jitter float64) time.Duration {
+	return time.Duration(rand.Float64() * jitter * float64(interval))
+}
+
+// scheduler ticks the sends of many pingers off one timer per shard instead
+// of a runtime timer each, keeping the sends on time with thousands of
+// targets. There is a shard per GOMAXPROCS so one goroutine doesn't have to
+// hand out every tick.
+type scheduler struct {
+	shards []*schedShard
+	next   atomic.Uint32
+}
+
+func newScheduler(shards int) *scheduler {
+	if shards < 1 {
+		shards = 1
+	}
+	s := &scheduler{shards: make([]*schedShard, shards)}
+	for i := range s.shards {
+		sh := &schedShard{wake: make(chan struct{}, 1)}
+		s.shards[i] = sh
+		go sh.run()
+	}
+	return s
+}
+
+// ticker returns a ticker firing every d, spread over the shards round
+// robin.
+func (s *scheduler) ticker(d time.Duration) *schedTicker {
+	sh := s.shards[int(s.next.Add(1))%len(s.shards)]
+	t := &schedTicker{sh: sh, c: make(chan time.Time, 1), index: -1}
+	t.Reset(d)
+	return t
+}
+
+// Lateness is how late the ticks went off after their time, on average and
+// at most, over all shards. Sends can only be later still.
+func (s *scheduler) Lateness() (avg, max time.Duration) {
+	var sum time.Duration
+	var n int64
+	for _, sh := range s.shards {
+		sh.mu.Lock()
+		sum += sh.lateSum
+		n += sh.lateN
+		if sh.lateMax > max {
+			max = sh.lateMax
+		}
+		sh.mu.Unlock()
+	}
+	if n == 0 {
+		return 0, 0
+	}
+	return sum / time.Duration(n), max
+}
+
+// schedShard is a heap of the tickers of one shard by their next tick.
+type schedShard struct {
+	mu      sync.Mutex
+	tickers schedHeap
+	wake    chan struct{}
+
+	lateSum time.Duration
+	lateMax time.Duration
+	lateN   int64
+}
+
+// schedTicker is a ticker driven by a scheduler. Like a *time.Ticker it
+// drops the ticks its pinger is too slow to take; it hands over the time
+// the tick was due, so what the pinger measures as send lag includes the
+// scheduler's lateness.
+type schedTicker struct {
+	sh     *schedShard
+	c      chan time.Time
+	period time.Duration
+	due    time.Time
+	// index is the place in the shard's heap, -1 when stopped
+	index int
+}
+
+func (t *schedTicker) Chan() <-chan time.Time { return t.c }
+
+func (t *schedTicker) Reset(d time.Duration) {
+	sh := t.sh
+	sh.mu.Lock()
+	t.drain()
+	t.period, t.due = d, time.Now().Add(d)
+	if t.index < 0 {
+		heap.Push(&sh.tickers, t)
+	} else {
+		heap.Fix(&sh.tickers, t.index)
+	}
+	first := sh.tickers[0] == t
+	sh.mu.Unlock()
+	if first {
+		sh.poke()
+	}
+}
+
+func (t *schedTicker) Stop() {
+	sh := t.sh
+	sh.mu.Lock()
+	if t.index >= 0 {
+		heap.Remove(&sh.tickers, t.index)
+	}
+	t.drain()
+	sh.mu.Unlock()
+}
+
+// drain drops a tick not taken yet, which would be stale after a Stop or
+// Reset. sh.mu held.
+func (t *schedTicker) drain() {
+	select {
+	case <-t.c:
+	default:
+	}
+}
+
+func (sh *schedShard) poke() {
+	select {
+	case sh.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run fires the tickers of the shard as they come due, for the life of the
+// process.
+func (sh *schedShard) run() {
+	timer := time.NewTimer(time.Hour)
+	for {
+		sh.mu.Lock()
+		now := time.Now()
+		for len(sh.tickers) > 0 && !sh.tickers[0].due.After(now) {
+			t := sh.tickers[0]
+			late := now.Sub(t.due)
+			sh.lateSum += late
+			sh.lateN++
+			if late > sh.lateMax {
+				sh.lateMax = late
+			}
+			select {
+			case t.c <- t.due:
+			default:
+			}
+			// skip the ticks missed, as a time.Ticker does
+			t.due = t.due.Add(t.period * (late/t.period + 1))
+			heap.Fix(&sh.tickers, 0)
+		}
+		wait := time.Hour
+		if len(sh.tickers) > 0 {
+			wait = time.Until(sh.tickers[0].due)
+		}
+		sh.mu.Unlock()
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+		select {
+		case <-timer.C:
+		case <-sh.wake:
+		}
+	}
+}
+
+// schedHeap orders tickers by their next tick.
+type schedHeap []*schedTicker
+
+func (h schedHeap) Len() int           { return len(h) }
+func (h schedHeap) Less(i, j int) bool { return h[i].due.Before(h[j].due) }
+func (h schedHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index, h[j].index = i, j
+}
+
+func (h *schedHeap) Push(x any) {
+	t := x.(*schedTicker)
+	t.index = len(*h)
+	*h = append(*h, t)
+}
+
+func (h *schedHeap) Pop() any {
+	old := *h
+	t := old[len(old)-1]
+	old[len(old)-1] = nil
+	t.index = -1
+	*h = old[:len(old)-1]
+	return t
+}
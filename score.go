@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The quality score of an interval is one number from 0, unusable, to 100,
+// perfect, for those who want one:
+//
+//	score = 100 × (1 − Σ wᵢ·cᵢ / Σ wᵢ)
+//
+// with the components cᵢ, each from 0 to 1:
+//
+//	loss    loss % / 10, 10% loss or more being the worst
+//	rtt     median RTT / 300ms
+//	jitter  mean difference between consecutive RTTs / 50ms
+//	spikes  share of the replies slower than twice the median, and by
+//	        10ms at least, / 10%
+//
+// and the weights wᵢ of -score-weights. An interval without any reply
+// scores 0.
+const (
+	scoreWorstLossPct = 10
+	scoreWorstRtt     = 300 * time.Millisecond
+	scoreWorstJitter  = 50 * time.Millisecond
+	scoreWorstSpikes  = 0.1
+	// spikeMin is how much slower than the median a spike is at least
+	spikeMin = 10 * time.Millisecond
+)
+
+const defaultScoreWeights = "loss=40,rtt=20,jitter=20,spikes=20"
+
+// scoreWeights are the weights of the components of the score.
+type scoreWeights struct {
+	Loss, RTT, Jitter, Spikes float64
+}
+
+// parseScoreWeights parses -score-weights, NAME=WEIGHT separated by commas,
+// the components left out weighing 0.
+func parseScoreWeights(s string) (scoreWeights, error) {
+	var w scoreWeights
+	for _, kv := range strings.Split(s, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(kv), "=")
+		f, err := strconv.ParseFloat(v, 64)
+		if !ok || err != nil || f < 0 || math.IsInf(f, 0) {
+			return w, fmt.Errorf("invalid score weight %q, want NAME=WEIGHT", kv)
+		}
+		switch k {
+		case "loss":
+			w.Loss = f
+		case "rtt":
+			w.RTT = f
+		case "jitter":
+			w.Jitter = f
+		case "spikes":
+			w.Spikes = f
+		default:
+			return w, fmt.Errorf("unknown score component %q, want loss, rtt, jitter or spikes", k)
+		}
+	}
+	if w.Loss+w.RTT+w.Jitter+w.Spikes == 0 {
+		return w, fmt.Errorf("-score-weights are all 0")
+	}
+	return w, nil
+}
+
+// rttQuality is the median, jitter and spike count of rtts, in the order
+// the replies came.
+func rttQuality(rtts []time.Duration) (median, jitter time.Duration, spikes int) {
+	if len(rtts) == 0 {
+		return 0, 0, 0
+	}
+	sorted := append([]time.Duration(nil), rtts...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	median = sorted[len(sorted)/2]
+	if len(sorted)%2 == 0 {
+		median = (sorted[len(sorted)/2-1] + median) / 2
+	}
+	var sum time.Duration
+	for i, rtt := range rtts {
+		if i > 0 {
+			d := rtt - rtts[i-1]
+			if d < 0 {
+				d = -d
+			}
+			sum += d
+		}
+		if rtt > 2*median && rtt-median >= spikeMin {
+			spikes++
+		}
+	}
+	if len(rtts) > 1 {
+		jitter = sum / time.Duration(len(rtts)-1)
+	}
+	return median, jitter, spikes
+}
+
+// score is the quality score of an interval, see above.
+func (w scoreWeights) score(lossPct float64, median, jitter time.Duration, spikes, recv int) float64 {
+	if recv == 0 {
+		return 0
+	}
+	c := func(v, worst float64) float64 { return math.Min(v/worst, 1) }
+	penalty := w.Loss*c(lossPct, scoreWorstLossPct) +
+		w.RTT*c(float64(median), float64(scoreWorstRtt)) +
+		w.Jitter*c(float64(jitter), float64(scoreWorstJitter)) +
+		w.Spikes*c(float64(spikes)/float64(recv), scoreWorstSpikes)
+	return math.Round(1000*(1-penalty/(w.Loss+w.RTT+w.Jitter+w.Spikes))) / 10
+}
@@ -0,0 +1,12 @@
+package main
+
+const (
+	sysSeccomp  = 317
+	seccompArch = 0xc000003e // AUDIT_ARCH_X86_64
+)
+
+// seccompDenied are execve, execveat, ptrace, process_vm_writev, mount,
+// umount2, pivot_root, chroot, unshare, setns, init_module, finit_module,
+// delete_module, kexec_load, kexec_file_load, reboot, swapon, swapoff, bpf
+// and perf_event_open.
+var seccompDenied = []uint32{59, 322, 101, 311, 165, 166, 155, 161, 272, 308, 175, 313, 176, 246, 320, 169, 167, 168, 321, 298}
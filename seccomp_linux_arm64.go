@@ -0,0 +1,9 @@
+package main
+
+const (
+	sysSeccomp  = 277
+	seccompArch = 0xc00000b7 // AUDIT_ARCH_AARCH64
+)
+
+// seccompDenied is the list of seccomp_linux_amd64.go in arm64 numbers.
+var seccompDenied = []uint32{221, 281, 117, 271, 40, 39, 41, 51, 97, 268, 105, 273, 106, 104, 294, 142, 224, 225, 280, 241}
@@ -0,0 +1,10 @@
+//go:build linux && !amd64 && !arm64
+
+package main
+
+const (
+	sysSeccomp  = 0
+	seccompArch = 0
+)
+
+var seccompDenied []uint32
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"time"
+)
+
+// selfStats is the health of the process itself: if it is starved or
+// stalls in GC, the RTTs it measures are off.
+type selfStats struct {
+	Goroutines   int
+	HeapBytes    uint64
+	GCCount      uint32
+	GCPauseTotal time.Duration
+	GCPauseLast  time.Duration
+	// SendLagAvg and SendLagMax are over all targets
+	SendLagAvg  time.Duration
+	SendLagMax  time.Duration
+	SendErrors  int
+	SinkDropped int
+	// SchedLateAvg and SchedLateMax are how late the scheduler ticked
+	SchedLateAvg time.Duration
+	SchedLateMax time.Duration
+}
+
+func (m *monitor) selfStats() *selfStats {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	s := &selfStats{
+		Goroutines:   runtime.NumGoroutine(),
+		HeapBytes:    ms.HeapAlloc,
+		GCCount:      ms.NumGC,
+		GCPauseTotal: time.Duration(ms.PauseTotalNs),
+	}
+	if ms.NumGC > 0 {
+		s.GCPauseLast = time.Duration(ms.PauseNs[(ms.NumGC+255)%256])
+	}
+	ts := m.list("")
+	for _, t := range ts {
+		avg, max := t.pinger.SendLag()
+		s.SendLagAvg += avg
+		if max > s.SendLagMax {
+			s.SendLagMax = max
+		}
+		s.SendErrors += t.pinger.Statistics().SendErrors
+	}
+	if len(ts) > 0 {
+		s.SendLagAvg /= time.Duration(len(ts))
+	}
+	s.SinkDropped = m.out.dropped()
+	s.SchedLateAvg, s.SchedLateMax = m.sched.Lateness()
+	return s
+}
+
+func (s *selfStats) String() string {
+	return fmt.Sprintf("self: goroutines=%d heap=%.1fMiB gc=%d pause last/total=%v/%v send lag avg/max=%v/%v scheduler late avg/max=%v/%v send errors=%d sink drops=%d",
+		s.Goroutines, float64(s.HeapBytes)/(1<<20), s.GCCount, s.GCPauseLast, s.GCPauseTotal,
+		s.SendLagAvg, s.SendLagMax, s.SchedLateAvg, s.SchedLateMax, s.SendErrors, s.SinkDropped)
+}
+
+// logSelfStats prints the self statistics every interval.
+func (m *monitor) logSelfStats(every time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			fmt.Println(m.selfStats())
+		case <-stop:
+			return
+		}
+	}
+}
+
+// writeSelfMetrics exposes the self statistics, per target where they are
+// per target.
+func (m *monitor) writeSelfMetrics(mw *metricsWriter) {
+	s := m.selfStats()
+	mw.gauge("keeping_goroutines", "Goroutines of the process.", float64(s.Goroutines))
+	mw.gauge("keeping_heap_bytes", "Bytes of allocated heap objects.", float64(s.HeapBytes))
+	mw.counter("keeping_gc_total", "Completed GC cycles.", float64(s.GCCount))
+	mw.counter("keeping_gc_pause_seconds_total", "Time spent in GC stop-the-world pauses.", s.GCPauseTotal.Seconds())
+	mw.gauge("keeping_gc_pause_last_seconds", "Duration of the latest GC pause.", s.GCPauseLast.Seconds())
+	mw.gauge("keeping_scheduler_lateness_avg_seconds", "How late the send scheduler ticked on average.", s.SchedLateAvg.Seconds())
+	mw.gauge("keeping_scheduler_lateness_max_seconds", "How late the send scheduler ticked at most.", s.SchedLateMax.Seconds())
+	ts := m.list("")
+	mw.header("keeping_send_lag_avg_seconds", "gauge", "How late scheduled probes were sent on average.")
+	for _, t := range ts {
+		avg, _ := t.pinger.SendLag()
+		mw.sample("keeping_send_lag_avg_seconds", avg.Seconds(), "target", t.host)
+	}
+	mw.header("keeping_send_lag_max_seconds", "gauge", "How late scheduled probes were sent at most.")
+	for _, t := range ts {
+		_, max := t.pinger.SendLag()
+		mw.sample("keeping_send_lag_max_seconds", max.Seconds(), "target", t.host)
+	}
+	mw.header("keeping_send_errors_total", "counter", "Probes that failed to go out.")
+	for _, t := range ts {
+		mw.sample("keeping_send_errors_total", float64(t.pinger.Statistics().SendErrors), "target", t.host)
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Interval rows of -intervals are signed with -sign-key for evidence in an
+// ISP dispute or SLA claim: the sig column holds "ed25519:" or
+// "hmac-sha256:" and the base64 signature of
+//
+//	previous signature || "\n" || row
+//
+// the row being the JSON line or CSV record without the sig, the previous
+// signature that of the row before in the same file, empty for the first
+// signed row only: a run appending to a file carries on from its last
+// signature. The chain makes a removed or reordered row or run fail as well
+// as an altered one; only rows cut off the end of the file, and a file
+// replaced as a whole by one signed with the same key, go unnoticed.
+
+// minHMACKey is the shortest HMAC secret a key file may hold.
+const minHMACKey = 16
+
+// signKey is an Ed25519 key pair, or the public key alone to verify, or an
+// HMAC secret.
+type signKey struct {
+	priv ed25519.PrivateKey
+	pub  ed25519.PublicKey
+	hmac []byte
+}
+
+// loadSignKey reads a key from a file, or from the variable NAME with
+// env:NAME: a PEM Ed25519 private key, as openssl genpkey -algorithm
+// ed25519 writes, or its public key, or anything else as an HMAC secret.
+func loadSignKey(spec string) (*signKey, error) {
+	var b []byte
+	if name, ok := strings.CutPrefix(spec, "env:"); ok {
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			return nil, fmt.Errorf("sign key: %s is not set", name)
+		}
+		b = []byte(v)
+	} else {
+		var err error
+		if b, err = os.ReadFile(spec); err != nil {
+			return nil, err
+		}
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		secret := bytes.TrimSpace(b)
+		if len(secret) < minHMACKey {
+			return nil, fmt.Errorf("sign key: an HMAC secret of %d bytes is too short, want %d at least", len(secret), minHMACKey)
+		}
+		return &signKey{hmac: secret}, nil
+	}
+	switch block.Type {
+	case "PRIVATE KEY":
+		k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("sign key: %w", err)
+		}
+		priv, ok := k.(ed25519.PrivateKey)
+		if !ok {
+			return nil, errors.New("sign key: not an Ed25519 key")
+		}
+		return &signKey{priv: priv, pub: priv.Public().(ed25519.PublicKey)}, nil
+	case "PUBLIC KEY":
+		k, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("sign key: %w", err)
+		}
+		pub, ok := k.(ed25519.PublicKey)
+		if !ok {
+			return nil, errors.New("sign key: not an Ed25519 key")
+		}
+		return &signKey{pub: pub}, nil
+	}
+	return nil, fmt.Errorf("sign key: unexpected PEM block %s", block.Type)
+}
+
+func (k *signKey) message(prev string, row []byte) []byte {
+	return append(append([]byte(prev), '\n'), row...)
+}
+
+// sign returns the signature of row after the one prev.
+func (k *signKey) sign(prev string, row []byte) string {
+	if k.hmac != nil {
+		mac := hmac.New(sha256.New, k.hmac)
+		mac.Write(k.message(prev, row))
+		return "hmac-sha256:" + base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	}
+	return "ed25519:" + base64.StdEncoding.EncodeToString(ed25519.Sign(k.priv, k.message(prev, row)))
+}
+
+// verify tells whether sig is the signature of row after the one prev.
+func (k *signKey) verify(prev string, row []byte, sig string) bool {
+	if k.hmac != nil {
+		return hmac.Equal([]byte(sig), []byte(k.sign(prev, row)))
+	}
+	b64, ok := strings.CutPrefix(sig, "ed25519:")
+	raw, err := base64.StdEncoding.DecodeString(b64)
+	return ok && err == nil && ed25519.Verify(k.pub, k.message(prev, row), raw)
+}
+
+// csvLine is fields as a CSV line, as -intervals writes it.
+func csvLine(fields []string) []byte {
+	var b bytes.Buffer
+	w := csv.NewWriter(&b)
+	_ = w.Write(fields)
+	w.Flush()
+	return b.Bytes()
+}
+
+// jsonSigField ends a signed JSON row, the sig field being the last.
+const jsonSigField = `,"sig":"`
+
+// splitJSONRow splits a JSON row into the row without its sig, as signed,
+// and the sig, which is empty when the row is not signed.
+func splitJSONRow(b []byte) (row []byte, sig string) {
+	if i := bytes.LastIndex(b, []byte(jsonSigField)); i >= 0 && bytes.HasSuffix(b, []byte(`"}`)) {
+		row = append(append([]byte(nil), b[:i]...), '}')
+		sig = string(b[i+len(jsonSigField) : len(b)-2])
+	}
+	return row, sig
+}
+
+// sigTail is how much of the end of an -intervals file lastSignature reads,
+// much more than a row.
+const sigTail = 64 << 10
+
+// lastSignature returns the signature of the last row of the -intervals
+// file f, for the rows appended to carry on its chain, or "" when the file
+// has no rows or its last row is not signed.
+func lastSignature(f *os.File, asCSV bool) (string, error) {
+	fi, err := f.Stat()
+	if err != nil || fi.Size() == 0 {
+		return "", err
+	}
+	off := fi.Size() - sigTail
+	if off < 0 {
+		off = 0
+	}
+	b := make([]byte, fi.Size()-off)
+	if _, err := f.ReadAt(b, off); err != nil {
+		return "", err
+	}
+	lines := bytes.Split(bytes.TrimSpace(b), []byte("\n"))
+	last := bytes.TrimSpace(lines[len(lines)-1])
+	if !asCSV {
+		_, sig := splitJSONRow(last)
+		return sig, nil
+	}
+	if off == 0 && len(lines) == 1 {
+		// the header alone
+		return "", nil
+	}
+	header, err := csv.NewReader(io.NewSectionReader(f, 0, fi.Size())).Read()
+	if err != nil {
+		return "", err
+	}
+	rec, err := csv.NewReader(bytes.NewReader(last)).Read()
+	if err != nil {
+		return "", fmt.Errorf("last row: %w", err)
+	}
+	for i, name := range header {
+		if name == "sig" && i < len(rec) {
+			return rec[i], nil
+		}
+	}
+	return "", nil
+}
+
+// verifyMain implements `keeping verify`, checking the signatures of
+// -intervals files. It exits 1 when a row is not signed or was altered,
+// removed or reordered, 2 on errors.
+func verifyMain(args []string) int {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	keySpec := fs.String("key", "", "the Ed25519 public or private key, or the HMAC secret, in this file, or env:NAME")
+	fs.Usage = func() {
+		fmt.Println("Usage: keeping verify -key FILE intervals.csv|intervals.jsonl...")
+		fmt.Println("Checks the signatures -sign-key put on the rows of -intervals files.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 || *keySpec == "" {
+		fs.Usage()
+		return 2
+	}
+	key, err := loadSignKey(*keySpec)
+	if err != nil {
+		fmt.Println("ERROR:", err)
+		return 2
+	}
+	code := 0
+	for _, path := range fs.Args() {
+		f, err := os.Open(path)
+		if err != nil {
+			fmt.Println("ERROR:", err)
+			code = 2
+			continue
+		}
+		rows, bad, err := verifyIntervals(key, f, strings.HasSuffix(path, ".csv"))
+		f.Close()
+		switch {
+		case err != nil:
+			fmt.Printf("ERROR: %s: %v\n", path, err)
+			code = 2
+		case len(bad) > 0:
+			for _, b := range bad {
+				fmt.Printf("%s:%s\n", path, b)
+			}
+			fmt.Printf("%s: FAILED, %d of %d rows\n", path, len(bad), rows)
+			if code == 0 {
+				code = 1
+			}
+		default:
+			fmt.Printf("%s: OK, %d rows\n", path, rows)
+		}
+	}
+	return code
+}
+
+// verifyIntervals checks every row read from r, returning their count and
+// what is wrong with the rows failing. Only the first signed row, or one
+// after a row not signed, starts the chain.
+func verifyIntervals(key *signKey, r io.Reader, asCSV bool) (rows int, bad []string, err error) {
+	var prev string
+	check := func(line int, row []byte, sig string) {
+		rows++
+		switch {
+		case sig == "":
+			bad = append(bad, fmt.Sprintf("%d: not signed", line))
+		case key.verify(prev, row, sig):
+		case key.verify("", row, sig):
+			bad = append(bad, fmt.Sprintf("%d: the chain starts over, the rows before were removed or come from another file", line))
+		default:
+			bad = append(bad, fmt.Sprintf("%d: bad signature, the row or the one before was altered, or rows removed", line))
+		}
+		prev = sig
+	}
+	if !asCSV {
+		sc := bufio.NewScanner(r)
+		sc.Buffer(nil, 1<<20)
+		for line := 1; sc.Scan(); line++ {
+			b := bytes.TrimSpace(sc.Bytes())
+			if len(b) == 0 {
+				continue
+			}
+			row, sig := splitJSONRow(b)
+			check(line, row, sig)
+		}
+		return rows, bad, sc.Err()
+	}
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err != nil {
+		return 0, nil, err
+	}
+	col := -1
+	for i, name := range header {
+		if name == "sig" {
+			col = i
+		}
+	}
+	if col < 0 {
+		return 0, nil, errors.New("no sig column, not signed")
+	}
+	for line := 2; ; line++ {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			return rows, bad, nil
+		} else if err != nil {
+			return rows, bad, err
+		}
+		var sig string
+		if col < len(rec) {
+			sig = rec[col]
+			rec = append(rec[:col:col], rec[col+1:]...)
+		}
+		check(line, csvLine(rec), sig)
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testSignKeys writes an Ed25519 key pair and an HMAC secret to dir and
+// returns their paths.
+func testSignKeys(t *testing.T, dir string) (priv, pub, secret string) {
+	t.Helper()
+	pk, sk, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(sk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubDER, err := x509.MarshalPKIXPublicKey(pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	priv, pub, secret = filepath.Join(dir, "key.pem"), filepath.Join(dir, "pub.pem"), filepath.Join(dir, "secret")
+	for path, b := range map[string][]byte{
+		priv:   pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}),
+		pub:    pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER}),
+		secret: []byte("0123456789abcdef0123\n"),
+	} {
+		if err := os.WriteFile(path, b, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return priv, pub, secret
+}
+
+func TestLoadSignKey(t *testing.T) {
+	dir := t.TempDir()
+	priv, pub, secret := testSignKeys(t, dir)
+	k, err := loadSignKey(priv)
+	if err != nil || k.priv == nil || k.pub == nil {
+		t.Fatalf("private key: %+v, %v", k, err)
+	}
+	if k, err := loadSignKey(pub); err != nil || k.priv != nil || k.pub == nil {
+		t.Errorf("public key: %+v, %v", k, err)
+	}
+	if k, err := loadSignKey(secret); err != nil || string(k.hmac) != "0123456789abcdef0123" {
+		t.Errorf("secret: %+v, %v", k, err)
+	}
+	t.Setenv("KEEPING_TEST_SECRET", "fedcba9876543210")
+	if k, err := loadSignKey("env:KEEPING_TEST_SECRET"); err != nil || string(k.hmac) != "fedcba9876543210" {
+		t.Errorf("env: %+v, %v", k, err)
+	}
+
+	short := filepath.Join(dir, "short")
+	other := filepath.Join(dir, "other.pem")
+	_ = os.WriteFile(short, []byte("tiny\n"), 0o600)
+	_ = os.WriteFile(other, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte{1}}), 0o600)
+	for _, tt := range []struct {
+		spec, want string
+	}{
+		{short, "too short"},
+		{other, "unexpected PEM block CERTIFICATE"},
+		{"env:KEEPING_TEST_UNSET", "KEEPING_TEST_UNSET is not set"},
+		{filepath.Join(dir, "missing"), "no such file"},
+	} {
+		if _, err := loadSignKey(tt.spec); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: error %v, want %q", tt.spec, err, tt.want)
+		}
+	}
+}
+
+func TestSignVerify(t *testing.T) {
+	priv, pub, secret := testSignKeys(t, t.TempDir())
+	for _, pair := range [][2]string{{priv, pub}, {priv, priv}, {secret, secret}} {
+		signer, _ := loadSignKey(pair[0])
+		verifier, _ := loadSignKey(pair[1])
+		sig := signer.sign("prev", []byte("row"))
+		if !verifier.verify("prev", []byte("row"), sig) {
+			t.Errorf("%s: signature refused", pair[1])
+		}
+		for _, tt := range []struct {
+			name, prev, row, sig string
+		}{
+			{"altered row", "prev", "rōw", sig},
+			{"other previous signature", "", "row", sig},
+			{"altered signature", "prev", "row", sig[:len(sig)-4] + "AAA="},
+			{"other algorithm", "prev", "row", strings.Replace(sig, ":", "x:", 1)},
+			{"empty", "prev", "row", ""},
+		} {
+			if verifier.verify(tt.prev, []byte(tt.row), tt.sig) {
+				t.Errorf("%s: %s accepted", pair[1], tt.name)
+			}
+		}
+	}
+}
+
+// writeSignedIntervals appends rows for the targets to path as -intervals
+// does, one run at a time.
+func writeSignedIntervals(t *testing.T, path string, key *signKey, targets ...string) {
+	t.Helper()
+	s, err := newIntervalFile(path, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, target := range targets {
+		st := &IntervalStats{Time: time.Date(2024, 1, 2, 3, 4, i, 0, time.UTC), Target: target, Sent: 10, Lost: int64(i)}
+		if err := s.HandleInterval(st); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// intervalLines reads the rows of the -intervals file path, without the
+// header of a CSV file.
+func intervalLines(t *testing.T, path string) []string {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.SplitAfter(string(b), "\n")
+	lines = lines[:len(lines)-1]
+	if strings.HasSuffix(path, ".csv") {
+		lines = lines[1:]
+	}
+	return lines
+}
+
+func TestVerifyIntervals(t *testing.T) {
+	dir := t.TempDir()
+	priv, pub, _ := testSignKeys(t, dir)
+	signer, _ := loadSignKey(priv)
+	verifier, _ := loadSignKey(pub)
+	for _, ext := range []string{".jsonl", ".csv"} {
+		asCSV := ext == ".csv"
+		path := filepath.Join(dir, "intervals"+ext)
+		// two runs, the second carrying on the chain of the first
+		writeSignedIntervals(t, path, signer, "a", "b")
+		writeSignedIntervals(t, path, signer, "c")
+		lines := intervalLines(t, path)
+		header, first := "", 1
+		altered := strings.Replace(lines[1], `"target":"b"`, `"target":"x"`, 1)
+		if asCSV {
+			header, first = strings.Join(intervalColumns, ",")+"\n", 2
+			altered = strings.Replace(lines[1], ",b,", ",x,", 1)
+		}
+		if rows, bad, err := verifyIntervals(verifier, strings.NewReader(header+strings.Join(lines, "")), asCSV); err != nil || rows != 3 || bad != nil {
+			t.Fatalf("%s: %d rows, %q, %v", ext, rows, bad, err)
+		}
+
+		other := filepath.Join(dir, "other"+ext)
+		writeSignedIntervals(t, other, signer, "d")
+		unsigned := filepath.Join(dir, "unsigned"+ext)
+		writeSignedIntervals(t, unsigned, nil, "b")
+		for _, tt := range []struct {
+			name  string
+			lines []string
+			// bad is the index of the first row failing, want its error
+			bad  int
+			want string
+		}{
+			{"altered", []string{lines[0], altered, lines[2]}, 1, "bad signature"},
+			{"row removed", []string{lines[0], lines[2]}, 1, "bad signature"},
+			{"first row removed", lines[1:], 0, "bad signature"},
+			{"reordered", []string{lines[1], lines[0], lines[2]}, 0, "bad signature"},
+			{"rows of another file", append(lines[:3:3], intervalLines(t, other)...), 3, "the chain starts over"},
+			{"not signed", []string{lines[0], intervalLines(t, unsigned)[0], lines[2]}, 1, "not signed"},
+		} {
+			rows, bad, err := verifyIntervals(verifier, strings.NewReader(header+strings.Join(tt.lines, "")), asCSV)
+			want := fmt.Sprintf("%d: %s", first+tt.bad, tt.want)
+			if err != nil || rows != len(tt.lines) || len(bad) == 0 || !strings.HasPrefix(bad[0], want) {
+				t.Errorf("%s %s: %d rows, %q, %v, want %q", ext, tt.name, rows, bad, err, want)
+			}
+		}
+	}
+	if _, _, err := verifyIntervals(verifier, strings.NewReader("time,target\n"), true); err == nil || !strings.Contains(err.Error(), "no sig column") {
+		t.Errorf("CSV without a sig column: %v", err)
+	}
+}
+
+func TestLastSignature(t *testing.T) {
+	dir := t.TempDir()
+	_, _, secret := testSignKeys(t, dir)
+	key, _ := loadSignKey(secret)
+	for _, ext := range []string{".jsonl", ".csv"} {
+		path := filepath.Join(dir, "last"+ext)
+		f, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sig, err := lastSignature(f, ext == ".csv"); err != nil || sig != "" {
+			t.Errorf("%s empty: %q, %v", ext, sig, err)
+		}
+		f.Close()
+
+		writeSignedIntervals(t, path, nil)
+		f, _ = os.Open(path)
+		if sig, err := lastSignature(f, ext == ".csv"); err != nil || sig != "" {
+			t.Errorf("%s no rows: %q, %v", ext, sig, err)
+		}
+		f.Close()
+
+		writeSignedIntervals(t, path, key, "a", "b")
+		last := intervalLines(t, path)[1]
+		f, _ = os.Open(path)
+		sig, err := lastSignature(f, ext == ".csv")
+		f.Close()
+		if err != nil || sig == "" || !strings.Contains(last, sig) {
+			t.Errorf("%s: last signature %q, %v, of %s", ext, sig, err, last)
+		}
+
+		writeSignedIntervals(t, path, nil, "c")
+		f, _ = os.Open(path)
+		if sig, err := lastSignature(f, ext == ".csv"); err != nil || sig != "" {
+			t.Errorf("%s last row not signed: %q, %v", ext, sig, err)
+		}
+		f.Close()
+	}
+}
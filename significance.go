@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// significant is the p-value below which a difference is called real.
+const significant = 0.05
+
+// mannWhitney tests whether the values of a tend to differ from those of b,
+// without assuming they are normal as RTTs never are. It returns the
+// two-sided p-value of the U statistic by its normal approximation,
+// corrected for ties, and whether a is the lower of the two.
+func mannWhitney(a, b []float64) (p float64, aLower bool) {
+	n1, n2 := float64(len(a)), float64(len(b))
+	if n1 == 0 || n2 == 0 {
+		return 1, false
+	}
+	type value struct {
+		v   float64
+		inA bool
+	}
+	vs := make([]value, 0, len(a)+len(b))
+	for _, v := range a {
+		vs = append(vs, value{v, true})
+	}
+	for _, v := range b {
+		vs = append(vs, value{v, false})
+	}
+	sort.Slice(vs, func(i, j int) bool { return vs[i].v < vs[j].v })
+	var rankA, ties float64
+	for i := 0; i < len(vs); {
+		j := i
+		for j < len(vs) && vs[j].v == vs[i].v {
+			j++
+		}
+		// tied values share the average of their ranks
+		rank, t := float64(i+j+1)/2, float64(j-i)
+		for _, v := range vs[i:j] {
+			if v.inA {
+				rankA += rank
+			}
+		}
+		ties += t*t*t - t
+		i = j
+	}
+	n := n1 + n2
+	u := rankA - n1*(n1+1)/2
+	mean := n1 * n2 / 2
+	sd := math.Sqrt(n1 * n2 / 12 * (n + 1 - ties/(n*(n-1))))
+	if sd == 0 {
+		return 1, false
+	}
+	// with a continuity correction
+	z := math.Max(math.Abs(u-mean)-0.5, 0) / sd
+	return math.Erfc(z / math.Sqrt2), u < mean
+}
+
+// lossTest tests whether the loss rates of lostA of nA and lostB of nB
+// probes differ, returning the two-sided p-value of the two-proportion z
+// test and whether a loses more.
+func lossTest(lostA, nA, lostB, nB float64) (p float64, aMore bool) {
+	pooled := (lostA + lostB) / (nA + nB)
+	if nA == 0 || nB == 0 || pooled <= 0 || pooled >= 1 {
+		return 1, false
+	}
+	z := (lostA/nA - lostB/nB) / math.Sqrt(pooled*(1-pooled)*(1/nA+1/nB))
+	return math.Erfc(math.Abs(z) / math.Sqrt2), z > 0
+}
+
+// ci95 is the half width of the 95% confidence interval of a mean, by the
+// normal approximation.
+func ci95(stddev float64, n int) float64 {
+	if n < 2 {
+		return 0
+	}
+	return 1.96 * stddev / math.Sqrt(float64(n))
+}
+
+// formatP is a p-value the way it is usually quoted.
+func formatP(p float64) string {
+	switch {
+	case p < 0.001:
+		return "p<0.001"
+	case p < 0.01:
+		return "p<0.01"
+	case p < significant:
+		return "p<0.05"
+	}
+	return fmt.Sprintf("p=%.2f", p)
+}
+
+// compareRtts says which of the RTTs of a and b are the faster, or that
+// they can't be told apart.
+func compareRtts(aName string, a []float64, bName string, b []float64) string {
+	p, aLower := mannWhitney(a, b)
+	switch {
+	case p >= significant:
+		return fmt.Sprintf(tr("no significant difference between %s and %s (%s)"), aName, bName, formatP(p))
+	case aLower:
+		return fmt.Sprintf(tr("%s is faster than %s (%s)"), aName, bName, formatP(p))
+	}
+	return fmt.Sprintf(tr("%s is faster than %s (%s)"), bName, aName, formatP(p))
+}
+
+// sampleRtts returns the RTTs in ms of the replies among ss.
+func sampleRtts(ss []sample) []float64 {
+	var out []float64
+	for _, s := range ss {
+		if !s.Lost {
+			out = append(out, ms(s.Rtt))
+		}
+	}
+	return out
+}
+
+func durationsMs(ds []time.Duration) []float64 {
+	out := make([]float64, len(ds))
+	for i, d := range ds {
+		out[i] = ms(d)
+	}
+	return out
+}
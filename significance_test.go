@@ -0,0 +1,54 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestMannWhitney(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		a, b   []float64
+		p      float64
+		aLower bool
+	}{
+		{"apart", []float64{1, 2, 3, 4, 5}, []float64{6, 7, 8, 9, 10}, 0.012186, true},
+		{"ties", []float64{1, 2, 2, 3, 3, 3}, []float64{2, 3, 3, 4, 4, 5, 6}, 0.045671, true},
+		// the outlier of a only counts as the highest rank
+		{"outlier", []float64{10.1, 12.5, 9.8, 11.0, 30.2, 10.4, 10.9, 11.7}, []float64{14.2, 13.9, 15.1, 12.8, 16.0, 14.4}, 0.023868, true},
+		{"same values", []float64{1, 2, 3}, []float64{1, 2, 3}, 1, false},
+		{"all tied", []float64{5, 5, 5}, []float64{5, 5}, 1, false},
+		{"empty", nil, []float64{1, 2}, 1, false},
+	} {
+		p, aLower := mannWhitney(tt.a, tt.b)
+		if math.Abs(p-tt.p) > 1e-6 || aLower != tt.aLower {
+			t.Errorf("%s: p %.6f, a lower %v, want %.6f, %v", tt.name, p, aLower, tt.p, tt.aLower)
+		}
+		// the test is two-sided
+		if p2, bLower := mannWhitney(tt.b, tt.a); math.Abs(p2-p) > 1e-12 || (p < 1 && bLower == aLower) {
+			t.Errorf("%s: swapped, p %.6f, b lower %v", tt.name, p2, bLower)
+		}
+	}
+}
+
+func TestLossTest(t *testing.T) {
+	if p, aMore := lossTest(50, 1000, 10, 1000); p >= 0.001 || !aMore {
+		t.Errorf("5%% against 1%%: p %g, a more %v", p, aMore)
+	}
+	if p, _ := lossTest(10, 1000, 11, 1000); p < significant {
+		t.Errorf("1%% against 1.1%%: p %g", p)
+	}
+	for _, c := range [][4]float64{{0, 100, 0, 100}, {100, 100, 100, 100}, {1, 0, 1, 100}} {
+		if p, aMore := lossTest(c[0], c[1], c[2], c[3]); p != 1 || aMore {
+			t.Errorf("%v: p %g, a more %v", c, p, aMore)
+		}
+	}
+}
+
+func TestFormatP(t *testing.T) {
+	for p, want := range map[float64]string{0.0001: "p<0.001", 0.005: "p<0.01", 0.03: "p<0.05", 0.05: "p=0.05", 0.5: "p=0.50"} {
+		if got := formatP(p); got != want {
+			t.Errorf("formatP(%g) = %q, want %q", p, got, want)
+		}
+	}
+}
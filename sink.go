@@ -0,0 +1,428 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sink consumes the records of a run. Every sink is fed from its own
+// goroutine by the dispatcher, so a slow or failing sink holds up neither
+// the others nor the probing.
+type Sink interface {
+	HandleResult(*Result) error
+	HandleInterval(*IntervalStats) error
+	HandleEvent(*Event) error
+	// Flush is called once all records have been handed over.
+	Flush() error
+}
+
+// unsampledSink is a Sink that sees every result whatever -sample leaves
+// out, as judging a target up or down needs them all.
+type unsampledSink interface {
+	Sink
+	unsampled()
+}
+
+// Overflow policies, what happens to a record when a sink's queue is full.
+const (
+	// overflowDrop drops the new record and counts it
+	overflowDrop = "drop"
+	// overflowDropOldest makes room by dropping the oldest queued record
+	overflowDropOldest = "drop-oldest"
+	// overflowBlock waits for the sink, holding up everything behind it,
+	// including the probes' callbacks; only for sinks that must see it all
+	overflowBlock = "block"
+)
+
+// defaultSinkQueue is how many records a sink may fall behind by default.
+const defaultSinkQueue = 1024
+
+// unredactedSink is a Sink for this host alone, which sees the names
+// -redact hides from the others.
+type unredactedSink interface {
+	Sink
+	unredacted()
+}
+
+// sinkQueue buffers the records of one sink.
+type sinkQueue struct {
+	name       string
+	sink       Sink
+	unsampled  bool
+	unredacted bool
+	ch         chan any
+	done       chan struct{}
+	mu         sync.Mutex
+	dropped    int
+	errors     int
+	lastErr    string
+}
+
+// dispatcher fans the records of a run out to the sinks. The zero value
+// queues defaultSinkQueue records per sink and drops on overflow.
+type dispatcher struct {
+	// QueueLength and Overflow apply to sinks added afterwards and to
+	// dispatching respectively
+	QueueLength int
+	Overflow    string
+	// Sample, when above 1, hands sinks only one result in Sample, see
+	// sampled
+	Sample int
+	// Redact, when set, hands the sinks but the unredacted ones records
+	// with the names replaced, or none when that fails
+	Redact *redactor
+
+	mu     sync.Mutex
+	queues []*sinkQueue
+	closed bool
+}
+
+// Add starts feeding s, name identifies it in warnings and metrics.
+func (d *dispatcher) Add(name string, s Sink) {
+	n := d.QueueLength
+	if n <= 0 {
+		n = defaultSinkQueue
+	}
+	q := &sinkQueue{name: name, sink: s, ch: make(chan any, n), done: make(chan struct{})}
+	_, q.unsampled = s.(unsampledSink)
+	_, q.unredacted = s.(unredactedSink)
+	d.mu.Lock()
+	d.queues = append(d.queues, q)
+	d.mu.Unlock()
+	go q.run()
+}
+
+func (d *dispatcher) Result(r *Result)           { d.dispatch(r) }
+func (d *dispatcher) Interval(st *IntervalStats) { d.dispatch(st) }
+func (d *dispatcher) Event(e *Event)             { d.dispatch(e) }
+
+func (d *dispatcher) dispatch(rec any) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return
+	}
+	r, ok := rec.(*Result)
+	skip := ok && !sampled(r.Seq, d.Sample)
+	plain := rec
+	var redacted *pendingRedaction
+	for _, q := range d.queues {
+		if skip && !q.unsampled {
+			continue
+		}
+		rec = plain
+		if d.Redact != nil && !q.unredacted {
+			if redacted == nil {
+				redacted = &pendingRedaction{r: d.Redact, rec: plain}
+			}
+			rec = redacted
+		}
+		switch d.Overflow {
+		case overflowBlock:
+			q.ch <- rec
+		case overflowDropOldest:
+			select {
+			case q.ch <- rec:
+				continue
+			default:
+			}
+			select {
+			case <-q.ch:
+				q.drop()
+			default:
+			}
+			select {
+			case q.ch <- rec:
+			default:
+				q.drop()
+			}
+		default:
+			select {
+			case q.ch <- rec:
+			default:
+				q.drop()
+			}
+		}
+	}
+}
+
+// pendingRedaction is a record queued for the sinks wanting it redacted. The
+// first of them to get to it redacts it, once for all and away from the
+// probes' callbacks dispatching it.
+type pendingRedaction struct {
+	r    *redactor
+	rec  any
+	once sync.Once
+	out  any
+	err  error
+}
+
+func (p *pendingRedaction) get() (any, error) {
+	p.once.Do(func() { p.out, p.err = p.r.record(p.rec) })
+	return p.out, p.err
+}
+
+// sampled tells whether the result of probe seq is kept when keeping one in
+// every n, the statistics count them all regardless.
+func sampled(seq, n int) bool {
+	return n <= 1 || seq%n == 0
+}
+
+// parseSample reads -sample, 1/N or N.
+func parseSample(s string) (int, error) {
+	if s == "" {
+		return 1, nil
+	}
+	den := s
+	if num, d, ok := strings.Cut(s, "/"); ok {
+		if num != "1" {
+			return 0, fmt.Errorf("invalid sample rate %q, want 1/N", s)
+		}
+		den = d
+	}
+	n, err := strconv.Atoi(den)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("invalid sample rate %q, want 1/N", s)
+	}
+	return n, nil
+}
+
+func (q *sinkQueue) drop() {
+	q.mu.Lock()
+	q.dropped++
+	q.mu.Unlock()
+}
+
+// dropped returns the records dropped over all sinks.
+func (d *dispatcher) dropped() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	n := 0
+	for _, q := range d.queues {
+		q.mu.Lock()
+		n += q.dropped
+		q.mu.Unlock()
+	}
+	return n
+}
+
+// writeMetrics exposes the queue depth and losses of every sink.
+func (d *dispatcher) writeMetrics(mw *metricsWriter) {
+	d.mu.Lock()
+	queues := d.queues
+	d.mu.Unlock()
+	for _, q := range queues {
+		mw.gauge("keeping_sink_queue_depth", "Records waiting for the sink.", float64(len(q.ch)), "sink", q.name)
+	}
+	for _, q := range queues {
+		mw.gauge("keeping_sink_queue_capacity", "Records the sink may fall behind by.", float64(cap(q.ch)), "sink", q.name)
+	}
+	for _, q := range queues {
+		q.mu.Lock()
+		mw.counter("keeping_sink_dropped_total", "Records the sink lost to a full queue.", float64(q.dropped), "sink", q.name)
+		q.mu.Unlock()
+	}
+	for _, q := range queues {
+		q.mu.Lock()
+		mw.counter("keeping_sink_errors_total", "Records the sink failed to handle.", float64(q.errors), "sink", q.name)
+		q.mu.Unlock()
+	}
+}
+
+// Close hands the remaining records over, flushes and closes every sink.
+func (d *dispatcher) Close() {
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return
+	}
+	d.closed = true
+	queues := d.queues
+	d.mu.Unlock()
+	for _, q := range queues {
+		close(q.ch)
+	}
+	for _, q := range queues {
+		<-q.done
+		if err := q.sink.Flush(); err != nil {
+			q.fail(err)
+		}
+		if c, ok := q.sink.(io.Closer); ok {
+			if err := c.Close(); err != nil {
+				q.fail(err)
+			}
+		}
+		if q.dropped > 0 {
+			fmt.Printf("WARN: sink %s dropped %d records it could not keep up with\n", q.name, q.dropped)
+		}
+	}
+}
+
+func (q *sinkQueue) run() {
+	defer close(q.done)
+	for rec := range q.ch {
+		if p, ok := rec.(*pendingRedaction); ok {
+			var err error
+			if rec, err = p.get(); err != nil {
+				// dropped rather than handed over unredacted
+				q.fail(fmt.Errorf("redacting a record, dropped: %w", err))
+				continue
+			}
+		}
+		if err := q.handle(rec); err != nil {
+			q.fail(err)
+		}
+	}
+}
+
+// handle passes one record on; a panicking sink is reported like a failing
+// one.
+func (q *sinkQueue) handle(rec any) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	switch rec := rec.(type) {
+	case *Result:
+		return q.sink.HandleResult(rec)
+	case *IntervalStats:
+		return q.sink.HandleInterval(rec)
+	case *Event:
+		return q.sink.HandleEvent(rec)
+	}
+	return nil
+}
+
+// fail reports err unless it is the same as the sink's previous error, so a
+// sink that is down for a while doesn't flood the output.
+func (q *sinkQueue) fail(err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.errors++
+	if err.Error() == q.lastErr {
+		return
+	}
+	q.lastErr = err.Error()
+	fmt.Printf("WARN: sink %s: %v\n", q.name, err)
+}
+
+// Compression of the raw logs.
+const (
+	compressNone = "none"
+	compressGzip = "gzip"
+)
+
+// gzipFlushEvery is how often a compressed log is flushed, flushing every
+// line would ruin the compression.
+const gzipFlushEvery = 10 * time.Second
+
+// jsonSink writes every record as a JSON line, in the form /ws streams
+// them.
+type jsonSink struct {
+	f   *os.File
+	w   *bufio.Writer
+	enc *json.Encoder
+	// gz compresses between w and f, flushed every gzipFlushEvery
+	gz        *gzip.Writer
+	lastFlush time.Time
+}
+
+// logPath is where a log asked for at path is written: .gz is added when
+// compressed.
+func logPath(path, compress string) string {
+	if compress == compressGzip && path != "-" && !strings.HasSuffix(path, ".gz") {
+		return path + ".gz"
+	}
+	return path
+}
+
+// newJSONSink writes to path, appending, or to stdout for "-", compressed
+// with gzip if asked to. Appending to a compressed log adds a gzip member,
+// gunzip and zcat read them all.
+func newJSONSink(path, compress string) (*jsonSink, error) {
+	f := os.Stdout
+	if path != "-" {
+		var err error
+		if f, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644); err != nil {
+			return nil, err
+		}
+	}
+	s := &jsonSink{f: f}
+	var out io.Writer = f
+	if compress == compressGzip {
+		s.gz = gzip.NewWriter(f)
+		out = s.gz
+	}
+	s.w = bufio.NewWriter(out)
+	s.enc = json.NewEncoder(s.w)
+	return s, nil
+}
+
+func (s *jsonSink) write(typ string, v any) error {
+	if err := s.enc.Encode(streamMessage{Type: typ, Data: v}); err != nil {
+		return err
+	}
+	// line buffered, so tail -f and pipes see records as they happen
+	if err := s.w.Flush(); err != nil {
+		return err
+	}
+	if s.gz != nil && time.Since(s.lastFlush) >= gzipFlushEvery {
+		s.lastFlush = time.Now()
+		return s.gz.Flush()
+	}
+	return nil
+}
+
+// The records are shared with the other sinks, the zone of their time is
+// changed on a copy.
+
+func (s *jsonSink) HandleResult(r *Result) error {
+	c := *r
+	c.Time = output.Zone(r.Time)
+	return s.write("result", &c)
+}
+
+func (s *jsonSink) HandleInterval(st *IntervalStats) error {
+	c := *st
+	c.Time = output.Zone(st.Time)
+	return s.write("interval", &c)
+}
+
+func (s *jsonSink) HandleEvent(e *Event) error {
+	c := *e
+	c.Time = output.Zone(e.Time)
+	return s.write("event", &c)
+}
+
+func (s *jsonSink) Flush() error {
+	if err := s.w.Flush(); err != nil {
+		return err
+	}
+	if s.gz != nil {
+		return s.gz.Flush()
+	}
+	return nil
+}
+
+// Close ends the gzip stream, a log cut short by a crash still reads up to
+// its last flush.
+func (s *jsonSink) Close() error {
+	if s.gz != nil {
+		if err := s.gz.Close(); err != nil {
+			return err
+		}
+	}
+	if s.f == os.Stdout {
+		return nil
+	}
+	return s.f.Close()
+}
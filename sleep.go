@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// sleepCheckEvery is how often the clocks are compared.
+const sleepCheckEvery = time.Second
+
+// watchSleep detects the system being suspended: the monotonic clock stops
+// meanwhile, the wall clock doesn't, so after a resume the two disagree on
+// how long the last tick took. A gap over threshold ends the current
+// statistics interval at the suspend and excuses the probes that were in
+// flight, instead of counting the sleep as an outage. Stepping the wall
+// clock forward by more than threshold looks the same.
+func (m *monitor) watchSleep(threshold time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(sleepCheckEvery)
+	defer ticker.Stop()
+	last := time.Now()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+		now := time.Now()
+		slept := now.Round(0).Sub(last.Round(0)) - now.Sub(last)
+		last = now
+		if slept < threshold {
+			continue
+		}
+		msg := fmt.Sprintf("system slept for %v", slept.Round(time.Second))
+		fmt.Printf("=== %s %s\n", output.Time(now, time.DateTime, time.Local), msg)
+		m.event(eventSleep, "", msg)
+		for _, t := range m.list("") {
+			_ = t.pinger.Excuse()
+			select {
+			case t.segment <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
@@ -0,0 +1,441 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// -snmp polls the error and discard counters of a router's interfaces over
+// SNMPv2c, from the ifTable of IF-MIB, so the loss the probes see can be
+// set against the drops the device owns up to.
+var (
+	oidIfDescr      = snmpOID{1, 3, 6, 1, 2, 1, 2, 2, 1, 2}
+	oidIfInDiscards = snmpOID{1, 3, 6, 1, 2, 1, 2, 2, 1, 13}
+	oidIfInErrors   = snmpOID{1, 3, 6, 1, 2, 1, 2, 2, 1, 14}
+	oidIfOutDiscard = snmpOID{1, 3, 6, 1, 2, 1, 2, 2, 1, 19}
+	oidIfOutErrors  = snmpOID{1, 3, 6, 1, 2, 1, 2, 2, 1, 20}
+	oidIfName       = snmpOID{1, 3, 6, 1, 2, 1, 31, 1, 1, 1, 1}
+)
+
+// BER tags of SNMP.
+const (
+	berInteger     = 0x02
+	berOctetString = 0x04
+	berNull        = 0x05
+	berOID         = 0x06
+	berSequence    = 0x30
+	berCounter32   = 0x41
+	berCounter64   = 0x46
+	// the exceptions a varbind of a v2c response holds instead of a value
+	berNoSuchObject   = 0x80
+	berNoSuchInstance = 0x81
+	berEndOfMibView   = 0x82
+
+	snmpGet      = 0xa0
+	snmpGetNext  = 0xa1
+	snmpResponse = 0xa2
+)
+
+type snmpOID []uint32
+
+func (o snmpOID) String() string {
+	s := make([]string, len(o))
+	for i, n := range o {
+		s[i] = strconv.FormatUint(uint64(n), 10)
+	}
+	return strings.Join(s, ".")
+}
+
+func (o snmpOID) child(n uint32) snmpOID {
+	return append(append(snmpOID(nil), o...), n)
+}
+
+// under tells whether o is in the subtree of prefix, returning the index
+// following it.
+func (o snmpOID) under(prefix snmpOID) (uint32, bool) {
+	if len(o) != len(prefix)+1 {
+		return 0, false
+	}
+	for i, n := range prefix {
+		if o[i] != n {
+			return 0, false
+		}
+	}
+	return o[len(prefix)], true
+}
+
+// berTLV appends a tag, its length and content to b.
+func berTLV(b []byte, tag byte, content []byte) []byte {
+	b = append(b, tag)
+	switch n := len(content); {
+	case n < 0x80:
+		b = append(b, byte(n))
+	case n < 0x100:
+		b = append(b, 0x81, byte(n))
+	default:
+		b = append(b, 0x82, byte(n>>8), byte(n))
+	}
+	return append(b, content...)
+}
+
+func berInt(n int64) []byte {
+	var b []byte
+	for {
+		b = append([]byte{byte(n)}, b...)
+		if n >= -0x80 && n < 0x80 {
+			return b
+		}
+		n >>= 8
+	}
+}
+
+func berOIDBytes(o snmpOID) []byte {
+	b := []byte{byte(40*o[0] + o[1])}
+	for _, n := range o[2:] {
+		var enc []byte
+		enc = append(enc, byte(n&0x7f))
+		for n >>= 7; n > 0; n >>= 7 {
+			enc = append([]byte{byte(n&0x7f | 0x80)}, enc...)
+		}
+		b = append(b, enc...)
+	}
+	return b
+}
+
+// berNext splits the TLV at the start of b from the rest.
+func berNext(b []byte) (tag byte, content, rest []byte, err error) {
+	if len(b) < 2 {
+		return 0, nil, nil, errors.New("snmp: short message")
+	}
+	tag, n, b := b[0], int(b[1]), b[2:]
+	if n&0x80 != 0 {
+		k := n & 0x7f
+		if k == 0 || k > 3 || len(b) < k {
+			return 0, nil, nil, errors.New("snmp: bad length")
+		}
+		n = 0
+		for _, c := range b[:k] {
+			n = n<<8 | int(c)
+		}
+		b = b[k:]
+	}
+	if len(b) < n {
+		return 0, nil, nil, errors.New("snmp: short message")
+	}
+	return tag, b[:n], b[n:], nil
+}
+
+func berUint(b []byte) uint64 {
+	var n uint64
+	for _, c := range b {
+		n = n<<8 | uint64(c)
+	}
+	return n
+}
+
+func parseBerOID(b []byte) snmpOID {
+	if len(b) == 0 {
+		return nil
+	}
+	o := snmpOID{uint32(b[0]) / 40, uint32(b[0]) % 40}
+	var n uint32
+	for _, c := range b[1:] {
+		n = n<<7 | uint32(c&0x7f)
+		if c&0x80 == 0 {
+			o = append(o, n)
+			n = 0
+		}
+	}
+	return o
+}
+
+// snmpVar is a varbind of a response.
+type snmpVar struct {
+	oid   snmpOID
+	tag   byte
+	value []byte
+}
+
+// snmpClient makes SNMPv2c requests of an agent.
+type snmpClient struct {
+	addr      string
+	community string
+	id        int32
+}
+
+// request sends a GET or GETNEXT of oids, trying thrice.
+func (c *snmpClient) request(pdu byte, oids []snmpOID) ([]snmpVar, error) {
+	conn, err := net.Dial("udp", c.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	c.id++
+	var binds []byte
+	for _, o := range oids {
+		binds = berTLV(binds, berSequence, berTLV(berTLV(nil, berOID, berOIDBytes(o)), berNull, nil))
+	}
+	var p []byte
+	p = berTLV(p, berInteger, berInt(int64(c.id)))
+	p = berTLV(p, berInteger, berInt(0))
+	p = berTLV(p, berInteger, berInt(0))
+	p = berTLV(p, berSequence, binds)
+	var msg []byte
+	msg = berTLV(msg, berInteger, berInt(1))
+	msg = berTLV(msg, berOctetString, []byte(c.community))
+	msg = berTLV(msg, pdu, p)
+	msg = berTLV(nil, berSequence, msg)
+	buf := make([]byte, 65536)
+	for try := 0; try < 3; try++ {
+		if _, err := conn.Write(msg); err != nil {
+			return nil, err
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				break
+			}
+			vars, id, err := parseSNMPResponse(buf[:n])
+			if id == c.id {
+				return vars, err
+			}
+		}
+	}
+	return nil, fmt.Errorf("snmp: %s does not answer, check the address and community", c.addr)
+}
+
+// parseSNMPResponse decodes a response, returning its varbinds and request
+// id.
+func parseSNMPResponse(b []byte) ([]snmpVar, int32, error) {
+	tag, msg, _, err := berNext(b)
+	if err != nil || tag != berSequence {
+		return nil, 0, errors.New("snmp: not an SNMP message")
+	}
+	var parts [3][]byte
+	var tags [3]byte
+	for i := range parts {
+		if tags[i], parts[i], msg, err = berNext(msg); err != nil {
+			return nil, 0, err
+		}
+	}
+	if tags[2] != snmpResponse {
+		return nil, 0, errors.New("snmp: not a response")
+	}
+	pdu := parts[2]
+	var fields [4][]byte
+	for i := range fields {
+		if _, fields[i], pdu, err = berNext(pdu); err != nil {
+			return nil, 0, err
+		}
+	}
+	id := int32(berUint(fields[0]))
+	if status := berUint(fields[1]); status != 0 {
+		return nil, id, fmt.Errorf("snmp: error status %d", status)
+	}
+	var vars []snmpVar
+	for binds := fields[3]; len(binds) > 0; {
+		var bind []byte
+		if _, bind, binds, err = berNext(binds); err != nil {
+			return nil, id, err
+		}
+		_, o, rest, err := berNext(bind)
+		if err != nil {
+			return nil, id, err
+		}
+		tag, v, _, err := berNext(rest)
+		if err != nil {
+			return nil, id, err
+		}
+		vars = append(vars, snmpVar{oid: parseBerOID(o), tag: tag, value: v})
+	}
+	return vars, id, nil
+}
+
+// walk returns the values of a table column by index.
+func (c *snmpClient) walk(column snmpOID) (map[uint32]snmpVar, error) {
+	out := make(map[uint32]snmpVar)
+	next := column
+	for len(out) < 10000 {
+		vars, err := c.request(snmpGetNext, []snmpOID{next})
+		if err != nil {
+			return nil, err
+		}
+		if len(vars) != 1 || vars[0].tag == berEndOfMibView {
+			break
+		}
+		idx, ok := vars[0].oid.under(column)
+		if !ok {
+			break
+		}
+		out[idx] = vars[0]
+		next = vars[0].oid
+	}
+	return out, nil
+}
+
+// RouterCounters are the errors and discards a router counted on the
+// interfaces of -snmp.
+type RouterCounters struct {
+	InErrors    uint64 `json:"in_errors"`
+	OutErrors   uint64 `json:"out_errors"`
+	InDiscards  uint64 `json:"in_discards"`
+	OutDiscards uint64 `json:"out_discards"`
+}
+
+func (c RouterCounters) sub(prev RouterCounters) RouterCounters {
+	return RouterCounters{InErrors: c.InErrors - prev.InErrors, OutErrors: c.OutErrors - prev.OutErrors,
+		InDiscards: c.InDiscards - prev.InDiscards, OutDiscards: c.OutDiscards - prev.OutDiscards}
+}
+
+func (c RouterCounters) zero() bool {
+	return c == RouterCounters{}
+}
+
+// snmpPoller adds up the counters of interfaces since keeping started, the
+// counters wrapping around included.
+type snmpPoller struct {
+	spec   string
+	client *snmpClient
+	ifaces []uint32
+
+	mu    sync.Mutex
+	last  map[string]snmpVar
+	total RouterCounters
+}
+
+// parseSNMP parses -snmp, COMMUNITY@HOST[:PORT]/IFACE[,IFACE...], the
+// interfaces given by index, name or description.
+func parseSNMP(spec string) (*snmpPoller, error) {
+	i := strings.LastIndex(spec, "@")
+	host, ifaces, ok := strings.Cut(spec[i+1:], "/")
+	if i <= 0 || !ok || host == "" || ifaces == "" {
+		return nil, fmt.Errorf("invalid -snmp %q, want COMMUNITY@HOST[:PORT]/IFACE[,IFACE...]", spec)
+	}
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(strings.Trim(host, "[]"), "161")
+	}
+	p := &snmpPoller{spec: spec, client: &snmpClient{addr: host, community: spec[:i]}}
+	var names map[string]uint32
+	for _, name := range strings.Split(ifaces, ",") {
+		if n, err := strconv.ParseUint(name, 10, 32); err == nil {
+			p.ifaces = append(p.ifaces, uint32(n))
+			continue
+		}
+		if names == nil {
+			var err error
+			if names, err = p.client.ifNames(); err != nil {
+				return nil, err
+			}
+		}
+		n, ok := names[name]
+		if !ok {
+			return nil, fmt.Errorf("snmp: %s has no interface named %q", host, name)
+		}
+		p.ifaces = append(p.ifaces, n)
+	}
+	return p, nil
+}
+
+// ifNames maps the names and descriptions of the agent's interfaces to
+// their index.
+func (c *snmpClient) ifNames() (map[string]uint32, error) {
+	names := make(map[string]uint32)
+	for _, column := range []snmpOID{oidIfDescr, oidIfName} {
+		vars, err := c.walk(column)
+		if err != nil {
+			return nil, err
+		}
+		for idx, v := range vars {
+			if v.tag == berOctetString {
+				names[string(v.value)] = idx
+			}
+		}
+	}
+	return names, nil
+}
+
+// poll reads the counters, adding what they grew by since the last poll.
+func (p *snmpPoller) poll() error {
+	var oids []snmpOID
+	for _, idx := range p.ifaces {
+		oids = append(oids, oidIfInErrors.child(idx), oidIfOutErrors.child(idx),
+			oidIfInDiscards.child(idx), oidIfOutDiscard.child(idx))
+	}
+	vars, err := p.client.request(snmpGet, oids)
+	if err != nil {
+		return err
+	}
+	if len(vars) != len(oids) {
+		return fmt.Errorf("snmp: %d values for %d counters", len(vars), len(oids))
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.last == nil {
+		p.last = make(map[string]snmpVar)
+	}
+	for i, v := range vars {
+		switch v.tag {
+		case berCounter32, berCounter64:
+		case berNoSuchObject, berNoSuchInstance:
+			return fmt.Errorf("snmp: %s has no %s, check the interface index", p.client.addr, oids[i])
+		default:
+			return fmt.Errorf("snmp: %s is not a counter", oids[i])
+		}
+		key := oids[i].String()
+		prev, ok := p.last[key]
+		p.last[key] = v
+		if !ok {
+			continue
+		}
+		d := berUint(v.value) - berUint(prev.value)
+		if v.tag == berCounter32 {
+			d = uint64(uint32(d))
+		}
+		switch i % 4 {
+		case 0:
+			p.total.InErrors += d
+		case 1:
+			p.total.OutErrors += d
+		case 2:
+			p.total.InDiscards += d
+		case 3:
+			p.total.OutDiscards += d
+		}
+	}
+	return nil
+}
+
+// totals are the counters added up so far.
+func (p *snmpPoller) totals() RouterCounters {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.total
+}
+
+// watchSNMP polls p every so often until stop is closed.
+func (m *monitor) watchSNMP(p *snmpPoller, every time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	var lastErr string
+	for {
+		if err := p.poll(); err != nil {
+			if err.Error() != lastErr {
+				fmt.Println("WARN:", err)
+				lastErr = err.Error()
+			}
+		} else {
+			lastErr = ""
+		}
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
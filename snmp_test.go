@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestBerInt(t *testing.T) {
+	for _, tt := range []struct {
+		n    int64
+		want []byte
+	}{
+		{0, []byte{0}},
+		{127, []byte{0x7f}},
+		{128, []byte{0, 0x80}},
+		{256, []byte{1, 0}},
+		{-1, []byte{0xff}},
+		{-128, []byte{0x80}},
+		{-129, []byte{0xff, 0x7f}},
+		{1 << 31, []byte{0, 0x80, 0, 0, 0}},
+	} {
+		if got := berInt(tt.n); !bytes.Equal(got, tt.want) {
+			t.Errorf("berInt(%d) = % x, want % x", tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestBerOID(t *testing.T) {
+	for _, tt := range []struct {
+		oid  snmpOID
+		want []byte
+	}{
+		{oidIfInDiscards.child(5), []byte{0x2b, 6, 1, 2, 1, 2, 2, 1, 13, 5}},
+		{snmpOID{1, 3, 6, 1, 4, 1, 300}, []byte{0x2b, 6, 1, 4, 1, 0x82, 0x2c}},
+		{snmpOID{1, 3, 0xffffffff}, []byte{0x2b, 0x8f, 0xff, 0xff, 0xff, 0x7f}},
+	} {
+		b := berOIDBytes(tt.oid)
+		if !bytes.Equal(b, tt.want) {
+			t.Errorf("%s: encoded as % x, want % x", tt.oid, b, tt.want)
+		}
+		if got := parseBerOID(b); !reflect.DeepEqual(got, tt.oid) {
+			t.Errorf("%s: decoded as %s", tt.oid, got)
+		}
+	}
+	if idx, ok := oidIfInErrors.child(7).under(oidIfInErrors); !ok || idx != 7 {
+		t.Errorf("under: %d, %v", idx, ok)
+	}
+	if _, ok := oidIfOutErrors.child(7).under(oidIfInErrors); ok {
+		t.Error("under another column")
+	}
+	if _, ok := oidIfInErrors.child(7).child(1).under(oidIfInErrors); ok {
+		t.Error("under, two levels down")
+	}
+}
+
+func TestBerTLV(t *testing.T) {
+	for _, n := range []int{0, 1, 0x7f, 0x80, 0xff, 0x100, 0x1234} {
+		content := bytes.Repeat([]byte{0xaa}, n)
+		b := berTLV(nil, berOctetString, content)
+		b = append(b, 0x05, 0x00)
+		tag, got, rest, err := berNext(b)
+		if err != nil || tag != berOctetString || !bytes.Equal(got, content) || !bytes.Equal(rest, []byte{5, 0}) {
+			t.Errorf("length %d: tag %x, %d bytes, rest % x, %v", n, tag, len(got), rest, err)
+		}
+	}
+	for _, tt := range []struct {
+		name string
+		b    []byte
+		want string
+	}{
+		{"empty", nil, "short message"},
+		{"content cut short", []byte{4, 3, 'a'}, "short message"},
+		{"indefinite length", []byte{4, 0x80, 'a'}, "bad length"},
+		{"length of 4 bytes", []byte{4, 0x84, 0, 0, 0, 1, 'a'}, "bad length"},
+		{"length cut short", []byte{4, 0x82, 1}, "bad length"},
+	} {
+		if _, _, _, err := berNext(tt.b); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: error %v, want %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+// snmpMessage encodes a v2c message of the PDU pdu, as an agent would.
+func snmpMessage(pdu byte, id int32, status int64, binds []snmpVar) []byte {
+	var vb []byte
+	for _, v := range binds {
+		vb = berTLV(vb, berSequence, berTLV(berTLV(nil, berOID, berOIDBytes(v.oid)), v.tag, v.value))
+	}
+	var p []byte
+	p = berTLV(p, berInteger, berInt(int64(id)))
+	p = berTLV(p, berInteger, berInt(status))
+	p = berTLV(p, berInteger, berInt(0))
+	p = berTLV(p, berSequence, vb)
+	var msg []byte
+	msg = berTLV(msg, berInteger, berInt(1))
+	msg = berTLV(msg, berOctetString, []byte("public"))
+	msg = berTLV(msg, pdu, p)
+	return berTLV(nil, berSequence, msg)
+}
+
+func TestParseSNMPResponse(t *testing.T) {
+	binds := []snmpVar{
+		{oid: oidIfInErrors.child(2), tag: berCounter32, value: []byte{1, 0}},
+		{oid: oidIfOutErrors.child(2), tag: berNoSuchInstance, value: []byte{}},
+	}
+	vars, id, err := parseSNMPResponse(snmpMessage(snmpResponse, 42, 0, binds))
+	if err != nil || id != 42 || !reflect.DeepEqual(vars, binds) {
+		t.Errorf("got %v, id %d, %v", vars, id, err)
+	}
+	if _, id, err := parseSNMPResponse(snmpMessage(snmpResponse, 43, 2, nil)); err == nil || id != 43 {
+		t.Errorf("error status: id %d, %v", id, err)
+	}
+	if _, _, err := parseSNMPResponse(snmpMessage(snmpGet, 44, 0, binds)); err == nil {
+		t.Error("a request taken for a response")
+	}
+	msg := snmpMessage(snmpResponse, 45, 0, binds)
+	for n := 0; n < len(msg); n++ {
+		if _, _, err := parseSNMPResponse(msg[:n]); err == nil {
+			t.Errorf("cut at %d bytes of %d: no error", n, len(msg))
+		}
+	}
+}
+
+// snmpAgent answers GET and GETNEXT of its values on a UDP socket.
+type snmpAgent struct {
+	conn net.PacketConn
+	mu   sync.Mutex
+	vals map[string]snmpVar
+}
+
+func startSNMPAgent(t *testing.T, vals ...snmpVar) *snmpAgent {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	a := &snmpAgent{conn: conn, vals: make(map[string]snmpVar)}
+	for _, v := range vals {
+		a.set(v)
+	}
+	go a.serve()
+	return a
+}
+
+func (a *snmpAgent) set(v snmpVar) {
+	a.mu.Lock()
+	a.vals[v.oid.String()] = v
+	a.mu.Unlock()
+}
+
+// after returns the value following o in OID order.
+func (a *snmpAgent) after(o snmpOID) snmpVar {
+	var all []snmpVar
+	for _, v := range a.vals {
+		all = append(all, v)
+	}
+	less := func(x, y snmpOID) bool {
+		for i := 0; i < len(x) && i < len(y); i++ {
+			if x[i] != y[i] {
+				return x[i] < y[i]
+			}
+		}
+		return len(x) < len(y)
+	}
+	sort.Slice(all, func(i, j int) bool { return less(all[i].oid, all[j].oid) })
+	for _, v := range all {
+		if less(o, v.oid) {
+			return v
+		}
+	}
+	return snmpVar{oid: o, tag: berEndOfMibView, value: []byte{}}
+}
+
+func (a *snmpAgent) serve() {
+	buf := make([]byte, 65536)
+	for {
+		n, from, err := a.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		_, msg, _, _ := berNext(buf[:n])
+		_, _, msg, _ = berNext(msg)
+		_, _, msg, _ = berNext(msg)
+		pdu, p, _, _ := berNext(msg)
+		_, id, p, _ := berNext(p)
+		_, _, p, _ = berNext(p)
+		_, _, p, _ = berNext(p)
+		_, binds, _, _ := berNext(p)
+		var out []snmpVar
+		a.mu.Lock()
+		for len(binds) > 0 {
+			var bind, o []byte
+			_, bind, binds, _ = berNext(binds)
+			_, o, _, _ = berNext(bind)
+			oid := parseBerOID(o)
+			v, ok := a.vals[oid.String()]
+			switch {
+			case pdu == snmpGetNext:
+				v = a.after(oid)
+			case !ok:
+				v = snmpVar{oid: oid, tag: berNoSuchInstance, value: []byte{}}
+			}
+			out = append(out, v)
+		}
+		a.mu.Unlock()
+		_, _ = a.conn.WriteTo(snmpMessage(snmpResponse, int32(berUint(id)), 0, out), from)
+	}
+}
+
+func counter32(idx uint32, column snmpOID, n uint32) snmpVar {
+	return snmpVar{oid: column.child(idx), tag: berCounter32, value: berInt(int64(n))}
+}
+
+func TestSNMPPoll(t *testing.T) {
+	a := startSNMPAgent(t,
+		snmpVar{oid: oidIfDescr.child(1), tag: berOctetString, value: []byte("lo")},
+		snmpVar{oid: oidIfDescr.child(2), tag: berOctetString, value: []byte("Ethernet0")},
+		snmpVar{oid: oidIfName.child(2), tag: berOctetString, value: []byte("eth0")},
+		counter32(2, oidIfInErrors, 10), counter32(2, oidIfOutErrors, 0xfffffffe),
+		counter32(2, oidIfInDiscards, 0), counter32(2, oidIfOutDiscard, 7))
+	p, err := parseSNMP("public@" + a.conn.LocalAddr().String() + "/eth0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(p.ifaces, []uint32{2}) {
+		t.Fatalf("interfaces %v, want [2]", p.ifaces)
+	}
+	if err := p.poll(); err != nil {
+		t.Fatal(err)
+	}
+	if !p.totals().zero() {
+		t.Errorf("first poll counted %+v", p.totals())
+	}
+	// the out errors counter wraps around
+	a.set(counter32(2, oidIfInErrors, 13))
+	a.set(counter32(2, oidIfOutErrors, 3))
+	if err := p.poll(); err != nil {
+		t.Fatal(err)
+	}
+	if want := (RouterCounters{InErrors: 3, OutErrors: 5}); p.totals() != want {
+		t.Errorf("totals %+v, want %+v", p.totals(), want)
+	}
+
+	p, err = parseSNMP("public@" + a.conn.LocalAddr().String() + "/9")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.poll(); err == nil || !strings.Contains(err.Error(), "check the interface index") {
+		t.Errorf("unknown interface: %v", err)
+	}
+	if _, err := parseSNMP("public@" + a.conn.LocalAddr().String() + "/wlan0"); err == nil {
+		t.Error("unknown interface name: no error")
+	}
+}
+
+func TestParseSNMPSpec(t *testing.T) {
+	for _, spec := range []string{"", "public", "@host/1", "public@/1", "public@host", "public@host/"} {
+		if _, err := parseSNMP(spec); err == nil {
+			t.Errorf("%q: no error", spec)
+		}
+	}
+	p, err := parseSNMP("pub@lic@192.0.2.1/1,3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.client.community != "pub@lic" || p.client.addr != "192.0.2.1:161" || !reflect.DeepEqual(p.ifaces, []uint32{1, 3}) {
+		t.Errorf("got %+v %v", p.client, p.ifaces)
+	}
+	if p, err := parseSNMP("c@[2001:db8::1]:1161/1"); err != nil || p.client.addr != "[2001:db8::1]:1161" {
+		t.Errorf("IPv6 with a port: %v", err)
+	}
+	if p, err := parseSNMP("c@2001:db8::1/1"); err != nil || p.client.addr != "[2001:db8::1]:161" {
+		t.Errorf("IPv6: %v", err)
+	}
+}
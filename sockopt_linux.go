@@ -0,0 +1,43 @@
+//go:build linux
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// setRouting marks the socket fd for policy routing and binds it to device,
+// an interface or a VRF, whichever is set.
+func setRouting(fd, mark int, device string) error {
+	if mark != 0 {
+		if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_MARK, mark); err != nil {
+			return os.NewSyscallError("setsockopt SO_MARK", err)
+		}
+	}
+	if device != "" {
+		if err := syscall.BindToDevice(fd, device); err != nil {
+			return os.NewSyscallError("setsockopt SO_BINDTODEVICE", err)
+		}
+	}
+	return nil
+}
+
+// routingControl is the net.Dialer Control doing setRouting, nil when
+// there is nothing to set.
+func routingControl(mark int, device string) func(network, address string, c syscall.RawConn) error {
+	if mark == 0 && device == "" {
+		return nil
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		var opErr error
+		if err := c.Control(func(fd uintptr) { opErr = setRouting(int(fd), mark, device) }); err != nil {
+			return err
+		}
+		return opErr
+	}
+}
+
+func (c *icmpConn) setRouting(mark int, device string) error {
+	return c.control(func(fd int) error { return setRouting(fd, mark, device) })
+}
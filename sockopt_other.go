@@ -0,0 +1,24 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+var errRoutingUnsupported = errors.New("-fwmark and -I are only supported on Linux")
+
+func routingControl(mark int, device string) func(network, address string, c syscall.RawConn) error {
+	if mark == 0 && device == "" {
+		return nil
+	}
+	return func(string, string, syscall.RawConn) error { return errRoutingUnsupported }
+}
+
+func (c *icmpConn) setRouting(mark int, device string) error {
+	if mark != 0 || device != "" {
+		return errRoutingUnsupported
+	}
+	return nil
+}
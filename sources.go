@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// probeSource is one of the -sources a target is probed from at once, a
+// local address or an interface, each by a Pinger of its own.
+type probeSource struct {
+	name string
+	// ip is the source address given, iface the interface, whose address
+	// of the target's family is the source
+	ip    net.IP
+	iface string
+	// local is the source address of a target, see localFor
+	local net.IP
+}
+
+// parseSources parses -sources, addresses or interface names separated by
+// commas.
+func parseSources(s string) ([]probeSource, error) {
+	var srcs []probeSource
+	seen := make(map[string]bool)
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" || seen[name] {
+			return nil, fmt.Errorf("invalid -sources %q, want distinct addresses or interfaces separated by commas", s)
+		}
+		seen[name] = true
+		src := probeSource{name: name}
+		if src.ip = net.ParseIP(name); src.ip == nil {
+			if _, err := net.InterfaceByName(name); err != nil {
+				return nil, fmt.Errorf("invalid source %q, neither an address nor an interface: %w", name, err)
+			}
+			src.iface = name
+		}
+		srcs = append(srcs, src)
+	}
+	return srcs, nil
+}
+
+// localFor returns the source for probing ip: the address given, or the
+// interface's first address of the family of ip, link-local ones last.
+func (src probeSource) localFor(ip net.IP) (*probeSource, error) {
+	v4 := ip.To4() != nil
+	if src.ip != nil {
+		if (src.ip.To4() != nil) != v4 {
+			return nil, fmt.Errorf("source %s can't probe %s, another address family", src.name, ip)
+		}
+		src.local = src.ip
+		return &src, nil
+	}
+	ifi, err := net.InterfaceByName(src.iface)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range addrs {
+		ipn, ok := a.(*net.IPNet)
+		if !ok || (ipn.IP.To4() != nil) != v4 {
+			continue
+		}
+		if src.local == nil || src.local.IsLinkLocalUnicast() && !ipn.IP.IsLinkLocalUnicast() {
+			src.local = ipn.IP
+		}
+	}
+	if src.local == nil {
+		family := "IPv6"
+		if v4 {
+			family = "IPv4"
+		}
+		return nil, fmt.Errorf("%s has no %s address to probe %s from", src.iface, family, ip)
+	}
+	return &src, nil
+}
+
+// apply binds p to the source, and to its interface when given one.
+func (src *probeSource) apply(p *Pinger) {
+	p.Source = src.local.String()
+	if src.iface != "" {
+		p.Device = src.iface
+	}
+}
+
+// addSources starts name once from each of the -sources as NAME%SOURCE,
+// each with its -profiles, or just once without.
+func (m *monitor) addSources(name, host, spec string, pinger *Pinger, ttl time.Duration) error {
+	if len(m.settings.Sources) == 0 {
+		return m.addProfiles(name, host, spec, pinger, nil, ttl)
+	}
+	for i := range m.settings.Sources {
+		p := pinger
+		if i > 0 {
+			p, _ = New(spec)
+			if pinger.pinned {
+				p.SetIPAddr(pinger.IPAddr())
+			} else if err := p.Resolve(); err != nil {
+				return err
+			}
+		}
+		if p.IPAddr() == nil {
+			return fmt.Errorf("%s: -sources needs the address of the target", name)
+		}
+		src, err := m.settings.Sources[i].localFor(p.IPAddr().IP)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		if err := m.addProfiles(name+"%"+src.name, host, spec, p, src, ttl); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SourceComparison returns, for every target probed with -sources, a table
+// of the statistics by source, and how the best and the worst of them
+// differ.
+func (m *monitor) SourceComparison() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	names := make([]string, 0, len(m.sourced))
+	for name := range m.sourced {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range names {
+		ts := m.sourced[name]
+		fmt.Fprintf(&b, tr("\n--- %s by source ---\n"), name)
+		tw := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "source\tlocal address\tsent\trecv\tloss\tmin\tavg\tmax\tstddev")
+		var best, worst *target
+		stats := make(map[*target]*Statistics, len(ts))
+		for _, t := range ts {
+			s := t.pinger.Statistics()
+			stats[t] = s
+			fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%.1f%%\t%v\t%v\t%v\t%v\n", t.source.name, t.source.local,
+				s.PacketsSent, s.PacketsRecv, s.PacketLoss, s.MinRtt, s.AvgRtt, s.MaxRtt, s.StdDevRtt)
+			if s.PacketsRecv == 0 {
+				continue
+			}
+			if best == nil || s.AvgRtt < stats[best].AvgRtt {
+				best = t
+			}
+			if worst == nil || s.AvgRtt > stats[worst].AvgRtt {
+				worst = t
+			}
+		}
+		tw.Flush()
+		for _, t := range ts {
+			if s := stats[t]; s.PacketsSent > 0 && s.PacketsRecv == 0 {
+				fmt.Fprintf(&b, tr("no reply through %s\n"), t.source.name)
+			}
+		}
+		if best == nil || best == worst {
+			continue
+		}
+		bs, ws := stats[best], stats[worst]
+		p, worstMore := lossTest(lossOf(ws), float64(ws.PacketsSent-ws.PacketsExcused),
+			lossOf(bs), float64(bs.PacketsSent-bs.PacketsExcused))
+		if p < significant {
+			more, less := worst, best
+			if !worstMore {
+				more, less = best, worst
+			}
+			fmt.Fprintf(&b, tr("%s loses more than %s (%s)\n"), more.source.name, less.source.name, formatP(p))
+		}
+		fast, slow := sampleRtts(m.history.Samples(best.host)), sampleRtts(m.history.Samples(worst.host))
+		if len(fast) >= 2 && len(slow) >= 2 {
+			fmt.Fprintln(&b, compareRtts(best.source.name, fast, worst.source.name, slow))
+		}
+	}
+	return b.String()
+}
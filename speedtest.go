@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// speedtestTime bounds a throughput sample: a download is cut off after
+// that long, iperf3 runs that long. Enough to fill most links, short enough
+// not to skew the latency of a whole interval.
+const speedtestTime = 5 * time.Second
+
+// speedtest samples the throughput of the link now and then, for context:
+// whether the latency rose while it was saturated. It is one of
+//
+//	http://... or https://...  a download, the body thrown away
+//	iperf3://HOST[:PORT]       iperf3 -R against an iperf3 server
+type speedtest struct {
+	spec string
+	host string
+}
+
+func parseSpeedtest(spec string) (*speedtest, error) {
+	switch {
+	case strings.HasPrefix(spec, "http://"), strings.HasPrefix(spec, "https://"):
+		return &speedtest{spec: spec}, nil
+	case strings.HasPrefix(spec, "iperf3://"):
+		host := strings.TrimSuffix(strings.TrimPrefix(spec, "iperf3://"), "/")
+		if host == "" {
+			break
+		}
+		if _, err := exec.LookPath("iperf3"); err != nil {
+			return nil, fmt.Errorf("-speedtest %s runs iperf3, which is not installed", spec)
+		}
+		return &speedtest{spec: spec, host: host}, nil
+	}
+	return nil, fmt.Errorf("invalid -speedtest %q, want an http:// or https:// URL or iperf3://HOST[:PORT]", spec)
+}
+
+// Throughput is a throughput sample of -speedtest.
+type Throughput struct {
+	Source  string  `json:"source"`
+	Bytes   int64   `json:"bytes"`
+	Seconds float64 `json:"seconds"`
+	Mbps    float64 `json:"mbps"`
+}
+
+func (s *speedtest) run() (*Throughput, error) {
+	if s.host != "" {
+		return s.iperf3()
+	}
+	return s.download()
+}
+
+// download fetches the URL for up to speedtestTime, timing the body only,
+// not the connection setup.
+func (s *speedtest) download() (*Throughput, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), speedtestTime+10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", s.spec, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Cache-Control", "no-cache")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", s.spec, resp.Status)
+	}
+	start := time.Now()
+	end := start.Add(speedtestTime)
+	buf := make([]byte, 64*1024)
+	var n int64
+	for time.Now().Before(end) {
+		k, err := resp.Body.Read(buf)
+		n += int64(k)
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	secs := time.Since(start).Seconds()
+	if n == 0 || secs == 0 {
+		return nil, fmt.Errorf("%s: empty body", s.spec)
+	}
+	return &Throughput{Source: s.spec, Bytes: n, Seconds: secs, Mbps: float64(n) * 8 / secs / 1e6}, nil
+}
+
+// iperf3 runs the iperf3 client in reverse mode, the server sending, as a
+// download is.
+func (s *speedtest) iperf3() (*Throughput, error) {
+	host, port := s.host, "5201"
+	if h, p, err := net.SplitHostPort(s.host); err == nil {
+		host, port = h, p
+	}
+	secs := strconv.Itoa(int(speedtestTime / time.Second))
+	out, err := exec.Command("iperf3", "-c", host, "-p", port, "-t", secs, "-R", "-J").Output()
+	var v struct {
+		Error string `json:"error"`
+		End   struct {
+			SumReceived struct {
+				Bytes   int64   `json:"bytes"`
+				Seconds float64 `json:"seconds"`
+				Bps     float64 `json:"bits_per_second"`
+			} `json:"sum_received"`
+		} `json:"end"`
+	}
+	if jerr := json.Unmarshal(out, &v); jerr != nil {
+		if ee, ok := err.(*exec.ExitError); ok && len(ee.Stderr) > 0 {
+			return nil, fmt.Errorf("iperf3: %s", bytes.TrimSpace(ee.Stderr))
+		} else if err != nil {
+			return nil, fmt.Errorf("iperf3: %w", err)
+		}
+		return nil, fmt.Errorf("iperf3: %w", jerr)
+	}
+	if v.Error != "" {
+		return nil, errors.New("iperf3: " + v.Error)
+	}
+	r := v.End.SumReceived
+	return &Throughput{Source: s.spec, Bytes: r.Bytes, Seconds: r.Seconds, Mbps: r.Bps / 1e6}, nil
+}
+
+// watchSpeedtest samples the throughput with s every so often, the first
+// time after one period, so the idle latency is known first. The targets
+// record the sample in the interval it ends in.
+func (m *monitor) watchSpeedtest(s *speedtest, every time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	var lastErr string
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+		tp, err := s.run()
+		if err != nil {
+			if err.Error() != lastErr {
+				fmt.Println("WARN: speedtest:", err)
+				lastErr = err.Error()
+			}
+			continue
+		}
+		lastErr = ""
+		msg := fmt.Sprintf(tr("speedtest: %.1f Mbit/s from %s, %s in %.1fs"), tp.Mbps, tp.Source, formatBytes(tp.Bytes), tp.Seconds)
+		fmt.Println(msg)
+		for _, t := range m.list("") {
+			t.mu.Lock()
+			t.throughput = tp.Mbps
+			t.mu.Unlock()
+		}
+		m.out.Event(&Event{Time: time.Now(), Type: eventThroughput, Message: msg, Throughput: tp})
+	}
+}
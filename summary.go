@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// writeRunSummary writes rs to path as indented JSON.
+func writeRunSummary(path string, rs *RunSummary) error {
+	b, err := json.MarshalIndent(rs, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(b, '\n'), 0o644)
+}
+
+// readSummaries reads the per-target summaries of a file written by
+// -summary, or of the JSON lines output of batch mode.
+func readSummaries(path string) ([]*Summary, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rs RunSummary
+	if err := json.Unmarshal(b, &rs); err == nil && rs.Targets != nil {
+		return rs.Targets, nil
+	}
+	var ss []*Summary
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for line := 1; sc.Scan(); line++ {
+		if len(bytes.TrimSpace(sc.Bytes())) == 0 {
+			continue
+		}
+		var res batchResult
+		if err := json.Unmarshal(sc.Bytes(), &res); err != nil {
+			return nil, fmt.Errorf("%s:%d: not a run summary or batch result: %v", path, line, err)
+		}
+		if res.Summary != nil {
+			ss = append(ss, res.Summary)
+		}
+	}
+	return ss, sc.Err()
+}
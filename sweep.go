@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// maxSweepSizes bounds the sizes of a -size-sweep, each wants a few probes.
+const maxSweepSizes = 512
+
+// parseSizeSweep reads MIN:MAX:STEP into the payload sizes to cycle
+// through.
+func parseSizeSweep(s string) ([]int, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("invalid size sweep %q, want MIN:MAX:STEP", s)
+	}
+	var v [3]int
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid size sweep %q, want MIN:MAX:STEP", s)
+		}
+		v[i] = n
+	}
+	lo, hi, step := v[0], v[1], v[2]
+	switch {
+	case lo < minPayloadSize:
+		return nil, fmt.Errorf("size sweep starts below the minimum size %d", minPayloadSize)
+	case hi < lo || step <= 0:
+		return nil, fmt.Errorf("invalid size sweep %q, want MIN <= MAX and STEP > 0", s)
+	case (hi-lo)/step+1 > maxSweepSizes:
+		return nil, fmt.Errorf("size sweep %q has more than %d sizes", s, maxSweepSizes)
+	}
+	var sizes []int
+	for n := lo; n <= hi; n += step {
+		sizes = append(sizes, n)
+	}
+	return sizes, nil
+}
+
+// SizeStats is the RTT of the probes of one payload size in a sweep.
+type SizeStats struct {
+	Size    int     `json:"size"`
+	Sent    int     `json:"sent"`
+	Recv    int     `json:"recv"`
+	LossPct float64 `json:"loss_pct"`
+	MinMs   float64 `json:"min_ms,omitempty"`
+	AvgMs   float64 `json:"avg_ms,omitempty"`
+	MaxMs   float64 `json:"max_ms,omitempty"`
+}
+
+// sizeSweep gathers the RTTs of a target by payload size.
+type sizeSweep struct {
+	mu    sync.Mutex
+	sizes []int
+	sent  map[int]int
+	rtts  map[int][]time.Duration
+}
+
+func newSizeSweep(sizes []int) *sizeSweep {
+	return &sizeSweep{sizes: sizes, sent: make(map[int]int), rtts: make(map[int][]time.Duration)}
+}
+
+func (s *sizeSweep) send(pkt *Packet) {
+	if pkt.Size == 0 {
+		return
+	}
+	s.mu.Lock()
+	s.sent[pkt.Size]++
+	s.mu.Unlock()
+}
+
+func (s *sizeSweep) recv(pkt *Packet) {
+	if pkt.Size == 0 {
+		return
+	}
+	s.mu.Lock()
+	s.rtts[pkt.Size] = append(s.rtts[pkt.Size], pkt.Rtt)
+	s.mu.Unlock()
+}
+
+// Stats returns the sizes probed so far, smallest first.
+func (s *sizeSweep) Stats() []SizeStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []SizeStats
+	for _, size := range s.sizes {
+		st := SizeStats{Size: size, Sent: s.sent[size], Recv: len(s.rtts[size])}
+		if st.Sent == 0 {
+			continue
+		}
+		st.LossPct = float64(st.Sent-st.Recv) / float64(st.Sent) * 100
+		if st.LossPct < 0 {
+			// a reply counted before the send, or a duplicate
+			st.LossPct = 0
+		}
+		var sum, lo, hi time.Duration
+		for i, rtt := range s.rtts[size] {
+			if i == 0 || rtt < lo {
+				lo = rtt
+			}
+			if rtt > hi {
+				hi = rtt
+			}
+			sum += rtt
+		}
+		if st.Recv > 0 {
+			st.MinMs, st.AvgMs, st.MaxMs = ms(lo), ms(sum/time.Duration(st.Recv)), ms(hi)
+		}
+		out = append(out, st)
+	}
+	return out
+}
+
+// sweepSlope fits avg RTT = a + b*size by least squares, b in ms per byte.
+func sweepSlope(stats []SizeStats) (b float64, ok bool) {
+	var n, sx, sy, sxx, sxy float64
+	for _, st := range stats {
+		if st.Recv == 0 {
+			continue
+		}
+		x, y := float64(st.Size), st.AvgMs
+		n++
+		sx, sy, sxx, sxy = sx+x, sy+y, sxx+x*x, sxy+x*y
+	}
+	d := n*sxx - sx*sx
+	if n < 2 || d == 0 {
+		return 0, false
+	}
+	return (n*sxy - sx*sy) / d, true
+}
+
+// Compare tells whether the largest size is slower than the smallest
+// beyond the noise, "" before both have replies.
+func (s *sizeSweep) Compare() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var small, large int
+	for _, size := range s.sizes {
+		if len(s.rtts[size]) < 2 {
+			continue
+		}
+		if small == 0 {
+			small = size
+		}
+		large = size
+	}
+	if small == large {
+		return ""
+	}
+	return compareRtts(fmt.Sprintf("%dB", small), durationsMs(s.rtts[small]),
+		fmt.Sprintf("%dB", large), durationsMs(s.rtts[large]))
+}
+
+// formatSizeSweep is the table and bar chart of a target's sweep, with the
+// bandwidth the growth of the RTT with size suggests and cmp, the
+// significance of it.
+func formatSizeSweep(name string, stats []SizeStats, cmp string) string {
+	if len(stats) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, tr("\n--- %s RTT by payload size ---\n"), name)
+	top := 0.0
+	for _, st := range stats {
+		top = math.Max(top, st.AvgMs)
+	}
+	tw := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "size\tsent\trecv\tloss\tmin\tavg\tmax\t")
+	for _, st := range stats {
+		bar := ""
+		if top > 0 {
+			bar = strings.Repeat("#", int(math.Round(st.AvgMs/top*40)))
+		}
+		fmt.Fprintf(tw, "%d\t%d\t%d\t%.1f%%\t%s\t%s\t%s\t%s\n",
+			st.Size, st.Sent, st.Recv, st.LossPct, output.Ms(st.MinMs, 3), output.Ms(st.AvgMs, 3), output.Ms(st.MaxMs, 3), bar)
+	}
+	tw.Flush()
+	if slope, ok := sweepSlope(stats); ok && slope > 0 {
+		// every payload byte crosses the bottleneck twice, 16 bits a round trip
+		fmt.Fprintf(&b, tr("RTT grows %.3fµs per byte, a bottleneck of about %s if symmetric\n"),
+			slope*1000, formatBandwidth(16/(slope/1000)))
+	}
+	if cmp != "" {
+		fmt.Fprintln(&b, cmp)
+	}
+	return b.String()
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// tableMinWidth is the narrowest the target column of -table gets.
+const tableMinWidth = 15
+
+// table prints every probe as a row of fixed-width columns, replacing the
+// ping-like sentences, for output with many targets to grep and scan.
+type table struct {
+	width int
+}
+
+// newTable sizes the target column for names, longer targets added later
+// push their row out of line.
+func newTable(names []string) *table {
+	t := &table{width: tableMinWidth}
+	for _, n := range names {
+		if len(n) > t.width {
+			t.width = len(n)
+		}
+	}
+	return t
+}
+
+func (tb *table) header() {
+	fmt.Println(tb.headerLine())
+}
+
+func (tb *table) headerLine() string {
+	return fmt.Sprintf("%-12s  %-*s  %6s  %12s  %3s  %s", "time", tb.width, "target", "seq", "rtt", "ttl", "flags")
+}
+
+// row prints one probe; rtt and ttl are left blank when zero or negative.
+func (tb *table) row(target string, seq int, rtt time.Duration, ttl int, flags ...string) {
+	fmt.Println(tb.line(time.Now(), target, seq, rtt, ttl, flags))
+}
+
+// line is the row of a probe at the time at.
+func (tb *table) line(at time.Time, target string, seq int, rtt time.Duration, ttl int, flags []string) string {
+	rs, ts := "-", "-"
+	if rtt > 0 {
+		rs = output.Dur(rtt)
+	}
+	if ttl > 0 {
+		ts = strconv.Itoa(ttl)
+	}
+	line := fmt.Sprintf("%-12s  %-*s  %6d  %12s  %3s  %s", output.Time(at, "15:04:05.000", time.Local),
+		tb.width, target, seq, rs, ts, strings.Join(flags, " "))
+	return strings.TrimRight(line, " ")
+}
+
+// packetFlags are the flags of a reply: its method unless ICMP, HTTP
+// status, proxy time and payload damage.
+func packetFlags(pkt *Packet) []string {
+	var flags []string
+	if pkt.Method != "" && pkt.Method != protocolICMP {
+		flags = append(flags, pkt.Method)
+	}
+	if pkt.StatusCode != 0 {
+		flags = append(flags, "status="+strconv.Itoa(pkt.StatusCode))
+	}
+	if pkt.ProxyConnect > 0 {
+		flags = append(flags, "proxy="+output.Dur(pkt.ProxyConnect))
+	}
+	if pkt.Payload != "" {
+		flags = append(flags, pkt.Payload)
+	}
+	if pkt.Detail != nil {
+		flags = append(flags, pkt.Detail.String())
+	}
+	if pkt.Reordered {
+		flags = append(flags, "REORDERED")
+	}
+	return flags
+}
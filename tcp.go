@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// tcpTransport probes a port with TCP connects, timing the handshake. A
+// refused connection is an answer too: the host is up and sent the RST.
+type tcpTransport struct {
+	addr    string
+	dialer  net.Dialer
+	proxy   *proxyDialer
+	timeout time.Duration
+
+	ctx     context.Context
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+	replies chan *reply
+}
+
+func newTCPTransport(p *Pinger, port int) (*tcpTransport, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t := &tcpTransport{
+		addr:    net.JoinHostPort(p.ipaddr.String(), strconv.Itoa(port)),
+		timeout: p.ReplyTimeout,
+		ctx:     ctx,
+		cancel:  cancel,
+		replies: make(chan *reply),
+	}
+	t.dialer.Control = routingControl(p.Mark, p.Device)
+	if p.Source != "" {
+		ip := net.ParseIP(p.Source)
+		if ip == nil {
+			cancel()
+			return nil, errors.New("invalid source address " + p.Source)
+		}
+		t.dialer.LocalAddr = &net.TCPAddr{IP: ip}
+	}
+	if p.Proxy != "" {
+		var err error
+		if t.proxy, err = newProxyDialer(p.Proxy, t.dialer.LocalAddr); err != nil {
+			cancel()
+			return nil, err
+		}
+		t.proxy.dialer.Control = t.dialer.Control
+	}
+	return t, nil
+}
+
+func (t *tcpTransport) Close() error {
+	t.cancel()
+	t.wg.Wait()
+	return nil
+}
+
+func (t *tcpTransport) send(seq int) (*Packet, error) {
+	pkt := &Packet{Seq: seq}
+	ctx := t.ctx
+	cancel := context.CancelFunc(func() {})
+	if t.timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, t.timeout)
+	}
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		defer cancel()
+		r := &reply{seq: seq, pkt: &Packet{TTL: -1}}
+		start := time.Now()
+		var conn net.Conn
+		var err error
+		if t.proxy != nil {
+			// through a proxy the handshake is the tunnel being set up
+			pctx, pt := withProxyTime(ctx)
+			conn, err = t.proxy.DialContext(pctx, "tcp", t.addr)
+			r.pkt.ProxyConnect = time.Duration(pt.Load())
+		} else {
+			conn, err = t.dialer.DialContext(ctx, "tcp", t.addr)
+		}
+		r.receivedAt = time.Now()
+		r.rtt = r.receivedAt.Sub(start)
+		if err == nil {
+			conn.Close()
+		} else if t.proxy != nil || !errors.Is(err, syscall.ECONNREFUSED) {
+			// a refusing proxy says nothing about the target
+			r.err = err
+		}
+		select {
+		case t.replies <- r:
+		case <-t.ctx.Done():
+		}
+	}()
+	return pkt, nil
+}
+
+func (t *tcpTransport) receive() (*reply, error) {
+	select {
+	case r := <-t.replies:
+		return r, nil
+	case <-t.ctx.Done():
+		return nil, net.ErrClosed
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// maxExpanded bounds the targets one template expands to, a typo in a
+// range or prefix length shouldn't start a million pingers.
+const maxExpanded = 4096
+
+// expandTarget expands a target template into the targets it stands for,
+// each keeping the rest of the spec, methods and all:
+//
+//	web-{01..20}.example.com          numeric ranges, zero padded like the bounds
+//	https://{www,api}.example.com/    lists
+//	tcp://db.example.com:{5432,6432}  anywhere in the spec, ports and paths too
+//	10.0.0.0/28=icmp,tcp:22           the hosts of a CIDR prefix
+//
+// Several braces multiply. A spec with none of these is returned as is.
+func expandTarget(spec string) ([]string, error) {
+	out, err := expandBraces(spec)
+	if err != nil {
+		return nil, err
+	}
+	var targets []string
+	for _, s := range out {
+		hosts, err := expandCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, hosts...)
+		if len(targets) > maxExpanded {
+			return nil, fmt.Errorf("%s: expands to more than %d targets", spec, maxExpanded)
+		}
+	}
+	return targets, nil
+}
+
+// expandTargets expands every spec in turn.
+func expandTargets(specs []string) ([]string, error) {
+	var targets []string
+	for _, spec := range specs {
+		t, err := expandTarget(spec)
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, t...)
+	}
+	return targets, nil
+}
+
+// expandBraces expands the first {...} of s and recurses into the rest.
+func expandBraces(s string) ([]string, error) {
+	open := strings.IndexByte(s, '{')
+	if open < 0 {
+		if strings.IndexByte(s, '}') >= 0 {
+			return nil, fmt.Errorf("%s: unbalanced }", s)
+		}
+		return []string{s}, nil
+	}
+	end := strings.IndexByte(s[open:], '}')
+	if end < 0 {
+		return nil, fmt.Errorf("%s: unbalanced {", s)
+	}
+	end += open
+	alts, err := braceAlternatives(s[open+1 : end])
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", s, err)
+	}
+	rest, err := expandBraces(s[end+1:])
+	if err != nil {
+		return nil, err
+	}
+	if len(alts)*len(rest) > maxExpanded {
+		return nil, fmt.Errorf("%s: expands to more than %d targets", s, maxExpanded)
+	}
+	out := make([]string, 0, len(alts)*len(rest))
+	for _, a := range alts {
+		for _, r := range rest {
+			out = append(out, s[:open]+a+r)
+		}
+	}
+	return out, nil
+}
+
+// braceAlternatives returns what the inside of a brace stands for: a..b
+// for a numeric range, a,b,c for a list.
+func braceAlternatives(body string) ([]string, error) {
+	if strings.ContainsRune(body, '{') {
+		return nil, fmt.Errorf("nested {")
+	}
+	if lo, hi, ok := strings.Cut(body, ".."); ok {
+		from, err1 := strconv.Atoi(lo)
+		to, err2 := strconv.Atoi(hi)
+		if err1 != nil || err2 != nil || from < 0 || to < 0 {
+			return nil, fmt.Errorf("invalid range {%s}, want {FROM..TO}", body)
+		}
+		step := 1
+		if to < from {
+			step = -1
+		}
+		if (to-from)*step >= maxExpanded {
+			return nil, fmt.Errorf("range {%s} is over %d long", body, maxExpanded)
+		}
+		// {01..20} pads to the width of its bounds, {1..20} doesn't
+		width := 0
+		if (len(lo) > 1 && lo[0] == '0') || (len(hi) > 1 && hi[0] == '0') {
+			width = len(lo)
+			if len(hi) > width {
+				width = len(hi)
+			}
+		}
+		var out []string
+		for i := from; ; i += step {
+			out = append(out, fmt.Sprintf("%0*d", width, i))
+			if i == to {
+				break
+			}
+		}
+		return out, nil
+	}
+	alts := strings.Split(body, ",")
+	if len(alts) < 2 {
+		return nil, fmt.Errorf("invalid {%s}, want {a,b} or {FROM..TO}", body)
+	}
+	return alts, nil
+}
+
+// expandCIDR expands a host target written as a prefix, PREFIX or
+// PREFIX=methods, into its hosts, leaving out the network and broadcast
+// addresses of IPv4 prefixes up to /30.
+func expandCIDR(spec string) ([]string, error) {
+	if strings.Contains(spec, "://") {
+		return []string{spec}, nil
+	}
+	host, suffix := spec, ""
+	if i := strings.IndexByte(spec, '='); i >= 0 {
+		host, suffix = spec[:i], spec[i:]
+	}
+	if !strings.Contains(host, "/") {
+		return []string{spec}, nil
+	}
+	ip, ipnet, err := net.ParseCIDR(host)
+	if err != nil {
+		return nil, err
+	}
+	ones, bits := ipnet.Mask.Size()
+	if bits-ones > 12 {
+		return nil, fmt.Errorf("%s: more than %d hosts", host, maxExpanded)
+	}
+	n := 1 << (bits - ones)
+	ip = ipnet.IP
+	if ip.To4() != nil {
+		ip = ip.To4()
+	}
+	skipEnds := ip.To4() != nil && n > 2
+	var out []string
+	cur := append(net.IP(nil), ip...)
+	for i := 0; i < n; i++ {
+		if !skipEnds || (i != 0 && i != n-1) {
+			out = append(out, cur.String()+suffix)
+		}
+		// next address
+		for j := len(cur) - 1; j >= 0; j-- {
+			cur[j]++
+			if cur[j] != 0 {
+				break
+			}
+		}
+	}
+	return out, nil
+}
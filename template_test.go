@@ -0,0 +1,70 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestExpandTarget(t *testing.T) {
+	for _, tt := range []struct {
+		spec string
+		want []string
+	}{
+		{"example.com", []string{"example.com"}},
+		{"web-{01..03}.example.com", []string{"web-01.example.com", "web-02.example.com", "web-03.example.com"}},
+		{"web-{1..3}", []string{"web-1", "web-2", "web-3"}},
+		{"web-{8..10}", []string{"web-8", "web-9", "web-10"}},
+		{"web-{3..1}", []string{"web-3", "web-2", "web-1"}},
+		{"web-{9..010}", []string{"web-009", "web-010"}},
+		{"https://{www,api}.example.com/", []string{"https://www.example.com/", "https://api.example.com/"}},
+		{"tcp://db.example.com:{5432,6432}", []string{"tcp://db.example.com:5432", "tcp://db.example.com:6432"}},
+		{"{a,b}-{1..2}", []string{"a-1", "a-2", "b-1", "b-2"}},
+		{"{a,}x", []string{"ax", "x"}},
+		{"10.0.0.0/30=icmp,tcp:22", []string{"10.0.0.1=icmp,tcp:22", "10.0.0.2=icmp,tcp:22"}},
+		{"10.0.0.7/29", []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4", "10.0.0.5", "10.0.0.6"}},
+		// no network or broadcast address on a point to point link
+		{"192.0.2.0/31", []string{"192.0.2.0", "192.0.2.1"}},
+		{"192.0.2.9/32", []string{"192.0.2.9"}},
+		{"2001:db8::/126", []string{"2001:db8::", "2001:db8::1", "2001:db8::2", "2001:db8::3"}},
+		{"10.0.{1,2}.0/31", []string{"10.0.1.0", "10.0.1.1", "10.0.2.0", "10.0.2.1"}},
+		{"10.0.0.254/31", []string{"10.0.0.254", "10.0.0.255"}},
+		// a path in a URL is no prefix
+		{"https://example.com/24", []string{"https://example.com/24"}},
+	} {
+		got, err := expandTarget(tt.spec)
+		if err != nil {
+			t.Errorf("%s: %v", tt.spec, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %q, want %q", tt.spec, got, tt.want)
+		}
+	}
+	if got, err := expandTarget("h-{0..4095}"); err != nil || len(got) != maxExpanded {
+		t.Errorf("%d targets: %d, %v", maxExpanded, len(got), err)
+	}
+}
+
+func TestExpandTargetErrors(t *testing.T) {
+	for _, tt := range []struct {
+		spec, want string
+	}{
+		{"web-{1..3", "unbalanced {"},
+		{"web-1..3}", "unbalanced }"},
+		{"web-{{1,2}}", "nested {"},
+		{"web-{a..c}", "invalid range"},
+		{"web-{-1..3}", "invalid range"},
+		{"web-{1}", "want {a,b} or {FROM..TO}"},
+		{"web-{}", "want {a,b} or {FROM..TO}"},
+		{"h-{0..4096}", "over 4096 long"},
+		{"h-{0..99}-{0..99}", "more than 4096 targets"},
+		{"10.0.0.0/8", "more than 4096 hosts"},
+		{"10.0.0.0/33", "invalid CIDR"},
+		{"10.0.{0..31}.0/24", "more than 4096 targets"},
+	} {
+		if _, err := expandTarget(tt.spec); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: error %v, want %q", tt.spec, err, tt.want)
+		}
+	}
+}
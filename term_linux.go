@@ -0,0 +1,9 @@
+package main
+
+import "syscall"
+
+// The termios requests of rawTerminal.
+const (
+	ioctlGetTermios = syscall.TCGETS
+	ioctlSetTermios = syscall.TCSETS
+)
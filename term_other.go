@@ -0,0 +1,15 @@
+//go:build !linux && !darwin
+
+package main
+
+import "errors"
+
+var errNoTUI = errors.New("-tui is only supported on Linux and macOS")
+
+func rawTerminal(fd int) (restore func() error, err error) {
+	return nil, errNoTUI
+}
+
+func terminalSize(fd int) (rows, cols int, err error) {
+	return 0, 0, errNoTUI
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// trendMinSamples is the fewest samples a target needs in each quarter of
+// the run for its trend to be reported.
+const trendMinSamples = 5
+
+// trendStats summarises the samples of one stretch of a run.
+type trendStats struct {
+	sent, lost    int
+	avg, p50, p95 time.Duration
+}
+
+func newTrendStats(ss []sample) trendStats {
+	var st trendStats
+	var rtts []time.Duration
+	var sum time.Duration
+	for _, s := range ss {
+		st.sent++
+		if s.Lost {
+			st.lost++
+			continue
+		}
+		rtts = append(rtts, s.Rtt)
+		sum += s.Rtt
+	}
+	if len(rtts) == 0 {
+		return st
+	}
+	sort.Slice(rtts, func(i, j int) bool { return rtts[i] < rtts[j] })
+	st.avg = sum / time.Duration(len(rtts))
+	st.p50 = rtts[(len(rtts)-1)/2]
+	st.p95 = rtts[int(math.Ceil(0.95*float64(len(rtts))))-1]
+	return st
+}
+
+// bucketTrendStats sums up history buckets, which have no percentiles.
+func bucketTrendStats(bs []bucket) trendStats {
+	var st trendStats
+	var sum float64
+	for _, b := range bs {
+		st.sent += b.Sent
+		st.lost += b.Lost
+		sum += b.AvgMs * float64(b.Sent-b.Lost)
+	}
+	if recv := st.sent - st.lost; recv > 0 {
+		st.avg = time.Duration(sum / float64(recv) * float64(time.Millisecond))
+	}
+	return st
+}
+
+// String is avg/p50/p95, - for what isn't known.
+func (st trendStats) String() string {
+	var f []string
+	for _, d := range []time.Duration{st.avg, st.p50, st.p95} {
+		if d == 0 {
+			f = append(f, "-")
+		} else {
+			f = append(f, d.String())
+		}
+	}
+	return strings.Join(f, "/")
+}
+
+func (st trendStats) loss() float64 {
+	if st.sent == 0 {
+		return 0
+	}
+	return float64(st.lost) / float64(st.sent) * 100
+}
+
+// Trend compares the first and the last quarter of the run of every target,
+// and names its best and worst hours when the run spans several, to show
+// whether latency degraded over time. Only what the history still holds is
+// looked at.
+func (m *monitor) Trend(start, end time.Time) string {
+	var rows, hours []string
+	for _, ht := range m.history.Targets() {
+		ss := m.history.Samples(ht.Name)
+		from := start
+		if oldest := m.history.Oldest(ht.Name); oldest.After(from) {
+			from = oldest
+		}
+		q := end.Sub(from) / 4
+		i := sort.Search(len(ss), func(i int) bool { return !ss[i].At.Before(from.Add(q)) })
+		j := sort.Search(len(ss), func(i int) bool { return !ss[i].At.Before(end.Add(-q)) })
+		var first trendStats
+		if len(ss) > 0 && ss[0].At.After(from.Add(q)) {
+			// the start of a long run is only kept folded into minutes
+			match := func(n, _ string) bool { return n == ht.Name }
+			first = bucketTrendStats(m.history.Query(match, from, from.Add(q), q))
+		} else {
+			first = newTrendStats(ss[:i])
+		}
+		if first.sent < trendMinSamples || len(ss)-j < trendMinSamples {
+			continue
+		}
+		last := newTrendStats(ss[j:])
+		rows = append(rows, fmt.Sprintf("%s\t%s\t%.1f%%\t%s\t%.1f%%\t%s", ht.Name,
+			first, first.loss(), last, last.loss(), trendVerdict(first, last)))
+
+		if end.Sub(from) < 2*time.Hour {
+			continue
+		}
+		bs := m.history.Query(func(n, _ string) bool { return n == ht.Name }, from, end, time.Hour)
+		var best, worst *bucket
+		for k := range bs {
+			bk := &bs[k]
+			if bk.Sent == bk.Lost {
+				continue
+			}
+			if best == nil || bk.AvgMs < best.AvgMs {
+				best = bk
+			}
+			if worst == nil || bk.AvgMs > worst.AvgMs {
+				worst = bk
+			}
+		}
+		if best != nil && best != worst {
+			hours = append(hours, fmt.Sprintf("%s: best hour from %s avg %s, worst from %s avg %s (loss %.1f%%)",
+				ht.Name, output.Time(best.Time, "Jan 2 15:04", time.Local), output.Ms(best.AvgMs, 3),
+				output.Time(worst.Time, "Jan 2 15:04", time.Local), output.Ms(worst.AvgMs, 3), float64(worst.Lost)/float64(worst.Sent)*100))
+		}
+	}
+	if len(rows) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteString(tr("\n--- trend, first vs last quarter of the run ---\n"))
+	tw := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "target\tfirst avg/p50/p95\tloss\tlast avg/p50/p95\tloss\ttrend")
+	for _, r := range rows {
+		fmt.Fprintln(tw, r)
+	}
+	tw.Flush()
+	for _, h := range hours {
+		b.WriteString(h + "\n")
+	}
+	return b.String()
+}
+
+// trendVerdict calls a change of a fifth of the average RTT, or of a
+// percentage point of loss, a trend.
+func trendVerdict(first, last trendStats) string {
+	var v []string
+	switch {
+	case first.avg > 0 && last.avg > first.avg*6/5:
+		v = append(v, fmt.Sprintf("slower (%+.0f%%)", float64(last.avg-first.avg)/float64(first.avg)*100))
+	case last.avg > 0 && last.avg < first.avg*5/6:
+		v = append(v, fmt.Sprintf("faster (%+.0f%%)", float64(last.avg-first.avg)/float64(first.avg)*100))
+	}
+	switch d := last.loss() - first.loss(); {
+	case d >= 1:
+		v = append(v, fmt.Sprintf("lossier (%+.1fpp)", d))
+	case d <= -1:
+		v = append(v, fmt.Sprintf("less loss (%+.1fpp)", d))
+	}
+	if len(v) == 0 {
+		return "stable"
+	}
+	return strings.Join(v, ", ")
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// ttlSweepWait is how long a -ttl-sweep waits for the hops to answer, its
+// probes all being out at once.
+const ttlSweepWait = 2 * time.Second
+
+// traceHops is how far the traceroute control command goes, unless
+// -ttl-sweep says.
+const traceHops = 30
+
+// Hop is a router, or the target itself, answering a probe sent with TTL.
+// Hops that didn't answer have no address.
+type Hop struct {
+	TTL   int     `json:"ttl"`
+	Addr  string  `json:"addr,omitempty"`
+	RttMs float64 `json:"rtt_ms,omitempty"`
+}
+
+// sweepTTL sends one echo request with every TTL from 1 to maxTTL to dst
+// and returns the hops which answered, up to the target: a one-shot
+// traceroute. It takes a raw socket, datagram ICMP sockets don't hand over
+// the time exceeded errors.
+func sweepTTL(dst *net.IPAddr, s probeSettings, maxTTL int) ([]Hop, error) {
+	if !s.Privileged {
+		return nil, errors.New("tracing the path needs --privileged")
+	}
+	v4 := dst.IP.To4() != nil
+	conn, err := listenICMP(v4, true, "")
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if err := conn.setRouting(s.Mark, s.Device); err != nil {
+		return nil, err
+	}
+	var b [2]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return nil, err
+	}
+	id := int(binary.BigEndian.Uint16(b[:]))
+	var typ icmp.Type = ipv4.ICMPTypeEcho
+	proto := ianaProtocolICMP
+	if !v4 {
+		typ, proto = ipv6.ICMPTypeEchoRequest, ianaProtocolIPv6ICMP
+	}
+	sent := make([]time.Time, maxTTL+1)
+	for ttl := 1; ttl <= maxTTL; ttl++ {
+		if err := conn.SetTTL(ttl); err != nil {
+			return nil, err
+		}
+		msg, err := (&icmp.Message{Type: typ, Body: &icmp.Echo{ID: id, Seq: ttl, Data: []byte("keeping ttl sweep")}}).Marshal(nil)
+		if err != nil {
+			return nil, err
+		}
+		sent[ttl] = time.Now()
+		if _, err := conn.WriteTo(msg, dst); err != nil {
+			return nil, err
+		}
+	}
+
+	hops := make([]Hop, maxTTL+1)
+	reached := 0
+	_ = conn.c.SetReadDeadline(time.Now().Add(ttlSweepWait))
+	for !sweepDone(hops, reached) {
+		r, err := conn.read(make([]byte, 1500))
+		if err != nil {
+			// the deadline
+			break
+		}
+		if v4 {
+			r.nbytes = stripIPv4Header(r.nbytes, r.bytes)
+		}
+		m, err := icmp.ParseMessage(proto, r.bytes[:r.nbytes])
+		if err != nil {
+			continue
+		}
+		ttl := 0
+		switch body := m.Body.(type) {
+		case *icmp.Echo:
+			if (m.Type == ipv4.ICMPTypeEchoReply || m.Type == ipv6.ICMPTypeEchoReply) && body.ID == id {
+				// every probe with enough TTL gets here, the first counts
+				ttl = body.Seq
+				if reached == 0 || ttl < reached {
+					reached = ttl
+				}
+			}
+		case *icmp.TimeExceeded:
+			ttl = quotedEchoSeq(body.Data, v4, id)
+		}
+		src := addrIP(r.src)
+		if ttl < 1 || ttl > maxTTL || hops[ttl].Addr != "" || src == nil {
+			continue
+		}
+		hops[ttl] = Hop{Addr: src.IP.String(), RttMs: ms(r.receivedAt.Sub(sent[ttl]))}
+	}
+	last := reached
+	if last == 0 {
+		for last = maxTTL; last > 0 && hops[last].Addr == ""; last-- {
+		}
+	}
+	path := hops[1 : last+1]
+	for i := range path {
+		path[i].TTL = i + 1
+	}
+	return path, nil
+}
+
+// sweepDone tells whether every hop up to the target answered.
+func sweepDone(hops []Hop, reached int) bool {
+	if reached == 0 {
+		return false
+	}
+	for _, h := range hops[1:reached] {
+		if h.Addr == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// quotedEchoSeq returns the sequence number of one of our echo requests
+// quoted by an ICMP error, 0 when it quotes something else.
+func quotedEchoSeq(data []byte, v4 bool, id int) int {
+	qid, seq, _, ok := quotedEcho(data, v4)
+	if !ok || qid != id {
+		return 0
+	}
+	return seq
+}
+
+// quotedEcho returns the identifier, sequence number and what the quote
+// kept of the payload of the echo request an ICMP error quotes.
+func quotedEcho(data []byte, v4 bool) (id, seq int, payload []byte, ok bool) {
+	var hdr int
+	if v4 {
+		if len(data) < 20 || data[9] != ianaProtocolICMP {
+			return 0, 0, nil, false
+		}
+		hdr = int(data[0]&0x0f) << 2
+	} else {
+		if len(data) < 40 || data[6] != ianaProtocolIPv6ICMP {
+			return 0, 0, nil, false
+		}
+		hdr = 40
+	}
+	if len(data) < hdr+8 {
+		return 0, 0, nil, false
+	}
+	return int(binary.BigEndian.Uint16(data[hdr+4:])), int(binary.BigEndian.Uint16(data[hdr+6:])), data[hdr+8:], true
+}
+
+func formatPath(name string, ip *net.IPAddr, path []Hop) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, tr("path to %s (%s), %d hops:\n"), name, ip, len(path))
+	for _, h := range path {
+		if h.Addr == "" {
+			fmt.Fprintf(&b, "%3d  *\n", h.TTL)
+			continue
+		}
+		fmt.Fprintf(&b, "%3d  %s  %s\n", h.TTL, h.Addr,
+			output.Dur(time.Duration(h.RttMs*float64(time.Millisecond))))
+	}
+	return b.String()
+}
@@ -0,0 +1,604 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// tuiLogLines are the console lines kept for the log pane of -tui.
+const tuiLogLines = 100
+
+// tuiGroupings are what -tui groups the targets by, in the order the g key
+// goes through them: the name a target was configured as, shared by its
+// addresses, sources and profiles, the -sources address it probes from, and
+// the AS and country -geoip finds for its address.
+var tuiGroupings = []string{"none", "name", "source", "provider", "country"}
+
+// tuiSorts are the orders of the rows, in the order the s key goes through
+// them; loss and rtt put the worst first.
+var tuiSorts = []string{"name", "loss", "rtt"}
+
+// tuiRow is a line of the target table of -tui, a target or, with a
+// grouping, the group of the targets below it added up.
+type tuiRow struct {
+	name  string
+	group string
+	// targets is the number of targets of a group row, 0 for a target
+	targets   int
+	paused    int
+	interval  time.Duration
+	sent      int
+	recv      int
+	loss      float64
+	avg, max  time.Duration
+	collapsed bool
+	// hosts are the targets of the row, those the keys act on
+	hosts []string
+}
+
+// key identifies the row across redraws, for the cursor to stay on it.
+func (r *tuiRow) key() string {
+	if r.targets > 0 {
+		return "group " + r.group
+	}
+	return r.name
+}
+
+// tuiLabel is what t is grouped under by groupBy.
+func tuiLabel(t *target, groupBy string) string {
+	switch groupBy {
+	case "name":
+		return t.group
+	case "source":
+		if t.source != nil {
+			return t.source.name
+		}
+		return "default"
+	case "provider":
+		return t.geo.provider()
+	case "country":
+		if t.geo != nil && t.geo.Country != "" {
+			return t.geo.Country
+		}
+		return "unknown"
+	}
+	return ""
+}
+
+// tuiSnapshot is a row for every target of m, labelled by groupBy.
+func tuiSnapshot(m *monitor, groupBy string) []tuiRow {
+	var rows []tuiRow
+	for _, t := range m.list("") {
+		stats := t.pinger.Statistics()
+		paused, interval := t.pinger.Paused()
+		r := tuiRow{name: t.host, group: tuiLabel(t, groupBy), interval: interval,
+			sent: stats.PacketsSent, recv: stats.PacketsRecv, loss: stats.PacketLoss,
+			avg: stats.AvgRtt, max: stats.MaxRtt, hosts: []string{t.host}}
+		if paused {
+			r.paused = 1
+		}
+		rows = append(rows, r)
+	}
+	return rows
+}
+
+// tuiGroup orders the rows of the targets by sortBy and, when they carry
+// group labels, puts them under a row for each group adding them up.
+// Groups are ordered by the same key, and the targets of the collapsed ones
+// left out.
+func tuiGroup(rows []tuiRow, sortBy string, collapsed map[string]bool) []tuiRow {
+	tuiSort(rows, sortBy)
+	if len(rows) == 0 || rows[0].group == "" {
+		return rows
+	}
+	byGroup := make(map[string][]tuiRow)
+	var groups []tuiRow
+	for _, r := range rows {
+		if _, ok := byGroup[r.group]; !ok {
+			groups = append(groups, tuiRow{name: r.group, group: r.group})
+		}
+		byGroup[r.group] = append(byGroup[r.group], r)
+	}
+	for i := range groups {
+		g := &groups[i]
+		var lost, rttSum float64
+		for _, r := range byGroup[g.group] {
+			g.targets++
+			g.hosts = append(g.hosts, r.name)
+			g.paused += r.paused
+			g.sent, g.recv = g.sent+r.sent, g.recv+r.recv
+			lost += r.loss * float64(r.sent)
+			rttSum += float64(r.avg) * float64(r.recv)
+			if r.max > g.max {
+				g.max = r.max
+			}
+			if g.interval == 0 || r.interval < g.interval {
+				g.interval = r.interval
+			}
+		}
+		if g.sent > 0 {
+			g.loss = lost / float64(g.sent)
+		}
+		if g.recv > 0 {
+			g.avg = time.Duration(rttSum / float64(g.recv))
+		}
+		g.collapsed = collapsed[g.group]
+	}
+	tuiSort(groups, sortBy)
+	out := make([]tuiRow, 0, len(groups)+len(rows))
+	for _, g := range groups {
+		out = append(out, g)
+		if !g.collapsed {
+			out = append(out, byGroup[g.group]...)
+		}
+	}
+	return out
+}
+
+func tuiSort(rows []tuiRow, sortBy string) {
+	sort.SliceStable(rows, func(i, j int) bool {
+		a, b := &rows[i], &rows[j]
+		switch {
+		case sortBy == "loss" && a.loss != b.loss:
+			return a.loss > b.loss
+		case sortBy == "rtt" && a.avg != b.avg:
+			return a.avg > b.avg
+		}
+		return a.name < b.name
+	})
+}
+
+// tuiKeys splits what a read of the terminal returned into the keys
+// pressed: runes, or up, down, enter, esc and backspace.
+func tuiKeys(b []byte) []string {
+	var keys []string
+	for len(b) > 0 {
+		switch {
+		case bytes.HasPrefix(b, []byte("\x1b[A")), bytes.HasPrefix(b, []byte("\x1bOA")):
+			keys, b = append(keys, "up"), b[3:]
+		case bytes.HasPrefix(b, []byte("\x1b[B")), bytes.HasPrefix(b, []byte("\x1bOB")):
+			keys, b = append(keys, "down"), b[3:]
+		case len(b) >= 3 && b[0] == 0x1b && (b[1] == '[' || b[1] == 'O'):
+			// another sequence, skipped up to its final byte
+			n := 2
+			for n < len(b)-1 && (b[n] < 0x40 || b[n] > 0x7e) {
+				n++
+			}
+			b = b[n+1:]
+		case b[0] == 0x1b:
+			keys, b = append(keys, "esc"), b[1:]
+		case b[0] == '\r' || b[0] == '\n':
+			keys, b = append(keys, "enter"), b[1:]
+		case b[0] == 0x7f || b[0] == 0x08:
+			keys, b = append(keys, "backspace"), b[1:]
+		default:
+			r, n := utf8.DecodeRune(b)
+			keys, b = append(keys, string(r)), b[n:]
+		}
+	}
+	return keys
+}
+
+// tui is the full-screen target table of -tui. The console output goes to
+// its log pane meanwhile. Its keys act on the targets through the control
+// commands, as keeping ctl does.
+type tui struct {
+	m        *monitor
+	handlers map[string]ctlHandler
+	term     *os.File
+	// stdout is the pipe standing in for os.Stdout
+	stdout  *os.File
+	restore func() error
+	keys    chan string
+	stop    chan struct{}
+	// done is closed once the drawing loop returned, captured once the
+	// console is read to its end
+	done     chan struct{}
+	captured chan struct{}
+	once     sync.Once
+
+	logMu sync.Mutex
+	log   []string
+	// output is what the last control command returned, shown in place
+	// of the log until a key is pressed
+	output []string
+
+	// the state below is the drawing loop's
+	grouping  int
+	sorting   int
+	collapsed map[string]bool
+	// cursor is the key of the row selected, offset the first row shown
+	cursor string
+	offset int
+	rows   []tuiRow
+	// prompt, when set, is the question input answers, then handed to
+	// answer
+	prompt string
+	input  []rune
+	answer func(string)
+}
+
+// openTUI takes the terminal over to show the targets of m until Close.
+func openTUI(m *monitor) (*tui, error) {
+	restore, err := rawTerminal(int(os.Stdin.Fd()))
+	if err != nil {
+		return nil, err
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		restore()
+		return nil, err
+	}
+	u := &tui{m: m, handlers: m.ctlHandlers(), term: os.Stdout, stdout: w, restore: restore, keys: make(chan string, 16),
+		stop: make(chan struct{}), done: make(chan struct{}), captured: make(chan struct{}), collapsed: make(map[string]bool)}
+	os.Stdout = w
+	fmt.Fprint(u.term, "\x1b[?1049h\x1b[?25l")
+	go u.capture(r)
+	go u.readKeys(os.Stdin)
+	go u.loop()
+	return u, nil
+}
+
+// Close gives the terminal back, printing there the last lines of the log
+// pane.
+func (u *tui) Close() {
+	u.once.Do(func() {
+		close(u.stop)
+		<-u.done
+		os.Stdout = u.term
+		u.stdout.Close()
+		<-u.captured
+		fmt.Fprint(u.term, "\x1b[?1049l\x1b[?25h")
+		u.restore()
+		for _, l := range u.lastLines(10) {
+			fmt.Fprintln(u.term, l)
+		}
+	})
+}
+
+// capture keeps the lines written to the console for the log pane.
+func (u *tui) capture(r io.Reader) {
+	defer close(u.captured)
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		u.logMu.Lock()
+		u.log = append(u.log, sc.Text())
+		if len(u.log) > tuiLogLines {
+			u.log = u.log[len(u.log)-tuiLogLines:]
+		}
+		u.logMu.Unlock()
+	}
+}
+
+func (u *tui) lastLines(n int) []string {
+	u.logMu.Lock()
+	defer u.logMu.Unlock()
+	if n > len(u.log) {
+		n = len(u.log)
+	}
+	return append([]string(nil), u.log[len(u.log)-n:]...)
+}
+
+func (u *tui) readKeys(r io.Reader) {
+	b := make([]byte, 64)
+	for {
+		n, err := r.Read(b)
+		if err != nil {
+			return
+		}
+		for _, k := range tuiKeys(b[:n]) {
+			select {
+			case u.keys <- k:
+			case <-u.stop:
+				return
+			}
+		}
+	}
+}
+
+func (u *tui) loop() {
+	defer close(u.done)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	u.draw()
+	for {
+		select {
+		case k := <-u.keys:
+			u.key(k)
+		case <-ticker.C:
+		case <-u.stop:
+			return
+		}
+		u.draw()
+	}
+}
+
+// key acts on a key pressed.
+func (u *tui) key(k string) {
+	u.setOutput(nil)
+	if u.prompt != "" {
+		u.promptKey(k)
+		return
+	}
+	r := u.selected()
+	switch k {
+	case "up", "k":
+		u.move(-1)
+	case "down", "j":
+		u.move(1)
+	case "enter", " ":
+		if r := u.selected(); r != nil && r.group != "" {
+			u.collapsed[r.group] = !u.collapsed[r.group]
+			u.cursor = "group " + r.group
+		}
+	case "+":
+		u.collapsed = make(map[string]bool)
+	case "-":
+		for _, r := range u.rows {
+			if r.group != "" {
+				u.collapsed[r.group] = true
+			}
+		}
+		if r := u.selected(); r != nil && r.group != "" {
+			u.cursor = "group " + r.group
+		}
+	case "g":
+		u.grouping = (u.grouping + 1) % len(tuiGroupings)
+		u.collapsed = make(map[string]bool)
+	case "s":
+		u.sorting = (u.sorting + 1) % len(tuiSorts)
+	case "p":
+		if r != nil {
+			cmd := "pause"
+			if r.paused == len(r.hosts) {
+				cmd = "resume"
+			}
+			u.ctl(cmd, r.hosts...)
+		}
+	case "i":
+		if r != nil {
+			hosts := r.hosts
+			u.ask(fmt.Sprintf(tr("interval of %s: "), r.name), func(d string) {
+				args := make([]string, len(hosts))
+				for i, h := range hosts {
+					args[i] = d + " " + h
+				}
+				u.ctl("set-interval", args...)
+			})
+		}
+	case "a":
+		u.ask(tr("add target (host [duration]): "), func(arg string) { u.ctl("add-target", arg) })
+	case "x":
+		if r != nil {
+			u.ctl("remove-target", r.hosts...)
+		}
+	case "t":
+		if r != nil {
+			u.ctl("traceroute", r.hosts...)
+		}
+	case "r":
+		if r != nil {
+			u.ctl("reset-stats", r.hosts...)
+		}
+	case "R":
+		u.ctl("reset-stats", "")
+	case "q":
+		u.m.Stop()
+	}
+}
+
+// ask prompts for a line of input, handed to answer unless esc is pressed.
+func (u *tui) ask(prompt string, answer func(string)) {
+	u.prompt, u.input, u.answer = prompt, nil, answer
+}
+
+func (u *tui) promptKey(k string) {
+	switch {
+	case k == "enter":
+		answer, input := u.answer, strings.TrimSpace(string(u.input))
+		u.prompt, u.input, u.answer = "", nil, nil
+		if input != "" {
+			answer(input)
+		}
+	case k == "esc":
+		u.prompt, u.input, u.answer = "", nil, nil
+	case k == "backspace":
+		if len(u.input) > 0 {
+			u.input = u.input[:len(u.input)-1]
+		}
+	case utf8.RuneCountInString(k) == 1:
+		u.input = append(u.input, []rune(k)...)
+	}
+}
+
+// ctl runs the control command cmd once with each of args, in the
+// background as a traceroute takes a while, and shows what it returned.
+func (u *tui) ctl(cmd string, args ...string) {
+	h := u.handlers[cmd]
+	go func() {
+		var out []string
+		for _, arg := range args {
+			res, err := h(arg)
+			switch {
+			case err != nil:
+				out = append(out, "ERROR: "+err.Error())
+			case res != "":
+				out = append(out, strings.Split(strings.TrimSuffix(res, "\n"), "\n")...)
+			default:
+				out = append(out, strings.TrimSpace(cmd+" "+arg)+": ok")
+			}
+		}
+		u.setOutput(out)
+	}()
+}
+
+func (u *tui) setOutput(lines []string) {
+	u.logMu.Lock()
+	defer u.logMu.Unlock()
+	u.output = lines
+}
+
+func (u *tui) index() int {
+	for i, r := range u.rows {
+		if r.key() == u.cursor {
+			return i
+		}
+	}
+	return 0
+}
+
+func (u *tui) move(by int) {
+	if len(u.rows) == 0 {
+		return
+	}
+	i := u.index() + by
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(u.rows) {
+		i = len(u.rows) - 1
+	}
+	u.cursor = u.rows[i].key()
+}
+
+func (u *tui) selected() *tuiRow {
+	if len(u.rows) == 0 {
+		return nil
+	}
+	return &u.rows[u.index()]
+}
+
+// draw redraws the screen: the header, the table and the log pane.
+func (u *tui) draw() {
+	groupBy, sortBy := tuiGroupings[u.grouping], tuiSorts[u.sorting]
+	if groupBy == "none" {
+		groupBy = ""
+	}
+	rows := tuiSnapshot(u.m, groupBy)
+	targets := len(rows)
+	u.rows = tuiGroup(rows, sortBy, u.collapsed)
+	height, width, err := terminalSize(int(u.term.Fd()))
+	if err != nil || height < 10 || width < 40 {
+		height, width = 24, 80
+	}
+	logLines := u.lastLines(height / 4)
+	u.logMu.Lock()
+	if len(u.output) > 0 {
+		logLines = u.output
+		if len(logLines) > height/2 {
+			logLines = logLines[len(logLines)-height/2:]
+		}
+	}
+	u.logMu.Unlock()
+	help := u.help(width)
+	if u.prompt != "" {
+		help = []string{u.prompt + string(u.input)}
+	}
+	room := height - 3 - len(logLines) - len(help)
+	cur := u.index()
+	if cur < u.offset {
+		u.offset = cur
+	}
+	if cur >= u.offset+room {
+		u.offset = cur - room + 1
+	}
+	if u.offset > len(u.rows)-room {
+		u.offset = len(u.rows) - room
+	}
+	if u.offset < 0 {
+		u.offset = 0
+	}
+
+	nameWidth := 20
+	for _, r := range u.rows {
+		if n := utf8.RuneCountInString(r.name) + 4; n > nameWidth {
+			nameWidth = n
+		}
+	}
+	if max := width - 64; nameWidth > max {
+		nameWidth = max
+	}
+	var b strings.Builder
+	b.WriteString("\x1b[?25l\x1b[H")
+	line := func(s string, attr string) {
+		if utf8.RuneCountInString(s) > width {
+			s = string([]rune(s)[:width])
+		}
+		if attr != "" {
+			s = attr + s + strings.Repeat(" ", width-utf8.RuneCountInString(s)) + "\x1b[0m"
+		}
+		b.WriteString(s + "\x1b[K\r\n")
+	}
+	line(fmt.Sprintf(tr("keeping: %d targets, grouped by %s, sorted by %s"), targets, tuiGroupings[u.grouping], sortBy), "\x1b[1m")
+	line(fmt.Sprintf("%-*s  %-9s  %8s  %7s  %7s  %6s  %10s  %10s", nameWidth, "target", "state", "interval", "sent", "recv", "loss", "avg", "max"), "\x1b[4m")
+	for i := u.offset; i < len(u.rows) && i < u.offset+room; i++ {
+		r := &u.rows[i]
+		name, state := r.name, "running"
+		switch {
+		case r.targets > 0:
+			mark := "-"
+			if r.collapsed {
+				mark = "+"
+			}
+			name = fmt.Sprintf("%s %s (%d)", mark, r.name, r.targets)
+			if r.paused > 0 {
+				state = fmt.Sprintf("%d paused", r.paused)
+			}
+		case r.paused > 0:
+			state = "paused"
+		}
+		if r.group != "" && r.targets == 0 {
+			name = "  " + name
+		}
+		if utf8.RuneCountInString(name) > nameWidth {
+			name = string([]rune(name)[:nameWidth-1]) + "~"
+		}
+		avg, max := "-", "-"
+		if r.recv > 0 {
+			avg, max = output.Dur(r.avg), output.Dur(r.max)
+		}
+		attr := ""
+		if r.targets > 0 {
+			attr = "\x1b[1m"
+		}
+		if i == cur {
+			attr += "\x1b[7m"
+		}
+		line(fmt.Sprintf("%-*s  %-9s  %8v  %7d  %7d  %5.1f%%  %10s  %10s", nameWidth, name, state, r.interval,
+			r.sent, r.recv, r.loss, avg, max), attr)
+	}
+	for i := len(u.rows) - u.offset; i < room; i++ {
+		line("", "")
+	}
+	for _, l := range logLines {
+		line(l, "\x1b[2m")
+	}
+	if u.prompt != "" {
+		// the cursor shows where the input goes
+		b.WriteString("\x1b[7m" + help[0] + "\x1b[0m\x1b[K\x1b[?25h")
+	} else {
+		for _, l := range help {
+			line(l, "\x1b[7m")
+		}
+	}
+	fmt.Fprint(u.term, strings.TrimSuffix(b.String(), "\r\n")+"\x1b[J")
+}
+
+// help is the line of the keys, split in two when it doesn't fit width.
+func (u *tui) help(width int) []string {
+	h := tr("enter/+/- fold  g group  s sort  p pause  i interval  a add  x remove  t trace  r/R reset  q quit")
+	if utf8.RuneCountInString(h) <= width {
+		return []string{h}
+	}
+	fields := strings.Split(h, "  ")
+	half := (len(fields) + 1) / 2
+	return []string{strings.Join(fields[:half], "  "), strings.Join(fields[half:], "  ")}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func tuiNames(rows []tuiRow) []string {
+	var names []string
+	for _, r := range rows {
+		names = append(names, r.key())
+	}
+	return names
+}
+
+func TestTUIGroup(t *testing.T) {
+	rows := func() []tuiRow {
+		return []tuiRow{
+			{name: "a1", group: "a", sent: 100, recv: 90, loss: 10, avg: 10 * time.Millisecond, max: 30 * time.Millisecond, interval: time.Second},
+			{name: "b1", group: "b", sent: 100, recv: 100, avg: 50 * time.Millisecond, max: 60 * time.Millisecond, interval: time.Second},
+			{name: "a2", group: "a", sent: 300, recv: 300, avg: 20 * time.Millisecond, max: 40 * time.Millisecond, interval: 500 * time.Millisecond, paused: 1},
+		}
+	}
+	for _, tt := range []struct {
+		name      string
+		sortBy    string
+		collapsed map[string]bool
+		want      []string
+	}{
+		{"by name", "name", nil, []string{"group a", "a1", "a2", "group b", "b1"}},
+		{"by loss", "loss", nil, []string{"group a", "a1", "a2", "group b", "b1"}},
+		{"by rtt", "rtt", nil, []string{"group b", "b1", "group a", "a2", "a1"}},
+		{"collapsed", "name", map[string]bool{"a": true}, []string{"group a", "group b", "b1"}},
+	} {
+		if got := tuiNames(tuiGroup(rows(), tt.sortBy, tt.collapsed)); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	g := tuiGroup(rows(), "name", nil)[0]
+	// the loss weighed by the probes sent, the RTT by the replies
+	if g.targets != 2 || g.paused != 1 || g.sent != 400 || g.recv != 390 || g.loss != 2.5 ||
+		g.avg != 6900*time.Millisecond/390 || g.max != 40*time.Millisecond || g.interval != 500*time.Millisecond {
+		t.Errorf("group a: %+v", g)
+	}
+
+	// without labels the targets are only sorted
+	flat := []tuiRow{{name: "b", loss: 1}, {name: "a"}, {name: "c", loss: 5}}
+	if got := tuiNames(tuiGroup(flat, "loss", nil)); !reflect.DeepEqual(got, []string{"c", "b", "a"}) {
+		t.Errorf("no grouping: %q", got)
+	}
+}
+
+func TestTUIKeys(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		want []string
+	}{
+		{"q", []string{"q"}},
+		{"\x1b[A\x1b[B\x1bOA", []string{"up", "down", "up"}},
+		{"\x1b[5~g", []string{"g"}},
+		{"\x1b", []string{"esc"}},
+		{"\r\n", []string{"enter", "enter"}},
+		{"ab\x7f", []string{"a", "b", "backspace"}},
+		{"é ", []string{"é", " "}},
+		{"\x1b[1;5", nil},
+	} {
+		if got := tuiKeys([]byte(tt.in)); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestTUIControls(t *testing.T) {
+	calls := make(chan string, 16)
+	handler := func(cmd string) ctlHandler {
+		return func(arg string) (string, error) {
+			calls <- cmd + " " + arg
+			return "", nil
+		}
+	}
+	u := &tui{handlers: map[string]ctlHandler{}, collapsed: make(map[string]bool)}
+	for _, cmd := range []string{"pause", "resume", "set-interval", "add-target", "remove-target", "traceroute", "reset-stats"} {
+		u.handlers[cmd] = handler(cmd)
+	}
+	u.rows = []tuiRow{
+		{name: "a", group: "a", targets: 2, paused: 2, hosts: []string{"a1", "a2"}},
+		{name: "a1", group: "a", paused: 1, hosts: []string{"a1"}},
+		{name: "a2", group: "a", paused: 1, hosts: []string{"a2"}},
+	}
+	u.cursor = "a2"
+	for _, tt := range []struct {
+		keys string
+		want []string
+	}{
+		{"p", []string{"resume a2"}},
+		{"x", []string{"remove-target a2"}},
+		{"r", []string{"reset-stats a2"}},
+		{"R", []string{"reset-stats "}},
+		{"i5m\x7fs\r", []string{"set-interval 5s a2"}},
+		{"a9.9.9.9 1m\r", []string{"add-target 9.9.9.9 1m"}},
+		// esc drops the input
+		{"a9.9.9.9\x1bt", []string{"traceroute a2"}},
+		// on a group, the keys act on its targets
+		{"kkp", []string{"resume a1", "resume a2"}},
+		{"i1s\r", []string{"set-interval 1s a1", "set-interval 1s a2"}},
+	} {
+		for _, k := range tuiKeys([]byte(tt.keys)) {
+			u.key(k)
+		}
+		var got []string
+		for range tt.want {
+			select {
+			case c := <-calls:
+				got = append(got, c)
+			case <-time.After(time.Second):
+			}
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: %q, want %q", tt.keys, got, tt.want)
+		}
+	}
+	if len(calls) > 0 || u.prompt != "" {
+		t.Errorf("%d calls too many, prompt %q", len(calls), u.prompt)
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// validation is what keeping validate checks without sending a probe: that
+// the targets resolve and their sockets open with the privileges at hand,
+// and that the outputs can be written to or reached.
+type validation struct {
+	settings probeSettings
+	targets  []string
+	// files are appended to or replaced, dirs get files of their own
+	files []string
+	dirs  []string
+	// mqttURL and mqttCA are the -mqtt broker
+	mqttURL, mqttCA string
+	uploads         []*s3Target
+	proxy           string
+	apiAddr         string
+
+	failed int
+}
+
+func (v *validation) check(what string, err error) {
+	if err != nil {
+		fmt.Printf("FAIL %s: %v\n", what, err)
+		v.failed++
+		return
+	}
+	fmt.Printf("ok   %s\n", what)
+}
+
+// run prints the outcome of every check and the effective settings of
+// every target, returning the exit code.
+func (v *validation) run() int {
+	for _, t := range v.targets {
+		if ext := filepath.Ext(t); ext == ".yaml" || ext == ".yml" {
+			fmt.Printf("ERROR: keeping has no config file, %s would be probed as a host; validate the flags and targets instead: keeping validate [flags] host...\n", t)
+			return 2
+		}
+	}
+	for _, host := range v.targets {
+		v.target(host)
+	}
+	for _, f := range v.files {
+		v.check("writing "+f, checkWritable(f))
+	}
+	for _, d := range v.dirs {
+		v.check("writing files in "+d, checkWritableDir(d))
+	}
+	if v.mqttURL != "" {
+		v.check("connecting to MQTT broker "+v.mqttURL, checkMQTT(v.mqttURL, v.mqttCA))
+	}
+	for _, u := range v.uploads {
+		v.check("reaching "+u.endpoint.Host, checkReachable(u.endpoint.Host, u.endpoint.Scheme))
+	}
+	if v.proxy != "" {
+		d, err := newProxyDialer(v.proxy, nil)
+		if err == nil {
+			err = checkReachable(d.u.Host, "")
+		}
+		v.check("reaching proxy "+v.proxy, err)
+	}
+	if v.apiAddr != "" {
+		l, err := net.Listen("tcp", v.apiAddr)
+		if err == nil {
+			l.Close()
+		}
+		v.check("listening on "+v.apiAddr, err)
+	}
+	if v.failed > 0 {
+		fmt.Printf("%d problems\n", v.failed)
+		return 1
+	}
+	return 0
+}
+
+// target resolves host, opens its sockets and prints what it would be
+// probed with.
+func (v *validation) target(host string) {
+	p, err := New(host)
+	if err != nil {
+		v.check(host, err)
+		return
+	}
+	var ips []net.IP
+	if v.settings.AllIPs {
+		ips, err = resolver.LookupIP(p.Host())
+	} else if err = p.Resolve(); err == nil {
+		ips = []net.IP{p.IPAddr().IP}
+	}
+	if err != nil {
+		v.check("resolving "+host, err)
+		return
+	}
+	for _, ip := range ips {
+		p, _ := New(host)
+		p.SetIPAddr(&net.IPAddr{IP: ip})
+		err := v.settings.apply(p)
+		if err == nil {
+			err = p.Open()
+		}
+		for _, t := range p.transports {
+			t.Close()
+		}
+		v.check(fmt.Sprintf("%s (%s): %s", host, ip, probeDescription(p)), err)
+	}
+}
+
+// probeDescription sums up the effective settings of p.
+func probeDescription(p *Pinger) string {
+	socket := map[string]string{"raw": "raw ICMP socket", "datagram": "datagram ICMP socket",
+		"tcp": "TCP connections"}[socketMode(p)]
+	methods := p.Methods()
+	d := fmt.Sprintf("methods=%s interval=%v timeout=%v size=%d ttl=%d, %s",
+		strings.Join(methods, ","), p.Interval, p.ReplyTimeout, p.Size, p.TTL, socket)
+	if p.Count >= 0 {
+		d += fmt.Sprintf(", %d probes", p.Count)
+	}
+	if p.Proxy != "" {
+		d += " via " + p.Proxy
+	}
+	if p.Mark != 0 || p.Device != "" {
+		d += fmt.Sprintf(" fwmark=%d dev=%s", p.Mark, p.Device)
+	}
+	if bw := p.bandwidth(); bw > 0 {
+		d += ", ~" + formatBandwidth(bw)
+	}
+	return d
+}
+
+// checkWritable tells whether path can be appended to or created, leaving
+// it as it was.
+func checkWritable(path string) error {
+	if f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0); err == nil {
+		return f.Close()
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	return checkWritableDir(filepath.Dir(path))
+}
+
+func checkWritableDir(dir string) error {
+	for {
+		if _, err := os.Stat(dir); err == nil {
+			break
+		}
+		// created when needed, as long as its parent is writable
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			break
+		}
+		dir = parent
+	}
+	f, err := os.CreateTemp(dir, ".keeping-validate-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+func checkMQTT(rawurl, caFile string) error {
+	c, err := newMQTTClient(rawurl, caFile, "")
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	err = c.dialLocked()
+	c.mu.Unlock()
+	c.Close()
+	return err
+}
+
+// checkReachable connects to host, on the default port of scheme unless it
+// has one.
+func checkReachable(host, scheme string) error {
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		port := "443"
+		if scheme == "http" {
+			port = "80"
+		}
+		host = net.JoinHostPort(host, port)
+	}
+	conn, err := net.DialTimeout("tcp", host, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func nonEmpty(ss ...string) []string {
+	var out []string
+	for _, s := range ss {
+		if s != "" {
+			out = append(out, s)
+		}
+	}
+	return out
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCrossOrigin(t *testing.T) {
+	for _, tt := range []struct {
+		origin string
+		want   bool
+	}{
+		{"", false},
+		{"http://127.0.0.1:8080", false},
+		{"http://127.0.0.1", true},
+		{"http://localhost:8080", true},
+		{"http://evil.example", true},
+		{"null", true},
+		{"http://%zz", true},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "http://127.0.0.1:8080/api/stream", nil)
+		if tt.origin != "" {
+			r.Header.Set("Origin", tt.origin)
+		}
+		if got := crossOrigin(r); got != tt.want {
+			t.Errorf("Origin %q: %v, want %v", tt.origin, got, tt.want)
+		}
+	}
+}
+
+func TestUpgradeWebSocketRefused(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		header map[string]string
+		want   int
+	}{
+		{"plain request", map[string]string{"Sec-WebSocket-Version": "13"}, http.StatusBadRequest},
+		{"old version", map[string]string{"Sec-WebSocket-Version": "8"}, http.StatusUpgradeRequired},
+		{"other origin", map[string]string{"Origin": "http://evil.example"}, http.StatusForbidden},
+		{"no key", map[string]string{"Sec-WebSocket-Key": ""}, http.StatusBadRequest},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "http://127.0.0.1:8080/api/stream", nil)
+		r.Header.Set("Upgrade", "websocket")
+		r.Header.Set("Connection", "keep-alive, Upgrade")
+		r.Header.Set("Sec-WebSocket-Version", "13")
+		r.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+		for k, v := range tt.header {
+			r.Header.Set(k, v)
+		}
+		if tt.name == "plain request" {
+			r.Header.Del("Upgrade")
+		}
+		w := httptest.NewRecorder()
+		if _, err := upgradeWebSocket(w, r); err == nil || w.Code != tt.want {
+			t.Errorf("%s: status %d, %v, want %d", tt.name, w.Code, err, tt.want)
+		}
+	}
+}
+
+// clientFrame is a frame masked as a client sends it.
+func clientFrame(op byte, payload []byte) []byte {
+	mask := []byte{1, 2, 3, 4}
+	b := []byte{0x80 | op, 0x80 | byte(len(payload))}
+	b = append(b, mask...)
+	for i, c := range payload {
+		b = append(b, c^mask[i%4])
+	}
+	return b
+}
+
+func TestWebSocket(t *testing.T) {
+	sizes := []int{5, 125, 126, 200, 0xffff, wsMaxFrame, wsMaxFrame + 1}
+	done := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgradeWebSocket(w, r)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer close(done)
+		defer ws.Close()
+		for _, n := range sizes {
+			if err := ws.WriteText(bytes.Repeat([]byte("x"), n)); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+		ws.readLoop()
+	}))
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// the example handshake of RFC 6455
+	fmt.Fprintf(conn, "GET /api/stream HTTP/1.1\r\nHost: %s\r\nOrigin: http://%[1]s\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n", srv.Listener.Addr())
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("handshake: %s, accept %q", resp.Status, resp.Header.Get("Sec-WebSocket-Accept"))
+	}
+
+	client := &wsConn{c: conn, br: br}
+	for _, n := range sizes {
+		op, payload, err := client.readFrame()
+		if n > wsMaxFrame {
+			// more than the server takes, read it by hand
+			if err == nil || !strings.Contains(err.Error(), fmt.Sprintf("frame of %d bytes", n)) {
+				t.Errorf("%d bytes: %v", n, err)
+			}
+			if _, err := br.Discard(n); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if err != nil || op != wsOpText || len(payload) != n {
+			t.Fatalf("%d bytes: op %#x, %d bytes, %v", n, op, len(payload), err)
+		}
+	}
+
+	if _, err := conn.Write(clientFrame(wsOpPing, []byte("hello"))); err != nil {
+		t.Fatal(err)
+	}
+	if op, payload, err := client.readFrame(); err != nil || op != wsOpPong || string(payload) != "hello" {
+		t.Errorf("pong: op %#x, %q, %v", op, payload, err)
+	}
+	if _, err := conn.Write(clientFrame(wsOpClose, nil)); err != nil {
+		t.Fatal(err)
+	}
+	if op, _, err := client.readFrame(); err != nil || op != wsOpClose {
+		t.Errorf("close: op %#x, %v", op, err)
+	}
+	<-done
+}
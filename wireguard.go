@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// wgHandshakeFresh is how old the latest handshake of a WireGuard peer may be
+// for its tunnel to count as up: a session is rekeyed every 2 minutes while
+// traffic flows and dropped after 3 without a handshake.
+const wgHandshakeFresh = 180 * time.Second
+
+// wgFailAfter is the number of consecutive lost probes after which a target
+// behind a tunnel counts as failing.
+const wgFailAfter = 3
+
+// wgPeer is one peer line of `wg show <iface> dump`.
+type wgPeer struct {
+	PublicKey     string
+	Endpoint      string
+	AllowedIPs    []*net.IPNet
+	LastHandshake time.Time
+	RxBytes       int64
+	TxBytes       int64
+}
+
+// short abbreviates the peer key the way wg(8) users recognise it.
+func (p *wgPeer) short() string {
+	if len(p.PublicKey) > 8 {
+		return p.PublicKey[:8] + "…"
+	}
+	return p.PublicKey
+}
+
+func (p *wgPeer) handshakeAge(now time.Time) time.Duration {
+	if p.LastHandshake.IsZero() {
+		return -1
+	}
+	return now.Sub(p.LastHandshake).Truncate(time.Second)
+}
+
+func (p *wgPeer) routes(ip net.IP) bool {
+	for _, n := range p.AllowedIPs {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// wgPeers lists the peers of iface. It uses the wg tool rather than talking
+// netlink directly, so it needs wireguard-tools installed and the privileges
+// wg itself needs.
+func wgPeers(iface string) ([]*wgPeer, error) {
+	out, err := exec.Command("wg", "show", iface, "dump").Output()
+	if err != nil {
+		if ee, ok := err.(*exec.ExitError); ok && len(ee.Stderr) > 0 {
+			return nil, fmt.Errorf("wg show %s: %s", iface, bytes.TrimSpace(ee.Stderr))
+		}
+		return nil, err
+	}
+	return parseWgDump(out)
+}
+
+// parseWgDump parses `wg show <iface> dump`: the first line describes the
+// interface, then one tab separated line per peer: public-key preshared-key
+// endpoint allowed-ips latest-handshake transfer-rx transfer-tx
+// persistent-keepalive.
+func parseWgDump(out []byte) ([]*wgPeer, error) {
+	var peers []*wgPeer
+	sc := bufio.NewScanner(bytes.NewReader(out))
+	for line := 0; sc.Scan(); line++ {
+		if line == 0 {
+			continue
+		}
+		f := strings.Split(sc.Text(), "\t")
+		if len(f) < 8 {
+			return nil, fmt.Errorf("unexpected wg dump line %q", sc.Text())
+		}
+		p := &wgPeer{PublicKey: f[0], Endpoint: f[2]}
+		for _, cidr := range strings.Split(f[3], ",") {
+			if _, n, err := net.ParseCIDR(cidr); err == nil {
+				p.AllowedIPs = append(p.AllowedIPs, n)
+			}
+		}
+		if ts, _ := strconv.ParseInt(f[4], 10, 64); ts > 0 {
+			p.LastHandshake = time.Unix(ts, 0)
+		}
+		p.RxBytes, _ = strconv.ParseInt(f[5], 10, 64)
+		p.TxBytes, _ = strconv.ParseInt(f[6], 10, 64)
+		peers = append(peers, p)
+	}
+	return peers, sc.Err()
+}
+
+// watchWireGuard polls the peers of iface and warns when the tunnel leading
+// to a probed target is up, judged by a fresh handshake, while its probes
+// fail. That points at the far side of the tunnel rather than the tunnel.
+func (m *monitor) watchWireGuard(iface string, every time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	alerted := make(map[string]bool)
+	var lastErr string
+	for {
+		peers, err := wgPeers(iface)
+		if err != nil {
+			if err.Error() != lastErr {
+				fmt.Println("WARN: wireguard:", err)
+				lastErr = err.Error()
+			}
+		} else {
+			lastErr = ""
+			now := time.Now()
+			for _, t := range m.list("") {
+				ip := t.pinger.IPAddr()
+				if ip == nil {
+					continue
+				}
+				for _, p := range peers {
+					if !p.routes(ip.IP) {
+						continue
+					}
+					age := p.handshakeAge(now)
+					up := age >= 0 && age <= wgHandshakeFresh
+					failing := t.lostInARow() >= wgFailAfter
+					switch {
+					case up && failing && !alerted[t.host]:
+						msg := fmt.Sprintf("wireguard %s peer %s (%s) handshake %v ago, tunnel is up but %s is not answering",
+							iface, p.short(), p.Endpoint, age, t.host)
+						fmt.Println("WARN:", msg)
+						m.event(eventWarning, t.host, msg)
+						alerted[t.host] = true
+					case !failing && alerted[t.host]:
+						fmt.Printf("wireguard %s: %s is answering again\n", iface, t.host)
+						delete(alerted, t.host)
+					}
+					break
+				}
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
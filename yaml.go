@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// yamlLine is a line of a YAML document without its indentation and
+// comment.
+type yamlLine struct {
+	n      int
+	indent int
+	text   string
+}
+
+// parseYAML parses the subset of YAML scenario files are written in: block
+// mappings and sequences, flow sequences of scalars, plain and quoted
+// scalars, and comments. It returns map[string]any, []any, string, float64,
+// bool or nil, as encoding/json would.
+func parseYAML(b []byte) (any, error) {
+	var lines []yamlLine
+	for i, raw := range strings.Split(string(b), "\n") {
+		text := strings.TrimRight(stripYAMLComment(raw), " \t\r")
+		trimmed := strings.TrimLeft(text, " ")
+		if trimmed == "" || trimmed == "---" {
+			continue
+		}
+		if strings.HasPrefix(trimmed, "\t") {
+			return nil, fmt.Errorf("line %d: tabs can't indent YAML", i+1)
+		}
+		lines = append(lines, yamlLine{n: i + 1, indent: len(text) - len(trimmed), text: trimmed})
+	}
+	if len(lines) == 0 {
+		return nil, nil
+	}
+	p := &yamlParser{lines: lines}
+	v, err := p.node(lines[0].indent)
+	if err == nil && p.i < len(p.lines) {
+		err = fmt.Errorf("line %d: unexpected indentation", p.lines[p.i].n)
+	}
+	return v, err
+}
+
+// stripYAMLComment cuts a # comment off a line, outside of quotes.
+func stripYAMLComment(s string) string {
+	var quote rune
+	for i, c := range s {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || s[i-1] == ' ' || s[i-1] == '\t'):
+			return s[:i]
+		}
+	}
+	return s
+}
+
+type yamlParser struct {
+	lines []yamlLine
+	i     int
+}
+
+// node parses the mapping or sequence whose lines are indented by indent.
+func (p *yamlParser) node(indent int) (any, error) {
+	if isYAMLItem(p.lines[p.i].text) {
+		return p.sequence(indent)
+	}
+	return p.mapping(indent)
+}
+
+func isYAMLItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+func (p *yamlParser) sequence(indent int) (any, error) {
+	seq := []any{}
+	for p.i < len(p.lines) && p.lines[p.i].indent == indent && isYAMLItem(p.lines[p.i].text) {
+		l := &p.lines[p.i]
+		rest := strings.TrimLeft(strings.TrimPrefix(l.text, "-"), " ")
+		if rest == "" {
+			p.i++
+			v, err := p.child(indent)
+			if err != nil {
+				return nil, err
+			}
+			seq = append(seq, v)
+			continue
+		}
+		if _, _, ok := cutYAMLKey(rest); ok || isYAMLItem(rest) {
+			// a mapping or sequence starting on the item's line, indented
+			// as far as its first key
+			l.indent += len(l.text) - len(rest)
+			l.text = rest
+			v, err := p.node(l.indent)
+			if err != nil {
+				return nil, err
+			}
+			seq = append(seq, v)
+			continue
+		}
+		v, err := yamlScalar(rest, l.n)
+		if err != nil {
+			return nil, err
+		}
+		seq = append(seq, v)
+		p.i++
+	}
+	return seq, nil
+}
+
+func (p *yamlParser) mapping(indent int) (any, error) {
+	m := map[string]any{}
+	for p.i < len(p.lines) && p.lines[p.i].indent == indent {
+		l := p.lines[p.i]
+		if isYAMLItem(l.text) {
+			return nil, fmt.Errorf("line %d: a sequence item among the keys of a mapping", l.n)
+		}
+		key, value, ok := cutYAMLKey(l.text)
+		if !ok {
+			return nil, fmt.Errorf("line %d: want key: value", l.n)
+		}
+		if _, dup := m[key]; dup {
+			return nil, fmt.Errorf("line %d: %s given twice", l.n, key)
+		}
+		p.i++
+		var v any
+		var err error
+		switch {
+		case value != "":
+			v, err = yamlScalar(value, l.n)
+		case p.i < len(p.lines) && p.lines[p.i].indent == indent && isYAMLItem(p.lines[p.i].text):
+			// a sequence may sit at the indentation of its key
+			v, err = p.sequence(indent)
+		default:
+			v, err = p.child(indent)
+		}
+		if err != nil {
+			return nil, err
+		}
+		m[key] = v
+	}
+	return m, nil
+}
+
+// child parses what is indented deeper than indent on the next lines, nil
+// when nothing is.
+func (p *yamlParser) child(indent int) (any, error) {
+	if p.i >= len(p.lines) || p.lines[p.i].indent <= indent {
+		return nil, nil
+	}
+	return p.node(p.lines[p.i].indent)
+}
+
+// cutYAMLKey splits "key: value" and "key:", the key unquoted.
+func cutYAMLKey(s string) (key, value string, ok bool) {
+	if s[0] == '"' || s[0] == '\'' {
+		end := strings.IndexByte(s[1:], s[0])
+		if end < 0 || !strings.HasPrefix(s[end+2:], ":") {
+			return "", "", false
+		}
+		key, s = s[1:end+1], s[end+2:]
+	} else {
+		i := strings.Index(s, ": ")
+		if i < 0 {
+			if !strings.HasSuffix(s, ":") {
+				return "", "", false
+			}
+			i = len(s) - 1
+		}
+		key, s = s[:i], s[i:]
+	}
+	if !strings.HasPrefix(s, ":") || len(s) > 1 && s[1] != ' ' {
+		return "", "", false
+	}
+	return key, strings.TrimSpace(s[1:]), true
+}
+
+// yamlScalar parses a scalar or a flow sequence of them.
+func yamlScalar(s string, n int) (any, error) {
+	switch {
+	case strings.HasPrefix(s, "["):
+		if !strings.HasSuffix(s, "]") {
+			return nil, fmt.Errorf("line %d: unclosed [", n)
+		}
+		seq := []any{}
+		inner := strings.TrimSpace(s[1 : len(s)-1])
+		if inner == "" {
+			return seq, nil
+		}
+		items, err := splitYAMLFlow(inner, n)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range items {
+			v, err := yamlScalar(item, n)
+			if err != nil {
+				return nil, err
+			}
+			seq = append(seq, v)
+		}
+		return seq, nil
+	case strings.HasPrefix(s, "{"):
+		return nil, fmt.Errorf("line %d: flow mappings are not supported, write the keys on lines of their own", n)
+	case strings.HasPrefix(s, `"`):
+		v, err := strconv.Unquote(s)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s: %w", n, s, err)
+		}
+		return v, nil
+	case strings.HasPrefix(s, "'"):
+		if len(s) < 2 || !strings.HasSuffix(s, "'") {
+			return nil, fmt.Errorf("line %d: unclosed '", n)
+		}
+		return strings.ReplaceAll(s[1:len(s)-1], "''", "'"), nil
+	}
+	switch s {
+	case "", "~", "null":
+		return nil, nil
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	}
+	if strings.ContainsRune("+-.0123456789", rune(s[0])) {
+		if v, err := strconv.ParseFloat(s, 64); err == nil {
+			return v, nil
+		}
+	}
+	return s, nil
+}
+
+// splitYAMLFlow splits the items of a flow sequence on the commas outside
+// quotes and nested sequences. A comma may end the sequence, as YAML allows,
+// but an item can't be empty elsewhere.
+func splitYAMLFlow(inner string, n int) ([]string, error) {
+	var items []string
+	var quote byte
+	depth, start := 0, 0
+	for i := 0; i < len(inner); i++ {
+		c := inner[i]
+		item := strings.TrimSpace(inner[start:i])
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else if c == '\\' && quote == '"' {
+				i++
+			}
+		case (c == '"' || c == '\'') && item == "":
+			quote = c
+		case c == '[' && (item == "" || depth > 0):
+			depth++
+		case c == ']' && depth > 0:
+			depth--
+		case c == ',' && depth == 0:
+			if item == "" {
+				return nil, fmt.Errorf("line %d: empty item in [%s]", n, inner)
+			}
+			items = append(items, item)
+			start = i + 1
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("line %d: unclosed %c", n, quote)
+	}
+	if last := strings.TrimSpace(inner[start:]); last != "" {
+		items = append(items, last)
+	}
+	return items, nil
+}
+
+// decodeYAML parses b into v as encoding/json would its JSON equivalent,
+// refusing keys v has no field for. JSON, which is YAML too, is decoded as
+// is.
+func decodeYAML(b []byte, v any) error {
+	js := bytes.TrimSpace(b)
+	if !bytes.HasPrefix(js, []byte("{")) {
+		tree, err := parseYAML(b)
+		if err != nil {
+			return err
+		}
+		if js, err = json.Marshal(tree); err != nil {
+			return err
+		}
+	}
+	dec := json.NewDecoder(bytes.NewReader(js))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return errors.New(strings.Replace(strings.TrimPrefix(err.Error(), "json: "), "unknown field", "unknown key", 1))
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseYAML(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want any
+	}{
+		{"empty", "# nothing\n---\n", nil},
+		{"mapping", "name: uplink\ncount: 10\nrate: 0.5\non: true\noff: false\nnone: ~\n", map[string]any{
+			"name": "uplink", "count": 10.0, "rate": 0.5, "on": true, "off": false, "none": nil,
+		}},
+		{"nested mapping", "a:\n  b:\n    c: d\n", map[string]any{"a": map[string]any{"b": map[string]any{"c": "d"}}}},
+		{"block sequence", "targets:\n  - 192.0.2.1\n  - example.com\n", map[string]any{"targets": []any{"192.0.2.1", "example.com"}}},
+		{"sequence at the key's indentation", "targets:\n- a\n- b\n", map[string]any{"targets": []any{"a", "b"}}},
+		{"sequence of mappings", "phases:\n  - name: idle\n    duration: 60s\n  - name: tcp\n    methods: [tcp:443]\n",
+			map[string]any{"phases": []any{
+				map[string]any{"name": "idle", "duration": "60s"},
+				map[string]any{"name": "tcp", "methods": []any{"tcp:443"}},
+			}}},
+		{"item on its own line", "-\n  a: b\n- c\n", []any{map[string]any{"a": "b"}, "c"}},
+		{"flow sequence", "t: [127.0.0.1, ::1, 10]\n", map[string]any{"t": []any{"127.0.0.1", "::1", 10.0}}},
+		{"empty flow sequence", "t: [ ]\n", map[string]any{"t": []any{}}},
+		{"trailing comma", "t: [127.0.0.1, ]\n", map[string]any{"t": []any{"127.0.0.1"}}},
+		{"quoted items with commas", `t: ["a, b", 'c, d', "e\"]"]` + "\n", map[string]any{"t": []any{"a, b", "c, d", `e"]`}}},
+		{"nested flow sequence", "t: [[a, b], c]\n", map[string]any{"t": []any{[]any{"a", "b"}, "c"}}},
+		{"quoted scalars", "a: \"x # y\"\nb: 'it''s'\n\"c d\": e\n", map[string]any{"a": "x # y", "b": "it's", "c d": "e"}},
+		{"comments", "a: b # why\n# alone\nc: d#not a comment\n", map[string]any{"a": "b", "c": "d#not a comment"}},
+		{"plain scalar with a quote", "a: it's\n", map[string]any{"a": "it's"}},
+		{"key without a value", "a:\nb: c\n", map[string]any{"a": nil, "b": "c"}},
+	}
+	for _, tt := range tests {
+		got, err := parseYAML([]byte(tt.in))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %#v, want %#v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseYAMLErrors(t *testing.T) {
+	tests := []struct {
+		name, in, want string
+	}{
+		{"double comma", "t: [a,, b]\n", "line 1: empty item"},
+		{"leading comma", "t: [, a]\n", "line 1: empty item"},
+		{"comma alone", "t: [,]\n", "line 1: empty item"},
+		{"unclosed flow sequence", "t: [a, b\n", "line 1: unclosed ["},
+		{"unclosed quote in a flow sequence", "t: [\"a, b]\n", "line 1: unclosed \""},
+		{"flow mapping", "t: {a: b}\n", "flow mappings are not supported"},
+		{"tab", "a:\n\tb: c\n", "line 2: tabs"},
+		{"duplicate key", "a: b\na: c\n", "line 2: a given twice"},
+		{"item among keys", "a: b\n- c\n", "line 2: a sequence item"},
+		{"not a key", "a: b\nc\n", "line 2: want key: value"},
+		{"bad indentation", "a:\n    b: c\n  d: e\n", "line 3: unexpected indentation"},
+	}
+	for _, tt := range tests {
+		_, err := parseYAML([]byte(tt.in))
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: error %v, want %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestDecodeYAML(t *testing.T) {
+	var v struct {
+		Name    string   `json:"name"`
+		Targets []string `json:"targets"`
+	}
+	if err := decodeYAML([]byte("name: x\ntargets: [a, b, ]\n"), &v); err != nil {
+		t.Fatal(err)
+	}
+	if v.Name != "x" || !reflect.DeepEqual(v.Targets, []string{"a", "b"}) {
+		t.Errorf("got %+v", v)
+	}
+	if err := decodeYAML([]byte(`{"name": "y"}`), &v); err != nil || v.Name != "y" {
+		t.Errorf("JSON: %v, name %q", err, v.Name)
+	}
+	if err := decodeYAML([]byte("nmae: x\n"), &v); err == nil || !strings.Contains(err.Error(), `unknown key "nmae"`) {
+		t.Errorf("misspelt key: %v", err)
+	}
+}